@@ -0,0 +1,186 @@
+package tahwil
+
+import (
+	"math"
+	"reflect"
+)
+
+// AsFields returns the fields of a struct node or the entries of a map
+// node, keyed by their json names or string keys. Besides the
+// map[string]*Value produced by ToValue and UnmarshalJSON, it accepts
+// map[string]any holding *Value, as built by hand or by older versions.
+// It reports false if v is neither a struct nor a map or its payload is
+// malformed.
+func (v *Value) AsFields() (map[string]*Value, bool) {
+	if v == nil || (v.Kind != Struct && v.Kind != Map) {
+		return nil, false
+	}
+	switch m := v.Value.(type) {
+	case map[string]*Value:
+		return m, true
+	case map[string]any:
+		res := make(map[string]*Value, len(m))
+		for k, mv := range m {
+			x, ok := mv.(*Value)
+			if !ok {
+				return nil, false
+			}
+			res[k] = x
+		}
+		return res, true
+	case nil:
+		return nil, true
+	}
+	return nil, false
+}
+
+// AsStruct returns the fields of a struct node, keyed by their json
+// names. It reports false if v is not a struct or its payload is
+// malformed.
+func (v *Value) AsStruct() (map[string]*Value, bool) {
+	if v == nil || v.Kind != Struct {
+		return nil, false
+	}
+	return v.AsFields()
+}
+
+// AsMap returns the entries of a map node, keyed by their string keys.
+// It reports false if v is not a map or its payload is malformed.
+func (v *Value) AsMap() (map[string]*Value, bool) {
+	if v == nil || v.Kind != Map {
+		return nil, false
+	}
+	return v.AsFields()
+}
+
+// AsSlice returns the elements of a slice or array node. Besides the
+// []*Value produced by ToValue and UnmarshalJSON, it accepts []any
+// holding *Value. It reports false if v is neither a slice nor an array
+// or its payload is malformed.
+func (v *Value) AsSlice() ([]*Value, bool) {
+	if v == nil || (v.Kind != Slice && v.Kind != Array) {
+		return nil, false
+	}
+	switch s := v.Value.(type) {
+	case []*Value:
+		return s, true
+	case []any:
+		res := make([]*Value, len(s))
+		for i, sv := range s {
+			x, ok := sv.(*Value)
+			if !ok {
+				return nil, false
+			}
+			res[i] = x
+		}
+		return res, true
+	case nil:
+		return nil, true
+	}
+	return nil, false
+}
+
+// AsPtr returns the target of a pointer node, nil for a nil pointer. It
+// reports false if v is not a pointer or its payload is malformed.
+func (v *Value) AsPtr() (*Value, bool) {
+	if v == nil || v.Kind != Ptr {
+		return nil, false
+	}
+	if v.Value == nil {
+		return nil, true
+	}
+	p, ok := v.Value.(*Value)
+	return p, ok
+}
+
+// AsRef returns the refid a ref node refers to. It reports false if v is
+// not a ref or its payload is malformed.
+func (v *Value) AsRef() (uint64, bool) {
+	if v == nil || v.Kind != Ref {
+		return 0, false
+	}
+	refid, err := refFromValue(v)
+	return refid, err == nil
+}
+
+// AsBool returns the payload of a bool node. It reports false if v is not
+// a bool.
+func (v *Value) AsBool() (bool, bool) {
+	if v == nil || v.Kind != Bool {
+		return false, false
+	}
+	b, ok := v.Value.(bool)
+	return b, ok
+}
+
+// AsString returns the payload of a string node. It reports false if v is
+// not a string.
+func (v *Value) AsString() (string, bool) {
+	if v == nil || v.Kind != String {
+		return "", false
+	}
+	s, ok := v.Value.(string)
+	return s, ok
+}
+
+// AsInt64 returns the payload of an int, int8, int16, int32 or int64 node.
+// It reports false if v is none of them or its payload is not an integer
+// that fits into an int64.
+func (v *Value) AsInt64() (int64, bool) {
+	if v == nil {
+		return 0, false
+	}
+	switch v.Kind {
+	case Int, Int8, Int16, Int32, Int64:
+	default:
+		return 0, false
+	}
+	rv := reflect.ValueOf(v.Value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Uint() <= math.MaxInt64 {
+			return int64(rv.Uint()), true
+		}
+	}
+	return 0, false
+}
+
+// AsUint64 returns the payload of a uint, uint8, uint16, uint32 or uint64
+// node. It reports false if v is none of them or its payload is not a
+// non-negative integer.
+func (v *Value) AsUint64() (uint64, bool) {
+	if v == nil {
+		return 0, false
+	}
+	switch v.Kind {
+	case Uint, Uint8, Uint16, Uint32, Uint64:
+	default:
+		return 0, false
+	}
+	rv := reflect.ValueOf(v.Value)
+	switch rv.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if rv.Int() >= 0 {
+			return uint64(rv.Int()), true
+		}
+	}
+	return 0, false
+}
+
+// AsFloat64 returns the payload of a float32 or float64 node. It reports
+// false if v is neither or its payload is not a float.
+func (v *Value) AsFloat64() (float64, bool) {
+	if v == nil || (v.Kind != Float32 && v.Kind != Float64) {
+		return 0, false
+	}
+	rv := reflect.ValueOf(v.Value)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
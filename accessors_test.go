@@ -0,0 +1,153 @@
+package tahwil_test
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+type accessorsT struct {
+	Name  string
+	Age   int8
+	Count uint16
+	Score float32
+	OK    bool
+	Tags  []string
+	Meta  map[string]int64
+	Next  *accessorsT
+	Self  *accessorsT
+}
+
+func TestValue_UnmarshalJSON_PayloadTypes(t *testing.T) {
+	in := &accessorsT{Name: "x", Tags: []string{"a"}, Meta: map[string]int64{"k": 1}}
+	in.Self = in
+	v, err := tahwil.ToValue(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded tahwil.Value
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := decoded.Value.(*tahwil.Value).Value.(map[string]*tahwil.Value)
+	if _, ok := fields["Tags"].Value.([]*tahwil.Value); !ok {
+		t.Errorf("slice payload is %T, want []*tahwil.Value", fields["Tags"].Value)
+	}
+	if _, ok := fields["Meta"].Value.(map[string]*tahwil.Value); !ok {
+		t.Errorf("map payload is %T, want map[string]*tahwil.Value", fields["Meta"].Value)
+	}
+	if _, ok := fields["Self"].Value.(uint64); !ok {
+		t.Errorf("ref payload is %T, want uint64", fields["Self"].Value)
+	}
+}
+
+func TestValue_Accessors(t *testing.T) {
+	in := &accessorsT{
+		Name: "x", Age: -3, Count: 7, Score: 1.5, OK: true,
+		Tags: []string{"a", "b"}, Meta: map[string]int64{"k": 1},
+	}
+	in.Self = in
+	v, err := tahwil.ToValue(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, ok := v.AsPtr()
+	if !ok {
+		t.Fatal("AsPtr() of the root failed")
+	}
+	fields, ok := p.AsStruct()
+	if !ok {
+		t.Fatal("AsStruct() failed")
+	}
+	if s, ok := fields["Name"].AsString(); !ok || s != "x" {
+		t.Errorf("AsString() = %q, %v", s, ok)
+	}
+	if i, ok := fields["Age"].AsInt64(); !ok || i != -3 {
+		t.Errorf("AsInt64() = %d, %v", i, ok)
+	}
+	if u, ok := fields["Count"].AsUint64(); !ok || u != 7 {
+		t.Errorf("AsUint64() = %d, %v", u, ok)
+	}
+	if f, ok := fields["Score"].AsFloat64(); !ok || f != 1.5 {
+		t.Errorf("AsFloat64() = %v, %v", f, ok)
+	}
+	if b, ok := fields["OK"].AsBool(); !ok || !b {
+		t.Errorf("AsBool() = %v, %v", b, ok)
+	}
+	if elems, ok := fields["Tags"].AsSlice(); !ok || len(elems) != 2 {
+		t.Errorf("AsSlice() = %v, %v", elems, ok)
+	}
+	if m, ok := fields["Meta"].AsMap(); !ok || len(m) != 1 {
+		t.Errorf("AsMap() = %v, %v", m, ok)
+	}
+	if refid, ok := fields["Self"].AsRef(); !ok || refid != v.Refid {
+		t.Errorf("AsRef() = %d, %v, want %d", refid, ok, v.Refid)
+	}
+	if next, ok := fields["Next"].AsPtr(); !ok || next != nil {
+		t.Errorf("AsPtr() of a nil pointer = %v, %v", next, ok)
+	}
+
+	// wrong kinds
+	if _, ok := fields["Name"].AsInt64(); ok {
+		t.Errorf("AsInt64() of a string succeeded")
+	}
+	if _, ok := fields["Meta"].AsStruct(); ok {
+		t.Errorf("AsStruct() of a map succeeded")
+	}
+	if _, ok := fields["Count"].AsInt64(); ok {
+		t.Errorf("AsInt64() of a uint16 succeeded")
+	}
+	var nilValue *tahwil.Value
+	if _, ok := nilValue.AsString(); ok {
+		t.Errorf("AsString() of a nil *Value succeeded")
+	}
+}
+
+func TestValue_Accessors_LooseShapes(t *testing.T) {
+	s := &tahwil.Value{Kind: tahwil.Slice, Value: []any{&tahwil.Value{Kind: tahwil.Int, Value: 1}}}
+	if elems, ok := s.AsSlice(); !ok || len(elems) != 1 {
+		t.Errorf("AsSlice() of []any = %v, %v", elems, ok)
+	}
+	bad := &tahwil.Value{Kind: tahwil.Slice, Value: []any{1}}
+	if _, ok := bad.AsSlice(); ok {
+		t.Errorf("AsSlice() of a malformed payload succeeded")
+	}
+	m := &tahwil.Value{Kind: tahwil.Struct, Value: map[string]any{"A": &tahwil.Value{Kind: tahwil.Int, Value: 1}}}
+	if fields, ok := m.AsStruct(); !ok || len(fields) != 1 {
+		t.Errorf("AsStruct() of map[string]any = %v, %v", fields, ok)
+	}
+	i := &tahwil.Value{Kind: tahwil.Int64, Value: uint64(math.MaxUint64)}
+	if _, ok := i.AsInt64(); ok {
+		t.Errorf("AsInt64() of an overflowing payload succeeded")
+	}
+	u := &tahwil.Value{Kind: tahwil.Uint, Value: -1}
+	if _, ok := u.AsUint64(); ok {
+		t.Errorf("AsUint64() of a negative payload succeeded")
+	}
+	r := &tahwil.Value{Kind: tahwil.Ref, Value: 3}
+	if refid, ok := r.AsRef(); !ok || refid != 3 {
+		t.Errorf("AsRef() of an int payload = %d, %v", refid, ok)
+	}
+}
+
+func TestFromValue_LooseShapes(t *testing.T) {
+	v := &tahwil.Value{Refid: 1, Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Struct, Value: map[string]any{
+		"Name": &tahwil.Value{Kind: tahwil.String, Value: "x"},
+		"Tags": &tahwil.Value{Kind: tahwil.Slice, Value: []any{&tahwil.Value{Kind: tahwil.String, Value: "a"}}},
+	}}}
+	var out accessorsT
+	if err := tahwil.FromValue(v, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "x" || len(out.Tags) != 1 || out.Tags[0] != "a" {
+		t.Errorf("FromValue() = %+v", out)
+	}
+}
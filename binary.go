@@ -0,0 +1,539 @@
+package tahwil
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+)
+
+// binaryMagic starts every binary encoded Value, the last byte is the
+// format version.
+var binaryMagic = [4]byte{'T', 'W', 'B', 1}
+
+const (
+	// binaryHasRefid is set in the node header when a refid follows
+	binaryHasRefid = 0x40
+	// binaryNilValue is set in the node header when the payload is nil
+	binaryNilValue = 0x80
+	// binaryTagMask extracts the kind tag from the node header
+	binaryTagMask = 0x3f
+	// binaryNilNode is the header of a nil *Value
+	binaryNilNode = 0xff
+)
+
+// An InvalidBinaryError describes malformed input passed to
+// Value.UnmarshalBinary.
+type InvalidBinaryError struct {
+	Offset int
+	Reason string
+}
+
+func (e *InvalidBinaryError) Error() string {
+	return "tahwil.Value: invalid binary data at offset " + strconv.Itoa(e.Offset) + ": " + e.Reason
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+//
+// The encoding is a compact format tailored to Value trees: every node
+// starts with a one-byte header holding the kind tag, followed by the
+// refid as a varint if it is non-zero, and the payload. Integers are
+// varints, floats use their fixed-size IEEE 754 representation and
+// strings are length-prefixed. Struct and map keys are interned: each
+// distinct key is written once and referred to by its index afterwards,
+// which shrinks graphs with many nodes of the same struct type.
+func (v *Value) MarshalBinary() ([]byte, error) {
+	e := newBinaryEncoder()
+	if err := e.encode(v); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+// It decodes data produced by MarshalBinary. Payloads have the same
+// types as the ones produced by ToValue.
+func (v *Value) UnmarshalBinary(data []byte) error {
+	if len(data) < len(binaryMagic) || [4]byte(data[:4]) != binaryMagic {
+		return &InvalidBinaryError{Offset: 0, Reason: "unknown format"}
+	}
+	d := &binaryDecoder{data: data, pos: len(binaryMagic)}
+	res, err := d.decode()
+	if err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return d.errorf("unexpected trailing data")
+	}
+	if res == nil {
+		*v = Value{}
+		return nil
+	}
+	*v = *res
+	return nil
+}
+
+type binaryEncoder struct {
+	buf []byte
+	// keys holds the interned struct and map keys
+	keys    map[string]uint64
+	tracker tracker
+}
+
+func newBinaryEncoder() *binaryEncoder {
+	return &binaryEncoder{
+		buf:  append([]byte(nil), binaryMagic[:]...),
+		keys: make(map[string]uint64),
+	}
+}
+
+func (e *binaryEncoder) writeString(s string) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// writeKey writes an interned key: 0 followed by the key when it's seen
+// for the first time, its index + 1 otherwise.
+func (e *binaryEncoder) writeKey(k string) {
+	if idx, ok := e.keys[k]; ok {
+		e.buf = binary.AppendUvarint(e.buf, idx+1)
+		return
+	}
+	e.keys[k] = uint64(len(e.keys))
+	e.buf = append(e.buf, 0)
+	e.writeString(k)
+}
+
+func (e *binaryEncoder) encode(v *Value) error {
+	if v == nil {
+		e.buf = append(e.buf, binaryNilNode)
+		return nil
+	}
+	if err := e.tracker.visit(); err != nil {
+		return err
+	}
+	tag, ok := tagOfKind[v.Kind]
+	if !ok {
+		return &InvalidValueKindError{Kind: v.Kind}
+	}
+	header := tag
+	if v.Refid != 0 {
+		header |= binaryHasRefid
+	}
+	if v.Value == nil {
+		header |= binaryNilValue
+	}
+	e.buf = append(e.buf, header)
+	if v.Refid != 0 {
+		e.buf = binary.AppendUvarint(e.buf, v.Refid)
+	}
+	if v.Value == nil {
+		return nil
+	}
+	return e.encodePayload(v)
+}
+
+func (e *binaryEncoder) encodePayload(v *Value) error {
+	switch v.Kind {
+	case Ptr:
+		inner, ok := v.AsPtr()
+		if !ok {
+			return &InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		return e.encode(inner)
+	case Struct, Map:
+		return e.encodeFields(v)
+	case Slice, Array:
+		return e.encodeElems(v)
+	case String, Func, Stub:
+		s, ok := v.Value.(string)
+		if !ok {
+			return &InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		e.writeString(s)
+		return nil
+	case Bool:
+		b, ok := v.AsBool()
+		if !ok {
+			return &InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		if b {
+			e.buf = append(e.buf, 1)
+		} else {
+			e.buf = append(e.buf, 0)
+		}
+		return nil
+	}
+	return e.encodeNumber(v)
+}
+
+// encodeNumber writes a number the way decodePayload reads it for the
+// kind of v, whatever the Go type of the payload: the payload of an int
+// node may be a uint, as long as it fits into the kind.
+func (e *binaryEncoder) encodeNumber(v *Value) error {
+	switch v.Kind {
+	case Int, Int8, Int16, Int32, Int64:
+		i, ok := v.AsInt64()
+		if !ok || !intFits(v.Kind, i) {
+			return &InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		e.buf = binary.AppendVarint(e.buf, i)
+	case Uint, Uint8, Uint16, Uint32, Uint64:
+		u, ok := v.AsUint64()
+		if !ok || !uintFits(v.Kind, u) {
+			return &InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		e.buf = binary.AppendUvarint(e.buf, u)
+	case Ref:
+		// refs from JSON may be ints or floats
+		refid, err := refFromValue(v)
+		if err != nil {
+			return err
+		}
+		e.buf = binary.AppendUvarint(e.buf, refid)
+	case Float32, Float64:
+		f, ok := v.AsFloat64()
+		if !ok {
+			return &InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		if v.Kind == Float32 {
+			e.buf = binary.LittleEndian.AppendUint32(e.buf, math.Float32bits(float32(f)))
+		} else {
+			e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(f))
+		}
+	default:
+		return &InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	return nil
+}
+
+// intFits reports whether i is in the range of the int kind.
+func intFits(kind Kind, i int64) bool {
+	switch kind {
+	case Int8:
+		return i >= math.MinInt8 && i <= math.MaxInt8
+	case Int16:
+		return i >= math.MinInt16 && i <= math.MaxInt16
+	case Int32:
+		return i >= math.MinInt32 && i <= math.MaxInt32
+	case Int:
+		return int64(int(i)) == i
+	}
+	return true
+}
+
+// uintFits reports whether u is in the range of the uint kind.
+func uintFits(kind Kind, u uint64) bool {
+	switch kind {
+	case Uint8:
+		return u <= math.MaxUint8
+	case Uint16:
+		return u <= math.MaxUint16
+	case Uint32:
+		return u <= math.MaxUint32
+	case Uint:
+		return uint64(uint(u)) == u
+	}
+	return true
+}
+
+func (e *binaryEncoder) encodeFields(v *Value) error {
+	fields, ok := v.AsFields()
+	if !ok {
+		return &InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(fields)))
+	for _, k := range sortedKeys(fields) {
+		e.writeKey(k)
+		if err := e.encode(fields[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *binaryEncoder) encodeElems(v *Value) error {
+	elems, ok := v.AsSlice()
+	if !ok {
+		return &InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(elems)))
+	for _, x := range elems {
+		if err := e.encode(x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type binaryDecoder struct {
+	data []byte
+	pos  int
+	// keys holds the interned struct and map keys
+	keys []string
+}
+
+func (d *binaryDecoder) errorf(reason string) error {
+	return &InvalidBinaryError{Offset: d.pos, Reason: reason}
+}
+
+func (d *binaryDecoder) next(n uint64) ([]byte, error) {
+	if uint64(len(d.data)-d.pos) < n {
+		return nil, d.errorf("unexpected end of input")
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *binaryDecoder) readUvarint() (uint64, error) {
+	u, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		return 0, d.errorf("invalid varint")
+	}
+	d.pos += n
+	return u, nil
+}
+
+func (d *binaryDecoder) readVarint() (int64, error) {
+	i, n := binary.Varint(d.data[d.pos:])
+	if n <= 0 {
+		return 0, d.errorf("invalid varint")
+	}
+	d.pos += n
+	return i, nil
+}
+
+// readLength reads a length; every counted item takes at least one byte.
+func (d *binaryDecoder) readLength() (int, error) {
+	n, err := d.readUvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, d.errorf("length out of range")
+	}
+	return int(n), nil
+}
+
+func (d *binaryDecoder) readString() (string, error) {
+	n, err := d.readLength()
+	if err != nil {
+		return "", err
+	}
+	b, err := d.next(uint64(n))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *binaryDecoder) readKey() (string, error) {
+	idx, err := d.readUvarint()
+	if err != nil {
+		return "", err
+	}
+	if idx == 0 {
+		k, err := d.readString()
+		if err != nil {
+			return "", err
+		}
+		d.keys = append(d.keys, k)
+		return k, nil
+	}
+	if idx > uint64(len(d.keys)) {
+		return "", d.errorf("unknown key index")
+	}
+	return d.keys[idx-1], nil
+}
+
+// binaryFrame is a node whose children are being decoded: the target of
+// a pointer, the fields of a struct or map, the elements of a slice or
+// array, or the root if none is set.
+type binaryFrame struct {
+	ptr    *Value
+	fields map[string]*Value
+	elems  []*Value
+	root   **Value
+	// left is the number of children left to decode
+	left int
+}
+
+// decode decodes a tree. Nested nodes are decoded with an explicit work
+// stack rather than recursion, so the depth of the input is not limited
+// by the goroutine stack.
+func (d *binaryDecoder) decode() (*Value, error) {
+	var root *Value
+	stack := []binaryFrame{{root: &root, left: 1}}
+	for len(stack) > 0 {
+		f := &stack[len(stack)-1]
+		if f.left == 0 {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		f.left--
+		var key string
+		if f.fields != nil {
+			var err error
+			if key, err = d.readKey(); err != nil {
+				return nil, err
+			}
+		}
+		v, children, err := d.decodeNode()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case f.fields != nil:
+			f.fields[key] = v
+		case f.elems != nil:
+			f.elems[len(f.elems)-f.left-1] = v
+		case f.ptr != nil:
+			if v != nil {
+				f.ptr.Value = v
+			}
+		default:
+			*f.root = v
+		}
+		if children.left > 0 {
+			stack = append(stack, children)
+		}
+	}
+	return root, nil
+}
+
+// decodeNode decodes a single node. The children of pointers and
+// containers are not decoded here, the frame they are decoded in is
+// returned instead.
+func (d *binaryDecoder) decodeNode() (*Value, binaryFrame, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, binaryFrame{}, err
+	}
+	header := b[0]
+	if header == binaryNilNode {
+		return nil, binaryFrame{}, nil
+	}
+	tag := int(header & binaryTagMask)
+	if tag >= len(kindTags) {
+		d.pos--
+		return nil, binaryFrame{}, d.errorf("unknown kind tag " + strconv.Itoa(tag))
+	}
+	v := &Value{Kind: kindTags[tag]}
+	if header&binaryHasRefid != 0 {
+		if v.Refid, err = d.readUvarint(); err != nil {
+			return nil, binaryFrame{}, err
+		}
+	}
+	if header&binaryNilValue != 0 {
+		return v, binaryFrame{}, nil
+	}
+	switch v.Kind {
+	case Ptr:
+		return v, binaryFrame{ptr: v, left: 1}, nil
+	case Struct, Map:
+		n, err := d.readLength()
+		if err != nil {
+			return nil, binaryFrame{}, err
+		}
+		fields := make(map[string]*Value, n)
+		v.Value = fields
+		return v, binaryFrame{fields: fields, left: n}, nil
+	case Slice, Array:
+		n, err := d.readLength()
+		if err != nil {
+			return nil, binaryFrame{}, err
+		}
+		elems := make([]*Value, n)
+		v.Value = elems
+		return v, binaryFrame{elems: elems, left: n}, nil
+	}
+	if v.Value, err = d.decodePayload(v.Kind); err != nil {
+		return nil, binaryFrame{}, err
+	}
+	return v, binaryFrame{}, nil
+}
+
+// decodePayload decodes the payload of a scalar node.
+func (d *binaryDecoder) decodePayload(kind Kind) (any, error) {
+	switch kind {
+	case String, Func, Stub:
+		return d.readString()
+	case Chan:
+		return nil, d.errorf("unexpected chan value")
+	case Bool:
+		b, err := d.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+	case Float32:
+		b, err := d.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float32frombits(binary.LittleEndian.Uint32(b)), nil
+	case Float64:
+		b, err := d.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	case Int, Int8, Int16, Int32, Int64:
+		return d.decodeInt(kind)
+	}
+	return d.decodeUint(kind)
+}
+
+func (d *binaryDecoder) decodeInt(kind Kind) (any, error) {
+	start := d.pos
+	i, err := d.readVarint()
+	if err != nil {
+		return nil, err
+	}
+	var res any
+	ok := true
+	switch kind {
+	case Int8:
+		res, ok = int8(i), i >= math.MinInt8 && i <= math.MaxInt8
+	case Int16:
+		res, ok = int16(i), i >= math.MinInt16 && i <= math.MaxInt16
+	case Int32:
+		res, ok = int32(i), i >= math.MinInt32 && i <= math.MaxInt32
+	case Int64:
+		res = i
+	default:
+		res, ok = int(i), int64(int(i)) == i
+	}
+	if !ok {
+		d.pos = start
+		return nil, d.errorf("value out of range for " + string(kind))
+	}
+	return res, nil
+}
+
+func (d *binaryDecoder) decodeUint(kind Kind) (any, error) {
+	start := d.pos
+	u, err := d.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	var res any
+	ok := true
+	switch kind {
+	case Uint8:
+		res, ok = uint8(u), u <= math.MaxUint8
+	case Uint16:
+		res, ok = uint16(u), u <= math.MaxUint16
+	case Uint32:
+		res, ok = uint32(u), u <= math.MaxUint32
+	case Uint:
+		res, ok = uint(u), uint64(uint(u)) == u
+	default: // Uint64, Ref
+		res = u
+	}
+	if !ok {
+		d.pos = start
+		return nil, d.errorf("value out of range for " + string(kind))
+	}
+	return res, nil
+}
@@ -0,0 +1,221 @@
+package tahwil_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+type binaryKindsT struct {
+	Bool    bool
+	Int     int
+	Int8    int8
+	Int16   int16
+	Int32   int32
+	Int64   int64
+	Uint    uint
+	Uint8   uint8
+	Uint16  uint16
+	Uint32  uint32
+	Uint64  uint64
+	Float32 float32
+	Float64 float64
+	String  string
+	Array   [2]int16
+	Map     map[string]int
+	Pointer *string
+	Nil     *string
+}
+
+func TestValue_MarshalBinary_RoundTrip(t *testing.T) {
+	s := "pointer"
+	in := &binaryKindsT{
+		Bool: true, Int: -1 << 40, Int8: -100, Int16: -30000, Int32: -1 << 30, Int64: -1 << 62,
+		Uint: 1 << 40, Uint8: 200, Uint16: 60000, Uint32: 1 << 31, Uint64: 1<<64 - 1,
+		Float32: 1.5, Float64: -2.25, String: "string",
+		Array: [2]int16{-1, 1}, Map: map[string]int{"a": 1}, Pointer: &s,
+	}
+	for _, toValue := range []func(any) (*tahwil.Value, error){tahwil.ToValue, tahwil.ToValueCompat} {
+		v, err := toValue(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := v.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := &tahwil.Value{}
+		if err = decoded.UnmarshalBinary(b); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, v) {
+			x, _ := json.Marshal(decoded)
+			y, _ := json.Marshal(v)
+			t.Errorf("mismatch\nhave: %s\nwant: %s", x, y)
+		}
+
+		out := &binaryKindsT{}
+		if err = tahwil.FromValue(decoded, out); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out, in) {
+			t.Errorf("mismatch\nhave: %+v\nwant: %+v", out, in)
+		}
+	}
+}
+
+func TestValue_MarshalBinary_Cycle(t *testing.T) {
+	parent := &personT{Name: "Arthur"}
+	parent.Children = []*personT{
+		{Name: "Ford", Parent: parent},
+		{Name: "Zaphod", Parent: parent},
+	}
+	v, err := tahwil.ToValue(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// decode through JSON first to make sure both payload shapes are accepted
+	j, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON := &tahwil.Value{}
+	if err = json.Unmarshal(j, fromJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := fromJSON.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) >= len(j) {
+		t.Errorf("expected binary encoding (%d bytes) to be smaller than JSON (%d bytes)", len(b), len(j))
+	}
+
+	decoded := &tahwil.Value{}
+	if err = decoded.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, v) {
+		x, _ := json.Marshal(decoded)
+		t.Errorf("mismatch\nhave: %s\nwant: %s", x, j)
+	}
+
+	out := &personT{}
+	if err = tahwil.FromValue(decoded, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Children[0].Parent != out || out.Children[1].Parent != out {
+		t.Error("expected the cycle to be preserved")
+	}
+}
+
+func TestValue_UnmarshalBinary_Errors(t *testing.T) {
+	tests := [][]byte{
+		{},
+		{'T', 'W', 'B', 2, 0x0e},             // unknown version
+		{'T', 'W', 'B', 1},                   // no root
+		{'T', 'W', 'B', 1, 0x3f},             // unknown kind tag
+		{'T', 'W', 'B', 1, 0x0e, 5},          // truncated string
+		{'T', 'W', 'B', 1, 0x03, 0x80, 0x02}, // int8 out of range
+		{'T', 'W', 'B', 1, 0x0f, 1, 3, 0x01, 0x01}, // unknown key index
+		{'T', 'W', 'B', 1, 0x01, 1, 0},             // trailing data
+	}
+	for i, data := range tests {
+		var binErr *tahwil.InvalidBinaryError
+		err := (&tahwil.Value{}).UnmarshalBinary(data)
+		if !errors.As(err, &binErr) {
+			t.Errorf("#%d: expected *InvalidBinaryError, got %T: %v", i, err, err)
+		}
+	}
+}
+
+func TestValue_UnmarshalBinary_Deep(t *testing.T) {
+	// nested nodes are decoded without recursion: a deep chain of
+	// pointers from untrusted input doesn't exhaust the stack
+	const depth = 1000000
+	b, err := (&tahwil.Value{Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Ptr}}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptr, nilPtr := b[4], b[5]
+	data := append(append(append([]byte{}, b[:4]...), bytes.Repeat([]byte{ptr}, depth)...), nilPtr)
+	var v tahwil.Value
+	if err = v.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for p := &v; p.Value != nil; p = p.Value.(*tahwil.Value) {
+		n++
+	}
+	if n != depth {
+		t.Errorf("decoded %d nested pointers, want %d", n, depth)
+	}
+
+	// a truncated chain is still an error
+	var binErr *tahwil.InvalidBinaryError
+	if err = v.UnmarshalBinary(data[:len(data)-1]); !errors.As(err, &binErr) {
+		t.Errorf("expected *InvalidBinaryError, got %T: %v", err, err)
+	}
+}
+
+func TestValue_MarshalBinary_Errors(t *testing.T) {
+	tests := []*tahwil.Value{
+		{Kind: "foo", Value: 1},
+		{Kind: tahwil.String, Value: 1},
+		{Kind: tahwil.Int, Value: "1"},
+		{Kind: tahwil.Float64, Value: 1},
+		{Kind: tahwil.Ptr, Value: "x"},
+		{Kind: tahwil.Struct, Value: []int{}},
+		{Kind: tahwil.Slice, Value: []any{1}},
+		{Kind: tahwil.Int8, Value: 300},
+		{Kind: tahwil.Uint, Value: -1},
+		{Kind: tahwil.Uint8, Value: uint16(256)},
+		{Kind: tahwil.Int64, Value: uint64(1) << 63},
+		{Kind: tahwil.Ref, Value: -1},
+	}
+	for i, v := range tests {
+		if _, err := v.MarshalBinary(); err == nil {
+			t.Errorf("#%d: expected error, got nil", i)
+		}
+	}
+}
+
+func TestValue_MarshalBinary_MixedPayloads(t *testing.T) {
+	// hand-built nodes may hold payloads of another Go type than their
+	// kind: they are encoded by kind, so that they decode to the same number
+	tests := []struct {
+		in   *tahwil.Value
+		want any
+	}{
+		{&tahwil.Value{Kind: tahwil.Int, Value: uint(5)}, 5},
+		{&tahwil.Value{Kind: tahwil.Int8, Value: -5}, int8(-5)},
+		{&tahwil.Value{Kind: tahwil.Int64, Value: uint8(200)}, int64(200)},
+		{&tahwil.Value{Kind: tahwil.Uint, Value: 5}, uint(5)},
+		{&tahwil.Value{Kind: tahwil.Uint16, Value: int64(65535)}, uint16(65535)},
+		{&tahwil.Value{Kind: tahwil.Float32, Value: 1.5}, float32(1.5)},
+		{&tahwil.Value{Kind: tahwil.Float64, Value: float32(0.25)}, 0.25},
+		{&tahwil.Value{Kind: tahwil.Ref, Value: 3}, uint64(3)},
+		{&tahwil.Value{Kind: tahwil.Ref, Value: float64(3)}, uint64(3)},
+	}
+	for i, tt := range tests {
+		data, err := tt.in.MarshalBinary()
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		res := &tahwil.Value{}
+		if err = res.UnmarshalBinary(data); err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		if res.Kind != tt.in.Kind || res.Value != tt.want {
+			t.Errorf("#%d: got %s %#v, want %s %#v", i, res.Kind, res.Value, tt.in.Kind, tt.want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package tahwil
+
+import (
+	"hash"
+)
+
+// canonTask fills dst with the canonical form of src
+type canonTask struct {
+	src *Value
+	dst *Value
+}
+
+type canonicalizer struct {
+	// g resolves the original refids, so that refs met before their
+	// pointer can be expanded
+	g *Graph
+	// refids maps original refids to canonical ones
+	refids    map[uint64]uint64
+	lastRefid uint64
+	stack     []canonTask
+}
+
+func (c *canonicalizer) nextRefid() uint64 {
+	c.lastRefid++
+	return c.lastRefid
+}
+
+// pointer fills dst with the canonical form of a pointer, a stub or a
+// ref to the target with the original refid: the first one met becomes
+// the pointer, or the stub standing for it, the others refs to it. A ref
+// to a nil pointer becomes a nil pointer.
+func (c *canonicalizer) pointer(refid uint64, dst *Value) error {
+	p, ok := c.g.Node(refid)
+	if !ok {
+		return &InvalidValueError{Value: refid, Kind: Ref}
+	}
+	dst.Refid = c.nextRefid()
+	inner, _ := p.AsPtr()
+	if p.Kind == Ptr && inner == nil {
+		dst.Kind = Ptr
+		return nil
+	}
+	if canon, ok := c.refids[refid]; ok {
+		dst.Kind = Ref
+		dst.Value = canon
+		return nil
+	}
+	c.refids[refid] = dst.Refid
+	dst.Kind = p.Kind
+	if p.Kind == Stub {
+		dst.Value = p.Value
+	} else {
+		dst.Value = c.child(inner)
+	}
+	return nil
+}
+
+// fillValue canonicalizes a single node. Children are not processed here,
+// they are pushed to the work stack in reverse order, so that the nodes
+// are numbered in preorder.
+func (c *canonicalizer) fillValue(src, dst *Value) error {
+	dst.Kind = src.Kind
+	switch src.Kind {
+	case Ptr:
+		if src.Value == nil {
+			dst.Refid = c.nextRefid()
+			return nil
+		}
+		if _, ok := c.g.Node(src.Refid); ok {
+			return c.pointer(src.Refid, dst)
+		}
+		// a pointer without a refid can't be shared
+		dst.Refid = c.nextRefid()
+		if inner, _ := src.AsPtr(); inner != nil {
+			dst.Value = c.child(inner)
+		}
+	case Ref:
+		refid, err := refFromValue(src)
+		if err != nil {
+			return err
+		}
+		return c.pointer(refid, dst)
+	case Stub:
+		if src.Refid != 0 {
+			return c.pointer(src.Refid, dst)
+		}
+		dst.Refid = c.nextRefid()
+		dst.Value = src.Value
+	case Struct, Map:
+		if src.Value == nil {
+			return nil
+		}
+		fields, ok := src.AsFields()
+		if !ok {
+			return &InvalidValueError{Value: src.Value, Kind: src.Kind}
+		}
+		keys := sortedKeys(fields)
+		m := make(map[string]*Value, len(keys))
+		for i := len(keys) - 1; i >= 0; i-- {
+			m[keys[i]] = c.child(fields[keys[i]])
+		}
+		dst.Value = m
+	case Slice, Array:
+		if src.Value == nil {
+			return nil
+		}
+		elems, ok := src.AsSlice()
+		if !ok {
+			return &InvalidValueError{Value: src.Value, Kind: src.Kind}
+		}
+		s := make([]*Value, len(elems))
+		for i := len(elems) - 1; i >= 0; i-- {
+			s[i] = c.child(elems[i])
+		}
+		dst.Value = s
+	default:
+		dst.Value = src.Value
+	}
+	return nil
+}
+
+// child allocates the canonical form of a child and schedules its filling.
+func (c *canonicalizer) child(src *Value) *Value {
+	if src == nil {
+		return nil
+	}
+	dst := &Value{}
+	c.stack = append(c.stack, canonTask{src: src, dst: dst})
+	return dst
+}
+
+func canonicalize(v *Value) (*Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+	g, err := NewGraph(v)
+	if err != nil {
+		return nil, err
+	}
+	c := &canonicalizer{g: g, refids: make(map[uint64]uint64)}
+	res := c.child(v)
+	for len(c.stack) > 0 {
+		t := c.stack[len(c.stack)-1]
+		c.stack = c.stack[:len(c.stack)-1]
+		if err := c.fillValue(t.src, t.dst); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Canonicalize returns the canonical form of v, which doesn't depend on
+// the identity of the pointers of the graph nor on the order it was
+// built in. The tree is walked in preorder, with struct fields and map
+// keys in sorted order; the first pointer or ref to every target met on
+// the way becomes the pointer holding it and the others become refs to
+// it. Pointers and refs are then numbered in the order they are met,
+// other nodes get no refid. Payloads have the same types as the ones
+// produced by ToValue, refs hold uint64 refids.
+//
+// Two graphs that only differ in the addresses of their pointers, or in
+// the order their pointers were first reached in, have equal canonical
+// forms. v itself is not modified; scalar payloads may be shared between
+// v and the result. Canonicalize returns nil if v is malformed, e.g. if
+// it holds a ref to an unknown refid; Hash reports the error instead.
+func Canonicalize(v *Value) *Value {
+	res, err := canonicalize(v)
+	if err != nil {
+		return nil
+	}
+	return res
+}
+
+// Hash writes the binary encoding (see Value.MarshalBinary) of the
+// canonical form of v to h, so that isomorphic graphs produce the same
+// hash. v may be a *Value, which is canonicalized as is, or any value
+// accepted by ToValue.
+func Hash(v any, h hash.Hash) error {
+	data, ok := v.(*Value)
+	if !ok {
+		var err error
+		if data, err = ToValue(v); err != nil {
+			return err
+		}
+	}
+	data, err := canonicalize(data)
+	if err != nil {
+		return err
+	}
+	b, err := data.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = h.Write(b)
+	return err
+}
@@ -0,0 +1,149 @@
+package tahwil_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+type canonNodeT struct {
+	Name  string
+	Left  *canonNodeT
+	Right *canonNodeT
+	Peers map[string]*canonNodeT
+}
+
+func hashOf(t *testing.T, v any) []byte {
+	t.Helper()
+	h := sha256.New()
+	if err := tahwil.Hash(v, h); err != nil {
+		t.Fatal(err)
+	}
+	return h.Sum(nil)
+}
+
+func TestCanonicalize(t *testing.T) {
+	shared := &canonNodeT{Name: "shared"}
+	root := &canonNodeT{Name: "root", Left: shared, Right: shared}
+	shared.Left = root
+
+	// the same graph, built the other way round: Right is reached first
+	v := &tahwil.Value{Refid: 7, Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Struct, Value: map[string]*tahwil.Value{
+		"Name":  {Kind: tahwil.String, Value: "root"},
+		"Left":  {Refid: 9, Kind: tahwil.Ref, Value: uint64(8)},
+		"Peers": {Kind: tahwil.Map, Value: map[string]*tahwil.Value{}},
+		"Right": {Refid: 8, Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Struct, Value: map[string]*tahwil.Value{
+			"Name":  {Kind: tahwil.String, Value: "shared"},
+			"Left":  {Refid: 10, Kind: tahwil.Ref, Value: uint64(7)},
+			"Peers": {Kind: tahwil.Map, Value: map[string]*tahwil.Value{}},
+			"Right": {Refid: 11, Kind: tahwil.Ptr},
+		}}},
+	}}}
+
+	want, err := tahwil.ToValue(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := tahwil.Canonicalize(v)
+	if !reflect.DeepEqual(got, tahwil.Canonicalize(want)) {
+		t.Errorf("Canonicalize() differs from the canonical form of ToValue()")
+	}
+
+	// Left sorts before Right, so it holds the pointer
+	left := got.Value.(*tahwil.Value).Value.(map[string]*tahwil.Value)["Left"]
+	if left.Kind != tahwil.Ptr || left.Refid != 2 {
+		t.Errorf("Left = %s(%d), want ptr(2)", left.Kind, left.Refid)
+	}
+	right := got.Value.(*tahwil.Value).Value.(map[string]*tahwil.Value)["Right"]
+	if right.Kind != tahwil.Ref || right.Value != uint64(2) {
+		t.Errorf("Right = %s(%v), want ref(2)", right.Kind, right.Value)
+	}
+
+	// the input is not modified
+	if v.Value.(*tahwil.Value).Value.(map[string]*tahwil.Value)["Left"].Kind != tahwil.Ref {
+		t.Errorf("Canonicalize() modified its input")
+	}
+}
+
+func TestCanonicalize_JSON(t *testing.T) {
+	a := &canonNodeT{Name: "a"}
+	b := &canonNodeT{Name: "b", Left: a}
+	a.Peers = map[string]*canonNodeT{"b": b, "self": a}
+
+	v, err := tahwil.ToValue(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded tahwil.Value
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	// decoded refs are ints and payloads are map[string]any and []any
+	want := tahwil.Canonicalize(v)
+	got := tahwil.Canonicalize(&decoded)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Canonicalize(decoded) differs from Canonicalize(v)")
+	}
+}
+
+func TestCanonicalize_Invalid(t *testing.T) {
+	if got := tahwil.Canonicalize(nil); got != nil {
+		t.Errorf("Canonicalize(nil) = %v, want nil", got)
+	}
+	v := &tahwil.Value{Refid: 1, Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Ref, Value: uint64(5)}}
+	if got := tahwil.Canonicalize(v); got != nil {
+		t.Errorf("Canonicalize(unknown ref) = %v, want nil", got)
+	}
+	if err := tahwil.Hash(v, sha256.New()); err == nil {
+		t.Errorf("Hash(unknown ref) returned no error")
+	}
+}
+
+func TestHash(t *testing.T) {
+	build := func(reversed bool) *canonNodeT {
+		x := &canonNodeT{Name: "x"}
+		y := &canonNodeT{Name: "y"}
+		root := &canonNodeT{Name: "root", Peers: map[string]*canonNodeT{}}
+		if reversed {
+			root.Peers["y"], root.Peers["x"] = y, x
+			y.Left, x.Right = x, y
+		} else {
+			root.Peers["x"], root.Peers["y"] = x, y
+			x.Right, y.Left = y, x
+		}
+		return root
+	}
+
+	h1 := hashOf(t, build(false))
+	h2 := hashOf(t, build(true))
+	if !bytes.Equal(h1, h2) {
+		t.Errorf("isomorphic graphs hash differently")
+	}
+
+	v, err := tahwil.ToValue(build(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hashOf(t, v), h1) {
+		t.Errorf("Hash(*Value) differs from Hash(value)")
+	}
+
+	// sharing is part of the graph
+	shared := &canonNodeT{Name: "s"}
+	distinct := hashOf(t, &canonNodeT{Left: &canonNodeT{Name: "s"}, Right: &canonNodeT{Name: "s"}})
+	if bytes.Equal(hashOf(t, &canonNodeT{Left: shared, Right: shared}), distinct) {
+		t.Errorf("shared and distinct pointers hash the same")
+	}
+	if bytes.Equal(hashOf(t, &canonNodeT{Name: "other"}), h1) {
+		t.Errorf("different graphs hash the same")
+	}
+}
@@ -0,0 +1,817 @@
+// Package cbor converts Go object graphs to and from CBOR (RFC 8949),
+// expressing shared and cyclic pointers with the value-sharing tags
+// 28 (shareable) and 29 (sharedref).
+//
+// Encoding goes through tahwil.ToValue: every non-nil pointer becomes a
+// tag 28 item wrapping its target, and every further pointer to the same
+// target becomes a tag 29 item holding the index of the shareable item
+// (counted from 0 in encoding order). All other values use the natural
+// CBOR representation: structs and maps become maps with text keys,
+// slices and arrays become arrays ([]byte becomes a byte string), and
+// scalars use the native integer, float, text and simple value types.
+// Func nodes, as produced by tahwil.ToValueWithOptions, are stored as
+// the text of their name, or null, and chan nodes as null. Stub nodes
+// can't be encoded: they stand for a pointer whose target is left out,
+// which the value-sharing tags have no way to express.
+//
+// Decoding is guided by the destination type and produces a
+// *tahwil.Value tree that is restored with tahwil.FromValue, so any CBOR
+// producer that marks shared values with tag 28 and refers to them with
+// tag 29 can be decoded, not only this package.
+package cbor
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/go-extras/tahwil"
+	"github.com/go-extras/tahwil/internal/bytesval"
+	"github.com/go-extras/tahwil/internal/fieldtag"
+	"github.com/go-extras/tahwil/internal/nesting"
+)
+
+const (
+	majorUint = iota
+	majorNegInt
+	majorBytes
+	majorText
+	majorArray
+	majorMap
+	majorTag
+)
+
+const (
+	tagShareable = 28
+	tagSharedRef = 29
+)
+
+const (
+	simpleFalse   = 0xf4
+	simpleTrue    = 0xf5
+	simpleNull    = 0xf6
+	simpleFloat16 = 0xf9
+	simpleFloat32 = 0xfa
+	simpleFloat64 = 0xfb
+)
+
+// A SyntaxError describes malformed CBOR input.
+type SyntaxError struct {
+	Offset int
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return "cbor: " + e.msg + " at offset " + strconv.Itoa(e.Offset)
+}
+
+// An UnsupportedTypeError is returned by Unmarshal when the destination
+// contains a type that can't be restored from CBOR input.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	if e.Type == nil {
+		return "cbor: unsupported type nil"
+	}
+	return "cbor: unsupported type " + e.Type.String()
+}
+
+// An UnsupportedValueError is returned by Marshal for a Value that has
+// no CBOR representation, such as a stub.
+type UnsupportedValueError struct {
+	Value  *tahwil.Value
+	Reason string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "cbor: unsupported value: " + e.Reason
+}
+
+// Marshal returns the CBOR encoding of v. A *tahwil.Value is encoded as
+// the tree it holds, like MarshalValue does.
+func Marshal(v any) ([]byte, error) {
+	if val, ok := v.(*tahwil.Value); ok {
+		return MarshalValue(val)
+	}
+	val, err := tahwil.ToValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return MarshalValue(val)
+}
+
+// MarshalValue returns the CBOR encoding of a *tahwil.Value tree, such as
+// one produced by tahwil.ToValue or decoded from tahwil JSON. The root is
+// expected to be a pointer, like the ones produced by ToValue; it is
+// encoded as the shareable item 0.
+func MarshalValue(v *tahwil.Value) ([]byte, error) {
+	g, err := tahwil.NewGraph(v)
+	if err != nil {
+		return nil, err
+	}
+	e := &encoder{
+		shared: make(map[uint64]int),
+		graph:  g,
+	}
+	if err := e.encode(v); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+type encoder struct {
+	buf []byte
+	// shared maps pointer refids to their shareable index, or to -1
+	// for nil pointers
+	shared map[uint64]int
+	// lastShared is the number of shareable items written so far
+	lastShared int
+	// graph indexes the pointers by refid, so that a ref can be encoded
+	// before the pointer it refers to has been reached
+	graph *tahwil.Graph
+}
+
+func (e *encoder) writeHead(major byte, n uint64) {
+	m := major << 5
+	switch {
+	case n < 24:
+		e.buf = append(e.buf, m|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, m|24, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, m|25), uint16(n))
+	case n <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, m|26), uint32(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, m|27), n)
+	}
+}
+
+func (e *encoder) writeInt(i int64) {
+	if i >= 0 {
+		e.writeHead(majorUint, uint64(i))
+		return
+	}
+	e.writeHead(majorNegInt, uint64(-1-i))
+}
+
+func (e *encoder) writeText(s string) {
+	e.writeHead(majorText, uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) encodePtr(v *tahwil.Value) error {
+	if idx, ok := e.shared[v.Refid]; ok {
+		// already written through a forward ref
+		return e.writeShared(idx)
+	}
+	if v.Value == nil {
+		e.shared[v.Refid] = -1
+		e.buf = append(e.buf, simpleNull)
+		return nil
+	}
+	inner, ok := v.AsPtr()
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	e.shared[v.Refid] = e.lastShared
+	e.lastShared++
+	e.writeHead(majorTag, tagShareable)
+	return e.encode(inner)
+}
+
+func (e *encoder) writeShared(idx int) error {
+	if idx < 0 {
+		e.buf = append(e.buf, simpleNull)
+		return nil
+	}
+	e.writeHead(majorTag, tagSharedRef)
+	e.writeHead(majorUint, uint64(idx))
+	return nil
+}
+
+func (e *encoder) encodeRef(v *tahwil.Value) error {
+	refid, ok := v.AsRef()
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	if idx, ok := e.shared[refid]; ok {
+		return e.writeShared(idx)
+	}
+	// forward ref: write the target pointer here; a stub is rejected like
+	// the stub itself
+	p, ok := e.graph.Node(refid)
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	return e.encode(p)
+}
+
+func (e *encoder) encodeFields(v *tahwil.Value) error {
+	fields, ok := v.AsFields()
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	e.writeHead(majorMap, uint64(len(keys)))
+	for _, k := range keys {
+		e.writeText(k)
+		if err := e.encode(fields[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) encodeElems(v *tahwil.Value) error {
+	elems, ok := v.AsSlice()
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	if b, ok := bytesval.Of(elems); ok {
+		e.writeHead(majorBytes, uint64(len(b)))
+		e.buf = append(e.buf, b...)
+		return nil
+	}
+	e.writeHead(majorArray, uint64(len(elems)))
+	for _, el := range elems {
+		if err := e.encode(el); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) encodeScalar(v *tahwil.Value) error {
+	switch v.Kind {
+	case tahwil.Bool:
+		b, ok := v.Value.(bool)
+		if !ok {
+			return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		if b {
+			e.buf = append(e.buf, simpleTrue)
+		} else {
+			e.buf = append(e.buf, simpleFalse)
+		}
+		return nil
+	case tahwil.String, tahwil.Func:
+		s, ok := v.Value.(string)
+		if !ok {
+			return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		e.writeText(s)
+		return nil
+	}
+
+	rv := reflect.ValueOf(v.Value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		e.writeHead(majorUint, rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		if v.Kind == tahwil.Float32 {
+			e.buf = binary.BigEndian.AppendUint32(append(e.buf, simpleFloat32), math.Float32bits(float32(rv.Float())))
+		} else {
+			e.buf = binary.BigEndian.AppendUint64(append(e.buf, simpleFloat64), math.Float64bits(rv.Float()))
+		}
+	default:
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	return nil
+}
+
+func (e *encoder) encode(v *tahwil.Value) error {
+	if v == nil {
+		e.buf = append(e.buf, simpleNull)
+		return nil
+	}
+	switch v.Kind {
+	case tahwil.Ptr:
+		return e.encodePtr(v)
+	case tahwil.Ref:
+		return e.encodeRef(v)
+	case tahwil.Stub:
+		// a tag 29 item can't refer to a target left out of the document
+		return &UnsupportedValueError{Value: v, Reason: "stub"}
+	}
+	if v.Value == nil {
+		e.buf = append(e.buf, simpleNull)
+		return nil
+	}
+	switch v.Kind {
+	case tahwil.Struct, tahwil.Map:
+		return e.encodeFields(v)
+	case tahwil.Slice, tahwil.Array:
+		return e.encodeElems(v)
+	case tahwil.Bool, tahwil.String, tahwil.Func,
+		tahwil.Int, tahwil.Int8, tahwil.Int16, tahwil.Int32, tahwil.Int64,
+		tahwil.Uint, tahwil.Uint8, tahwil.Uint16, tahwil.Uint32, tahwil.Uint64,
+		tahwil.Float32, tahwil.Float64:
+		return e.encodeScalar(v)
+	}
+	return &tahwil.InvalidValueKindError{Kind: v.Kind}
+}
+
+// Unmarshal parses CBOR data and stores the result in the value pointed
+// to by v. Items marked with tag 28 and decoded into pointers become
+// shared pointers, and tag 29 items referring to them restore the
+// sharing, so cycles are preserved. A tag 29 item decoded into a pointer
+// of another type than its shareable item is a *SyntaxError.
+func Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &UnsupportedTypeError{Type: reflect.TypeOf(v)}
+	}
+	val, err := UnmarshalValue(data, rv.Type())
+	if err != nil {
+		return err
+	}
+	return tahwil.FromValue(val, v)
+}
+
+// UnmarshalValue parses CBOR data into a *tahwil.Value tree shaped after
+// t, which must be a pointer type. The result can be passed to
+// tahwil.FromValue with a destination of type t.
+func UnmarshalValue(data []byte, t reflect.Type) (*tahwil.Value, error) {
+	if t == nil || t.Kind() != reflect.Ptr {
+		return nil, &UnsupportedTypeError{Type: t}
+	}
+	d := &decoder{data: data}
+	v, err := d.decode(t)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, d.errorf("unexpected trailing data")
+	}
+	return v, nil
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+	// shared holds the shareable items in encoding order
+	shared []sharedItem
+	// refid that was last generated
+	lastRefid uint64
+	depth     nesting.Depth
+}
+
+// sharedItem is a shareable item; a zero refid marks items that were not
+// decoded into a pointer.
+type sharedItem struct {
+	refid uint64
+	// typ is the pointer type the item was decoded into, the refs to the
+	// item must have the same one
+	typ reflect.Type
+}
+
+func (d *decoder) errorf(msg string) error {
+	return &SyntaxError{Offset: d.pos, msg: msg}
+}
+
+func (d *decoder) nextRefid() uint64 {
+	d.lastRefid++
+	return d.lastRefid
+}
+
+func (d *decoder) peek() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, d.errorf("unexpected end of input")
+	}
+	return d.data[d.pos], nil
+}
+
+func (d *decoder) next(n uint64) ([]byte, error) {
+	if uint64(len(d.data)-d.pos) < n {
+		return nil, d.errorf("unexpected end of input")
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// readHead reads the initial byte of an item and its argument.
+func (d *decoder) readHead() (major byte, arg uint64, err error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, err
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	if info > 27 {
+		d.pos--
+		return 0, 0, d.errorf("indefinite length items are not supported")
+	}
+	ext, err := d.next(1 << (info - 24))
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, c := range ext {
+		arg = arg<<8 | uint64(c)
+	}
+	return major, arg, nil
+}
+
+// readLength reads the head of a string, array or map item.
+func (d *decoder) readLength(expected byte) (int, error) {
+	start := d.pos
+	major, n, err := d.readHead()
+	if err != nil {
+		return 0, err
+	}
+	if major != expected {
+		d.pos = start
+		return 0, d.errorf("unexpected major type " + strconv.Itoa(int(major)))
+	}
+	if n > uint64(len(d.data)) {
+		// every element takes at least one byte
+		d.pos = start
+		return 0, d.errorf("length out of range")
+	}
+	return int(n), nil
+}
+
+func (d *decoder) readText() (string, error) {
+	n, err := d.readLength(majorText)
+	if err != nil {
+		return "", err
+	}
+	b, err := d.next(uint64(n))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *decoder) isNull() bool {
+	if d.pos < len(d.data) && d.data[d.pos] == simpleNull {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+// skipShareable skips a shareable tag in front of an item that is not
+// decoded into a pointer. Such an item can't be shared, the tag is only
+// counted so that the following shareable items keep their indexes.
+func (d *decoder) skipShareable() error {
+	start := d.pos
+	major, tag, err := d.readHead()
+	if err != nil {
+		return err
+	}
+	if major == majorTag && tag == tagShareable {
+		d.shared = append(d.shared, sharedItem{})
+		return nil
+	}
+	d.pos = start
+	return nil
+}
+
+// skip skips a single item, keeping track of the shareable items inside.
+func (d *decoder) skip() error {
+	defer d.depth.Leave()
+	if !d.depth.Enter() {
+		return d.errorf("exceeded max depth")
+	}
+	major, arg, err := d.readHead()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case majorBytes, majorText:
+		_, err = d.next(arg)
+		return err
+	case majorArray, majorMap:
+		n := arg
+		if major == majorMap {
+			n *= 2
+		}
+		for i := uint64(0); i < n; i++ {
+			if err = d.skip(); err != nil {
+				return err
+			}
+		}
+	case majorTag:
+		if arg == tagShareable {
+			d.shared = append(d.shared, sharedItem{})
+		}
+		return d.skip()
+	}
+	return nil
+}
+
+func (d *decoder) decodePtr(t reflect.Type) (*tahwil.Value, error) {
+	if d.isNull() {
+		return &tahwil.Value{Refid: d.nextRefid(), Kind: tahwil.Ptr}, nil
+	}
+	start := d.pos
+	major, tag, err := d.readHead()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case major == majorTag && tag == tagShareable:
+		refid := d.nextRefid()
+		d.shared = append(d.shared, sharedItem{refid: refid, typ: t})
+		inner, err := d.decode(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &tahwil.Value{Refid: refid, Kind: tahwil.Ptr, Value: inner}, nil
+	case major == majorTag && tag == tagSharedRef:
+		_, idx, err := d.readHead()
+		if err != nil {
+			return nil, err
+		}
+		if idx >= uint64(len(d.shared)) || d.shared[idx].refid == 0 {
+			d.pos = start
+			return nil, d.errorf("invalid shared reference " + strconv.FormatUint(idx, 10))
+		}
+		item := d.shared[idx]
+		if item.typ != t {
+			d.pos = start
+			return nil, d.errorf("shared reference " + strconv.FormatUint(idx, 10) + " to a " + item.typ.String() + " decoded into a " + t.String())
+		}
+		return &tahwil.Value{Refid: d.nextRefid(), Kind: tahwil.Ref, Value: item.refid}, nil
+	}
+
+	// a value without sharing tags, not aliased by anything else
+	d.pos = start
+	refid := d.nextRefid()
+	inner, err := d.decode(t.Elem())
+	if err != nil {
+		return nil, err
+	}
+	return &tahwil.Value{Refid: refid, Kind: tahwil.Ptr, Value: inner}, nil
+}
+
+func (d *decoder) decodeStruct(t reflect.Type) (*tahwil.Value, error) {
+	n, err := d.readLength(majorMap)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]reflect.Type)
+	for _, ft := range reflect.VisibleFields(t) {
+		k, ok := fieldtag.Key(ft)
+		if !ok || !ft.IsExported() {
+			continue
+		}
+		fields[k] = ft.Type
+	}
+
+	res := make(map[string]*tahwil.Value, n)
+	for i := 0; i < n; i++ {
+		k, err := d.readText()
+		if err != nil {
+			return nil, err
+		}
+		ft, ok := fields[k]
+		if !ok {
+			if err = d.skip(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if res[k], err = d.decode(ft); err != nil {
+			return nil, err
+		}
+	}
+	return &tahwil.Value{Kind: tahwil.Struct, Value: res}, nil
+}
+
+func (d *decoder) decodeMap(t reflect.Type) (*tahwil.Value, error) {
+	if t.Key().Kind() != reflect.String {
+		return nil, &UnsupportedTypeError{Type: t}
+	}
+	if d.isNull() {
+		return &tahwil.Value{Kind: tahwil.Map}, nil
+	}
+	n, err := d.readLength(majorMap)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]*tahwil.Value, n)
+	for i := 0; i < n; i++ {
+		k, err := d.readText()
+		if err != nil {
+			return nil, err
+		}
+		if res[k], err = d.decode(t.Elem()); err != nil {
+			return nil, err
+		}
+	}
+	return &tahwil.Value{Kind: tahwil.Map, Value: res}, nil
+}
+
+func (d *decoder) decodeSlice(t reflect.Type) (*tahwil.Value, error) {
+	kind := tahwil.Kind(t.Kind().String())
+	if d.isNull() {
+		return &tahwil.Value{Kind: kind}, nil
+	}
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	if c>>5 == majorBytes && t.Elem().Kind() == reflect.Uint8 {
+		n, err := d.readLength(majorBytes)
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(uint64(n))
+		if err != nil {
+			return nil, err
+		}
+		res := make([]*tahwil.Value, n)
+		values := make([]tahwil.Value, n)
+		for i, x := range b {
+			values[i] = tahwil.Value{Kind: tahwil.Uint8, Value: x}
+			res[i] = &values[i]
+		}
+		return &tahwil.Value{Kind: kind, Value: res}, nil
+	}
+
+	n, err := d.readLength(majorArray)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*tahwil.Value, n)
+	for i := range res {
+		if res[i], err = d.decode(t.Elem()); err != nil {
+			return nil, err
+		}
+	}
+	return &tahwil.Value{Kind: kind, Value: res}, nil
+}
+
+func (d *decoder) decodeBool() (*tahwil.Value, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	if c != simpleFalse && c != simpleTrue {
+		return nil, d.errorf("expected bool")
+	}
+	d.pos++
+	return &tahwil.Value{Kind: tahwil.Bool, Value: c == simpleTrue}, nil
+}
+
+func (d *decoder) decodeFloat(t reflect.Type) (*tahwil.Value, error) {
+	kind := tahwil.Kind(t.Kind().String())
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	var f float64
+	switch c {
+	case simpleFloat16:
+		b, err := d.next(3)
+		if err != nil {
+			return nil, err
+		}
+		f = float16(binary.BigEndian.Uint16(b[1:]))
+	case simpleFloat32:
+		b, err := d.next(5)
+		if err != nil {
+			return nil, err
+		}
+		f = float64(math.Float32frombits(binary.BigEndian.Uint32(b[1:])))
+	case simpleFloat64:
+		b, err := d.next(9)
+		if err != nil {
+			return nil, err
+		}
+		f = math.Float64frombits(binary.BigEndian.Uint64(b[1:]))
+	default:
+		start := d.pos
+		major, arg, err := d.readHead()
+		if err != nil {
+			return nil, err
+		}
+		switch major {
+		case majorUint:
+			f = float64(arg)
+		case majorNegInt:
+			f = -1 - float64(arg)
+		default:
+			d.pos = start
+			return nil, d.errorf("expected number")
+		}
+	}
+	return &tahwil.Value{Kind: kind, Value: f}, nil
+}
+
+func (d *decoder) decodeInt(t reflect.Type) (*tahwil.Value, error) {
+	kind := tahwil.Kind(t.Kind().String())
+	start := d.pos
+	major, arg, err := d.readHead()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case major != majorUint && major != majorNegInt:
+		d.pos = start
+		return nil, d.errorf("expected integer")
+	case t.Kind() >= reflect.Uint && t.Kind() <= reflect.Uint64:
+		if major != majorUint {
+			d.pos = start
+			return nil, d.errorf("negative value for " + string(kind))
+		}
+		return &tahwil.Value{Kind: kind, Value: arg}, nil
+	case arg > math.MaxInt64:
+		d.pos = start
+		return nil, d.errorf("integer out of range for " + string(kind))
+	case major == majorNegInt:
+		return &tahwil.Value{Kind: kind, Value: -1 - int64(arg)}, nil
+	default:
+		return &tahwil.Value{Kind: kind, Value: int64(arg)}, nil
+	}
+}
+
+// decode reads a single item into a *tahwil.Value matching t.
+func (d *decoder) decode(t reflect.Type) (*tahwil.Value, error) {
+	defer d.depth.Leave()
+	if !d.depth.Enter() {
+		return nil, d.errorf("exceeded max depth")
+	}
+	if t.Kind() != reflect.Ptr {
+		if err := d.skipShareable(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return d.decodePtr(t)
+	case reflect.Struct:
+		return d.decodeStruct(t)
+	case reflect.Map:
+		return d.decodeMap(t)
+	case reflect.Slice, reflect.Array:
+		return d.decodeSlice(t)
+	case reflect.String:
+		s, err := d.readText()
+		if err != nil {
+			return nil, err
+		}
+		return &tahwil.Value{Kind: tahwil.String, Value: s}, nil
+	case reflect.Bool:
+		return d.decodeBool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return d.decodeInt(t)
+	case reflect.Float32, reflect.Float64:
+		return d.decodeFloat(t)
+	case reflect.Func:
+		if d.isNull() {
+			return &tahwil.Value{Kind: tahwil.Func}, nil
+		}
+		s, err := d.readText()
+		if err != nil {
+			return nil, err
+		}
+		return &tahwil.Value{Kind: tahwil.Func, Value: s}, nil
+	case reflect.Chan:
+		if !d.isNull() {
+			return nil, d.errorf("expected null for a chan")
+		}
+		return &tahwil.Value{Kind: tahwil.Chan}, nil
+	}
+	return nil, &UnsupportedTypeError{Type: t}
+}
+
+// float16 converts an IEEE 754 half-precision number to float64.
+func float16(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
@@ -0,0 +1,292 @@
+package cbor_test
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+	"github.com/go-extras/tahwil/cbor"
+	"github.com/go-extras/tahwil/internal/nesting"
+)
+
+type personT struct {
+	Name     string     `json:"name"`
+	Parent   *personT   `json:"parent"`
+	Children []*personT `json:"children"`
+}
+
+type hooksT struct {
+	Name string
+	Fn   func(string) string
+	Nil  func(string) string
+	Done chan struct{}
+	Next *hooksT
+}
+
+type scalarsT struct {
+	Bool    bool
+	Int8    int8
+	Int64   int64
+	Uint16  uint16
+	Uint64  uint64
+	Float32 float32
+	Float64 float64
+	String  string
+	Bytes   []byte
+	Array   [2]int
+	Map     map[string]int
+}
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		in  any
+		out []byte
+	}{
+		{in: 10, out: []byte{0xd8, 0x1c, 0x0a}},
+		{in: -500, out: []byte{0xd8, 0x1c, 0x39, 0x01, 0xf3}},
+		{in: "a", out: []byte{0xd8, 0x1c, 0x61, 'a'}},
+		{in: []byte{1, 2}, out: []byte{0xd8, 0x1c, 0x42, 0x01, 0x02}},
+		{in: map[string]bool{"b": true, "a": false}, out: []byte{0xd8, 0x1c, 0xa2, 0x61, 'a', 0xf4, 0x61, 'b', 0xf5}},
+		{in: nil, out: []byte{0xf6}},
+	}
+	for i, tt := range tests {
+		res, err := cbor.Marshal(tt.in)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !bytes.Equal(res, tt.out) {
+			t.Errorf("#%d: have % x, want % x", i, res, tt.out)
+		}
+	}
+}
+
+func TestMarshal_SharedRefs(t *testing.T) {
+	parent := &personT{Name: "A"}
+	parent.Children = []*personT{{Name: "B", Parent: parent}}
+
+	res, err := cbor.Marshal(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0xd8, 0x1c, 0xa3, // 28({ ... }) - shareable 0
+		0x68, 'c', 'h', 'i', 'l', 'd', 'r', 'e', 'n', 0x81, // "children": [
+		0xd8, 0x1c, 0xa3, // 28({ ... }) - shareable 1
+		0x68, 'c', 'h', 'i', 'l', 'd', 'r', 'e', 'n', 0x80, // "children": []
+		0x64, 'n', 'a', 'm', 'e', 0x61, 'B', // "name": "B"
+		0x66, 'p', 'a', 'r', 'e', 'n', 't', 0xd8, 0x1d, 0x00, // "parent": 29(0)
+		0x64, 'n', 'a', 'm', 'e', 0x61, 'A', // "name": "A"
+		0x66, 'p', 'a', 'r', 'e', 'n', 't', 0xf6, // "parent": null
+	}
+	if !bytes.Equal(res, want) {
+		t.Errorf("have % x\nwant % x", res, want)
+	}
+
+	// a *tahwil.Value is encoded as the tree it holds
+	v, err := tahwil.ToValue(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err = cbor.Marshal(v); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, want) {
+		t.Errorf("have % x\nwant % x", res, want)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := &scalarsT{
+		Bool: true, Int8: -100, Int64: math.MinInt64, Uint16: 60000, Uint64: math.MaxUint64,
+		Float32: 1.5, Float64: -2.25, String: "string", Bytes: []byte{0, 255},
+		Array: [2]int{-1, 1}, Map: map[string]int{"a": 1},
+	}
+	b, err := cbor.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &scalarsT{}
+	if err = cbor.Unmarshal(b, out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("mismatch\nhave: %+v\nwant: %+v", out, in)
+	}
+}
+
+func TestRoundTrip_Cycle(t *testing.T) {
+	parent := &personT{Name: "Arthur"}
+	parent.Children = []*personT{{Name: "Ford", Parent: parent}, {Name: "Trillian", Parent: parent}}
+	parent.Children = append(parent.Children, parent.Children[0])
+
+	b, err := cbor.Marshal(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &personT{}
+	if err = cbor.Unmarshal(b, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "Arthur" || len(out.Children) != 3 {
+		t.Fatalf("unexpected result: %+v", out)
+	}
+	for i, c := range out.Children {
+		if c.Parent != out {
+			t.Errorf("Children[%d].Parent does not point to the root", i)
+		}
+	}
+	if out.Children[0] != out.Children[2] {
+		t.Error("expected Children[0] and Children[2] to be shared")
+	}
+}
+
+func TestRoundTrip_Funcs(t *testing.T) {
+	funcs := tahwil.NewFuncRegistry()
+	if err := funcs.Register("upper", strings.ToUpper); err != nil {
+		t.Fatal(err)
+	}
+	opts := &tahwil.Options{Funcs: funcs, FuncsAndChans: tahwil.FuncChanNull}
+	in := &hooksT{Name: "a", Fn: strings.ToUpper, Done: make(chan struct{}), Next: &hooksT{Name: "b"}}
+	v, err := tahwil.ToValueWithOptions(in, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := cbor.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := cbor.UnmarshalValue(b, reflect.TypeOf(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &hooksT{}
+	if err = tahwil.FromValueWithOptions(decoded, out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if out.Fn == nil || out.Fn("x") != "X" || out.Nil != nil || out.Done != nil || out.Next.Name != "b" {
+		t.Errorf("unexpected result: %+v", out)
+	}
+
+	// stubs have no CBOR representation
+	opts.MaxDepth = 1
+	if v, err = tahwil.ToValueWithOptions(in, opts); err != nil {
+		t.Fatal(err)
+	}
+	var unsupported *cbor.UnsupportedValueError
+	if _, err = cbor.MarshalValue(v); !errors.As(err, &unsupported) {
+		t.Errorf("expected *UnsupportedValueError, got %T: %v", err, err)
+	}
+
+	// and neither have the refs to them, met first here as the keys are
+	// sorted
+	c := &personT{Name: "c"}
+	if v, err = tahwil.ToValueWithOptions(&personT{Parent: c, Children: []*personT{c}}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cbor.MarshalValue(v); !errors.As(err, &unsupported) {
+		t.Errorf("expected *UnsupportedValueError, got %T: %v", err, err)
+	}
+}
+
+func TestUnmarshal_Foreign(t *testing.T) {
+	// {"name": "A", "extra": 28([1]), "children": [28({"name": "B", "parent": 29(1)})]}
+	// with a float16 and an unknown shareable item that is skipped
+	data := []byte{
+		0xa3,
+		0x64, 'n', 'a', 'm', 'e', 0x61, 'A',
+		0x65, 'e', 'x', 't', 'r', 'a', 0xd8, 0x1c, 0x81, 0xf9, 0x3c, 0x00,
+		0x68, 'c', 'h', 'i', 'l', 'd', 'r', 'e', 'n', 0x81,
+		0xd8, 0x1c, 0xa2, 0x64, 'n', 'a', 'm', 'e', 0x61, 'B', 0x66, 'p', 'a', 'r', 'e', 'n', 't', 0xd8, 0x1d, 0x01,
+	}
+	out := &personT{}
+	if err := cbor.Unmarshal(data, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "A" || len(out.Children) != 1 || out.Children[0].Name != "B" {
+		t.Fatalf("unexpected result: %+v", out)
+	}
+	if out.Children[0].Parent != out.Children[0] {
+		t.Error("expected the child to refer to itself")
+	}
+
+	var f struct{ F float64 }
+	if err := cbor.Unmarshal([]byte{0xa1, 0x61, 'F', 0xf9, 0xc1, 0x00}, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.F != -2.5 {
+		t.Errorf("float16: have %v, want -2.5", f.F)
+	}
+}
+
+func TestUnmarshal_Errors(t *testing.T) {
+	var syntaxErr *cbor.SyntaxError
+	type xT struct{}
+	type yT struct{}
+	type pairT struct {
+		A *xT `json:"a"`
+		B *yT `json:"b"`
+	}
+	tests := []struct {
+		data []byte
+		out  any
+	}{
+		{data: []byte{}, out: new(int)},
+		{data: []byte{0x61}, out: new(string)},              // truncated
+		{data: []byte{0x18, 0xff}, out: new(int8)},          // out of range, caught by FromValue
+		{data: []byte{0x20}, out: new(uint)},                // negative uint
+		{data: []byte{0x01, 0x01}, out: new(int)},           // trailing data
+		{data: []byte{0x9f, 0xff}, out: new([]int)},         // indefinite length
+		{data: []byte{0xd8, 0x1d, 0x00}, out: new(*int)},    // dangling shared ref
+		{data: []byte{0x61, 'a'}, out: new(bool)},           // not a bool
+		{data: []byte{0xa1, 0x01, 0x01}, out: new(personT)}, // non-text key
+		{data: []byte{0x01}, out: new(chan int)},            // non-null chan
+		// {a: 28({}), b: 29(0)}: a shared ref of another pointer type
+		{data: []byte{0xa2, 0x61, 'a', 0xd8, 0x1c, 0xa0, 0x61, 'b', 0xd8, 0x1d, 0x00}, out: new(pairT)},
+	}
+	for i, tt := range tests {
+		err := cbor.Unmarshal(tt.data, tt.out)
+		if err == nil {
+			t.Errorf("#%d: expected error, got nil", i)
+			continue
+		}
+		if i != 2 && !errors.As(err, &syntaxErr) {
+			t.Errorf("#%d: expected *SyntaxError, got %T: %v", i, err, err)
+		}
+	}
+
+	var unsupported *cbor.UnsupportedTypeError
+	if err := cbor.Unmarshal([]byte{0x01}, 1); !errors.As(err, &unsupported) {
+		t.Errorf("expected *UnsupportedTypeError, got %T: %v", err, err)
+	}
+	var c complex128
+	if err := cbor.Unmarshal([]byte{0x01}, &c); !errors.As(err, &unsupported) {
+		t.Errorf("expected *UnsupportedTypeError, got %T: %v", err, err)
+	}
+}
+
+func TestUnmarshal_MaxDepth(t *testing.T) {
+	type nestedT []nestedT
+	// depth arrays nested in each other
+	arrays := func(depth int) []byte {
+		return append(bytes.Repeat([]byte{0x81}, depth-1), 0x80)
+	}
+	// the pointer passed to Unmarshal is the first level
+	var out nestedT
+	if err := cbor.Unmarshal(arrays(nesting.MaxDepth-1), &out); err != nil {
+		t.Errorf("Unmarshal() at max depth = %v", err)
+	}
+	var syntaxErr *cbor.SyntaxError
+	if err := cbor.Unmarshal(arrays(nesting.MaxDepth), &out); !errors.As(err, &syntaxErr) {
+		t.Errorf("expected *SyntaxError, got %T: %v", err, err)
+	}
+
+	// the items of unknown fields are skipped within the same limit
+	skipped := append([]byte{0xa1, 0x61, 'x'}, arrays(nesting.MaxDepth)...)
+	if err := cbor.Unmarshal(skipped, &struct{}{}); !errors.As(err, &syntaxErr) {
+		t.Errorf("expected *SyntaxError, got %T: %v", err, err)
+	}
+}
@@ -0,0 +1,183 @@
+package tahwil
+
+import (
+	"reflect"
+)
+
+// An InvalidCloneKindError describes a value Clone can't copy.
+type InvalidCloneKindError struct {
+	Kind string
+}
+
+func (e *InvalidCloneKindError) Error() string {
+	return "tahwil.Clone: unsupported kind (" + e.Kind + ")"
+}
+
+// cloneTask copies src into dst. Tasks with target set store the already
+// copied dst into target: into the map target under key if key is valid,
+// into the interface target otherwise.
+type cloneTask struct {
+	src    reflect.Value
+	dst    reflect.Value
+	target reflect.Value
+	key    reflect.Value
+}
+
+// cloner copies values the way ToValue followed by FromValue would,
+// without building the intermediate *Value tree. Pointers are tracked
+// with the refid maps of the mapper and the unmapper: the mapper assigns
+// a refid to every source pointer, the unmapper holds the copy allocated
+// for it.
+type cloner struct {
+	vm    *valueMapper
+	vu    *valueUnmapper
+	stack []cloneTask
+}
+
+func newCloner() *cloner {
+	return &cloner{vm: newValueMapper(), vu: newValueUnmapper()}
+}
+
+func (c *cloner) push(src, dst reflect.Value) {
+	c.stack = append(c.stack, cloneTask{src: src, dst: dst})
+}
+
+// pushStored schedules the copy of src into a fresh dst of type t, which
+// is stored into target (under key for maps) once it is complete.
+func (c *cloner) pushStored(src reflect.Value, t reflect.Type, target, key reflect.Value) {
+	dst := reflect.New(t).Elem()
+	c.stack = append(c.stack, cloneTask{dst: dst, target: target, key: key})
+	c.push(src, dst)
+}
+
+func (c *cloner) clonePtr(src, dst reflect.Value) {
+	if src.IsNil() {
+		return
+	}
+	if refid, ok := c.vm.refs[src.Pointer()]; ok {
+		// pointers of different types may share an address
+		// (e.g. a struct and its first field)
+		if p := c.vu.refs[refid]; p.Type() == dst.Type() {
+			dst.Set(p)
+			return
+		}
+	}
+	p := reflect.New(dst.Type().Elem())
+	c.vu.refs[c.vm.saveRef(src)] = p
+	dst.Set(p)
+	c.push(src.Elem(), p.Elem())
+}
+
+func (c *cloner) cloneStruct(src, dst reflect.Value) {
+	fields := c.vm.cachedStructFields(src.Type())
+	for n := len(fields) - 1; n >= 0; n-- {
+		sf, err := src.FieldByIndexErr(fields[n].index)
+		if err != nil {
+			// promoted through a nil embedded pointer
+			continue
+		}
+		c.push(sf, fieldByIndexAlloc(dst, fields[n].index))
+	}
+}
+
+// fieldByIndexAlloc returns the nested field of v, allocating the nil
+// embedded pointers on the way.
+func fieldByIndexAlloc(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// fillValue copies a single value. Nested values are not processed
+// here, they are pushed to the work stack instead.
+func (c *cloner) fillValue(src, dst reflect.Value) error {
+	switch src.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return &InvalidCloneKindError{Kind: src.Kind().String()}
+	case reflect.Interface:
+		if !src.IsNil() {
+			el := src.Elem()
+			c.pushStored(el, el.Type(), dst, reflect.Value{})
+		}
+	case reflect.Ptr:
+		c.clonePtr(src, dst)
+	case reflect.Array:
+		for i := src.Len() - 1; i >= 0; i-- {
+			c.push(src.Index(i), dst.Index(i))
+		}
+	case reflect.Slice:
+		if src.IsNil() {
+			return nil
+		}
+		dst.Set(reflect.MakeSlice(dst.Type(), src.Len(), src.Len()))
+		for i := src.Len() - 1; i >= 0; i-- {
+			c.push(src.Index(i), dst.Index(i))
+		}
+	case reflect.Map:
+		if src.IsNil() {
+			return nil
+		}
+		dst.Set(reflect.MakeMapWithSize(dst.Type(), src.Len()))
+		// map elements are not addressable: copy into a fresh value
+		// first, then store it into the map
+		iter := src.MapRange()
+		for iter.Next() {
+			c.pushStored(iter.Value(), dst.Type().Elem(), dst, iter.Key())
+		}
+	case reflect.Struct:
+		c.cloneStruct(src, dst)
+	default:
+		dst.Set(src)
+	}
+	return nil
+}
+
+func (c *cloner) clone(src, dst reflect.Value) error {
+	c.push(src, dst)
+	for len(c.stack) > 0 {
+		t := c.stack[len(c.stack)-1]
+		c.stack = c.stack[:len(c.stack)-1]
+		if t.target.IsValid() {
+			if t.key.IsValid() {
+				t.target.SetMapIndex(t.key, t.dst)
+			} else {
+				t.target.Set(t.dst)
+			}
+			continue
+		}
+		if err := c.fillValue(t.src, t.dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clone returns a deep copy of src. It copies what ToValue followed by
+// FromValue would copy, but directly from value to value, without the
+// intermediate *Value tree:
+//   - pointers reachable more than once, including cycles, are copied
+//     once, so the copy has the same sharing as src;
+//   - only exported struct fields are copied, fields tagged json:"-"
+//     or json:"_" are left zero;
+//   - slices and maps are copied element by element, nil ones stay nil;
+//     map keys are copied as is;
+//   - the dynamic values of interfaces are copied as well.
+//
+// Funcs, chans and unsafe pointers can't be copied and lead to an
+// *InvalidCloneKindError.
+func Clone[T any](src T) (T, error) {
+	var dst T
+	c := newCloner()
+	if err := c.clone(reflect.ValueOf(&src).Elem(), reflect.ValueOf(&dst).Elem()); err != nil {
+		var zero T
+		return zero, err
+	}
+	return dst, nil
+}
@@ -0,0 +1,147 @@
+package tahwil_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+type cloneT struct {
+	Name    string
+	Hidden  string `json:"-"`
+	private int
+	Tags    []string
+	Scores  [2]float64
+	Meta    map[string]cloneLeafT
+	Any     any
+	Self    *cloneT
+	Left    *cloneLeafT
+	Right   *cloneLeafT
+	Leaves  map[string]*cloneLeafT
+}
+
+type cloneLeafT struct {
+	Value int
+}
+
+func TestClone(t *testing.T) {
+	shared := &cloneLeafT{Value: 1}
+	src := &cloneT{
+		Name:    "root",
+		Hidden:  "hidden",
+		private: 7,
+		Tags:    []string{"a", "b"},
+		Scores:  [2]float64{1.5, 2.5},
+		Meta:    map[string]cloneLeafT{"x": {Value: 2}},
+		Any:     &cloneLeafT{Value: 3},
+		Left:    shared,
+		Right:   shared,
+		Leaves:  map[string]*cloneLeafT{"l": shared},
+	}
+	src.Self = src
+
+	dst, err := tahwil.Clone(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst == src || dst.Left == src.Left {
+		t.Fatal("expected a deep copy")
+	}
+	if dst.Self != dst {
+		t.Error("expected the cycle to be preserved")
+	}
+	if dst.Left != dst.Right || dst.Left != dst.Leaves["l"] {
+		t.Error("expected the shared pointer to be preserved")
+	}
+	if dst.Hidden != "" || dst.private != 0 {
+		t.Errorf("expected ignored fields to be zero, got %q, %d", dst.Hidden, dst.private)
+	}
+
+	src.Hidden, src.private = "", 0
+	if !reflect.DeepEqual(dst, src) {
+		t.Errorf("mismatch\nhave: %+v\nwant: %+v", dst, src)
+	}
+
+	src.Tags[0] = "changed"
+	src.Any.(*cloneLeafT).Value = 30
+	shared.Value = 10
+	if dst.Tags[0] != "a" || dst.Any.(*cloneLeafT).Value != 3 || dst.Left.Value != 1 {
+		t.Error("expected the copy to be independent of the source")
+	}
+}
+
+func TestClone_MatchesValueRoundTrip(t *testing.T) {
+	// nil slices are decoded as empty ones by FromValue, but kept by Clone
+	parent := &personT{Name: "parent"}
+	parent.Children = []*personT{{Name: "child", Parent: parent, Children: []*personT{}}}
+
+	dst, err := tahwil.Clone(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := tahwil.ToValue(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &personT{}
+	if err = tahwil.FromValue(v, want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dst, want) {
+		t.Errorf("mismatch\nhave: %+v\nwant: %+v", dst, want)
+	}
+	if dst.Children[0].Parent != dst {
+		t.Error("expected the cycle to be preserved")
+	}
+}
+
+func TestClone_NonPointer(t *testing.T) {
+	src := map[string][]int{"a": {1, 2}}
+	dst, err := tahwil.Clone(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src["a"][0] = 10
+	if !reflect.DeepEqual(dst, map[string][]int{"a": {1, 2}}) {
+		t.Errorf("unexpected copy: %v", dst)
+	}
+
+	var nilPtr *personT
+	if res, err := tahwil.Clone(nilPtr); err != nil || res != nil {
+		t.Errorf("expected nil, got %v, %v", res, err)
+	}
+}
+
+func TestClone_LongChain(t *testing.T) {
+	const n = 100000
+	var head *listNodeT
+	for i := n; i > 0; i-- {
+		head = &listNodeT{Value: i, Next: head}
+	}
+	dst, err := tahwil.Clone(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for p := dst; p != nil; p = p.Next {
+		count++
+	}
+	if count != n {
+		t.Errorf("chain length = %d, want %d", count, n)
+	}
+}
+
+func TestClone_Errors(t *testing.T) {
+	type withFunc struct {
+		F func()
+	}
+	var kindErr *tahwil.InvalidCloneKindError
+	if _, err := tahwil.Clone(&withFunc{}); !errors.As(err, &kindErr) {
+		t.Errorf("expected *InvalidCloneKindError, got %T: %v", err, err)
+	}
+	if _, err := tahwil.Clone(make(chan int)); !errors.As(err, &kindErr) {
+		t.Errorf("expected *InvalidCloneKindError, got %T: %v", err, err)
+	}
+}
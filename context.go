@@ -0,0 +1,120 @@
+package tahwil
+
+import (
+	"context"
+	"reflect"
+)
+
+// progressInterval is the number of nodes between two checks of the
+// context and two progress reports.
+const progressInterval = 1024
+
+// Progress describes how much of a graph has been processed so far.
+type Progress struct {
+	// Nodes is the number of nodes transformed, decoded or encoded.
+	Nodes int
+	// Bytes is the number of bytes produced so far by the encoders that
+	// produce output, such as MarshalBinaryContext. It is 0 for
+	// ToValueContext and FromValueContext: a *Value is not encoded yet.
+	Bytes int
+}
+
+// tracker counts the processed nodes, reports them to the progress
+// callback and checks the context every progressInterval nodes.
+type tracker struct {
+	ctx      context.Context
+	progress func(Progress)
+	nodes    int
+	// size returns the number of bytes produced so far, if any
+	size func() int
+}
+
+func (t *tracker) visit() error {
+	t.nodes++
+	if t.nodes%progressInterval != 0 {
+		return nil
+	}
+	return t.check()
+}
+
+func (t *tracker) check() error {
+	t.report()
+	if t.ctx != nil {
+		return t.ctx.Err()
+	}
+	return nil
+}
+
+func (t *tracker) report() {
+	if t.progress == nil {
+		return
+	}
+	p := Progress{Nodes: t.nodes}
+	if t.size != nil {
+		p.Bytes = t.size()
+	}
+	t.progress(p)
+}
+
+// done reports the final count, unless it has just been reported.
+func (t *tracker) done() {
+	if t.nodes%progressInterval != 0 {
+		t.report()
+	}
+}
+
+// ToValueContext works like ToValueWithOptions, but stops with the
+// context error once ctx is done. The context is checked, and
+// Options.Progress called, every 1024 nodes, so large graphs can be
+// abandoned midway.
+func ToValueContext(ctx context.Context, i any, opts *Options) (*Value, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	v := reflect.ValueOf(i)
+	if v.Kind() != reflect.Ptr {
+		v = reflect.ValueOf(&i)
+	}
+	vm := newValueMapper()
+	if opts != nil {
+		vm.opts = *opts
+	}
+	vm.tracker.ctx = ctx
+	return vm.toValue(v)
+}
+
+// FromValueContext works like FromValueWithOptions, but stops with the
+// context error once ctx is done, see ToValueContext. The target may be
+// partially filled when it stops.
+func FromValueContext(ctx context.Context, data *Value, v any, opts *Options) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	vu := newValueUnmapper()
+	if opts != nil {
+		vu.opts = *opts
+	}
+	vu.tracker.ctx = ctx
+	return vu.fromValueRoot(data, v)
+}
+
+// MarshalBinaryContext works like MarshalBinary, but stops with the
+// context error once ctx is done, see ToValueContext. Options.Progress,
+// if set, gets the number of bytes produced along with the number of
+// nodes; the other options are ignored.
+func (v *Value) MarshalBinaryContext(ctx context.Context, opts *Options) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	e := newBinaryEncoder()
+	e.tracker.ctx = ctx
+	if opts != nil {
+		e.tracker.progress = opts.Progress
+	}
+	e.tracker.size = func() int { return len(e.buf) }
+	if err := e.encode(v); err != nil {
+		return nil, err
+	}
+	e.tracker.done()
+	return e.buf, nil
+}
@@ -0,0 +1,113 @@
+package tahwil_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+func newList(n int) *listNodeT {
+	var head *listNodeT
+	for i := n; i > 0; i-- {
+		head = &listNodeT{Value: i, Next: head}
+	}
+	return head
+}
+
+func TestToValueContext(t *testing.T) {
+	var reports []int
+	opts := &tahwil.Options{Progress: func(p tahwil.Progress) { reports = append(reports, p.Nodes) }}
+	v, err := tahwil.ToValueContext(context.Background(), newList(1000), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a ptr, a struct, an int and a ptr per element, plus the last nil ptr
+	if len(reports) != 3 || reports[0] != 1024 || reports[1] != 2048 || reports[2] != 3001 {
+		t.Errorf("progress reports = %v", reports)
+	}
+
+	reports = nil
+	var out listNodeT
+	if err = tahwil.FromValueContext(context.Background(), v, &out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if out.Value != 1 || out.Next.Value != 2 {
+		t.Errorf("FromValueContext() = %v", out)
+	}
+	if len(reports) == 0 || reports[len(reports)-1] != 3001 {
+		t.Errorf("progress reports = %v", reports)
+	}
+}
+
+func TestToValueContext_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls := 0
+	// cancel as soon as the work is reported
+	opts := &tahwil.Options{Progress: func(tahwil.Progress) { calls++; cancel() }}
+	v, err := tahwil.ToValueContext(ctx, newList(1000), opts)
+	if !errors.Is(err, context.Canceled) || v != nil {
+		t.Fatalf("ToValueContext() = %v, %v, want context.Canceled", v, err)
+	}
+	if calls != 1 {
+		t.Errorf("progress called %d times after cancellation", calls)
+	}
+
+	// a done context stops before any work
+	if _, err = tahwil.ToValueContext(ctx, newList(1), nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("ToValueContext() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestFromValueContext_Canceled(t *testing.T) {
+	v, err := tahwil.ToValue(newList(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := &tahwil.Options{Progress: func(tahwil.Progress) { cancel() }}
+	var out listNodeT
+	if err = tahwil.FromValueContext(ctx, v, &out, opts); !errors.Is(err, context.Canceled) {
+		t.Errorf("FromValueContext() error = %v, want context.Canceled", err)
+	}
+	if err = tahwil.FromValueContext(ctx, v, &out, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("FromValueContext() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestValue_MarshalBinaryContext(t *testing.T) {
+	v, err := tahwil.ToValue(newList(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reports []tahwil.Progress
+	opts := &tahwil.Options{Progress: func(p tahwil.Progress) { reports = append(reports, p) }}
+	data, err := v.MarshalBinaryContext(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := v.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Error("expected the same encoding as MarshalBinary")
+	}
+	if len(reports) != 3 || reports[0].Nodes != 1024 || reports[2].Nodes != 3001 {
+		t.Fatalf("progress reports = %v", reports)
+	}
+	if reports[0].Bytes <= 0 || reports[1].Bytes <= reports[0].Bytes || reports[2].Bytes != len(data) {
+		t.Errorf("progress reports = %v, want growing byte counts up to %d", reports, len(data))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts = &tahwil.Options{Progress: func(tahwil.Progress) { cancel() }}
+	if data, err = v.MarshalBinaryContext(ctx, opts); !errors.Is(err, context.Canceled) || data != nil {
+		t.Errorf("MarshalBinaryContext() = %v, %v, want context.Canceled", data, err)
+	}
+}
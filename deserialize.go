@@ -3,7 +3,8 @@ package tahwil
 import (
 	"fmt"
 	"reflect"
-	"strings"
+
+	"github.com/go-extras/tahwil/internal/fieldtag"
 )
 
 type UnmapperError struct {
@@ -40,6 +41,35 @@ type deferredRef struct {
 	refid  uint64
 }
 
+// mapFixup is a map element that received deferred refs; since map
+// elements are not addressable, it has to be stored again once
+// the refs are resolved
+type mapFixup struct {
+	m    reflect.Value
+	key  reflect.Value
+	elem reflect.Value
+}
+
+// pendingNode is a table node whose target has been allocated
+// but not filled yet
+type pendingNode struct {
+	data   *Value
+	target reflect.Value
+}
+
+// unmapTask is a node waiting to be decoded into v. Tasks with m set
+// store the already decoded v into the map m under key.
+type unmapTask struct {
+	data *Value
+	v    reflect.Value
+	m    reflect.Value
+	key  reflect.Value
+	// deferred is the number of deferred refs before the map element was decoded
+	deferred int
+	// mapElem marks a decode task whose result is stored by the task below it
+	mapElem bool
+}
+
 type valueUnmapper struct {
 	// refs contains pointers to reference values during deserialization
 	// can be used both forward and backward lookups
@@ -47,11 +77,25 @@ type valueUnmapper struct {
 	// deferred holds forward references that could not be resolved during the
 	// main walk because the target refid had not been visited yet
 	deferred []deferredRef
+	// mapFixups holds map elements that depend on deferred refs
+	mapFixups []mapFixup
 	// fieldTagCache holds type => json:<tag> => field
 	// e.g. if a struct Struct has a field that is called FieldName
 	// and it has a struct tag `json:"field_name", filedTagCache will hold
 	// [<Struct>]["field_name"]["FieldName"]
 	fieldTagCache map[reflect.Type]map[string]string
+	// nodes holds the node table when decoding a Table
+	nodes map[uint64]*Value
+	// node returns the pointer or the stub with the given refid when
+	// decoding a path, so that refs to targets that have not been decoded
+	// yet can be followed without indexing the whole tree
+	node func(refid uint64) (*Value, bool)
+	// pending holds table nodes waiting to be decoded
+	pending []pendingNode
+	// stack holds the nodes that still need to be decoded
+	stack   []unmapTask
+	opts    Options
+	tracker tracker
 }
 
 func newValueUnmapper() *valueUnmapper {
@@ -70,17 +114,8 @@ func (vu *valueUnmapper) fieldByTag(t reflect.Type, key string) string {
 
 	vu.fieldTagCache[t] = make(map[string]string)
 	for _, ft := range reflect.VisibleFields(t) {
-		if !ft.IsExported() || ft.Anonymous {
-			continue
-		}
-		k := ft.Tag.Get("json")
-		if k != "" {
-			k, _, _ = strings.Cut(k, ",")
-		}
-		if k == "" {
-			k = ft.Name
-		}
-		if k == "-" || k == "_" {
+		k, ok := fieldtag.Key(ft)
+		if !ok || (!ft.IsExported() && !vu.opts.includeUnexported(t, ft)) {
 			continue
 		}
 		vu.fieldTagCache[t][k] = ft.Name
@@ -216,32 +251,14 @@ func (vu *valueUnmapper) fromArrayValue(data *Value, v reflect.Value) error {
 	if data.Value == nil {
 		return nil
 	}
-	mi, _ := data.Value.([]any)
-	mv, _ := data.Value.([]*Value)
-	if mi == nil && mv == nil {
+	elems, ok := data.AsSlice()
+	if !ok {
 		return &InvalidValueError{Value: data.Value, Kind: data.Kind}
 	}
 
-	dataLen := len(mv)
-	if mi != nil {
-		dataLen = len(mi)
-	}
-	n := v.Len()
-	if dataLen < n {
-		n = dataLen
-	}
-	for i := 0; i < n; i++ {
-		var x *Value
-		el := v.Index(i)
-		if mv != nil {
-			x = mv[i]
-		} else {
-			x = mi[i].(*Value)
-		}
-		err := vu.fromValue(x, el)
-		if err != nil {
-			return err
-		}
+	n := min(v.Len(), len(elems))
+	for i := n - 1; i >= 0; i-- {
+		vu.push(elems[i], v.Index(i))
 	}
 
 	return nil
@@ -251,32 +268,14 @@ func (vu *valueUnmapper) fromSliceValue(data *Value, v reflect.Value) error {
 	if data.Value == nil {
 		return nil
 	}
-	var sl reflect.Value
-	mi, ok := data.Value.([]any)
-	if ok {
-		sl = reflect.MakeSlice(v.Type(), len(mi), len(mi))
-	}
-	mv, ok := data.Value.([]*Value)
-	if ok {
-		sl = reflect.MakeSlice(v.Type(), len(mv), len(mv))
-	}
-	if mi == nil && mv == nil {
+	elems, ok := data.AsSlice()
+	if !ok {
 		return &InvalidValueError{Value: data.Value, Kind: data.Kind}
 	}
 
-	v.Set(sl)
-	for i := 0; i < v.Len(); i++ {
-		var x *Value
-		el := v.Index(i)
-		if mv != nil {
-			x = mv[i]
-		} else {
-			x = mi[i].(*Value)
-		}
-		err := vu.fromValue(x, el)
-		if err != nil {
-			return err
-		}
+	v.Set(reflect.MakeSlice(v.Type(), len(elems), len(elems)))
+	for i := len(elems) - 1; i >= 0; i-- {
+		vu.push(elems[i], v.Index(i))
 	}
 
 	return nil
@@ -289,34 +288,17 @@ func (vu *valueUnmapper) fromMapValue(data *Value, v reflect.Value) error {
 	if v.Kind() != reflect.Map {
 		return &InvalidUnmapperKindError{Expected: string(Map), Kind: v.Kind().String()}
 	}
-	var keys []reflect.Value
-	mi, ok := data.Value.(map[string]any)
-	if ok {
-		rm := reflect.ValueOf(mi)
-		keys = rm.MapKeys()
-	}
-	mv, ok := data.Value.(map[string]*Value)
-	if ok {
-		rm := reflect.ValueOf(mv)
-		keys = rm.MapKeys()
-	}
-	if mi == nil && mv == nil {
+	fields, ok := data.AsFields()
+	if !ok {
 		return &InvalidValueError{Value: data.Value, Kind: data.Kind}
 	}
 	v.Set(reflect.MakeMap(v.Type()))
-	for _, key := range keys {
-		var x *Value
-		if mv != nil {
-			x = mv[key.String()]
-		} else {
-			x = mi[key.String()].(*Value)
-		}
+	for key, x := range fields {
 		f := reflect.New(v.Type().Elem()).Elem()
-		err := vu.fromValue(x, f)
-		if err != nil {
-			return err
-		}
-		v.SetMapIndex(key, f)
+		// map elements are not addressable: decode into f first,
+		// then store it into the map
+		vu.stack = append(vu.stack, unmapTask{v: f, m: v, key: reflect.ValueOf(key)})
+		vu.stack = append(vu.stack, unmapTask{data: x, v: f, mapElem: true})
 	}
 
 	return nil
@@ -327,6 +309,10 @@ func (vu *valueUnmapper) fromPtrValue(data *Value, v reflect.Value) error {
 		return nil
 	}
 
+	inner, ok := data.AsPtr()
+	if !ok {
+		return &InvalidValueError{Value: data.Value, Kind: data.Kind}
+	}
 	el := v.Elem()
 	if !el.IsValid() {
 		t := v.Type()
@@ -335,11 +321,7 @@ func (vu *valueUnmapper) fromPtrValue(data *Value, v reflect.Value) error {
 		v.Set(elm)
 		el = v.Elem()
 	}
-	x := data.Value.(*Value)
-	err := vu.fromValue(x, el)
-	if err != nil {
-		return err
-	}
+	vu.push(inner, el)
 
 	return nil
 }
@@ -367,40 +349,29 @@ func (vu *valueUnmapper) fromStructValue(data *Value, v reflect.Value) error {
 	if v.Kind() != reflect.Struct {
 		return &InvalidUnmapperKindError{Expected: string(Struct), Kind: v.Kind().String()}
 	}
-	var keys []reflect.Value
-	mi, ok := data.Value.(map[string]any)
-	if ok {
-		rm := reflect.ValueOf(mi)
-		keys = rm.MapKeys()
-	}
-	mv, ok := data.Value.(map[string]*Value)
-	if ok {
-		rm := reflect.ValueOf(mv)
-		keys = rm.MapKeys()
-	}
-	if mi == nil && mv == nil {
+	fields, ok := data.AsFields()
+	if !ok || data.Value == nil {
 		return &InvalidValueError{Value: data.Value, Kind: data.Kind}
 	}
 
-	for _, key := range keys {
-		tagName := key.String()
+	for tagName, x := range fields {
 		keyName := vu.fieldByTag(v.Type(), tagName)
-		if keyName == "" {
+		included := keyName != ""
+		if !included {
 			keyName = tagName
 		}
 		f := v.FieldByName(keyName)
-		var x *Value
-		if mv != nil {
-			x = mv[tagName]
-		} else {
-			x = mi[tagName].(*Value)
+		if !f.IsValid() {
+			continue
 		}
-		if f.IsValid() {
-			err := vu.fromValue(x, f)
-			if err != nil {
-				return err
+		if !f.CanInterface() {
+			// unexported fields are only decoded if the options include them
+			if !included || !f.CanAddr() {
+				continue
 			}
+			f = exposeField(f)
 		}
+		vu.push(x, f)
 	}
 
 	return nil
@@ -412,7 +383,29 @@ func (vu *valueUnmapper) fromRefValue(data *Value, v reflect.Value) error {
 		return &UnmapperError{cause: err}
 	}
 	if refv, ok := vu.refs[refid]; ok {
-		v.Set(refv)
+		return setRef(v, refv, refid)
+	}
+	if node, stub, ok := vu.lookupNode(refid); ok {
+		if stub != nil {
+			// first reference to a stub: decode it here, the stub itself
+			// is given the result when it is met
+			vu.refs[refid] = v
+			return vu.fromStubValue(stub, v)
+		}
+		if node == nil {
+			// a ref to a nil pointer
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		// first reference to a node: allocate the target
+		// and decode the node later
+		if v.Kind() != reflect.Ptr {
+			return &InvalidUnmapperKindError{Expected: string(Ptr), Kind: v.Kind().String()}
+		}
+		p := reflect.New(v.Type().Elem())
+		vu.refs[refid] = p
+		vu.pending = append(vu.pending, pendingNode{data: node, target: p.Elem()})
+		v.Set(p)
 		return nil
 	}
 	// forward reference: target not yet visited, defer resolution
@@ -420,12 +413,97 @@ func (vu *valueUnmapper) fromRefValue(data *Value, v reflect.Value) error {
 	return nil
 }
 
-// fills v with the values from data
+// lookupNode returns the table node or path target with the given refid;
+// the target of a nil pointer is nil. When decoding a path, the refid
+// may be the one of a stub instead, which is returned as stub.
+func (vu *valueUnmapper) lookupNode(refid uint64) (node, stub *Value, ok bool) {
+	if vu.node != nil {
+		p, ok := vu.node(refid)
+		if !ok {
+			return nil, nil, false
+		}
+		if p.Kind == Stub {
+			return nil, p, true
+		}
+		inner, _ := p.AsPtr()
+		return inner, nil, true
+	}
+	node, ok = vu.nodes[refid]
+	return node, nil, ok
+}
+
+// setRef stores the target refv of the ref refid in v, if their types
+// allow it: a ref may point to a pointer of another type, e.g. in
+// hand-built trees. A ref to a nil pointer stores nil whatever the type:
+// older versions of ToValue encoded every nil pointer of a graph but the
+// first as a ref to the first one.
+func setRef(v, refv reflect.Value, refid uint64) error {
+	if refv.Kind() == reflect.Ptr && refv.IsNil() {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if !refv.Type().AssignableTo(v.Type()) {
+		return &UnmapperError{text: fmt.Sprintf("ref %d of type %s is not assignable to %s", refid, refv.Type(), v.Type())}
+	}
+	v.Set(refv)
+	return nil
+}
+
+func (vu *valueUnmapper) push(data *Value, v reflect.Value) {
+	vu.stack = append(vu.stack, unmapTask{data: data, v: v})
+}
+
+// storeMapElem puts a decoded map element into its map.
+func (vu *valueUnmapper) storeMapElem(t unmapTask) {
+	t.m.SetMapIndex(t.key, t.v)
+	if len(vu.deferred) > t.deferred {
+		vu.mapFixups = append(vu.mapFixups, mapFixup{m: t.m, key: t.key, elem: t.v})
+	}
+}
+
+// fills v with the values from data. The tree is traversed depth-first
+// using an explicit work stack rather than recursion, so arbitrarily
+// deep trees are processed in bounded goroutine stack space.
 func (vu *valueUnmapper) fromValue(data *Value, v reflect.Value) error {
+	vu.tracker.progress = vu.opts.Progress
+	vu.push(data, v)
+	for len(vu.stack) > 0 {
+		t := vu.stack[len(vu.stack)-1]
+		vu.stack = vu.stack[:len(vu.stack)-1]
+		if t.m.IsValid() {
+			vu.storeMapElem(t)
+			continue
+		}
+		if t.mapElem {
+			// the store task is right below, remember where its refs start
+			vu.stack[len(vu.stack)-1].deferred = len(vu.deferred)
+		}
+		err := vu.fillValue(t.data, t.v)
+		if err == nil {
+			err = vu.tracker.visit()
+		}
+		if err != nil {
+			vu.stack = vu.stack[:0]
+			return err
+		}
+	}
+	vu.tracker.done()
+	return nil
+}
+
+// fillValue fills v with a single node from data. Nested nodes are
+// not processed here, they are pushed to the work stack instead.
+func (vu *valueUnmapper) fillValue(data *Value, v reflect.Value) error {
 	if data == nil {
 		return &UnmapperError{text: "nil *Value node"}
 	}
 	if data.Refid != 0 {
+		if refv, ok := vu.refs[data.Refid]; ok && (data.Kind == Ptr || data.Kind == Stub) && vu.node != nil {
+			// the target has been allocated, or the stub decoded, by a
+			// ref met first
+			v.Set(refv)
+			return nil
+		}
 		vu.refs[data.Refid] = v
 	}
 
@@ -452,28 +530,49 @@ func (vu *valueUnmapper) fromValue(data *Value, v reflect.Value) error {
 		return vu.fromStructValue(data, v)
 	case Ref:
 		return vu.fromRefValue(data, v)
+	case Func:
+		return vu.fromFuncValue(data, v)
+	case Chan:
+		return vu.fromChanValue(data, v)
+	case Stub:
+		return vu.fromStubValue(data, v)
 	}
 
 	return &InvalidUnmapperKindError{Kind: string(data.Kind)}
 }
 
 func FromValue(data *Value, v any) error {
+	return newValueUnmapper().fromValueRoot(data, v)
+}
+
+func (vu *valueUnmapper) fromValueRoot(data *Value, v any) error {
 	rv := reflect.ValueOf(v)
 	if rv.Kind() != reflect.Ptr || rv.IsNil() {
 		return &UnmapperError{text: "value must be non-nil Pointer"}
 	}
 
-	vu := newValueUnmapper()
 	if err := vu.fromValue(data, rv); err != nil {
 		return err
 	}
 
+	return vu.resolveDeferred()
+}
+
+// resolveDeferred sets forward references once all the targets are known.
+func (vu *valueUnmapper) resolveDeferred() error {
 	for _, d := range vu.deferred {
 		refv, ok := vu.refs[d.refid]
 		if !ok {
 			return &UnmapperError{text: "can't resolve all refs, invalid input"}
 		}
-		d.target.Set(refv)
+		if err := setRef(d.target, refv, d.refid); err != nil {
+			return err
+		}
+	}
+	// inner maps are registered first, so they are stored
+	// before the elements that contain them
+	for _, fx := range vu.mapFixups {
+		fx.m.SetMapIndex(fx.key, fx.elem)
 	}
 	return nil
 }
@@ -1,6 +1,7 @@
 package tahwil_test
 
 import (
+	"encoding/json"
 	"errors"
 	"reflect"
 	"testing"
@@ -654,3 +655,157 @@ func TestFromValue_ForwardRef(t *testing.T) {
 		t.Errorf("Children[1].Name = %q, want %q", result.Children[1].Name, "childB")
 	}
 }
+
+// TestFromValue_ForwardRefInMap verifies that a forward Ref stored in a map
+// element is visible in the map once the ref is resolved.
+func TestFromValue_ForwardRefInMap(t *testing.T) {
+	data := &tahwil.Value{
+		Refid: 1,
+		Kind:  tahwil.Ptr,
+		Value: &tahwil.Value{
+			Kind: tahwil.Slice,
+			Value: []*tahwil.Value{
+				{
+					Kind:  tahwil.Map,
+					Value: map[string]*tahwil.Value{"a": {Refid: 2, Kind: tahwil.Ref, Value: uint64(3)}},
+				},
+				{
+					Kind: tahwil.Map,
+					Value: map[string]*tahwil.Value{
+						"b": {
+							Refid: 3,
+							Kind:  tahwil.Ptr,
+							Value: &tahwil.Value{
+								Kind:  tahwil.Struct,
+								Value: map[string]*tahwil.Value{"name": {Kind: tahwil.String, Value: "shared"}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	var result []map[string]*personT
+	if err := tahwil.FromValue(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 {
+		t.Fatalf("len(result) = %d, want 2", len(result))
+	}
+	if result[0]["a"] == nil {
+		t.Fatal(`result[0]["a"] is nil, expected resolved forward ref`)
+	}
+	if result[0]["a"] != result[1]["b"] {
+		t.Error("expected both map elements to share the pointer")
+	}
+}
+
+// TestFromValue_RefTypeMismatch verifies that refs to pointers of another
+// type are reported, whether the target is already known or not.
+func TestFromValue_RefTypeMismatch(t *testing.T) {
+	type xT struct{ Name string }
+	type yT struct{ Name string }
+	type pairT struct {
+		X *xT
+		Y *yT
+	}
+	x := &tahwil.Value{Refid: 2, Kind: tahwil.Ptr, Value: &tahwil.Value{
+		Kind:  tahwil.Struct,
+		Value: map[string]*tahwil.Value{"Name": {Kind: tahwil.String, Value: "x"}},
+	}}
+	y := &tahwil.Value{Refid: 3, Kind: tahwil.Ref, Value: uint64(2)}
+	elem := func(key string, v *tahwil.Value) *tahwil.Value {
+		return &tahwil.Value{Kind: tahwil.Struct, Value: map[string]*tahwil.Value{key: v}}
+	}
+
+	// slice elements are decoded in order, so a ref before its target is
+	// resolved once all the targets are known
+	tests := map[string][]*tahwil.Value{
+		"known":   {elem("X", x), elem("Y", y)},
+		"forward": {elem("Y", y), elem("X", x)},
+	}
+	for name, elems := range tests {
+		data := &tahwil.Value{Refid: 1, Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Slice, Value: elems}}
+		var result []pairT
+		var unmapperErr *tahwil.UnmapperError
+		if err := tahwil.FromValue(data, &result); !errors.As(err, &unmapperErr) {
+			t.Errorf("%s: expected *UnmapperError, got %T: %v", name, err, err)
+		}
+	}
+}
+
+func TestFromValue_RefsToNilPointers(t *testing.T) {
+	// older versions of ToValue encoded every nil pointer but the first
+	// as a ref to the first one, whatever their types
+	type nilsT struct {
+		A *int
+		B *string
+		C *int
+		D []*int
+	}
+	old := `{"refid":1,"kind":"ptr","value":{"refid":0,"kind":"struct","value":{` +
+		`"A":{"refid":2,"kind":"ptr","value":null},"B":{"refid":3,"kind":"ref","value":2},` +
+		`"C":{"refid":4,"kind":"ref","value":2},"D":{"refid":0,"kind":"slice","value":[{"refid":5,"kind":"ref","value":2}]}}}}`
+	v := &tahwil.Value{}
+	if err := json.Unmarshal([]byte(old), v); err != nil {
+		t.Fatal(err)
+	}
+	want := nilsT{D: []*int{nil}}
+
+	var res nilsT
+	if err := tahwil.FromValue(v, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("FromValue() = %+v, want %+v", res, want)
+	}
+
+	tbl, err := tahwil.Flatten(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = nilsT{}
+	if err = tahwil.FromTable(tbl, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("FromTable() = %+v, want %+v", res, want)
+	}
+	u, err := tahwil.Unflatten(tbl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nv, err := tahwil.ToValue(&want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tahwil.Canonicalize(u), tahwil.Canonicalize(nv)) {
+		t.Error("expected the unflattened tree to hold nil pointers")
+	}
+	if c := tahwil.Canonicalize(v); c == nil || !reflect.DeepEqual(c, tahwil.Canonicalize(nv)) {
+		t.Errorf("expected the canonical form of the current encoding, got %v", c)
+	}
+
+	i, err := tahwil.ToInterface(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := (*i.(*any)).(map[string]any)
+	if b, ok := fields["B"].(*any); !ok || b != nil {
+		t.Errorf("ToInterface() B = %#v, want a nil *any", fields["B"])
+	}
+
+	var s *string
+	if err = tahwil.FromValuePath(v, "B", &s); err != nil || s != nil {
+		t.Errorf("FromValuePath() = %v, %v", s, err)
+	}
+
+	p, err := tahwil.ComputePatch(nv, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tahwil.ApplyPatch(nv, p); err != nil {
+		t.Error(err)
+	}
+}
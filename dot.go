@@ -0,0 +1,223 @@
+package tahwil
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DOTOptions configures WriteDOT. A nil *DOTOptions uses the defaults.
+type DOTOptions struct {
+	// Name is the name of the graph, "tahwil" if empty.
+	Name string
+	// RankDir sets the rankdir graph attribute ("TB", "LR", ...).
+	RankDir string
+	// MaxStringLen limits the number of runes of the strings shown in
+	// vertex labels; 0 means no limit.
+	MaxStringLen int
+}
+
+// dotVertex is a pointer target waiting to be written
+type dotVertex struct {
+	id    string
+	refid uint64
+	v     *Value
+}
+
+type dotWriter struct {
+	opts  DOTOptions
+	sb    strings.Builder
+	queue []dotVertex
+	// seen holds the refids of the pointers that have a vertex
+	seen map[uint64]bool
+	// refs holds the refids ref edges point to
+	refs []uint64
+	// anon counts the vertices of pointers without a refid
+	anon int
+}
+
+// WriteDOT writes v as a Graphviz DOT digraph to w. Every pointer target
+// becomes a vertex labelled with its kind, its refid and the scalar
+// values reachable from it without following another pointer; every
+// non-nil pointer and every ref becomes an edge labelled with the path
+// of the field holding it. The output of ToValue can be rendered with
+// e.g. "dot -Tsvg".
+func WriteDOT(w io.Writer, v *Value, opts *DOTOptions) error {
+	dw := &dotWriter{seen: make(map[uint64]bool)}
+	if opts != nil {
+		dw.opts = *opts
+	}
+	name := dw.opts.Name
+	if name == "" {
+		name = "tahwil"
+	}
+	dw.sb.WriteString("digraph " + dotQuote(name) + " {\n")
+	if dw.opts.RankDir != "" {
+		dw.sb.WriteString("\trankdir=" + dotQuote(dw.opts.RankDir) + ";\n")
+	}
+	dw.sb.WriteString("\tnode [shape=box, fontname=\"monospace\"];\n")
+
+	if v != nil {
+		if v.Kind == Ptr && v.Value != nil {
+			if _, err := dw.vertex(v); err != nil {
+				return err
+			}
+		} else {
+			dw.queue = append(dw.queue, dotVertex{id: "root", v: v})
+		}
+	}
+	for len(dw.queue) > 0 {
+		vx := dw.queue[0]
+		dw.queue = dw.queue[1:]
+		if err := dw.writeVertex(vx); err != nil {
+			return err
+		}
+	}
+	for _, refid := range dw.refs {
+		if !dw.seen[refid] {
+			return &InvalidValueError{Value: refid, Kind: Ref}
+		}
+	}
+	dw.sb.WriteString("}\n")
+
+	_, err := io.WriteString(w, dw.sb.String())
+	return err
+}
+
+// vertex schedules the target of the non-nil pointer p and returns its id.
+func (dw *dotWriter) vertex(p *Value) (string, error) {
+	inner, ok := p.AsPtr()
+	if !ok {
+		return "", &InvalidValueError{Value: p.Value, Kind: p.Kind}
+	}
+	var id string
+	if p.Refid != 0 {
+		id = "n" + strconv.FormatUint(p.Refid, 10)
+		if dw.seen[p.Refid] {
+			return id, nil
+		}
+		dw.seen[p.Refid] = true
+	} else {
+		dw.anon++
+		id = "p" + strconv.Itoa(dw.anon)
+	}
+	dw.queue = append(dw.queue, dotVertex{id: id, refid: p.Refid, v: inner})
+	return id, nil
+}
+
+func (dw *dotWriter) writeVertex(vx dotVertex) error {
+	title := "nil"
+	if vx.v != nil {
+		title = string(vx.v.Kind)
+	}
+	if vx.refid != 0 {
+		title += " #" + strconv.FormatUint(vx.refid, 10)
+	}
+	lines := []string{title}
+	var edges []string
+	if err := dw.walk(vx.id, "", vx.v, &lines, &edges); err != nil {
+		return err
+	}
+
+	label := ""
+	for _, l := range lines {
+		label += dotEscape(l) + "\\l"
+	}
+	dw.sb.WriteString("\t" + vx.id + " [label=\"" + label + "\"];\n")
+	for _, e := range edges {
+		dw.sb.WriteString(e)
+	}
+	return nil
+}
+
+func (dw *dotWriter) edge(from, to, path string) string {
+	if path == "" {
+		path = "*"
+	}
+	return "\t" + from + " -> " + to + " [label=" + dotQuote(path) + "];\n"
+}
+
+// walk adds the scalars reachable from v to the label lines of the
+// vertex id and the pointers and refs to its edges.
+func (dw *dotWriter) walk(id, path string, v *Value, lines, edges *[]string) error {
+	if v == nil {
+		return nil
+	}
+	switch v.Kind {
+	case Ptr:
+		if v.Value == nil {
+			if path != "" {
+				*lines = append(*lines, path+": nil")
+			}
+			return nil
+		}
+		to, err := dw.vertex(v)
+		if err != nil {
+			return err
+		}
+		*edges = append(*edges, dw.edge(id, to, path))
+	case Ref:
+		refid, err := refFromValue(v)
+		if err != nil {
+			return err
+		}
+		dw.refs = append(dw.refs, refid)
+		*edges = append(*edges, dw.edge(id, "n"+strconv.FormatUint(refid, 10), path))
+	case Struct, Map:
+		fields, ok := v.AsFields()
+		if !ok {
+			return &InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		keys := sortedKeys(fields)
+		for _, k := range keys {
+			p := path + "." + k
+			switch {
+			case v.Kind == Map:
+				p = path + "[" + strconv.Quote(k) + "]"
+			case path == "":
+				p = k
+			}
+			if err := dw.walk(id, p, fields[k], lines, edges); err != nil {
+				return err
+			}
+		}
+	case Slice, Array:
+		elems, ok := v.AsSlice()
+		if !ok {
+			return &InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		for i, el := range elems {
+			if err := dw.walk(id, path+"["+strconv.Itoa(i)+"]", el, lines, edges); err != nil {
+				return err
+			}
+		}
+	case Bool, String,
+		Int, Int8, Int16, Int32, Int64,
+		Uint, Uint8, Uint16, Uint32, Uint64,
+		Float32, Float64:
+		text := fmt.Sprint(v.Value)
+		if s, ok := v.Value.(string); ok {
+			if n := dw.opts.MaxStringLen; n > 0 && len([]rune(s)) > n {
+				s = string([]rune(s)[:n]) + "…"
+			}
+			text = strconv.Quote(s)
+		}
+		if path != "" {
+			text = path + ": " + text
+		}
+		*lines = append(*lines, text)
+	default:
+		return &InvalidValueKindError{Kind: v.Kind}
+	}
+	return nil
+}
+
+// dotEscape escapes s for use in a DOT double-quoted string.
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func dotQuote(s string) string {
+	return `"` + dotEscape(s) + `"`
+}
@@ -0,0 +1,83 @@
+package tahwil_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+func TestWriteDOT(t *testing.T) {
+	parent := &personT{Name: "Arthur"}
+	parent.Children = []*personT{
+		{Name: "Ford", Parent: parent},
+		{Name: "Trillian \"Tricia\"", Parent: parent},
+	}
+	v, err := tahwil.ToValue(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = tahwil.WriteDOT(&buf, v, &tahwil.DOTOptions{RankDir: "LR", MaxStringLen: 8}); err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph "tahwil" {
+	rankdir="LR";
+	node [shape=box, fontname="monospace"];
+	n1 [label="struct #1\lname: \"Arthur\"\lparent: nil\l"];
+	n1 -> n3 [label="children[0]"];
+	n1 -> n5 [label="children[1]"];
+	n3 [label="struct #3\lname: \"Ford\"\l"];
+	n3 -> n1 [label="parent"];
+	n5 [label="struct #5\lname: \"Trillian…\"\l"];
+	n5 -> n1 [label="parent"];
+}
+`
+	if buf.String() != want {
+		t.Errorf("have:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteDOT_Scalars(t *testing.T) {
+	v, err := tahwil.ToValue(map[string][]int{"a": {1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = tahwil.WriteDOT(&buf, v, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph "tahwil" {
+	node [shape=box, fontname="monospace"];
+	n1 [label="map #1\l[\"a\"][0]: 1\l[\"a\"][1]: 2\l"];
+}
+`
+	if buf.String() != want {
+		t.Errorf("have:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteDOT_Errors(t *testing.T) {
+	tests := []*tahwil.Value{
+		{Kind: "foo", Value: 1},
+		{Kind: tahwil.Ptr, Value: "x"},
+		{Kind: tahwil.Struct, Value: []int{}},
+		{Kind: tahwil.Ref, Value: uint64(3)},
+	}
+	for i, v := range tests {
+		var buf bytes.Buffer
+		if err := tahwil.WriteDOT(&buf, v, nil); err == nil {
+			t.Errorf("#%d: expected error, got nil", i)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("#%d: expected no output on error, got %q", i, buf.String())
+		}
+	}
+
+	var invalid *tahwil.InvalidValueError
+	err := tahwil.WriteDOT(&bytes.Buffer{}, &tahwil.Value{Kind: tahwil.Ref, Value: uint64(3)}, nil)
+	if !errors.As(err, &invalid) {
+		t.Errorf("expected *InvalidValueError, got %T: %v", err, err)
+	}
+}
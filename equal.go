@@ -0,0 +1,331 @@
+package tahwil
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Difference is a difference between two values found by Diff.
+type Difference struct {
+	// Path locates the difference from the root, e.g. "Children[0].Name";
+	// it is empty for the root itself. Struct fields are named after their
+	// keys in the *Value tree, i.e. after their json tags.
+	Path string
+	// Reason describes the difference, e.g. "values differ: 1 != 2" or
+	// "aliasing differs: same as Left in a, distinct in b".
+	Reason string
+}
+
+func (d Difference) String() string {
+	if d.Path == "" {
+		return d.Reason
+	}
+	return d.Path + ": " + d.Reason
+}
+
+// ptrKey identifies a pointer; pointers of different types may share an
+// address (e.g. a struct and its first field)
+type ptrKey struct {
+	addr uintptr
+	typ  reflect.Type
+}
+
+// diffPath is the last step of the path of a value, linked to the path
+// of its parent, so that path strings are only built for the differences
+// reported; a nil *diffPath is the root. elem is a struct field key, a
+// mapKey or a slice index.
+type diffPath struct {
+	parent *diffPath
+	elem   any
+}
+
+// mapKey is a map key in the notation of Difference.Path, e.g. ["a"]
+type mapKey string
+
+func (p *diffPath) child(e any) *diffPath {
+	return &diffPath{parent: p, elem: e}
+}
+
+func (p *diffPath) String() string {
+	var steps []any
+	for x := p; x != nil; x = x.parent {
+		steps = append(steps, x.elem)
+	}
+	var sb strings.Builder
+	for i := len(steps) - 1; i >= 0; i-- {
+		switch e := steps[i].(type) {
+		case string:
+			if sb.Len() > 0 {
+				sb.WriteByte('.')
+			}
+			sb.WriteString(e)
+		case mapKey:
+			sb.WriteString(string(e))
+		case int:
+			sb.WriteString("[" + strconv.Itoa(e) + "]")
+		}
+	}
+	return sb.String()
+}
+
+// diffTask compares a and b, or reports reason if it is set
+type diffTask struct {
+	a, b   reflect.Value
+	path   *diffPath
+	reason string
+}
+
+type differ struct {
+	vm *valueMapper
+	// aToB and bToA pair the pointers visited in lockstep
+	aToB map[ptrKey]uintptr
+	bToA map[ptrKey]uintptr
+	// aPaths and bPaths hold the path each pointer was first visited at
+	aPaths map[ptrKey]*diffPath
+	bPaths map[ptrKey]*diffPath
+	stack  []diffTask
+	diffs  []Difference
+	// first stops the walk at the first difference
+	first bool
+}
+
+func newDiffer() *differ {
+	return &differ{
+		vm:     newValueMapper(),
+		aToB:   make(map[ptrKey]uintptr),
+		bToA:   make(map[ptrKey]uintptr),
+		aPaths: make(map[ptrKey]*diffPath),
+		bPaths: make(map[ptrKey]*diffPath),
+	}
+}
+
+func (d *differ) push(a, b reflect.Value, path *diffPath) {
+	d.stack = append(d.stack, diffTask{a: a, b: b, path: path})
+}
+
+func (d *differ) report(path *diffPath, format string, args ...any) {
+	d.diffs = append(d.diffs, Difference{Path: path.String(), Reason: fmt.Sprintf(format, args...)})
+}
+
+// diffPtr compares two non-nil pointers of the same type. Their targets
+// are compared the first time the pair is met; meeting either pointer
+// again with another partner means the graphs are shared differently.
+func (d *differ) diffPtr(a, b reflect.Value, path *diffPath) {
+	ka := ptrKey{addr: a.Pointer(), typ: a.Type()}
+	kb := ptrKey{addr: b.Pointer(), typ: b.Type()}
+	pb, seenA := d.aToB[ka]
+	pa, seenB := d.bToA[kb]
+	switch {
+	case seenA && seenB && pb == kb.addr && pa == ka.addr:
+		// the pair has already been compared
+		return
+	case seenA && seenB:
+		d.report(path, "aliasing differs: same as %s in a, as %s in b", pathOrRoot(d.aPaths[ka].String()), pathOrRoot(d.bPaths[kb].String()))
+		return
+	case seenA:
+		d.report(path, "aliasing differs: same as %s in a, distinct in b", pathOrRoot(d.aPaths[ka].String()))
+		return
+	case seenB:
+		d.report(path, "aliasing differs: same as %s in b, distinct in a", pathOrRoot(d.bPaths[kb].String()))
+		return
+	}
+	d.aToB[ka], d.bToA[kb] = kb.addr, ka.addr
+	d.aPaths[ka], d.bPaths[kb] = path, path
+	d.push(a.Elem(), b.Elem(), path)
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "root"
+	}
+	return path
+}
+
+func (d *differ) diffStruct(a, b reflect.Value, path *diffPath) {
+	fields := d.vm.cachedStructFields(a.Type())
+	for n := len(fields) - 1; n >= 0; n-- {
+		p := path.child(fields[n].key)
+		fa, errA := a.FieldByIndexErr(fields[n].index)
+		fb, errB := b.FieldByIndexErr(fields[n].index)
+		switch {
+		case errA != nil && errB != nil:
+		case errA != nil:
+			d.stack = append(d.stack, diffTask{path: p, reason: "nil in a"})
+		case errB != nil:
+			d.stack = append(d.stack, diffTask{path: p, reason: "nil in b"})
+		default:
+			d.push(fa, fb, p)
+		}
+	}
+}
+
+func (d *differ) diffMap(a, b reflect.Value, path *diffPath) {
+	type entry struct {
+		name mapKey
+		key  reflect.Value
+	}
+	var entries []entry
+	for _, k := range a.MapKeys() {
+		entries = append(entries, entry{name: mapKeyPath(k), key: k})
+	}
+	for _, k := range b.MapKeys() {
+		if !a.MapIndex(k).IsValid() {
+			entries = append(entries, entry{name: mapKeyPath(k), key: k})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	for n := len(entries) - 1; n >= 0; n-- {
+		p := path.child(entries[n].name)
+		ea, eb := a.MapIndex(entries[n].key), b.MapIndex(entries[n].key)
+		switch {
+		case !ea.IsValid():
+			d.stack = append(d.stack, diffTask{path: p, reason: "missing in a"})
+		case !eb.IsValid():
+			d.stack = append(d.stack, diffTask{path: p, reason: "missing in b"})
+		default:
+			d.push(ea, eb, p)
+		}
+	}
+}
+
+func mapKeyPath(k reflect.Value) mapKey {
+	if k.Kind() == reflect.String {
+		return mapKey("[" + strconv.Quote(k.String()) + "]")
+	}
+	return mapKey("[" + fmt.Sprint(k.Interface()) + "]")
+}
+
+func (d *differ) diffElems(a, b reflect.Value, path *diffPath) {
+	n := a.Len()
+	if b.Len() != n {
+		d.report(path, "length differs: %d != %d", a.Len(), b.Len())
+		n = min(n, b.Len())
+	}
+	for i := n - 1; i >= 0; i-- {
+		d.push(a.Index(i), b.Index(i), path.child(i))
+	}
+}
+
+// diffValue compares a single pair of values of the same type. Nested
+// values are not compared here, they are pushed to the work stack
+// instead.
+//
+//nolint:gocyclo // one case per kind
+func (d *differ) diffValue(a, b reflect.Value, path *diffPath) {
+	if a.Type() != b.Type() {
+		d.report(path, "types differ: %s != %s", a.Type(), b.Type())
+		return
+	}
+	switch a.Kind() {
+	case reflect.Interface:
+		switch {
+		case a.IsNil() && b.IsNil():
+		case a.IsNil():
+			d.report(path, "nil in a")
+		case b.IsNil():
+			d.report(path, "nil in b")
+		default:
+			d.push(a.Elem(), b.Elem(), path)
+		}
+	case reflect.Ptr:
+		switch {
+		case a.IsNil() && b.IsNil():
+		case a.IsNil():
+			d.report(path, "nil in a")
+		case b.IsNil():
+			d.report(path, "nil in b")
+		default:
+			d.diffPtr(a, b, path)
+		}
+	case reflect.Struct:
+		d.diffStruct(a, b, path)
+	case reflect.Map:
+		d.diffMap(a, b, path)
+	case reflect.Slice, reflect.Array:
+		d.diffElems(a, b, path)
+	case reflect.Func:
+		if !a.IsNil() || !b.IsNil() {
+			d.report(path, "funcs differ")
+		}
+	case reflect.Chan, reflect.UnsafePointer:
+		if a.Pointer() != b.Pointer() {
+			d.report(path, "values differ: %v != %v", a, b)
+		}
+	case reflect.String:
+		if a.String() != b.String() {
+			d.report(path, "values differ: %q != %q", a.String(), b.String())
+		}
+	case reflect.Bool:
+		if a.Bool() != b.Bool() {
+			d.report(path, "values differ: %v != %v", a.Bool(), b.Bool())
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if a.Int() != b.Int() {
+			d.report(path, "values differ: %d != %d", a.Int(), b.Int())
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if a.Uint() != b.Uint() {
+			d.report(path, "values differ: %d != %d", a.Uint(), b.Uint())
+		}
+	case reflect.Float32, reflect.Float64:
+		if a.Float() != b.Float() {
+			d.report(path, "values differ: %v != %v", a.Float(), b.Float())
+		}
+	case reflect.Complex64, reflect.Complex128:
+		if a.Complex() != b.Complex() {
+			d.report(path, "values differ: %v != %v", a.Complex(), b.Complex())
+		}
+	}
+}
+
+func (d *differ) diff(a, b any) []Difference {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	switch {
+	case !va.IsValid() && !vb.IsValid():
+		return nil
+	case !va.IsValid():
+		d.report(nil, "nil in a")
+		return d.diffs
+	case !vb.IsValid():
+		d.report(nil, "nil in b")
+		return d.diffs
+	}
+
+	d.push(va, vb, nil)
+	for len(d.stack) > 0 && (!d.first || len(d.diffs) == 0) {
+		t := d.stack[len(d.stack)-1]
+		d.stack = d.stack[:len(d.stack)-1]
+		if t.reason != "" {
+			d.report(t.path, "%s", t.reason)
+			continue
+		}
+		d.diffValue(t.a, t.b, t.path)
+	}
+	return d.diffs
+}
+
+// Diff walks a and b in lockstep and returns their differences, in the
+// order of the fields, elements and sorted map keys they are found at.
+// Like ToValue, it only looks at the exported struct fields not tagged
+// json:"-" or json:"_". Pointers are compared by their targets: the
+// first time a pair of pointers is met their targets are compared, and
+// meeting either pointer again with another partner is reported as
+// "aliasing differs", e.g. when two fields share a pointer in a but point
+// to distinct (even if equal) values in b. Cycles are therefore
+// compared once. Slices and arrays of different lengths are reported
+// once, their common elements are still compared; nil and empty slices
+// and maps are equal. Funcs are equal only when both are nil.
+func Diff(a, b any) []Difference {
+	return newDiffer().diff(a, b)
+}
+
+// Equal reports whether Diff(a, b) finds no difference. It stops at the
+// first difference.
+func Equal(a, b any) bool {
+	d := newDiffer()
+	d.first = true
+	return len(d.diff(a, b)) == 0
+}
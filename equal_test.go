@@ -0,0 +1,160 @@
+package tahwil_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+type diffLeafT struct {
+	Value int
+}
+
+type diffT struct {
+	Name   string
+	Hidden string `json:"-"`
+	Tags   []string
+	Meta   map[string]int
+	Any    any
+	Left   *diffLeafT
+	Right  *diffLeafT
+	Self   *diffT
+}
+
+func newDiffT() *diffT {
+	shared := &diffLeafT{Value: 1}
+	v := &diffT{
+		Name:  "root",
+		Tags:  []string{"a", "b"},
+		Meta:  map[string]int{"x": 1},
+		Any:   2,
+		Left:  shared,
+		Right: shared,
+	}
+	v.Self = v
+	return v
+}
+
+func TestEqual(t *testing.T) {
+	a, b := newDiffT(), newDiffT()
+	if !tahwil.Equal(a, b) {
+		t.Errorf("expected equal values, got %v", tahwil.Diff(a, b))
+	}
+
+	b.Hidden = "ignored"
+	b.Meta = nil
+	a.Meta = map[string]int{}
+	if !tahwil.Equal(a, b) {
+		t.Errorf("expected ignored fields and empty maps to be equal, got %v", tahwil.Diff(a, b))
+	}
+
+	b.Tags[1] = "c"
+	if tahwil.Equal(a, b) {
+		t.Error("expected different values")
+	}
+
+	if !tahwil.Equal(nil, nil) || tahwil.Equal(nil, 1) || tahwil.Equal(1, int64(1)) {
+		t.Error("unexpected result for nil or differently typed values")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a, b := newDiffT(), newDiffT()
+	b.Name = "other"
+	b.Tags = []string{"a", "c", "d"}
+	b.Meta = map[string]int{"x": 2, "y": 3}
+	b.Any = "2"
+	b.Right = &diffLeafT{Value: 1}
+	b.Self = nil
+
+	want := []tahwil.Difference{
+		{Path: "Name", Reason: `values differ: "root" != "other"`},
+		{Path: "Tags", Reason: "length differs: 2 != 3"},
+		{Path: "Tags[1]", Reason: `values differ: "b" != "c"`},
+		{Path: `Meta["x"]`, Reason: "values differ: 1 != 2"},
+		{Path: `Meta["y"]`, Reason: "missing in a"},
+		{Path: "Any", Reason: "types differ: int != string"},
+		{Path: "Right", Reason: "aliasing differs: same as Left in a, distinct in b"},
+		{Path: "Self", Reason: "nil in b"},
+	}
+	if diffs := tahwil.Diff(a, b); !reflect.DeepEqual(diffs, want) {
+		t.Errorf("have:\n%v\nwant:\n%v", diffs, want)
+	}
+}
+
+func TestDiff_Cycles(t *testing.T) {
+	// a is a two-node cycle, b is a one-node cycle: the values are equal
+	// everywhere, only the sharing differs
+	a1, a2 := &listNodeT{Value: 1}, &listNodeT{Value: 1}
+	a1.Next, a2.Next = a2, a1
+	b := &listNodeT{Value: 1}
+	b.Next = b
+
+	if !reflect.DeepEqual(a1, b) {
+		t.Fatal("expected reflect.DeepEqual to miss the difference")
+	}
+	want := []tahwil.Difference{{Path: "Next", Reason: "aliasing differs: same as root in b, distinct in a"}}
+	if diffs := tahwil.Diff(a1, b); !reflect.DeepEqual(diffs, want) {
+		t.Errorf("have:\n%v\nwant:\n%v", diffs, want)
+	}
+}
+
+func TestDiff_DecodedGraph(t *testing.T) {
+	parent := &personT{Name: "parent"}
+	parent.Children = []*personT{
+		{Name: "child 1", Parent: parent},
+		{Name: "child 2", Parent: parent},
+	}
+	v, err := tahwil.ToValue(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &personT{}
+	if err = tahwil.FromValue(v, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if diffs := tahwil.Diff(parent, decoded); len(diffs) != 0 {
+		t.Errorf("unexpected differences: %v", diffs)
+	}
+
+	decoded.Children[1].Parent = &personT{Name: "parent"}
+	want := []tahwil.Difference{{Path: "children[1].parent", Reason: "aliasing differs: same as root in a, distinct in b"}}
+	if diffs := tahwil.Diff(parent, decoded); !reflect.DeepEqual(diffs, want) {
+		t.Errorf("have:\n%v\nwant:\n%v", diffs, want)
+	}
+}
+
+func TestDifference_String(t *testing.T) {
+	d := tahwil.Difference{Path: "Tags[0]", Reason: "missing in a"}
+	if d.String() != "Tags[0]: missing in a" {
+		t.Errorf("unexpected string %q", d.String())
+	}
+	d.Path = ""
+	if d.String() != "missing in a" {
+		t.Errorf("unexpected string %q", d.String())
+	}
+}
+
+func TestDiff_Deep(t *testing.T) {
+	// paths are only built for the differences found, so a deep list
+	// doesn't copy them at every level
+	const depth = 100000
+	list := func(last int) *listNodeT {
+		head := &listNodeT{Value: last}
+		for i := 1; i < depth; i++ {
+			head = &listNodeT{Value: 0, Next: head}
+		}
+		return head
+	}
+	a, b := list(1), list(2)
+	if tahwil.Equal(a, b) {
+		t.Error("expected the lists to differ")
+	}
+	diffs := tahwil.Diff(a, b)
+	want := strings.Repeat("Next.", depth-1) + "Value"
+	if len(diffs) != 1 || diffs[0].Path != want {
+		t.Errorf("have %d differences, want 1 at a path of %d Next", len(diffs), depth-1)
+	}
+}
@@ -0,0 +1,157 @@
+package tahwil
+
+import (
+	"reflect"
+	"strings"
+)
+
+// anyIndex is the [*] element of a field pattern.
+type anyIndex struct{}
+
+// fieldFilter holds the compiled Options.Exclude and Options.Only
+// patterns.
+type fieldFilter struct {
+	exclude []fieldPattern
+	only    []fieldPattern
+}
+
+// fieldPattern is a compiled field pattern: either a Type.Field pattern,
+// which matches the fields of the struct types it names wherever they
+// are, or a path pattern, which matches fields and entries by their path
+// from the root.
+type fieldPattern struct {
+	path  Path
+	typed bool
+}
+
+func newFieldFilter(opts *Options) (*fieldFilter, error) {
+	if len(opts.Exclude) == 0 && len(opts.Only) == 0 {
+		return nil, nil
+	}
+	f := &fieldFilter{}
+	var err error
+	if f.exclude, err = parsePatterns(opts.Exclude); err != nil {
+		return nil, err
+	}
+	if f.only, err = parsePatterns(opts.Only); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parsePatterns compiles field patterns. Patterns of two keys, such as
+// User.Name, are Type.Field patterns, unless they start with a dot.
+func parsePatterns(patterns []string) ([]fieldPattern, error) {
+	res := make([]fieldPattern, 0, len(patterns))
+	for _, s := range patterns {
+		s, isPath := strings.CutPrefix(s, ".")
+		p, err := parsePath(s, true)
+		if err != nil {
+			return nil, err
+		}
+		typed := !isPath && len(p) == 2 && !strings.Contains(s, "[")
+		res = append(res, fieldPattern{path: p, typed: typed})
+	}
+	return res, nil
+}
+
+// matchType reports whether the Type.Field pattern p applies to the
+// fields of t.
+func (p fieldPattern) matchType(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t.Name() != "" && matchElem(p.path[0], t.Name())
+}
+
+// matchField reports whether p matches the field or entry with the Go
+// name name and the key key at path of a struct or map of type t.
+func (p fieldPattern) matchField(t reflect.Type, path Path, name, key string) bool {
+	if p.typed {
+		return p.matchType(t) && (matchElem(p.path[1], name) || matchElem(p.path[1], key))
+	}
+	return matchPath(p.path, path, false)
+}
+
+// skip reports whether the field or entry with the Go name name and the
+// key key of a struct or map of type t at path is left out. path is the
+// path of the field or entry.
+func (f *fieldFilter) skip(t reflect.Type, path Path, name, key string) bool {
+	for _, p := range f.exclude {
+		if p.matchField(t, path, name, key) {
+			return true
+		}
+	}
+	if len(f.only) == 0 {
+		return false
+	}
+	// the fields of a struct or map are restricted if a Type.Field
+	// pattern names its type or a path pattern goes through it
+	restricted := false
+	for _, p := range f.only {
+		if p.matchField(t, path, name, key) {
+			return false
+		}
+		if p.typed {
+			restricted = restricted || p.matchType(t)
+			continue
+		}
+		if matchPath(p.path, path, true) {
+			// on the way to the fields matched
+			return false
+		}
+		restricted = restricted || matchPath(p.path, path[:len(path)-1], true)
+	}
+	return restricted
+}
+
+// matchPath reports whether path matches the pattern p, or only a proper
+// prefix of it if prefix is set.
+func matchPath(p Path, path Path, prefix bool) bool {
+	if prefix && len(path) >= len(p) || !prefix && len(path) != len(p) {
+		return false
+	}
+	for i, e := range path {
+		if !matchElem(p[i], e) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchElem(p, e any) bool {
+	switch p := p.(type) {
+	case anyIndex:
+		_, ok := e.(int)
+		return ok
+	case string:
+		k, ok := e.(string)
+		return ok && matchGlob(p, k)
+	}
+	return p == e
+}
+
+// matchGlob matches s against a pattern where * matches any sequence of
+// bytes and ? a single byte.
+func matchGlob(p, s string) bool {
+	pi, si := 0, 0
+	// star is the index of the last star met, next the index in s it
+	// is matched up to
+	star, next := -1, 0
+	for si < len(s) {
+		switch {
+		case pi < len(p) && p[pi] == '*':
+			star, next = pi, si
+			pi++
+		case pi < len(p) && (p[pi] == '?' || p[pi] == s[si]):
+			pi++
+			si++
+		case star >= 0:
+			next++
+			pi, si = star+1, next
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
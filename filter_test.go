@@ -0,0 +1,191 @@
+package tahwil_test
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+type userT struct {
+	Name         string
+	PasswordHash string `json:"password_hash"`
+	Friend       *userT
+}
+
+type customerT struct {
+	Name  string
+	Email string
+	User  *userT
+}
+
+type itemT struct {
+	SKU   string
+	Price int
+}
+
+type orderT struct {
+	ID       int
+	Customer customerT
+	Items    []itemT
+	Meta     map[string]string
+	Notes    string
+}
+
+type accountT struct {
+	Name   string
+	Email  string
+	Orders []orderT
+}
+
+func newOrder() *orderT {
+	u := &userT{Name: "u", PasswordHash: "x"}
+	u.Friend = u
+	return &orderT{
+		ID:       1,
+		Customer: customerT{Name: "c", Email: "c@example.com", User: u},
+		Items:    []itemT{{SKU: "a", Price: 1}, {SKU: "b", Price: 2}},
+		Meta:     map[string]string{"api key": "k", "source": "web"},
+		Notes:    "n",
+	}
+}
+
+// keysAt returns the sorted keys of the struct or map at path.
+func keysAt(t *testing.T, v *tahwil.Value, path ...any) []string {
+	t.Helper()
+	n, err := v.Get(path...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n.Kind == tahwil.Ptr {
+		n, _ = n.AsPtr()
+	}
+	fields, ok := n.AsStruct()
+	if !ok {
+		fields, _ = n.AsMap()
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestToValueWithOptions_Exclude(t *testing.T) {
+	opts := &tahwil.Options{Exclude: []string{"userT.PasswordHash", "Items[*].Price", `Meta["api key"]`, "N?tes"}}
+	v, err := tahwil.ToValueWithOptions(newOrder(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path []any
+		want []string
+	}{
+		{nil, []string{"Customer", "ID", "Items", "Meta"}},
+		{[]any{"Customer", "User"}, []string{"Friend", "Name"}},
+		{[]any{"Items", 1}, []string{"SKU"}},
+		{[]any{"Meta"}, []string{"source"}},
+	}
+	for _, tt := range tests {
+		if got := keysAt(t, v, tt.path...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("keys at %v = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	var out orderT
+	if err = tahwil.FromValue(v, &out); err != nil {
+		t.Fatal(err)
+	}
+	u := out.Customer.User
+	if u.Name != "u" || u.PasswordHash != "" || u.Friend != u {
+		t.Errorf("User = %+v", u)
+	}
+}
+
+func TestToValueWithOptions_Only(t *testing.T) {
+	tests := []struct {
+		name string
+		only []string
+		path []any
+		want []string
+	}{
+		{"type fields", []string{"orderT.*", "customerT.Name"}, []any{"Customer"}, []string{"Name"}},
+		{"whole type", []string{"orderT.*", "customerT.Name"}, nil, []string{"Customer", "ID", "Items", "Meta", "Notes"}},
+		{"unrestricted below", []string{"orderT.*", "customerT.Name"}, []any{"Items", 0}, []string{"Price", "SKU"}},
+		{"path", []string{"Items[*].SKU", "ID"}, nil, []string{"ID", "Items"}},
+		{"path below", []string{"Items[*].SKU", "ID"}, []any{"Items", 1}, []string{"SKU"}},
+		{"map entry", []string{".Meta.source"}, []any{"Meta"}, []string{"source"}},
+		{"type, not path", []string{"Meta.source"}, []any{"Meta"}, []string{"api key", "source"}},
+		{"subtree", []string{"Customer"}, []any{"Customer"}, []string{"Email", "Name", "User"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := tahwil.ToValueWithOptions(newOrder(), &tahwil.Options{Only: tt.only})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := keysAt(t, v, tt.path...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("keys at %v = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToValueWithOptions_OnlyNestedTypes(t *testing.T) {
+	// Type.Field patterns restrict the structs of the types they name,
+	// wherever they are, and leave the root of another type whole
+	in := &accountT{Name: "a", Email: "a@example.com", Orders: []orderT{*newOrder()}}
+	v, err := tahwil.ToValueWithOptions(in, &tahwil.Options{Only: []string{"orderT.*", "customerT.Name"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path []any
+		want []string
+	}{
+		{nil, []string{"Email", "Name", "Orders"}},
+		{[]any{"Orders", 0}, []string{"Customer", "ID", "Items", "Meta", "Notes"}},
+		{[]any{"Orders", 0, "Customer"}, []string{"Name"}},
+		{[]any{"Orders", 0, "Items", 0}, []string{"Price", "SKU"}},
+	}
+	for _, tt := range tests {
+		if got := keysAt(t, v, tt.path...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("keys at %v = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestToValueWithOptions_ExcludeRefs(t *testing.T) {
+	// the first occurrence of the user is left out, the second one
+	// becomes the pointer the others refer to
+	u := &userT{Name: "u"}
+	u.Friend = u
+	in := &struct {
+		A *userT
+		B *userT
+		C *userT
+	}{u, u, u}
+	v, err := tahwil.ToValueWithOptions(in, &tahwil.Options{Exclude: []string{"A"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = v.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := v.Get("B")
+	c, _ := v.Get("C")
+	if b.Kind != tahwil.Ptr || c.Kind != tahwil.Ref {
+		t.Errorf("B is a %s, C a %s", b.Kind, c.Kind)
+	}
+}
+
+func TestToValueWithOptions_InvalidPattern(t *testing.T) {
+	_, err := tahwil.ToValueWithOptions(newOrder(), &tahwil.Options{Exclude: []string{"Items[x]"}})
+	var se *tahwil.PathSyntaxError
+	if !errors.As(err, &se) {
+		t.Errorf("ToValueWithOptions() error = %v, want a *PathSyntaxError", err)
+	}
+}
@@ -0,0 +1,536 @@
+// Package flatted converts Go object graphs to and from the JSON layout
+// produced by the JavaScript "flatted" library (the successor of
+// "circular-json").
+//
+// A flatted document is a JSON array. Entry 0 is the root value; every
+// object, array and string is stored once as a separate entry and is
+// referenced by its index, written as a decimal string. Numbers, booleans
+// and null are stored inline. Shared and cyclic references are expressed
+// by reusing the same index.
+//
+// Encoding goes through tahwil.ToValue, so pointer identity is tracked
+// exactly as in the rest of tahwil: every pointer target becomes one entry
+// and further pointers to it reuse its index. Decoding is guided by the
+// destination type and produces a *tahwil.Value tree that is restored with
+// tahwil.FromValue.
+package flatted
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/go-extras/tahwil"
+	"github.com/go-extras/tahwil/internal/fieldtag"
+)
+
+// An InvalidInputError describes malformed flatted input.
+type InvalidInputError struct {
+	Index  int
+	Reason string
+}
+
+func (e *InvalidInputError) Error() string {
+	return "flatted: invalid entry " + strconv.Itoa(e.Index) + ": " + e.Reason
+}
+
+// An UnsupportedTypeError is returned by Unmarshal when the destination
+// contains a type that can't be restored from flatted input.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "flatted: unsupported type " + e.Type.String()
+}
+
+// Marshal returns the flatted encoding of v. A *tahwil.Value is encoded as
+// the tree it holds, like MarshalValue does.
+func Marshal(v any) ([]byte, error) {
+	if val, ok := v.(*tahwil.Value); ok {
+		return MarshalValue(val)
+	}
+	val, err := tahwil.ToValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return MarshalValue(val)
+}
+
+// MarshalValue returns the flatted encoding of a *tahwil.Value tree, such
+// as one produced by tahwil.ToValue or decoded from tahwil JSON.
+// Refs met before the pointer they refer to, e.g. in hand-built trees,
+// are supported: the pointer target is encoded at the first of them.
+func MarshalValue(v *tahwil.Value) ([]byte, error) {
+	g, err := tahwil.NewGraph(v)
+	if err != nil {
+		return nil, err
+	}
+	e := &encoder{
+		strings: make(map[string]int),
+		refs:    make(map[uint64]any),
+		graph:   g,
+	}
+	root, err := e.encode(v)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := root.(string); !ok {
+		// primitive roots are stored inline as the only entry
+		e.entries = append(e.entries, root)
+	}
+	return json.Marshal(e.entries)
+}
+
+type encoder struct {
+	// entries is the resulting flat table
+	entries []any
+	// strings maps already stored strings to their entry index
+	strings map[string]int
+	// refs maps pointer refids to their encoded form
+	refs map[uint64]any
+	// graph indexes the pointers by refid, so that a ref can be encoded
+	// before the pointer it refers to has been reached
+	graph *tahwil.Graph
+}
+
+func (e *encoder) alloc() int {
+	e.entries = append(e.entries, nil)
+	return len(e.entries) - 1
+}
+
+func (e *encoder) encodeString(s string) string {
+	idx, ok := e.strings[s]
+	if !ok {
+		idx = e.alloc()
+		e.entries[idx] = s
+		e.strings[s] = idx
+	}
+	return strconv.Itoa(idx)
+}
+
+func isContainer(k tahwil.Kind) bool {
+	switch k {
+	case tahwil.Struct, tahwil.Map, tahwil.Slice, tahwil.Array:
+		return true
+	}
+	return false
+}
+
+func (e *encoder) encodePtr(v *tahwil.Value) (any, error) {
+	if res, ok := e.refs[v.Refid]; ok {
+		// already encoded through a forward ref
+		return res, nil
+	}
+	if v.Value == nil {
+		e.refs[v.Refid] = nil
+		return nil, nil
+	}
+	inner, ok := v.AsPtr()
+	if !ok {
+		return nil, &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	if !isContainer(inner.Kind) {
+		res, err := e.encode(inner)
+		if err != nil {
+			return nil, err
+		}
+		e.refs[v.Refid] = res
+		return res, nil
+	}
+
+	// the index is registered before the target is filled in,
+	// so that cycles leading back to it can be resolved
+	idx := e.alloc()
+	e.refs[v.Refid] = strconv.Itoa(idx)
+	if err := e.encodeContainer(idx, inner); err != nil {
+		return nil, err
+	}
+	return strconv.Itoa(idx), nil
+}
+
+func (e *encoder) encodeRef(v *tahwil.Value) (any, error) {
+	refid, ok := v.AsRef()
+	if !ok {
+		return nil, &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	if res, ok := e.refs[refid]; ok {
+		return res, nil
+	}
+	// forward ref: encode the target pointer first; a stub is rejected
+	// like the stub itself
+	p, ok := e.graph.Node(refid)
+	if !ok {
+		return nil, &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	return e.encode(p)
+}
+
+func (e *encoder) encodeContainer(idx int, v *tahwil.Value) error {
+	switch v.Kind {
+	case tahwil.Struct, tahwil.Map:
+		fields, ok := v.AsFields()
+		if !ok {
+			return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		obj := make(map[string]any, len(fields))
+		e.entries[idx] = obj
+		for _, k := range keys {
+			res, err := e.encode(fields[k])
+			if err != nil {
+				return err
+			}
+			obj[k] = res
+		}
+	case tahwil.Slice, tahwil.Array:
+		elems, ok := v.AsSlice()
+		if !ok {
+			return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		arr := make([]any, len(elems))
+		e.entries[idx] = arr
+		for i, el := range elems {
+			res, err := e.encode(el)
+			if err != nil {
+				return err
+			}
+			arr[i] = res
+		}
+	}
+	return nil
+}
+
+func (e *encoder) encode(v *tahwil.Value) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch v.Kind {
+	case tahwil.Ptr:
+		return e.encodePtr(v)
+	case tahwil.Ref:
+		return e.encodeRef(v)
+	case tahwil.Struct, tahwil.Map, tahwil.Slice, tahwil.Array:
+		idx := e.alloc()
+		if err := e.encodeContainer(idx, v); err != nil {
+			return nil, err
+		}
+		return strconv.Itoa(idx), nil
+	case tahwil.String:
+		s, ok := v.Value.(string)
+		if !ok {
+			return nil, &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		return e.encodeString(s), nil
+	case tahwil.Bool,
+		tahwil.Int, tahwil.Int8, tahwil.Int16, tahwil.Int32, tahwil.Int64,
+		tahwil.Uint, tahwil.Uint8, tahwil.Uint16, tahwil.Uint32, tahwil.Uint64,
+		tahwil.Float32, tahwil.Float64:
+		return v.Value, nil
+	}
+	return nil, &tahwil.InvalidValueKindError{Kind: v.Kind}
+}
+
+// Unmarshal parses flatted data and stores the result in the value
+// pointed to by v. Objects referenced more than once through pointer
+// fields are restored as shared pointers, so cycles are preserved. An
+// object shared by pointers of different types, or containing itself
+// other than through a pointer, is reported as an *InvalidInputError.
+func Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &UnsupportedTypeError{Type: reflect.TypeOf(v)}
+	}
+	val, err := UnmarshalValue(data, rv.Type())
+	if err != nil {
+		return err
+	}
+	return tahwil.FromValue(val, v)
+}
+
+// UnmarshalValue parses flatted data into a *tahwil.Value tree shaped
+// after t, which must be a pointer type. The result can be passed to
+// tahwil.FromValue with a destination of type t.
+func UnmarshalValue(data []byte, t reflect.Type) (*tahwil.Value, error) {
+	if t == nil || t.Kind() != reflect.Ptr {
+		return nil, &UnsupportedTypeError{Type: t}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	d := &decoder{refs: make(map[int]sharedEntry), active: make(map[int]bool)}
+	if err := dec.Decode(&d.entries); err != nil {
+		return nil, err
+	}
+	if len(d.entries) == 0 {
+		return nil, &InvalidInputError{Index: 0, Reason: "empty document"}
+	}
+	var root any
+	switch d.entries[0].(type) {
+	case string, map[string]any, []any:
+		root = "0"
+	default:
+		root = d.entries[0]
+	}
+	return d.decode(root, t)
+}
+
+// sharedEntry is an entry owned by a pointer
+type sharedEntry struct {
+	refid uint64
+	// typ is the type of the pointer, the other pointers to the entry
+	// must have the same one
+	typ reflect.Type
+}
+
+type decoder struct {
+	entries []any
+	// refs maps entry indexes to the pointers that own them
+	refs map[int]sharedEntry
+	// active holds the indexes of the entries being decoded; an entry
+	// met again before it is done, other than through a pointer, would
+	// contain itself
+	active map[int]bool
+	// refid that was last generated
+	lastRefid uint64
+}
+
+func (d *decoder) nextRefid() uint64 {
+	d.lastRefid++
+	return d.lastRefid
+}
+
+// entry resolves an index reference to the entry it points to.
+func (d *decoder) entry(raw any) (int, any, error) {
+	s, ok := raw.(string)
+	if !ok {
+		return 0, nil, &InvalidInputError{Index: -1, Reason: "expected index, got " + describe(raw)}
+	}
+	idx, err := strconv.Atoi(s)
+	if err != nil || idx < 0 || idx >= len(d.entries) {
+		return 0, nil, &InvalidInputError{Index: -1, Reason: "index " + strconv.Quote(s) + " out of range"}
+	}
+	return idx, d.entries[idx], nil
+}
+
+func describe(v any) string {
+	if v == nil {
+		return "null"
+	}
+	return reflect.TypeOf(v).String()
+}
+
+func (d *decoder) decodePtr(raw any, t reflect.Type) (*tahwil.Value, error) {
+	if raw == nil {
+		return &tahwil.Value{Refid: d.nextRefid(), Kind: tahwil.Ptr}, nil
+	}
+
+	elem := t.Elem()
+	if elem.Kind() == reflect.Ptr {
+		// only the innermost pointer owns the entry
+		refid := d.nextRefid()
+		inner, err := d.decode(raw, elem)
+		if err != nil {
+			return nil, err
+		}
+		return &tahwil.Value{Refid: refid, Kind: tahwil.Ptr, Value: inner}, nil
+	}
+
+	var idx int
+	shared := false
+	if _, ok := raw.(string); ok {
+		i, ent, err := d.entry(raw)
+		if err != nil {
+			return nil, err
+		}
+		switch ent.(type) {
+		case map[string]any, []any:
+			idx, shared = i, true
+		}
+	}
+	if shared {
+		if se, ok := d.refs[idx]; ok {
+			if se.typ != t {
+				return nil, &InvalidInputError{Index: idx, Reason: "entry shared by " + se.typ.String() + " and " + t.String()}
+			}
+			return &tahwil.Value{Refid: d.nextRefid(), Kind: tahwil.Ref, Value: se.refid}, nil
+		}
+	}
+
+	refid := d.nextRefid()
+	if shared {
+		d.refs[idx] = sharedEntry{refid: refid, typ: t}
+	}
+	inner, err := d.decode(raw, elem)
+	if err != nil {
+		return nil, err
+	}
+	return &tahwil.Value{Refid: refid, Kind: tahwil.Ptr, Value: inner}, nil
+}
+
+// enter marks the container entry idx as being decoded; the returned
+// func unmarks it.
+func (d *decoder) enter(idx int) (func(), error) {
+	if d.active[idx] {
+		return nil, &InvalidInputError{Index: idx, Reason: "entry contains itself"}
+	}
+	d.active[idx] = true
+	return func() { delete(d.active, idx) }, nil
+}
+
+func (d *decoder) decodeStruct(raw any, t reflect.Type) (*tahwil.Value, error) {
+	idx, ent, err := d.entry(raw)
+	if err != nil {
+		return nil, err
+	}
+	leave, err := d.enter(idx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	obj, ok := ent.(map[string]any)
+	if !ok {
+		return nil, &InvalidInputError{Index: idx, Reason: "expected object, got " + describe(ent)}
+	}
+	res := make(map[string]*tahwil.Value)
+	for _, ft := range reflect.VisibleFields(t) {
+		k, ok := fieldtag.Key(ft)
+		if !ok || !ft.IsExported() {
+			continue
+		}
+		fv, ok := obj[k]
+		if !ok {
+			continue
+		}
+		res[k], err = d.decode(fv, ft.Type)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &tahwil.Value{Kind: tahwil.Struct, Value: res}, nil
+}
+
+func (d *decoder) decodeMap(raw any, t reflect.Type) (*tahwil.Value, error) {
+	if t.Key().Kind() != reflect.String {
+		return nil, &UnsupportedTypeError{Type: t}
+	}
+	idx, ent, err := d.entry(raw)
+	if err != nil {
+		return nil, err
+	}
+	leave, err := d.enter(idx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	obj, ok := ent.(map[string]any)
+	if !ok {
+		return nil, &InvalidInputError{Index: idx, Reason: "expected object, got " + describe(ent)}
+	}
+	res := make(map[string]*tahwil.Value, len(obj))
+	for k, mv := range obj {
+		res[k], err = d.decode(mv, t.Elem())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &tahwil.Value{Kind: tahwil.Map, Value: res}, nil
+}
+
+func (d *decoder) decodeSlice(raw any, t reflect.Type) (*tahwil.Value, error) {
+	idx, ent, err := d.entry(raw)
+	if err != nil {
+		return nil, err
+	}
+	leave, err := d.enter(idx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	arr, ok := ent.([]any)
+	if !ok {
+		return nil, &InvalidInputError{Index: idx, Reason: "expected array, got " + describe(ent)}
+	}
+	res := make([]*tahwil.Value, len(arr))
+	for i, el := range arr {
+		res[i], err = d.decode(el, t.Elem())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &tahwil.Value{Kind: tahwil.Kind(t.Kind().String()), Value: res}, nil
+}
+
+func (d *decoder) decodeString(raw any) (*tahwil.Value, error) {
+	idx, ent, err := d.entry(raw)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := ent.(string)
+	if !ok {
+		return nil, &InvalidInputError{Index: idx, Reason: "expected string, got " + describe(ent)}
+	}
+	return &tahwil.Value{Kind: tahwil.String, Value: s}, nil
+}
+
+func (d *decoder) decodeNumber(raw any, t reflect.Type) (*tahwil.Value, error) {
+	n, ok := raw.(json.Number)
+	if !ok {
+		return nil, &InvalidInputError{Index: -1, Reason: "expected number, got " + describe(raw)}
+	}
+	res := &tahwil.Value{Kind: tahwil.Kind(t.Kind().String())}
+	var err error
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		res.Value, err = strconv.ParseInt(n.String(), 10, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		res.Value, err = strconv.ParseUint(n.String(), 10, 64)
+	default:
+		res.Value, err = n.Float64()
+	}
+	if err != nil {
+		return nil, &InvalidInputError{Index: -1, Reason: err.Error()}
+	}
+	return res, nil
+}
+
+// decode converts a raw flatted value (an index reference or an inline
+// primitive) into a *tahwil.Value matching t.
+func (d *decoder) decode(raw any, t reflect.Type) (*tahwil.Value, error) {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return d.decodePtr(raw, t)
+	case reflect.Struct:
+		return d.decodeStruct(raw, t)
+	case reflect.Map:
+		if raw == nil {
+			return &tahwil.Value{Kind: tahwil.Map}, nil
+		}
+		return d.decodeMap(raw, t)
+	case reflect.Slice:
+		if raw == nil {
+			return &tahwil.Value{Kind: tahwil.Slice}, nil
+		}
+		return d.decodeSlice(raw, t)
+	case reflect.Array:
+		return d.decodeSlice(raw, t)
+	case reflect.String:
+		return d.decodeString(raw)
+	case reflect.Bool:
+		b, ok := raw.(bool)
+		if !ok {
+			return nil, &InvalidInputError{Index: -1, Reason: "expected boolean, got " + describe(raw)}
+		}
+		return &tahwil.Value{Kind: tahwil.Bool, Value: b}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return d.decodeNumber(raw, t)
+	}
+	return nil, &UnsupportedTypeError{Type: t}
+}
@@ -0,0 +1,227 @@
+package flatted_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+	"github.com/go-extras/tahwil/flatted"
+)
+
+type personT struct {
+	Name     string     `json:"name"`
+	Age      int        `json:"age"`
+	Parent   *personT   `json:"parent"`
+	Children []*personT `json:"children"`
+}
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		in  any
+		out string
+	}{
+		{in: 42, out: `[42]`},
+		{in: "x", out: `["x"]`},
+		{in: nil, out: `[null]`},
+		{in: map[string]string{"a": "x", "b": "x"}, out: `[{"a":"1","b":"1"},"x"]`},
+		{in: []int{1, 2}, out: `[[1,2]]`},
+	}
+	for i, tt := range tests {
+		res, err := flatted.Marshal(tt.in)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if string(res) != tt.out {
+			t.Errorf("#%d: have %s, want %s", i, res, tt.out)
+		}
+	}
+}
+
+func TestMarshal_Cycle(t *testing.T) {
+	parent := &personT{Name: "Arthur", Age: 42}
+	parent.Children = []*personT{{Name: "Ford", Parent: parent}}
+
+	res, err := flatted.Marshal(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//nolint:lll // valid JSON
+	want := `[{"age":42,"children":"1","name":"5","parent":null},["2"],{"age":0,"children":"3","name":"4","parent":"0"},[],"Ford","Arthur"]`
+	if string(res) != want {
+		t.Errorf("have %s\nwant %s", res, want)
+	}
+
+	// a *tahwil.Value is encoded as the tree it holds
+	v, err := tahwil.ToValue(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err = flatted.Marshal(v); err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != want {
+		t.Errorf("have %s\nwant %s", res, want)
+	}
+}
+
+func TestMarshalValue_FromJSON(t *testing.T) {
+	parent := &personT{Name: "Arthur"}
+	parent.Children = []*personT{{Name: "Ford", Parent: parent}}
+	v, err := tahwil.ToValue(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &tahwil.Value{}
+	if err = json.Unmarshal(b, decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	have, err := flatted.MarshalValue(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := flatted.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(have) != string(want) {
+		t.Errorf("have %s\nwant %s", have, want)
+	}
+}
+
+func TestMarshalValue_ForwardRef(t *testing.T) {
+	// the ref to the pointer 2 is met before the pointer itself
+	v := &tahwil.Value{Refid: 1, Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Slice, Value: []*tahwil.Value{
+		{Refid: 3, Kind: tahwil.Ref, Value: uint64(2)},
+		{Refid: 2, Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Struct, Value: map[string]*tahwil.Value{
+			"name": {Kind: tahwil.String, Value: "Ford"},
+		}}},
+	}}}
+	res, err := flatted.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[["1","1"],{"name":"2"},"Ford"]`; string(res) != want {
+		t.Errorf("have %s, want %s", res, want)
+	}
+
+	var out []*personT
+	if err = flatted.Unmarshal(res, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || out[0] != out[1] || out[0].Name != "Ford" {
+		t.Errorf("unexpected value: %v", out)
+	}
+
+	// stubs have no flatted representation, nor have the refs to them
+	v.Value.(*tahwil.Value).Value.([]*tahwil.Value)[1] = &tahwil.Value{Refid: 2, Kind: tahwil.Stub, Value: "flatted_test.personT"}
+	var kindErr *tahwil.InvalidValueKindError
+	if _, err = flatted.MarshalValue(v); !errors.As(err, &kindErr) {
+		t.Errorf("expected *InvalidValueKindError, got %T: %v", err, err)
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	// produced by flatted.stringify in JavaScript
+	data := `[{"name":"1","age":42,"parent":null,"children":"2"},"Arthur",["3","4"],` +
+		`{"name":"5","age":7,"parent":"0","children":"6"},{"name":"7","parent":"0","children":"6"},` +
+		`"Ford",[],"Trillian"]`
+
+	var p personT
+	if err := flatted.Unmarshal([]byte(data), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "Arthur" || p.Age != 42 || p.Parent != nil {
+		t.Fatalf("unexpected root: %+v", p)
+	}
+	if len(p.Children) != 2 {
+		t.Fatalf("len(Children) = %d, want 2", len(p.Children))
+	}
+	if p.Children[0].Name != "Ford" || p.Children[0].Age != 7 {
+		t.Errorf("unexpected Children[0]: %+v", p.Children[0])
+	}
+	if p.Children[1].Name != "Trillian" {
+		t.Errorf("unexpected Children[1]: %+v", p.Children[1])
+	}
+	if p.Children[0].Parent != &p || p.Children[1].Parent != &p {
+		t.Error("expected children to point back to the root")
+	}
+}
+
+func TestUnmarshal_RoundTrip(t *testing.T) {
+	shared := &personT{Name: "shared"}
+	in := map[string]*personT{"a": shared, "b": shared}
+	shared.Parent = shared
+
+	b, err := flatted.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]*personT
+	if err = flatted.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["a"] != out["b"] {
+		t.Error("expected shared pointer to be preserved")
+	}
+	if out["a"].Parent != out["a"] {
+		t.Error("expected self reference to be preserved")
+	}
+	if out["a"].Name != "shared" || len(out["a"].Children) != 0 {
+		t.Errorf("unexpected value: %+v", out["a"])
+	}
+}
+
+func TestUnmarshal_Errors(t *testing.T) {
+	var p personT
+	var invalid *flatted.InvalidInputError
+	for i, data := range []string{`[]`, `[{"name":"9"}]`, `[{"name":1}]`, `[{"age":"1"},"x"]`} {
+		err := flatted.Unmarshal([]byte(data), &p)
+		if !errors.As(err, &invalid) {
+			t.Errorf("#%d: expected *InvalidInputError, got %T: %v", i, err, err)
+		}
+	}
+
+	var unsupported *flatted.UnsupportedTypeError
+	if err := flatted.Unmarshal([]byte(`[1]`), p); !errors.As(err, &unsupported) {
+		t.Errorf("expected *UnsupportedTypeError, got %T: %v", err, err)
+	}
+	var m map[int]string
+	if err := flatted.Unmarshal([]byte(`[{}]`), &m); !errors.As(err, &unsupported) {
+		t.Errorf("expected *UnsupportedTypeError, got %T: %v", err, err)
+	}
+}
+
+func TestUnmarshal_InvalidGraphs(t *testing.T) {
+	type nodeT struct {
+		Name     string  `json:"name"`
+		Children []nodeT `json:"children"`
+	}
+	type xT struct{}
+	type yT struct{}
+	type pairT struct {
+		A *xT `json:"a"`
+		B *yT `json:"b"`
+	}
+	tests := []struct {
+		data string
+		dst  any
+	}{
+		// entries reached through values, not pointers, can't contain themselves
+		{data: `[{"name":"1","children":"2"},"a",["0"]]`, dst: &nodeT{}},
+		{data: `[["0"]]`, dst: &[][]nodeT{}},
+		// an entry shared by pointers of different types
+		{data: `[{"a":"1","b":"1"},{}]`, dst: &pairT{}},
+	}
+	var invalid *flatted.InvalidInputError
+	for i, tt := range tests {
+		if err := flatted.Unmarshal([]byte(tt.data), tt.dst); !errors.As(err, &invalid) {
+			t.Errorf("#%d: expected *InvalidInputError, got %T: %v", i, err, err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package tahwil
+
+import (
+	"reflect"
+	"strconv"
+)
+
+// FuncChanMode selects how ToValueWithOptions encodes the funcs that are
+// not registered in Options.Funcs and the chans.
+type FuncChanMode int
+
+const (
+	// FuncChanFail fails with an *InvalidMapperKindError, like ToValue.
+	FuncChanFail FuncChanMode = iota
+	// FuncChanOmit leaves struct fields and map entries holding them
+	// out. Slice and array elements, which can't be left out, and the
+	// root are encoded like FuncChanNull does.
+	FuncChanOmit
+	// FuncChanNull encodes them as func or chan nodes with a nil value,
+	// which are decoded as nil funcs or chans.
+	FuncChanNull
+)
+
+// An InvalidFuncError describes a func that can't be registered.
+type InvalidFuncError struct {
+	Name   string
+	Reason string
+}
+
+func (e *InvalidFuncError) Error() string {
+	return "tahwil.FuncRegistry: " + strconv.Quote(e.Name) + ": " + e.Reason
+}
+
+// FuncRegistry maps funcs to names and back. Set as Options.Funcs, it
+// makes ToValueWithOptions encode the registered funcs by their names,
+// and FromValueWithOptions bind the names back to the funcs.
+//
+// Funcs are identified by their code: closures created by the same func
+// literal can't be told apart, so only top-level funcs and method
+// expressions should be registered.
+type FuncRegistry struct {
+	funcs map[string]reflect.Value
+	names map[uintptr]string
+}
+
+// NewFuncRegistry returns an empty registry.
+func NewFuncRegistry() *FuncRegistry {
+	return &FuncRegistry{
+		funcs: make(map[string]reflect.Value),
+		names: make(map[uintptr]string),
+	}
+}
+
+// Register registers the non-nil func fn under name. A name and a func
+// can only be registered once.
+func (r *FuncRegistry) Register(name string, fn any) error {
+	v := reflect.ValueOf(fn)
+	switch {
+	case v.Kind() != reflect.Func:
+		return &InvalidFuncError{Name: name, Reason: "not a func: " + reflect.TypeOf(fn).String()}
+	case v.IsNil():
+		return &InvalidFuncError{Name: name, Reason: "nil func"}
+	}
+	if _, ok := r.funcs[name]; ok {
+		return &InvalidFuncError{Name: name, Reason: "name already registered"}
+	}
+	if other, ok := r.names[v.Pointer()]; ok {
+		return &InvalidFuncError{Name: name, Reason: "func already registered as " + strconv.Quote(other)}
+	}
+	r.funcs[name] = v
+	r.names[v.Pointer()] = name
+	return nil
+}
+
+// name returns the name of the non-nil func v.
+func (r *FuncRegistry) name(v reflect.Value) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	name, ok := r.names[v.Pointer()]
+	return name, ok
+}
+
+func (r *FuncRegistry) lookup(name string) (reflect.Value, bool) {
+	if r == nil {
+		return reflect.Value{}, false
+	}
+	fn, ok := r.funcs[name]
+	return fn, ok
+}
+
+// encodable reports whether the func or chan v gets a non-placeholder
+// node: nil funcs and registered funcs do if a registry is set.
+func (vm *valueMapper) encodable(v reflect.Value) bool {
+	if v.Kind() != reflect.Func || vm.opts.Funcs == nil {
+		return false
+	}
+	if v.IsNil() {
+		return true
+	}
+	_, ok := vm.opts.Funcs.name(v)
+	return ok
+}
+
+// omitted reports whether the struct field or map entry v is left out by
+// FuncChanOmit.
+func (vm *valueMapper) omitted(v reflect.Value) bool {
+	if vm.opts.FuncsAndChans != FuncChanOmit {
+		return false
+	}
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Func, reflect.Chan:
+		return !vm.encodable(v)
+	}
+	return false
+}
+
+func (vm *valueMapper) funcOrChanToValue(v reflect.Value, kind reflect.Kind, result *Value) error {
+	if vm.allRefids {
+		result.Refid = vm.nextRefid()
+	}
+	result.Kind = Kind(kind.String())
+	if vm.encodable(v) {
+		if !v.IsNil() {
+			result.Value, _ = vm.opts.Funcs.name(v)
+		}
+		return nil
+	}
+	if vm.opts.FuncsAndChans == FuncChanFail {
+		return &InvalidMapperKindError{Kind: kind.String()}
+	}
+	return nil
+}
+
+func (vu *valueUnmapper) fromFuncValue(data *Value, v reflect.Value) error {
+	if v.Kind() != reflect.Func {
+		return &InvalidUnmapperKindError{Expected: string(Func), Kind: v.Kind().String()}
+	}
+	if data.Value == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	name, ok := data.Value.(string)
+	if !ok {
+		return &InvalidValueError{Value: data.Value, Kind: data.Kind}
+	}
+	fn, ok := vu.opts.Funcs.lookup(name)
+	if !ok {
+		return &UnmapperError{text: "unknown func " + strconv.Quote(name)}
+	}
+	if !fn.Type().AssignableTo(v.Type()) {
+		return &UnmapperError{text: "func " + strconv.Quote(name) + " of type " + fn.Type().String() + " can't be assigned to " + v.Type().String()}
+	}
+	v.Set(fn)
+	return nil
+}
+
+func (vu *valueUnmapper) fromChanValue(data *Value, v reflect.Value) error {
+	if v.Kind() != reflect.Chan {
+		return &InvalidUnmapperKindError{Expected: string(Chan), Kind: v.Kind().String()}
+	}
+	if data.Value != nil {
+		return &InvalidValueError{Value: data.Value, Kind: data.Kind}
+	}
+	v.Set(reflect.Zero(v.Type()))
+	return nil
+}
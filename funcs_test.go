@@ -0,0 +1,198 @@
+package tahwil_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+type handlerT struct {
+	Name    string
+	Fn      func(string) string
+	Done    chan struct{}
+	Filters []func(string) string
+	Hooks   map[string]func(string) string
+}
+
+func newFuncs(t *testing.T) *tahwil.FuncRegistry {
+	t.Helper()
+	funcs := tahwil.NewFuncRegistry()
+	if err := funcs.Register("upper", strings.ToUpper); err != nil {
+		t.Fatal(err)
+	}
+	if err := funcs.Register("lower", strings.ToLower); err != nil {
+		t.Fatal(err)
+	}
+	return funcs
+}
+
+func TestToValueWithOptions_Funcs(t *testing.T) {
+	opts := &tahwil.Options{Funcs: newFuncs(t), FuncsAndChans: tahwil.FuncChanOmit}
+	in := &handlerT{
+		Name:    "h",
+		Fn:      strings.ToUpper,
+		Done:    make(chan struct{}),
+		Filters: []func(string) string{strings.ToLower, strings.TrimSpace, nil},
+		Hooks:   map[string]func(string) string{"a": strings.ToLower, "b": strings.TrimSpace},
+	}
+	v, err := tahwil.ToValueWithOptions(in, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields, _ := v.Value.(*tahwil.Value).AsStruct()
+	if _, ok := fields["Done"]; ok {
+		t.Errorf("chan field was not omitted")
+	}
+	if fn := fields["Fn"]; fn.Kind != tahwil.Func || fn.Value != "upper" {
+		t.Errorf("Fn = %v", fn)
+	}
+	hooks, _ := fields["Hooks"].AsMap()
+	if _, ok := hooks["b"]; ok {
+		t.Errorf("unregistered func entry was not omitted")
+	}
+	// slice elements can't be omitted
+	filters, _ := fields["Filters"].AsSlice()
+	if len(filters) != 3 || filters[0].Value != "lower" || filters[1].Kind != tahwil.Func || filters[1].Value != nil {
+		t.Errorf("Filters = %v", filters)
+	}
+
+	// round trip through JSON and binary
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON tahwil.Value
+	if err = json.Unmarshal(data, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	bin, err := fromJSON.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromBinary tahwil.Value
+	if err = fromBinary.UnmarshalBinary(bin); err != nil {
+		t.Fatal(err)
+	}
+	if !tahwil.Equal(v, &fromBinary) {
+		t.Errorf("round trip changed the value")
+	}
+
+	var out handlerT
+	if err = tahwil.FromValueWithOptions(&fromBinary, &out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if out.Fn == nil || out.Fn("a") != "A" {
+		t.Errorf("Fn was not bound")
+	}
+	if out.Done != nil {
+		t.Errorf("Done = %v, want nil", out.Done)
+	}
+	if len(out.Filters) != 3 || out.Filters[0]("A") != "a" || out.Filters[1] != nil || out.Filters[2] != nil {
+		t.Errorf("Filters were not bound")
+	}
+	if fn := out.Hooks["a"]; fn == nil || fn("A") != "a" {
+		t.Errorf("Hooks[a] was not bound")
+	}
+	if _, ok := out.Hooks["b"]; ok {
+		t.Errorf("Hooks[b] was decoded")
+	}
+}
+
+func TestToValueWithOptions_FuncChanNull(t *testing.T) {
+	in := &handlerT{Fn: strings.ToUpper, Done: make(chan struct{})}
+	v, err := tahwil.ToValueWithOptions(in, &tahwil.Options{FuncsAndChans: tahwil.FuncChanNull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, _ := v.Value.(*tahwil.Value).AsStruct()
+	if fn := fields["Fn"]; fn.Kind != tahwil.Func || fn.Value != nil {
+		t.Errorf("Fn = %v", fn)
+	}
+	if ch := fields["Done"]; ch.Kind != tahwil.Chan || ch.Value != nil {
+		t.Errorf("Done = %v", ch)
+	}
+	if err = v.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+
+	out := handlerT{Fn: strings.ToLower, Done: make(chan struct{})}
+	if err = tahwil.FromValue(v, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Fn != nil || out.Done != nil {
+		t.Errorf("placeholders were not decoded as nil")
+	}
+}
+
+func TestToValueWithOptions_FuncChanFail(t *testing.T) {
+	// the default mode fails on unregistered funcs and on chans
+	opts := &tahwil.Options{Funcs: newFuncs(t)}
+	for _, in := range []*handlerT{{Fn: strings.TrimSpace}, {Done: make(chan struct{})}} {
+		_, err := tahwil.ToValueWithOptions(in, opts)
+		var e *tahwil.InvalidMapperKindError
+		if !errors.As(err, &e) {
+			t.Errorf("ToValueWithOptions() error = %v, want an *InvalidMapperKindError", err)
+		}
+	}
+	if _, err := tahwil.ToValueWithOptions(&struct{ Fn func(string) string }{strings.ToUpper}, opts); err != nil {
+		t.Errorf("ToValueWithOptions() error = %v", err)
+	}
+}
+
+func TestFromValueWithOptions_FuncErrors(t *testing.T) {
+	opts := &tahwil.Options{Funcs: newFuncs(t)}
+	tests := []struct {
+		name string
+		fn   *tahwil.Value
+	}{
+		{"unknown func", &tahwil.Value{Kind: tahwil.Func, Value: "trim"}},
+		{"no registry", &tahwil.Value{Kind: tahwil.Func, Value: "upper"}},
+		{"type mismatch", &tahwil.Value{Kind: tahwil.Func, Value: "upper"}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := &tahwil.Value{Refid: 1, Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Struct, Value: map[string]*tahwil.Value{"Fn": tt.fn}}}
+			var err error
+			switch i {
+			case 1:
+				err = tahwil.FromValue(data, &handlerT{})
+			case 2:
+				err = tahwil.FromValueWithOptions(data, &struct{ Fn func(int) }{}, opts)
+			default:
+				err = tahwil.FromValueWithOptions(data, &handlerT{}, opts)
+			}
+			var e *tahwil.UnmapperError
+			if !errors.As(err, &e) {
+				t.Errorf("FromValueWithOptions() error = %v, want an *UnmapperError", err)
+			}
+		})
+	}
+}
+
+func TestFuncRegistry_Register(t *testing.T) {
+	funcs := newFuncs(t)
+	tests := []struct {
+		name string
+		key  string
+		fn   any
+		want error
+	}{
+		{"not a func", "x", 1, &tahwil.InvalidFuncError{Name: "x", Reason: "not a func: int"}},
+		{"nil func", "x", (func())(nil), &tahwil.InvalidFuncError{Name: "x", Reason: "nil func"}},
+		{"name taken", "upper", strings.TrimSpace, &tahwil.InvalidFuncError{Name: "upper", Reason: "name already registered"}},
+		{"func taken", "x", strings.ToUpper, &tahwil.InvalidFuncError{Name: "x", Reason: `func already registered as "upper"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := funcs.Register(tt.key, tt.fn)
+			if !reflect.DeepEqual(err, tt.want) {
+				t.Errorf("Register() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,800 @@
+// Package graph exports *tahwil.Value trees as graphs in the GraphML and
+// JSON Graph Format (JGF) formats understood by graph tools, and imports
+// them back.
+//
+// Every pointer target becomes a node whose id is the refid of its
+// pointer. The scalars reachable from the target without following
+// another pointer become attributes of the node named after their path,
+// and every non-nil pointer and every ref becomes an edge from the node
+// holding it to the node of its target, labelled with the same path:
+//
+//	Name                  struct field
+//	Address.City          field of a nested struct
+//	Tags[0]               slice or array element
+//	Meta["key"]           map entry
+//	$                     the target itself, e.g. a pointer to a string
+//
+// Struct fields whose name is not an identifier are written like map
+// entries. Two reserved attributes make the export lossless: "@kind"
+// holds the kind of the target, and "@kinds" holds a JSON object mapping
+// paths to the kinds that can't be told from the path syntax and the
+// attribute type, e.g. {"Age":"uint8","Scores":"array"}. Empty
+// containers and nil pointers, which have no attributes of their own,
+// are listed there too.
+//
+// The importers rebuild the tree starting from the node with the given
+// id, so the result can be passed to tahwil.FromValue. Node ids that are
+// not decimal refids get fresh ones. Attributes whose path has no kind
+// listed in "@kinds" get the kind of their value: bool, int, float64 or
+// string.
+package graph
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-extras/tahwil"
+)
+
+const (
+	attrKind  = "@kind"
+	attrKinds = "@kinds"
+	attrLabel = "label"
+	pathSelf  = "$"
+)
+
+// InvalidGraphError is returned when a graph does not describe a Value
+// tree.
+type InvalidGraphError struct {
+	Reason string
+}
+
+func (e *InvalidGraphError) Error() string {
+	return "graph: " + e.Reason
+}
+
+// attr is a scalar reachable from a node. Its value is a bool, int64,
+// uint64, float64 or string.
+type attr struct {
+	name  string
+	value any
+}
+
+type node struct {
+	id    string
+	kind  tahwil.Kind
+	attrs []attr
+	// kinds holds the kinds listed in the @kinds attribute
+	kinds map[string]tahwil.Kind
+}
+
+type edge struct {
+	source string
+	target string
+	label  string
+}
+
+// graph is the format independent form of a Value tree
+type graph struct {
+	root  string
+	nodes []*node
+	edges []edge
+}
+
+// kindsJSON returns the @kinds attribute of n, or "" if it has none.
+func (n *node) kindsJSON() (string, error) {
+	if len(n.kinds) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(n.kinds)
+	return string(b), err
+}
+
+// setKinds reads the @kinds attribute of n.
+func (n *node) setKinds(data []byte) error {
+	if err := json.Unmarshal(data, &n.kinds); err != nil {
+		return &InvalidGraphError{Reason: "node " + strconv.Quote(n.id) + ": invalid " + attrKinds + " attribute: " + err.Error()}
+	}
+	return nil
+}
+
+// newGraph builds the graph of v, which must be a pointer as produced by
+// tahwil.ToValue.
+func newGraph(v *tahwil.Value) (*graph, error) {
+	table, err := tahwil.Flatten(v)
+	if err != nil {
+		return nil, err
+	}
+	g := &graph{}
+	if table.Root == 0 {
+		return g, nil
+	}
+	g.root = strconv.FormatUint(table.Root, 10)
+
+	refids := make([]uint64, 0, len(table.Nodes))
+	for refid := range table.Nodes {
+		refids = append(refids, refid)
+	}
+	sort.Slice(refids, func(i, j int) bool { return refids[i] < refids[j] })
+	for _, refid := range refids {
+		nv := table.Nodes[refid]
+		if nv == nil {
+			return nil, &tahwil.InvalidValueError{Value: nil, Kind: tahwil.Ptr}
+		}
+		n := &node{id: strconv.FormatUint(refid, 10), kind: nv.Kind, kinds: make(map[string]tahwil.Kind)}
+		if err = g.walk(n, "", nv); err != nil {
+			return nil, err
+		}
+		g.nodes = append(g.nodes, n)
+	}
+	for _, e := range g.edges {
+		refid, _ := strconv.ParseUint(e.target, 10, 64)
+		if _, ok := table.Nodes[refid]; !ok {
+			return nil, &tahwil.InvalidValueError{Value: refid, Kind: tahwil.Ref}
+		}
+	}
+	return g, nil
+}
+
+// walk adds the scalars reachable from v to the attributes of n and the
+// refs to the edges of g.
+//
+//nolint:gocyclo // one case per kind
+func (g *graph) walk(n *node, path string, v *tahwil.Value) error {
+	if v == nil {
+		return nil
+	}
+	switch v.Kind {
+	case tahwil.Ptr:
+		// non-nil pointers have been replaced by refs by tahwil.Flatten
+		n.kinds[selfPath(path)] = tahwil.Ptr
+	case tahwil.Ref:
+		refid, ok := v.AsRef()
+		if !ok {
+			return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		g.edges = append(g.edges, edge{source: n.id, target: strconv.FormatUint(refid, 10), label: selfPath(path)})
+	case tahwil.Struct, tahwil.Map:
+		fields, ok := v.AsFields()
+		if !ok {
+			return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		if v.Value == nil {
+			return nil
+		}
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if path != "" && len(keys) == 0 {
+			n.kinds[path] = v.Kind
+		}
+		for _, k := range keys {
+			p := path + "[" + strconv.Quote(k) + "]"
+			switch {
+			case v.Kind == tahwil.Map:
+			case isIdent(k):
+				p = joinField(path, k)
+			case path != "":
+				// quoted fields would otherwise make it a map
+				n.kinds[path] = v.Kind
+			}
+			if err := g.walk(n, p, fields[k]); err != nil {
+				return err
+			}
+		}
+	case tahwil.Slice, tahwil.Array:
+		elems, ok := v.AsSlice()
+		if !ok {
+			return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		if v.Value == nil {
+			return nil
+		}
+		if path != "" && (len(elems) == 0 || v.Kind == tahwil.Array) {
+			n.kinds[path] = v.Kind
+		}
+		for i, el := range elems {
+			if err := g.walk(n, path+"["+strconv.Itoa(i)+"]", el); err != nil {
+				return err
+			}
+		}
+	case tahwil.Bool, tahwil.String,
+		tahwil.Int, tahwil.Int8, tahwil.Int16, tahwil.Int32, tahwil.Int64,
+		tahwil.Uint, tahwil.Uint8, tahwil.Uint16, tahwil.Uint32, tahwil.Uint64,
+		tahwil.Float32, tahwil.Float64:
+		value, err := scalarOf(v)
+		if err != nil {
+			return err
+		}
+		p := selfPath(path)
+		if f, ok := value.(float64); v.Kind != defaultKind(value) || ok && (math.IsInf(f, 0) || math.IsNaN(f)) {
+			n.kinds[p] = v.Kind
+		}
+		n.attrs = append(n.attrs, attr{name: p, value: value})
+	default:
+		return &tahwil.InvalidValueKindError{Kind: v.Kind}
+	}
+	return nil
+}
+
+func selfPath(path string) string {
+	if path == "" {
+		return pathSelf
+	}
+	return path
+}
+
+func joinField(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// isIdent reports whether a struct field can be written as a plain path
+// segment. Names starting with '@' or '$' are quoted as well, so they
+// can't be mistaken for the reserved attributes.
+func isIdent(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultKind returns the kind a scalar gets when @kinds doesn't list it.
+func defaultKind(value any) tahwil.Kind {
+	switch value.(type) {
+	case bool:
+		return tahwil.Bool
+	case int64, uint64:
+		return tahwil.Int
+	case float64:
+		return tahwil.Float64
+	}
+	return tahwil.String
+}
+
+// scalarOf returns the value of a scalar node as a bool, int64, uint64,
+// float64 or string.
+func scalarOf(v *tahwil.Value) (any, error) {
+	switch x := v.Value.(type) {
+	case bool:
+		if v.Kind == tahwil.Bool {
+			return x, nil
+		}
+	case string:
+		if v.Kind == tahwil.String {
+			return x, nil
+		}
+	case int:
+		return intOf(v, int64(x))
+	case int8:
+		return intOf(v, int64(x))
+	case int16:
+		return intOf(v, int64(x))
+	case int32:
+		return intOf(v, int64(x))
+	case int64:
+		return intOf(v, x)
+	case uint:
+		return uintOf(v, uint64(x))
+	case uint8:
+		return uintOf(v, uint64(x))
+	case uint16:
+		return uintOf(v, uint64(x))
+	case uint32:
+		return uintOf(v, uint64(x))
+	case uint64:
+		return uintOf(v, x)
+	case float32:
+		if v.Kind == tahwil.Float32 {
+			return float64(x), nil
+		}
+	case float64:
+		if v.Kind == tahwil.Float32 || v.Kind == tahwil.Float64 {
+			return x, nil
+		}
+	}
+	return nil, &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+}
+
+func intOf(v *tahwil.Value, i int64) (any, error) {
+	switch v.Kind {
+	case tahwil.Int, tahwil.Int8, tahwil.Int16, tahwil.Int32, tahwil.Int64:
+		return i, nil
+	case tahwil.Uint, tahwil.Uint8, tahwil.Uint16, tahwil.Uint32, tahwil.Uint64:
+		if i >= 0 {
+			return uint64(i), nil
+		}
+	}
+	return nil, &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+}
+
+func uintOf(v *tahwil.Value, u uint64) (any, error) {
+	switch v.Kind {
+	case tahwil.Uint, tahwil.Uint8, tahwil.Uint16, tahwil.Uint32, tahwil.Uint64:
+		return u, nil
+	case tahwil.Int, tahwil.Int8, tahwil.Int16, tahwil.Int32, tahwil.Int64:
+		if u <= math.MaxInt64 {
+			return int64(u), nil
+		}
+	}
+	return nil, &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+}
+
+// segment is a step of an attribute or edge path
+type segment struct {
+	// syntax is the container kind implied by the segment syntax
+	syntax tahwil.Kind
+	key    string
+	index  int
+	// end is the offset of the end of the segment in the path
+	end int
+}
+
+// parsePath splits an attribute or edge path into its segments. The path
+// of the node itself has no segments.
+func parsePath(path string) ([]segment, error) {
+	if path == pathSelf {
+		return nil, nil
+	}
+	if path == "" {
+		return nil, &InvalidGraphError{Reason: "empty path"}
+	}
+	var segs []segment
+	s := path
+	for len(s) > 0 {
+		var seg segment
+		switch {
+		case s[0] == '[' && len(s) > 1 && s[1] == '"':
+			end := quotedEnd(s[1:])
+			if end < 0 || len(s) < end+3 || s[end+2] != ']' {
+				return nil, &InvalidGraphError{Reason: "invalid path " + strconv.Quote(path)}
+			}
+			key, err := strconv.Unquote(s[1 : end+2])
+			if err != nil {
+				return nil, &InvalidGraphError{Reason: "invalid path " + strconv.Quote(path)}
+			}
+			seg = segment{syntax: tahwil.Map, key: key}
+			s = s[end+3:]
+		case s[0] == '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, &InvalidGraphError{Reason: "invalid path " + strconv.Quote(path)}
+			}
+			i, err := strconv.Atoi(s[1:end])
+			if err != nil || i < 0 || s[1] == '+' {
+				return nil, &InvalidGraphError{Reason: "invalid path " + strconv.Quote(path)}
+			}
+			seg = segment{syntax: tahwil.Slice, index: i}
+			s = s[end+1:]
+		default:
+			if len(segs) > 0 {
+				if s[0] != '.' {
+					return nil, &InvalidGraphError{Reason: "invalid path " + strconv.Quote(path)}
+				}
+				s = s[1:]
+			}
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+			if !isIdent(s[:end]) {
+				return nil, &InvalidGraphError{Reason: "invalid path " + strconv.Quote(path)}
+			}
+			seg = segment{syntax: tahwil.Struct, key: s[:end]}
+			s = s[end:]
+		}
+		seg.end = len(path) - len(s)
+		segs = append(segs, seg)
+	}
+	return segs, nil
+}
+
+// quotedEnd returns the index of the closing quote of the Go string
+// literal s starts with, or -1.
+func quotedEnd(s string) int {
+	for i := 1; i < len(s); {
+		switch s[i] {
+		case '\\':
+			i += 2
+		case '"':
+			return i
+		default:
+			_, size := utf8.DecodeRuneInString(s[i:])
+			i += size
+		}
+	}
+	return -1
+}
+
+// builder collects the attributes and edges of a node or of a container
+// inside it
+type builder struct {
+	kind   tahwil.Kind
+	fields map[string]*builder
+	elems  map[int]*builder
+	leaf   *tahwil.Value
+}
+
+// importer rebuilds a Value tree from a graph
+type importer struct {
+	// refids maps node ids to refids
+	refids map[string]uint64
+	nodes  map[uint64]*builder
+}
+
+func newImporter(g *graph) (*importer, error) {
+	im := &importer{refids: make(map[string]uint64), nodes: make(map[uint64]*builder)}
+	var maxRefid uint64
+	var named []string
+	for _, n := range g.nodes {
+		if _, ok := im.refids[n.id]; ok {
+			return nil, &InvalidGraphError{Reason: "duplicate node " + strconv.Quote(n.id)}
+		}
+		refid, err := strconv.ParseUint(n.id, 10, 64)
+		if err != nil || refid == 0 || strconv.FormatUint(refid, 10) != n.id {
+			named = append(named, n.id)
+			im.refids[n.id] = 0
+			continue
+		}
+		im.refids[n.id] = refid
+		maxRefid = max(maxRefid, refid)
+	}
+	for _, id := range named {
+		maxRefid++
+		im.refids[id] = maxRefid
+	}
+	return im, nil
+}
+
+// importGraph rebuilds the Value tree of g starting from the node rootID.
+func importGraph(g *graph, rootID string) (*tahwil.Value, error) {
+	if rootID == "" {
+		rootID = g.root
+	}
+	if rootID == "" && len(g.nodes) == 0 {
+		return tahwil.Unflatten(nil)
+	}
+	im, err := newImporter(g)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range g.nodes {
+		if n.kind == "" {
+			return nil, &InvalidGraphError{Reason: "node " + strconv.Quote(n.id) + " has no " + attrKind + " attribute"}
+		}
+		b := &builder{kind: n.kind}
+		im.nodes[im.refids[n.id]] = b
+		for path, kind := range n.kinds {
+			if err = b.set(n, path, kind, nil); err != nil {
+				return nil, err
+			}
+		}
+		for _, a := range n.attrs {
+			leaf, err := scalarValue(n.kinds[a.name], a.value)
+			if err != nil {
+				return nil, &InvalidGraphError{Reason: "node " + strconv.Quote(n.id) + ": attribute " + strconv.Quote(a.name) + ": " + err.Error()}
+			}
+			if err = b.set(n, a.name, leaf.Kind, leaf); err != nil {
+				return nil, err
+			}
+		}
+	}
+	byID := make(map[string]*node, len(g.nodes))
+	for _, n := range g.nodes {
+		byID[n.id] = n
+	}
+	for _, e := range g.edges {
+		n, ok := byID[e.source]
+		if !ok {
+			return nil, &InvalidGraphError{Reason: "edge from unknown node " + strconv.Quote(e.source)}
+		}
+		refid, ok := im.refids[e.target]
+		if !ok {
+			return nil, &InvalidGraphError{Reason: "edge to unknown node " + strconv.Quote(e.target)}
+		}
+		ref := &tahwil.Value{Kind: tahwil.Ref, Value: refid}
+		if err = im.nodes[im.refids[n.id]].set(n, e.label, tahwil.Ref, ref); err != nil {
+			return nil, err
+		}
+	}
+
+	table := &tahwil.Table{Nodes: make(map[uint64]*tahwil.Value, len(im.nodes))}
+	for refid, b := range im.nodes {
+		if table.Nodes[refid], err = b.build(); err != nil {
+			return nil, err
+		}
+	}
+	root, ok := im.refids[rootID]
+	if !ok {
+		return nil, &InvalidGraphError{Reason: "unknown root node " + strconv.Quote(rootID)}
+	}
+	table.Root = root
+	return tahwil.Unflatten(table)
+}
+
+// set stores the value at path, creating the containers on the way. A nil
+// leaf declares the kind of the path: a nil pointer, a container kind or
+// the kind of a scalar given by another attribute.
+func (b *builder) set(n *node, path string, kind tahwil.Kind, leaf *tahwil.Value) error {
+	segs, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	fail := func(reason string) error {
+		return &InvalidGraphError{Reason: "node " + strconv.Quote(n.id) + ": path " + strconv.Quote(path) + ": " + reason}
+	}
+
+	cur := b
+	for i, seg := range segs {
+		if cur.leaf != nil {
+			return fail("not a container")
+		}
+		if cur.kind == "" {
+			// the container kind follows from the syntax unless @kinds lists it
+			if k, ok := n.kinds[path[:segs[i-1].end]]; ok {
+				cur.kind = k
+			} else {
+				cur.kind = seg.syntax
+			}
+		}
+		var next *builder
+		switch {
+		case seg.syntax == tahwil.Slice && (cur.kind == tahwil.Slice || cur.kind == tahwil.Array):
+			if cur.elems == nil {
+				cur.elems = make(map[int]*builder)
+			}
+			if next = cur.elems[seg.index]; next == nil {
+				next = &builder{}
+				cur.elems[seg.index] = next
+			}
+		case seg.syntax != tahwil.Slice && (cur.kind == tahwil.Map || cur.kind == tahwil.Struct):
+			if cur.fields == nil {
+				cur.fields = make(map[string]*builder)
+			}
+			if next = cur.fields[seg.key]; next == nil {
+				next = &builder{}
+				cur.fields[seg.key] = next
+			}
+		default:
+			return fail("does not match the kind " + string(cur.kind))
+		}
+		cur = next
+	}
+
+	if leaf == nil {
+		switch {
+		case isScalar(kind):
+			return nil
+		case kind == tahwil.Ptr:
+			leaf = &tahwil.Value{Kind: tahwil.Ptr}
+		case kind == tahwil.Struct, kind == tahwil.Map, kind == tahwil.Slice, kind == tahwil.Array:
+			if cur.kind != "" && cur.kind != kind {
+				return fail("kind " + string(kind) + " does not match " + string(cur.kind))
+			}
+			cur.kind = kind
+			return nil
+		default:
+			return fail("invalid kind " + strconv.Quote(string(kind)))
+		}
+	}
+	if cur.leaf != nil || cur.fields != nil || cur.elems != nil || len(segs) > 0 && cur.kind != "" {
+		return fail("duplicate value")
+	}
+	if len(segs) == 0 && cur.kind != leaf.Kind {
+		return fail("kind " + string(leaf.Kind) + " does not match " + string(cur.kind))
+	}
+	cur.kind = leaf.Kind
+	cur.leaf = leaf
+	return nil
+}
+
+func (b *builder) build() (*tahwil.Value, error) {
+	if b.leaf != nil {
+		return b.leaf, nil
+	}
+	switch b.kind {
+	case tahwil.Struct, tahwil.Map:
+		m := make(map[string]*tahwil.Value, len(b.fields))
+		for k, f := range b.fields {
+			v, err := f.build()
+			if err != nil {
+				return nil, err
+			}
+			m[k] = v
+		}
+		return &tahwil.Value{Kind: b.kind, Value: m}, nil
+	case tahwil.Slice, tahwil.Array:
+		s := make([]*tahwil.Value, len(b.elems))
+		for i := range s {
+			el, ok := b.elems[i]
+			if !ok {
+				return nil, &InvalidGraphError{Reason: "missing element " + strconv.Itoa(i) + " of a " + string(b.kind)}
+			}
+			v, err := el.build()
+			if err != nil {
+				return nil, err
+			}
+			s[i] = v
+		}
+		return &tahwil.Value{Kind: b.kind, Value: s}, nil
+	}
+	return nil, &InvalidGraphError{Reason: "missing value of kind " + strconv.Quote(string(b.kind))}
+}
+
+func isScalar(kind tahwil.Kind) bool {
+	switch kind {
+	case tahwil.Bool, tahwil.String,
+		tahwil.Int, tahwil.Int8, tahwil.Int16, tahwil.Int32, tahwil.Int64,
+		tahwil.Uint, tahwil.Uint8, tahwil.Uint16, tahwil.Uint32, tahwil.Uint64,
+		tahwil.Float32, tahwil.Float64:
+		return true
+	}
+	return false
+}
+
+// scalarValue converts an attribute value to a scalar of the given kind,
+// or of the default kind of the value if kind is empty. String values are
+// parsed, so formats without typed attributes can carry any kind.
+//
+//nolint:gocyclo // one case per kind
+func scalarValue(kind tahwil.Kind, value any) (*tahwil.Value, error) {
+	if kind == "" {
+		kind = defaultKind(value)
+	}
+	if s, ok := value.(string); ok && kind != tahwil.String {
+		var err error
+		if value, err = parseScalar(kind, s); err != nil {
+			return nil, err
+		}
+	}
+
+	var res any
+	switch kind {
+	case tahwil.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return nil, strconv.ErrSyntax
+		}
+		res = b
+	case tahwil.String:
+		s, ok := value.(string)
+		if !ok {
+			return nil, strconv.ErrSyntax
+		}
+		res = s
+	case tahwil.Int, tahwil.Int8, tahwil.Int16, tahwil.Int32, tahwil.Int64:
+		var i int64
+		switch x := value.(type) {
+		case int64:
+			i = x
+		case uint64:
+			if x > math.MaxInt64 {
+				return nil, strconv.ErrRange
+			}
+			i = int64(x)
+		default:
+			return nil, strconv.ErrSyntax
+		}
+		return intValue(kind, i)
+	case tahwil.Uint, tahwil.Uint8, tahwil.Uint16, tahwil.Uint32, tahwil.Uint64:
+		var u uint64
+		switch x := value.(type) {
+		case uint64:
+			u = x
+		case int64:
+			if x < 0 {
+				return nil, strconv.ErrRange
+			}
+			u = uint64(x)
+		default:
+			return nil, strconv.ErrSyntax
+		}
+		return uintValue(kind, u)
+	case tahwil.Float32, tahwil.Float64:
+		var f float64
+		switch x := value.(type) {
+		case float64:
+			f = x
+		case int64:
+			f = float64(x)
+		case uint64:
+			f = float64(x)
+		default:
+			return nil, strconv.ErrSyntax
+		}
+		if kind == tahwil.Float32 {
+			res = float32(f)
+		} else {
+			res = f
+		}
+	default:
+		return nil, &tahwil.InvalidValueKindError{Kind: kind}
+	}
+	return &tahwil.Value{Kind: kind, Value: res}, nil
+}
+
+func parseScalar(kind tahwil.Kind, s string) (any, error) {
+	switch kind {
+	case tahwil.Bool:
+		return strconv.ParseBool(s)
+	case tahwil.Int, tahwil.Int8, tahwil.Int16, tahwil.Int32, tahwil.Int64:
+		return strconv.ParseInt(s, 10, 64)
+	case tahwil.Uint, tahwil.Uint8, tahwil.Uint16, tahwil.Uint32, tahwil.Uint64:
+		return strconv.ParseUint(s, 10, 64)
+	case tahwil.Float32, tahwil.Float64:
+		return strconv.ParseFloat(s, 64)
+	}
+	return nil, &tahwil.InvalidValueKindError{Kind: kind}
+}
+
+func intValue(kind tahwil.Kind, i int64) (*tahwil.Value, error) {
+	var res any
+	switch kind {
+	case tahwil.Int:
+		if i != int64(int(i)) {
+			return nil, strconv.ErrRange
+		}
+		res = int(i)
+	case tahwil.Int8:
+		if i != int64(int8(i)) {
+			return nil, strconv.ErrRange
+		}
+		res = int8(i)
+	case tahwil.Int16:
+		if i != int64(int16(i)) {
+			return nil, strconv.ErrRange
+		}
+		res = int16(i)
+	case tahwil.Int32:
+		if i != int64(int32(i)) {
+			return nil, strconv.ErrRange
+		}
+		res = int32(i)
+	default:
+		res = i
+	}
+	return &tahwil.Value{Kind: kind, Value: res}, nil
+}
+
+func uintValue(kind tahwil.Kind, u uint64) (*tahwil.Value, error) {
+	var res any
+	switch kind {
+	case tahwil.Uint:
+		if u != uint64(uint(u)) {
+			return nil, strconv.ErrRange
+		}
+		res = uint(u)
+	case tahwil.Uint8:
+		if u > math.MaxUint8 {
+			return nil, strconv.ErrRange
+		}
+		res = uint8(u)
+	case tahwil.Uint16:
+		if u > math.MaxUint16 {
+			return nil, strconv.ErrRange
+		}
+		res = uint16(u)
+	case tahwil.Uint32:
+		if u > math.MaxUint32 {
+			return nil, strconv.ErrRange
+		}
+		res = uint32(u)
+	default:
+		res = u
+	}
+	return &tahwil.Value{Kind: kind, Value: res}, nil
+}
@@ -0,0 +1,240 @@
+package graph
+
+import (
+	"encoding/xml"
+	"math"
+	"strconv"
+
+	"github.com/go-extras/tahwil"
+)
+
+const graphMLNamespace = "http://graphml.graphdrawing.org/xmlns"
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	Xmlns   string       `xml:"xmlns,attr,omitempty"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr,omitempty"`
+	Name string `xml:"attr.name,attr,omitempty"`
+	Type string `xml:"attr.type,attr,omitempty"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr,omitempty"`
+	EdgeDefault string        `xml:"edgedefault,attr,omitempty"`
+	Data        []graphMLData `xml:"data"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key  string `xml:"key,attr"`
+	Text string `xml:",chardata"`
+}
+
+// MarshalGraphML returns the GraphML document of the graph of v, which
+// must be a pointer as produced by tahwil.ToValue. Attribute keys are
+// typed boolean, long, double or string; an attribute whose values have
+// different types in different nodes gets the string type, and its kinds
+// are listed in "@kinds". The refid of the root pointer is stored in the
+// "root" attribute of the graph.
+func MarshalGraphML(v *tahwil.Value) ([]byte, error) {
+	g, err := newGraph(v)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &graphML{Xmlns: graphMLNamespace}
+	doc.Graph = graphMLGraph{ID: "tahwil", EdgeDefault: "directed"}
+	addKey := func(forElem, name, typ string) string {
+		id := "d" + strconv.Itoa(len(doc.Keys))
+		doc.Keys = append(doc.Keys, graphMLKey{ID: id, For: forElem, Name: name, Type: typ})
+		return id
+	}
+	if g.root != "" {
+		doc.Graph.Data = []graphMLData{{Key: addKey("graph", "root", "string"), Text: g.root}}
+	}
+	kindKey := addKey("node", attrKind, "string")
+	kindsKey := addKey("node", attrKinds, "string")
+
+	// an attribute gets a single type for all nodes
+	types := make(map[string]string)
+	var names []string
+	for _, n := range g.nodes {
+		for _, a := range n.attrs {
+			typ := graphMLType(a.value)
+			if old, ok := types[a.name]; !ok {
+				names = append(names, a.name)
+				types[a.name] = typ
+			} else if old != typ {
+				types[a.name] = "string"
+			}
+		}
+	}
+	keys := make(map[string]string, len(names))
+	for _, name := range names {
+		keys[name] = addKey("node", name, types[name])
+	}
+	labelKey := addKey("edge", attrLabel, "string")
+
+	for _, n := range g.nodes {
+		xn := graphMLNode{ID: n.id, Data: []graphMLData{{Key: kindKey, Text: string(n.kind)}}}
+		for _, a := range n.attrs {
+			// values written as strings must keep their kind
+			if _, ok := n.kinds[a.name]; !ok && types[a.name] == "string" && defaultKind(a.value) != tahwil.String {
+				n.kinds[a.name] = defaultKind(a.value)
+			}
+		}
+		kinds, err := n.kindsJSON()
+		if err != nil {
+			return nil, err
+		}
+		if kinds != "" {
+			xn.Data = append(xn.Data, graphMLData{Key: kindsKey, Text: kinds})
+		}
+		for _, a := range n.attrs {
+			xn.Data = append(xn.Data, graphMLData{Key: keys[a.name], Text: graphMLText(a.value)})
+		}
+		doc.Graph.Nodes = append(doc.Graph.Nodes, xn)
+	}
+	for _, e := range g.edges {
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{
+			Source: e.source,
+			Target: e.target,
+			Data:   []graphMLData{{Key: labelKey, Text: e.label}},
+		})
+	}
+
+	b, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// UnmarshalGraphML rebuilds a Value tree from a GraphML document, starting
+// from the node with the id rootID. An empty rootID selects the node named
+// by the "root" attribute of the graph. Data elements whose key has no
+// attr.name, such as the graphics of graph editors, are ignored.
+func UnmarshalGraphML(data []byte, rootID string) (*tahwil.Value, error) {
+	var doc graphML
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]graphMLKey, len(doc.Keys))
+	for _, k := range doc.Keys {
+		keys[k.ID] = k
+	}
+	g := &graph{}
+	for _, d := range doc.Graph.Data {
+		if keys[d.Key].Name == "root" {
+			g.root = d.Text
+		}
+	}
+	for _, xn := range doc.Graph.Nodes {
+		n := &node{id: xn.ID, kinds: make(map[string]tahwil.Kind)}
+		for _, d := range xn.Data {
+			k, ok := keys[d.Key]
+			if !ok {
+				return nil, &InvalidGraphError{Reason: "node " + strconv.Quote(xn.ID) + ": unknown key " + strconv.Quote(d.Key)}
+			}
+			switch k.Name {
+			case "":
+			case attrKind:
+				n.kind = tahwil.Kind(d.Text)
+			case attrKinds:
+				if err := n.setKinds([]byte(d.Text)); err != nil {
+					return nil, err
+				}
+			default:
+				value, err := graphMLValue(k.Type, d.Text)
+				if err != nil {
+					return nil, &InvalidGraphError{Reason: "node " + strconv.Quote(xn.ID) + ": attribute " + strconv.Quote(k.Name) + ": " + err.Error()}
+				}
+				n.attrs = append(n.attrs, attr{name: k.Name, value: value})
+			}
+		}
+		g.nodes = append(g.nodes, n)
+	}
+	for _, xe := range doc.Graph.Edges {
+		e := edge{source: xe.Source, target: xe.Target}
+		for _, d := range xe.Data {
+			if keys[d.Key].Name == attrLabel {
+				e.label = d.Text
+			}
+		}
+		g.edges = append(g.edges, e)
+	}
+	return importGraph(g, rootID)
+}
+
+func graphMLType(value any) string {
+	switch x := value.(type) {
+	case bool:
+		return "boolean"
+	case int64:
+		return "long"
+	case uint64:
+		if x <= math.MaxInt64 {
+			return "long"
+		}
+	case float64:
+		return "double"
+	}
+	return "string"
+}
+
+func graphMLText(value any) string {
+	switch x := value.(type) {
+	case bool:
+		return strconv.FormatBool(x)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case uint64:
+		return strconv.FormatUint(x, 10)
+	case float64:
+		switch {
+		case math.IsInf(x, 1):
+			return "INF"
+		case math.IsInf(x, -1):
+			return "-INF"
+		}
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	case string:
+		return x
+	}
+	return ""
+}
+
+// graphMLValue parses the text of a data element of the given type.
+func graphMLValue(typ, text string) (any, error) {
+	switch typ {
+	case "boolean":
+		return strconv.ParseBool(text)
+	case "int", "long":
+		if u, err := strconv.ParseUint(text, 10, 64); err == nil && u > math.MaxInt64 {
+			return u, nil
+		}
+		return strconv.ParseInt(text, 10, 64)
+	case "float", "double":
+		return strconv.ParseFloat(text, 64)
+	}
+	return text, nil
+}
@@ -0,0 +1,259 @@
+package graph_test
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+	"github.com/go-extras/tahwil/graph"
+)
+
+type personT struct {
+	Name     string
+	Parent   *personT
+	Children []*personT
+}
+
+type addressT struct {
+	City string
+	Zip  uint16
+}
+
+type allKindsT struct {
+	Bool     bool
+	Int      int
+	Int8     int8
+	Int16    int16
+	Int32    int32
+	Int64    int64
+	Uint     uint
+	Uint8    uint8
+	Uint16   uint16
+	Uint32   uint32
+	Uint64   uint64
+	Float32  float32
+	Float64  float64
+	Whole    float64
+	Inf      float64
+	String   string `json:"string value"`
+	Strings  []string
+	Empty    []string
+	Array    [2]int16
+	Map      map[string]int
+	Address  addressT
+	Pointer  *string
+	PtrPtr   **int
+	Nil      *addressT
+	Shared   *addressT
+	Shared2  *addressT
+	Interior []*addressT
+}
+
+func newAllKinds() *allKindsT {
+	s := "pointer"
+	i := 7
+	pi := &i
+	shared := &addressT{City: "Cottington", Zip: 1}
+	return &allKindsT{
+		Bool: true, Int: -1 << 40, Int8: -100, Int16: -30000, Int32: -1 << 30, Int64: -1 << 62,
+		Uint: 1 << 40, Uint8: 200, Uint16: 60000, Uint32: 1 << 31, Uint64: 1<<64 - 1,
+		Float32: 1.5, Float64: -2.25, Whole: 3, Inf: math.Inf(1),
+		String: "a \"quoted\" <string>", Strings: []string{"", "x"}, Empty: []string{},
+		Array: [2]int16{-1, 1}, Map: map[string]int{"a b": 1, "": 2, "x.y": 3},
+		Address: addressT{City: "Islington", Zip: 12345}, Pointer: &s, PtrPtr: &pi,
+		Shared: shared, Shared2: shared, Interior: []*addressT{shared, {City: "Magrathea"}},
+	}
+}
+
+func TestMarshalGraphML(t *testing.T) {
+	parent := &personT{Name: "Arthur"}
+	parent.Children = []*personT{{Name: "Ford", Parent: parent}}
+	v, err := tahwil.ToValue(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := graph.MarshalGraphML(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<graphml xmlns="http://graphml.graphdrawing.org/xmlns">
+  <key id="d0" for="graph" attr.name="root" attr.type="string"></key>
+  <key id="d1" for="node" attr.name="@kind" attr.type="string"></key>
+  <key id="d2" for="node" attr.name="@kinds" attr.type="string"></key>
+  <key id="d3" for="node" attr.name="Name" attr.type="string"></key>
+  <key id="d4" for="edge" attr.name="label" attr.type="string"></key>
+  <graph id="tahwil" edgedefault="directed">
+    <data key="d0">1</data>
+    <node id="1">
+      <data key="d1">struct</data>
+      <data key="d2">{&#34;Parent&#34;:&#34;ptr&#34;}</data>
+      <data key="d3">Arthur</data>
+    </node>
+    <node id="3">
+      <data key="d1">struct</data>
+      <data key="d2">{&#34;Children&#34;:&#34;slice&#34;}</data>
+      <data key="d3">Ford</data>
+    </node>
+    <edge source="1" target="3">
+      <data key="d4">Children[0]</data>
+    </edge>
+    <edge source="3" target="1">
+      <data key="d4">Parent</data>
+    </edge>
+  </graph>
+</graphml>`
+	if string(res) != want {
+		t.Errorf("have:\n%s\nwant:\n%s", res, want)
+	}
+}
+
+func TestGraphML_RoundTrip(t *testing.T) {
+	in := newAllKinds()
+	v, err := tahwil.ToValue(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := graph.MarshalGraphML(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := graph.UnmarshalGraphML(b, "")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, b)
+	}
+	out := &allKindsT{}
+	if err = tahwil.FromValue(decoded, out); err != nil {
+		t.Fatalf("%v\n%s", err, b)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("mismatch\nhave: %+v\nwant: %+v", out, in)
+	}
+	if out.Shared != out.Shared2 || out.Shared != out.Interior[0] {
+		t.Error("expected the shared pointer to be preserved")
+	}
+}
+
+func TestGraphML_MixedTypes(t *testing.T) {
+	// the same attribute holds an int in one node and a string in another
+	type stringNodeT struct {
+		Value string
+	}
+	type nodeT struct {
+		Value int
+		Next  *stringNodeT
+	}
+	in := &nodeT{Value: 1, Next: &stringNodeT{Value: "one"}}
+	v, err := tahwil.ToValue(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := graph.MarshalGraphML(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := graph.UnmarshalGraphML(b, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &nodeT{}
+	if err = tahwil.FromValue(decoded, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Value != 1 || out.Next.Value != "one" {
+		t.Errorf("unexpected result: %+v, %+v", out, out.Next)
+	}
+}
+
+func TestUnmarshalGraphML_HandWritten(t *testing.T) {
+	// node ids are names, there is no @kinds attribute and the editor
+	// added graphics data of its own
+	data := `<?xml version="1.0" encoding="UTF-8"?>
+<graphml xmlns="http://graphml.graphdrawing.org/xmlns" xmlns:y="http://www.yworks.com/xml/graphml">
+  <key id="kind" for="node" attr.name="@kind" attr.type="string"/>
+  <key id="name" for="node" attr.name="Name" attr.type="string"/>
+  <key id="gfx" for="node" yfiles.type="nodegraphics"/>
+  <key id="label" for="edge" attr.name="label" attr.type="string"/>
+  <graph edgedefault="directed">
+    <node id="arthur">
+      <data key="kind">struct</data>
+      <data key="name">Arthur</data>
+      <data key="gfx"><y:ShapeNode/></data>
+    </node>
+    <node id="ford">
+      <data key="kind">struct</data>
+      <data key="name">Ford</data>
+    </node>
+    <edge source="arthur" target="ford"><data key="label">Children[0]</data></edge>
+    <edge source="ford" target="arthur"><data key="label">Parent</data></edge>
+  </graph>
+</graphml>`
+	v, err := graph.UnmarshalGraphML([]byte(data), "arthur")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &personT{}
+	if err = tahwil.FromValue(v, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "Arthur" || len(out.Children) != 1 || out.Children[0].Name != "Ford" || out.Children[0].Parent != out {
+		t.Errorf("unexpected result: %+v", out)
+	}
+}
+
+func TestUnmarshalGraphML_Errors(t *testing.T) {
+	const head = `<graphml>
+  <key id="k" for="node" attr.name="@kind"/>
+  <key id="ks" for="node" attr.name="@kinds"/>
+  <key id="n" for="node" attr.name="N" attr.type="int"/>
+  <key id="s" for="node" attr.name="S"/>
+  <key id="l" for="edge" attr.name="label"/>
+  <graph>`
+	tests := []string{
+		`<node id="1"><data key="n">1</data></node>`,
+		`<node id="1"><data key="k">struct</data><data key="x">1</data></node>`,
+		`<node id="1"><data key="k">struct</data><data key="n">x</data></node>`,
+		`<node id="1"><data key="k">struct</data><data key="ks">[</data></node>`,
+		`<node id="1"><data key="k">struct</data><data key="ks">{"N":"int8"}</data><data key="n">300</data></node>`,
+		`<node id="1"><data key="k">struct</data><data key="ks">{"N":"foo"}</data></node>`,
+		`<node id="1"><data key="k">slice</data><data key="ks">{"S":"int"}</data><data key="s">1</data></node>`,
+		`<node id="1"><data key="k">struct</data></node><node id="1"><data key="k">struct</data></node>`,
+		`<node id="1"><data key="k">struct</data></node><edge source="1" target="2"><data key="l">P</data></edge>`,
+		`<node id="1"><data key="k">struct</data></node><edge source="2" target="1"><data key="l">P</data></edge>`,
+		`<node id="1"><data key="k">struct</data></node><edge source="1" target="1"><data key="l">[x</data></edge>`,
+		`<node id="1"><data key="k">struct</data></node><edge source="1" target="1"></edge>`,
+		`<node id="1"><data key="k">struct</data><data key="n">1</data></node><edge source="1" target="1"><data key="l">N</data></edge>`,
+		`<node id="1"><data key="k">slice</data></node><edge source="1" target="1"><data key="l">[1]</data></edge>`,
+		`<node id="1"><data key="k">int</data></node>`,
+		`<node id="2"><data key="k">struct</data></node>`,
+	}
+	for i, data := range tests {
+		var graphErr *graph.InvalidGraphError
+		_, err := graph.UnmarshalGraphML([]byte(head+data+`</graph></graphml>`), "1")
+		if !errors.As(err, &graphErr) {
+			t.Errorf("#%d: expected *InvalidGraphError, got %T: %v", i, err, err)
+		}
+	}
+
+	if _, err := graph.UnmarshalGraphML([]byte(`<graphml>`), "1"); err == nil {
+		t.Error("expected error for malformed XML, got nil")
+	}
+}
+
+func TestMarshalGraphML_Errors(t *testing.T) {
+	tests := []*tahwil.Value{
+		{Kind: tahwil.Struct, Value: map[string]*tahwil.Value{}},
+		{Kind: tahwil.Ptr, Refid: 1, Value: &tahwil.Value{Kind: "foo", Value: 1}},
+		{Kind: tahwil.Ptr, Refid: 1, Value: &tahwil.Value{Kind: tahwil.String, Value: 1}},
+		{Kind: tahwil.Ptr, Refid: 1, Value: &tahwil.Value{Kind: tahwil.Int, Value: "1"}},
+		{Kind: tahwil.Ptr, Refid: 1, Value: &tahwil.Value{Kind: tahwil.Struct, Value: []int{}}},
+		{Kind: tahwil.Ptr, Refid: 1, Value: &tahwil.Value{Kind: tahwil.Ref, Value: uint64(3)}},
+	}
+	for i, v := range tests {
+		if _, err := graph.MarshalGraphML(v); err == nil {
+			t.Errorf("#%d: expected error, got nil", i)
+		}
+	}
+}
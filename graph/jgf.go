@@ -0,0 +1,209 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/go-extras/tahwil"
+)
+
+type jgfDocument struct {
+	Graph  *jgfGraph  `json:"graph,omitempty"`
+	Graphs []jgfGraph `json:"graphs,omitempty"`
+}
+
+type jgfGraph struct {
+	Directed bool            `json:"directed"`
+	Metadata map[string]any  `json:"metadata,omitempty"`
+	Nodes    json.RawMessage `json:"nodes"`
+	Edges    []jgfEdge       `json:"edges"`
+}
+
+type jgfNode struct {
+	ID       string                     `json:"id,omitempty"`
+	Label    string                     `json:"label,omitempty"`
+	Metadata map[string]json.RawMessage `json:"metadata,omitempty"`
+}
+
+type jgfEdge struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	Relation string `json:"relation,omitempty"`
+	Label    string `json:"label,omitempty"`
+}
+
+// MarshalJGF returns the JSON Graph Format (version 2) document of the
+// graph of v, which must be a pointer as produced by tahwil.ToValue.
+// Nodes are keyed by id and labelled with their kind, attributes are
+// stored in the node metadata and the refid of the root pointer is
+// stored as "root" in the graph metadata. Integers are written exactly;
+// infinite and NaN floats are written as strings.
+func MarshalJGF(v *tahwil.Value) ([]byte, error) {
+	g, err := newGraph(v)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]jgfNode, len(g.nodes))
+	for _, n := range g.nodes {
+		meta := map[string]json.RawMessage{attrKind: jsonString(string(n.kind))}
+		for _, a := range n.attrs {
+			value := a.value
+			if f, ok := value.(float64); ok {
+				if math.IsInf(f, 0) || math.IsNaN(f) {
+					value = strconv.FormatFloat(f, 'g', -1, 64)
+				} else if f == math.Trunc(f) {
+					// integral floats would be read back as integers
+					if _, ok := n.kinds[a.name]; !ok {
+						n.kinds[a.name] = tahwil.Float64
+					}
+				}
+			}
+			b, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			meta[a.name] = b
+		}
+		if len(n.kinds) > 0 {
+			b, err := json.Marshal(n.kinds)
+			if err != nil {
+				return nil, err
+			}
+			meta[attrKinds] = b
+		}
+		nodes[n.id] = jgfNode{Label: string(n.kind), Metadata: meta}
+	}
+	rawNodes, err := json.Marshal(nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	jg := &jgfGraph{Directed: true, Nodes: rawNodes, Edges: make([]jgfEdge, 0, len(g.edges))}
+	if g.root != "" {
+		jg.Metadata = map[string]any{"root": g.root}
+	}
+	for _, e := range g.edges {
+		jg.Edges = append(jg.Edges, jgfEdge{Source: e.source, Target: e.target, Label: e.label})
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(&jgfDocument{Graph: jg}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJGF rebuilds a Value tree from a JSON Graph Format document,
+// starting from the node with the id rootID. An empty rootID selects the
+// node named by "root" in the graph metadata. Both the version 2 layout,
+// with nodes keyed by id, and the version 1 layout, with a node array,
+// are accepted; of a document with several graphs the first one is used.
+// Edges are labelled with their label, or else their relation.
+func UnmarshalJGF(data []byte, rootID string) (*tahwil.Value, error) {
+	var doc jgfDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	jg := doc.Graph
+	if jg == nil {
+		if len(doc.Graphs) == 0 {
+			return nil, &InvalidGraphError{Reason: "no graph"}
+		}
+		jg = &doc.Graphs[0]
+	}
+
+	g := &graph{}
+	if root, ok := jg.Metadata["root"].(string); ok {
+		g.root = root
+	}
+	var list []jgfNode
+	if nodes := bytes.TrimSpace(jg.Nodes); len(nodes) > 0 && nodes[0] == '[' {
+		if err := json.Unmarshal(nodes, &list); err != nil {
+			return nil, err
+		}
+	} else if len(nodes) > 0 && !bytes.Equal(nodes, []byte("null")) {
+		var byID map[string]jgfNode
+		if err := json.Unmarshal(nodes, &byID); err != nil {
+			return nil, err
+		}
+		for id, n := range byID {
+			n.ID = id
+			list = append(list, n)
+		}
+	}
+
+	for _, jn := range list {
+		n := &node{id: jn.ID, kinds: make(map[string]tahwil.Kind)}
+		for name, raw := range jn.Metadata {
+			switch name {
+			case attrKind:
+				var kind string
+				if err := json.Unmarshal(raw, &kind); err != nil {
+					return nil, &InvalidGraphError{Reason: "node " + strconv.Quote(jn.ID) + ": invalid " + attrKind + " attribute"}
+				}
+				n.kind = tahwil.Kind(kind)
+			case attrKinds:
+				if err := n.setKinds(raw); err != nil {
+					return nil, err
+				}
+			default:
+				value, err := jgfValue(raw)
+				if err != nil {
+					return nil, &InvalidGraphError{Reason: "node " + strconv.Quote(jn.ID) + ": attribute " + strconv.Quote(name) + ": " + err.Error()}
+				}
+				n.attrs = append(n.attrs, attr{name: name, value: value})
+			}
+		}
+		g.nodes = append(g.nodes, n)
+	}
+	for _, je := range jg.Edges {
+		label := je.Label
+		if label == "" {
+			label = je.Relation
+		}
+		g.edges = append(g.edges, edge{source: je.Source, target: je.Target, label: label})
+	}
+	return importGraph(g, rootID)
+}
+
+// jgfValue converts a metadata value to a bool, int64, uint64, float64 or
+// string. Numbers without a fraction or an exponent are integers.
+func jgfValue(raw json.RawMessage) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	switch x := value.(type) {
+	case bool, string:
+		return x, nil
+	case json.Number:
+		s := string(x)
+		if strings.ContainsAny(s, ".eE") {
+			return strconv.ParseFloat(s, 64)
+		}
+		if strings.HasPrefix(s, "-") {
+			return strconv.ParseInt(s, 10, 64)
+		}
+		u, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || u > math.MaxInt64 {
+			return u, err
+		}
+		return int64(u), nil
+	}
+	return nil, errors.New("unsupported value " + string(raw))
+}
+
+func jsonString(s string) json.RawMessage {
+	b, _ := json.Marshal(s)
+	return b
+}
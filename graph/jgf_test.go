@@ -0,0 +1,203 @@
+package graph_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+	"github.com/go-extras/tahwil/graph"
+)
+
+func TestMarshalJGF(t *testing.T) {
+	parent := &personT{Name: "Arthur"}
+	parent.Children = []*personT{{Name: "Ford", Parent: parent}}
+	v, err := tahwil.ToValue(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := graph.MarshalJGF(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "graph": {
+    "directed": true,
+    "metadata": {
+      "root": "1"
+    },
+    "nodes": {
+      "1": {
+        "label": "struct",
+        "metadata": {
+          "@kind": "struct",
+          "@kinds": {
+            "Parent": "ptr"
+          },
+          "Name": "Arthur"
+        }
+      },
+      "3": {
+        "label": "struct",
+        "metadata": {
+          "@kind": "struct",
+          "@kinds": {
+            "Children": "slice"
+          },
+          "Name": "Ford"
+        }
+      }
+    },
+    "edges": [
+      {
+        "source": "1",
+        "target": "3",
+        "label": "Children[0]"
+      },
+      {
+        "source": "3",
+        "target": "1",
+        "label": "Parent"
+      }
+    ]
+  }
+}
+`
+	if string(res) != want {
+		t.Errorf("have:\n%s\nwant:\n%s", res, want)
+	}
+}
+
+func TestJGF_RoundTrip(t *testing.T) {
+	in := newAllKinds()
+	v, err := tahwil.ToValue(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// encode from the JSON shapes as well, which can't hold infinities
+	// nor integers beyond the float64 precision
+	finite := newAllKinds()
+	finite.Inf = 0
+	finite.Uint64 = 1 << 53
+	fv, err := tahwil.ToValue(finite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := json.Marshal(fv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON := &tahwil.Value{}
+	if err = json.Unmarshal(j, fromJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in *allKindsT
+		v  *tahwil.Value
+	}{
+		{in, v},
+		{finite, fromJSON},
+	}
+	for i, test := range tests {
+		b, err := graph.MarshalJGF(test.v)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		decoded, err := graph.UnmarshalJGF(b, "")
+		if err != nil {
+			t.Fatalf("#%d: %v\n%s", i, err, b)
+		}
+		out := &allKindsT{}
+		if err = tahwil.FromValue(decoded, out); err != nil {
+			t.Fatalf("#%d: %v\n%s", i, err, b)
+		}
+		if !reflect.DeepEqual(out, test.in) {
+			t.Errorf("#%d: mismatch\nhave: %+v\nwant: %+v", i, out, test.in)
+		}
+		if out.Shared != out.Shared2 || out.Shared != out.Interior[0] {
+			t.Errorf("#%d: expected the shared pointer to be preserved", i)
+		}
+	}
+}
+
+func TestUnmarshalJGF_HandWritten(t *testing.T) {
+	// version 1 layout with named node ids and edge relations
+	data := `{"graphs": [{
+		"directed": true,
+		"nodes": [
+			{"id": "arthur", "metadata": {"@kind": "struct", "Name": "Arthur"}},
+			{"id": "ford", "metadata": {"@kind": "struct", "Name": "Ford"}},
+			{"id": "zaphod", "metadata": {"@kind": "struct", "Name": "Zaphod"}}
+		],
+		"edges": [
+			{"source": "arthur", "target": "ford", "relation": "Children[0]"},
+			{"source": "arthur", "target": "zaphod", "relation": "Children[1]"},
+			{"source": "ford", "target": "arthur", "relation": "Parent"},
+			{"source": "zaphod", "target": "arthur", "relation": "Parent"}
+		]
+	}]}`
+	v, err := graph.UnmarshalJGF([]byte(data), "arthur")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &personT{}
+	if err = tahwil.FromValue(v, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "Arthur" || len(out.Children) != 2 || out.Children[1].Name != "Zaphod" {
+		t.Errorf("unexpected result: %+v", out)
+	}
+	if out.Children[0].Parent != out || out.Children[1].Parent != out {
+		t.Error("expected the cycle to be preserved")
+	}
+}
+
+func TestJGF_NilRoot(t *testing.T) {
+	var p *personT
+	v, err := tahwil.ToValue(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := graph.MarshalJGF(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := graph.UnmarshalJGF(b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Kind != tahwil.Ptr || decoded.Value != nil {
+		t.Errorf("expected a nil pointer, got %+v", decoded)
+	}
+}
+
+func TestUnmarshalJGF_Errors(t *testing.T) {
+	tests := []string{
+		`{}`,
+		`{"graph": {"nodes": {"1": {"metadata": {"@kind": 1}}}}}`,
+		`{"graph": {"nodes": {"1": {"metadata": {"@kind": "struct", "@kinds": []}}}}}`,
+		`{"graph": {"nodes": {"1": {"metadata": {"@kind": "struct", "A": [1]}}}}}`,
+		`{"graph": {"nodes": {"1": {"metadata": {"@kind": "struct", "A": null}}}}}`,
+		`{"graph": {"nodes": {"1": {"metadata": {"@kind": "struct", "A": 1.5, "@kinds": {"A": "int"}}}}}}`,
+		`{"graph": {"nodes": {"1": {"metadata": {"@kind": "struct", "A.B": 1, "A[0]": 2}}}}}`,
+		`{"graph": {"nodes": {"1": {"metadata": {"@kind": "struct"}}}, "edges": [{"source": "1", "target": "x", "label": "A"}]}}`,
+		`{"graph": {"nodes": {"1": {"metadata": {"@kind": "struct"}}}}}`,
+	}
+	for i, data := range tests {
+		var graphErr *graph.InvalidGraphError
+		_, err := graph.UnmarshalJGF([]byte(data), "")
+		if i == len(tests)-1 {
+			_, err = graph.UnmarshalJGF([]byte(data), "2")
+		}
+		if !errors.As(err, &graphErr) {
+			t.Errorf("#%d: expected *InvalidGraphError, got %T: %v", i, err, err)
+		}
+	}
+
+	if _, err := graph.UnmarshalJGF([]byte(`{"graph": `), "1"); err == nil {
+		t.Error("expected error for malformed JSON, got nil")
+	}
+}
@@ -0,0 +1,171 @@
+package tahwil
+
+// ifaceTask converts src and stores the result into p, into m under key
+// if m is not nil, or into s at index i otherwise
+type ifaceTask struct {
+	src *Value
+	p   *any
+	m   map[string]any
+	key string
+	s   []any
+	i   int
+}
+
+// store stores x where the task says.
+func (t ifaceTask) store(x any) {
+	switch {
+	case t.p != nil:
+		*t.p = x
+	case t.m != nil:
+		t.m[t.key] = x
+	default:
+		t.s[t.i] = x
+	}
+}
+
+type ifaceBuilder struct {
+	// ptrs holds the pointers allocated per refid, by a ptr or a ref
+	ptrs map[uint64]*any
+	// filled holds the refids whose ptr has been met
+	filled map[uint64]bool
+	// nils holds the refids of the nil pointers and stubs met
+	nils map[uint64]bool
+	// refs holds the tasks that stored a ref, which become nil if the ref
+	// turns out to point to a nil pointer or a stub
+	refs  []ifaceTask
+	stack []ifaceTask
+}
+
+func (b *ifaceBuilder) ptr(refid uint64) *any {
+	p, ok := b.ptrs[refid]
+	if !ok {
+		p = new(any)
+		b.ptrs[refid] = p
+	}
+	return p
+}
+
+// convert returns the generic value of a single node. Nested nodes are
+// not converted here, they are pushed to the work stack and stored into
+// the returned containers later.
+func (b *ifaceBuilder) convert(n *Value) (any, error) {
+	if n == nil {
+		return nil, nil
+	}
+	switch n.Kind {
+	case Ptr:
+		inner, ok := n.AsPtr()
+		if !ok {
+			return nil, &InvalidValueError{Value: n.Value, Kind: n.Kind}
+		}
+		if inner == nil {
+			if n.Refid != 0 {
+				b.nils[n.Refid] = true
+			}
+			return (*any)(nil), nil
+		}
+		p := new(any)
+		if n.Refid != 0 {
+			if b.filled[n.Refid] {
+				return nil, &InvalidValueError{Value: n.Refid, Kind: n.Kind}
+			}
+			b.filled[n.Refid] = true
+			p = b.ptr(n.Refid)
+		}
+		b.stack = append(b.stack, ifaceTask{src: inner, p: p})
+		return p, nil
+	case Ref:
+		refid, ok := n.AsRef()
+		if !ok {
+			return nil, &InvalidValueError{Value: n.Value, Kind: n.Kind}
+		}
+		// the target may not have been met yet: it is filled in when it is
+		return b.ptr(refid), nil
+	case Stub:
+		if _, ok := n.Value.(string); !ok {
+			return nil, &InvalidValueError{Value: n.Value, Kind: n.Kind}
+		}
+		if n.Refid != 0 {
+			b.nils[n.Refid] = true
+		}
+		return (*any)(nil), nil
+	case Struct, Map:
+		fields, ok := n.AsFields()
+		if !ok {
+			return nil, &InvalidValueError{Value: n.Value, Kind: n.Kind}
+		}
+		if fields == nil {
+			return map[string]any(nil), nil
+		}
+		m := make(map[string]any, len(fields))
+		for k, x := range fields {
+			b.stack = append(b.stack, ifaceTask{src: x, m: m, key: k})
+		}
+		return m, nil
+	case Slice, Array:
+		elems, ok := n.AsSlice()
+		if !ok {
+			return nil, &InvalidValueError{Value: n.Value, Kind: n.Kind}
+		}
+		if elems == nil {
+			return []any(nil), nil
+		}
+		s := make([]any, len(elems))
+		for i, x := range elems {
+			b.stack = append(b.stack, ifaceTask{src: x, s: s, i: i})
+		}
+		return s, nil
+	}
+	if _, ok := tagOfKind[n.Kind]; !ok {
+		return nil, &InvalidValueKindError{Kind: n.Kind}
+	}
+	if !payloadValid(n) {
+		return nil, &InvalidValueError{Value: n.Value, Kind: n.Kind}
+	}
+	return n.Value, nil
+}
+
+// ToInterface converts a *Value tree into generic Go values, without a
+// target type: structs and maps become map[string]any, slices and arrays
+// []any, and pointers *any. Scalars keep their payload, e.g. an int64
+// for an int64 node. Every pointer target is converted once: refs become
+// the *any of the pointer they refer to, so the result has the same
+// sharing and cycles as the original graph. A nil pointer, like a stub,
+// becomes a nil *any, and so do the refs to them; older versions of
+// ToValue produced refs to nil pointers.
+//
+// The result is meant for tools that inspect graphs whose Go types they
+// don't know; it can be walked with type switches, but cyclic results
+// can't be passed to encoding/json as they are.
+func ToInterface(v *Value) (any, error) {
+	b := &ifaceBuilder{
+		ptrs:   make(map[uint64]*any),
+		filled: make(map[uint64]bool),
+		nils:   make(map[uint64]bool),
+	}
+	var res any
+	b.stack = append(b.stack, ifaceTask{src: v, p: &res})
+	for len(b.stack) > 0 {
+		t := b.stack[len(b.stack)-1]
+		b.stack = b.stack[:len(b.stack)-1]
+		x, err := b.convert(t.src)
+		if err != nil {
+			return nil, err
+		}
+		t.store(x)
+		if t.src != nil && t.src.Kind == Ref {
+			b.refs = append(b.refs, t)
+		}
+	}
+	for _, t := range b.refs {
+		if refid, _ := t.src.AsRef(); b.nils[refid] && !b.filled[refid] {
+			t.store((*any)(nil))
+		}
+	}
+	for refid := range b.ptrs {
+		if !b.filled[refid] && !b.nils[refid] {
+			return nil, &InvalidValueError{Value: refid, Kind: Ref}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,130 @@
+package tahwil_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+type ifaceNodeT struct {
+	Name     string
+	Age      int32
+	Tags     []string
+	Parent   *ifaceNodeT
+	Children []*ifaceNodeT
+	Next     *ifaceNodeT
+}
+
+func TestToInterface(t *testing.T) {
+	root := &ifaceNodeT{Name: "root", Age: 40, Tags: []string{"a"}}
+	child := &ifaceNodeT{Name: "child", Parent: root}
+	root.Children = []*ifaceNodeT{child, child}
+
+	v, err := tahwil.ToValue(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// decode from JSON, as a tool without the Go types would
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded tahwil.Value
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := tahwil.ToInterface(&decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, ok := res.(*any)
+	if !ok {
+		t.Fatalf("ToInterface() = %T, want *any", res)
+	}
+	rm := (*rp).(map[string]any)
+	if rm["Name"] != "root" || rm["Age"] != int32(40) {
+		t.Errorf("root = %v", rm)
+	}
+	if !reflect.DeepEqual(rm["Tags"], []any{"a"}) {
+		t.Errorf("Tags = %#v", rm["Tags"])
+	}
+	if p := rm["Next"].(*any); p != nil {
+		t.Errorf("Next = %v, want a nil *any", p)
+	}
+
+	children := rm["Children"].([]any)
+	if len(children) != 2 {
+		t.Fatalf("Children = %v", children)
+	}
+	// sharing and cycles are preserved
+	if children[0].(*any) != children[1].(*any) {
+		t.Errorf("shared child converted twice")
+	}
+	cm := (*children[0].(*any)).(map[string]any)
+	if cm["Parent"].(*any) != rp {
+		t.Errorf("child Parent is not the root pointer")
+	}
+}
+
+func TestToInterface_ForwardRef(t *testing.T) {
+	// the ref to the pointer 2 is met before the pointer itself
+	v := &tahwil.Value{Refid: 1, Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Slice, Value: []*tahwil.Value{
+		{Kind: tahwil.Ref, Value: uint64(2)},
+		{Refid: 2, Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.String, Value: "x"}},
+	}}}
+	res, err := tahwil.ToInterface(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := (*res.(*any)).([]any)
+	if s[0].(*any) != s[1].(*any) || *s[0].(*any) != "x" {
+		t.Errorf("ToInterface() = %#v", s)
+	}
+}
+
+func TestToInterface_Scalars(t *testing.T) {
+	res, err := tahwil.ToInterface(&tahwil.Value{Kind: tahwil.Uint8, Value: uint8(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != uint8(3) {
+		t.Errorf("ToInterface() = %#v, want uint8(3)", res)
+	}
+	if res, err = tahwil.ToInterface(nil); err != nil || res != nil {
+		t.Errorf("ToInterface(nil) = %v, %v", res, err)
+	}
+}
+
+func TestToInterface_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		v    *tahwil.Value
+		want error
+	}{
+		{"unknown ref", &tahwil.Value{Kind: tahwil.Ref, Value: uint64(3)}, &tahwil.InvalidValueError{Value: uint64(3), Kind: tahwil.Ref}},
+		{"unknown kind", &tahwil.Value{Kind: "complex64", Value: 1}, &tahwil.InvalidValueKindError{Kind: "complex64"}},
+		{"invalid payload", &tahwil.Value{Kind: tahwil.Int, Value: "1"}, &tahwil.InvalidValueError{Value: "1", Kind: tahwil.Int}},
+		{"invalid slice", &tahwil.Value{Kind: tahwil.Slice, Value: 1}, &tahwil.InvalidValueError{Value: 1, Kind: tahwil.Slice}},
+		{"duplicate refid", &tahwil.Value{Kind: tahwil.Slice, Value: []*tahwil.Value{
+			{Refid: 2, Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Bool, Value: true}},
+			{Refid: 2, Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Bool, Value: true}},
+		}}, &tahwil.InvalidValueError{Value: uint64(2), Kind: tahwil.Ptr}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tahwil.ToInterface(tt.v)
+			if err == nil || !reflect.DeepEqual(err, tt.want) {
+				t.Errorf("ToInterface() error = %v, want %v", err, tt.want)
+			}
+			var ve *tahwil.InvalidValueError
+			var ke *tahwil.InvalidValueKindError
+			if !errors.As(err, &ve) && !errors.As(err, &ke) {
+				t.Errorf("ToInterface() error has type %T", err)
+			}
+		})
+	}
+}
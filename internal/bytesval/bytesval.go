@@ -0,0 +1,27 @@
+// Package bytesval recognises the slices and arrays of *tahwil.Value trees
+// that hold raw bytes, so that the binary format sub-packages can store
+// them in a compact form.
+package bytesval
+
+import "github.com/go-extras/tahwil"
+
+// Of returns the contents of a non-empty list of uint8 values without
+// refids. It reports false for any other list, whose elements have to be
+// encoded one by one.
+func Of(elems []*tahwil.Value) ([]byte, bool) {
+	if len(elems) == 0 {
+		return nil, false
+	}
+	res := make([]byte, len(elems))
+	for i, el := range elems {
+		if el == nil || el.Kind != tahwil.Uint8 || el.Refid != 0 {
+			return nil, false
+		}
+		b, ok := el.Value.(uint8)
+		if !ok {
+			return nil, false
+		}
+		res[i] = b
+	}
+	return res, true
+}
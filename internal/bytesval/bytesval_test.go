@@ -0,0 +1,31 @@
+package bytesval_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+	"github.com/go-extras/tahwil/internal/bytesval"
+)
+
+func TestOf(t *testing.T) {
+	u8 := func(b uint8) *tahwil.Value { return &tahwil.Value{Kind: tahwil.Uint8, Value: b} }
+	b, ok := bytesval.Of([]*tahwil.Value{u8(0), u8(1), u8(255)})
+	if !ok || !bytes.Equal(b, []byte{0, 1, 255}) {
+		t.Errorf("Of() = %v, %v, want [0 1 255], true", b, ok)
+	}
+
+	tests := [][]*tahwil.Value{
+		nil,
+		{},
+		{u8(1), nil},
+		{u8(1), {Kind: tahwil.Int8, Value: int8(1)}},
+		{u8(1), {Kind: tahwil.Uint8, Value: 1}},
+		{u8(1), {Refid: 2, Kind: tahwil.Uint8, Value: uint8(1)}},
+	}
+	for i, elems := range tests {
+		if b, ok := bytesval.Of(elems); ok {
+			t.Errorf("#%d: Of() = %v, true, want false", i, b)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// Package fieldtag resolves the keys struct fields have in *tahwil.Value
+// trees, so that the root package and the format sub-packages agree on
+// them.
+package fieldtag
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Key returns the key of the struct field f: the name in its json tag, or
+// the field name if the tag has none. It reports false for embedded
+// fields, whose fields are promoted instead, and for fields tagged "-" or
+// "_", which are left out. Whether unexported fields are included is up
+// to the caller.
+func Key(f reflect.StructField) (string, bool) {
+	if f.Anonymous {
+		return "", false
+	}
+	k := f.Tag.Get("json")
+	if k != "" {
+		k, _, _ = strings.Cut(k, ",")
+	}
+	if k == "" {
+		k = f.Name
+	}
+	if k == "-" || k == "_" {
+		return "", false
+	}
+	return k, true
+}
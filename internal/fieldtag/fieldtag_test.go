@@ -0,0 +1,46 @@
+package fieldtag_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-extras/tahwil/internal/fieldtag"
+)
+
+type embeddedT struct{}
+
+type keysT struct {
+	embeddedT
+	Plain    string
+	Tagged   string `json:"tagged"`
+	Options  string `json:",omitempty"`
+	Both     string `json:"both,omitempty"`
+	Skipped  string `json:"-"`
+	Blank    string `json:"_"`
+	internal string
+}
+
+func TestKey(t *testing.T) {
+	want := map[string]struct {
+		key string
+		ok  bool
+	}{
+		"embeddedT": {"", false},
+		"Plain":     {"Plain", true},
+		"Tagged":    {"tagged", true},
+		"Options":   {"Options", true},
+		"Both":      {"both", true},
+		"Skipped":   {"", false},
+		"Blank":     {"", false},
+		"internal":  {"internal", true},
+	}
+	rt := reflect.TypeOf(keysT{})
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		k, ok := fieldtag.Key(f)
+		if w := want[f.Name]; k != w.key || ok != w.ok {
+			t.Errorf("Key(%s) = %q, %v, want %q, %v", f.Name, k, ok, w.key, w.ok)
+		}
+	}
+	_ = keysT{}.internal
+}
@@ -0,0 +1,23 @@
+// Package nesting limits the nesting depth of the recursive decoders of
+// the format sub-packages, so that deeply nested input is reported as an
+// error instead of exhausting the goroutine stack.
+package nesting
+
+// MaxDepth is the maximum nesting depth of a decoded document. It is the
+// limit of encoding/json, which tahwil JSON documents are decoded with.
+const MaxDepth = 10000
+
+// Depth is the nesting depth of a decoder.
+type Depth int
+
+// Enter enters a nested value and reports whether the depth is still
+// within MaxDepth. Every call must be matched by a call to Leave.
+func (d *Depth) Enter() bool {
+	*d++
+	return *d <= MaxDepth
+}
+
+// Leave leaves the value entered last.
+func (d *Depth) Leave() {
+	*d--
+}
@@ -0,0 +1,24 @@
+package nesting_test
+
+import (
+	"testing"
+
+	"github.com/go-extras/tahwil/internal/nesting"
+)
+
+func TestDepth(t *testing.T) {
+	var d nesting.Depth
+	for i := 1; i <= nesting.MaxDepth; i++ {
+		if !d.Enter() {
+			t.Fatalf("Enter() = false at depth %d", i)
+		}
+	}
+	if d.Enter() {
+		t.Error("Enter() = true beyond MaxDepth")
+	}
+	d.Leave()
+	d.Leave()
+	if !d.Enter() {
+		t.Error("Enter() = false after Leave()")
+	}
+}
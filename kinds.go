@@ -29,4 +29,35 @@ const (
 	Array  Kind = "array"
 	Map    Kind = "map"
 	Ptr    Kind = "ptr"
+
+	// Func holds the name a func is registered under in a FuncRegistry,
+	// or nil for a nil or skipped func.
+	Func Kind = "func"
+	// Chan is a placeholder for a skipped chan, its value is always nil.
+	Chan Kind = "chan"
+	// Stub replaces a pointer left out by Options.MaxDepth. It holds the
+	// name of the type the pointer points to, and has the refid of the
+	// pointer, which the refs to the pointer refer to.
+	Stub Kind = "stub"
 )
+
+// kindTags lists the one-byte tags of the kinds in the binary encoding
+// (see Value.MarshalBinary); the tag of a kind is its index. Tags are
+// part of the wire format: never reorder this list, only append to it.
+var kindTags = [...]Kind{
+	Ref, Bool,
+	Int, Int8, Int16, Int32, Int64,
+	Uint, Uint8, Uint16, Uint32, Uint64,
+	Float32, Float64,
+	String, Struct, Slice, Array, Map, Ptr,
+	Func, Chan, Stub,
+}
+
+// tagOfKind is the reverse of kindTags.
+var tagOfKind = func() map[Kind]byte {
+	res := make(map[Kind]byte, len(kindTags))
+	for i, k := range kindTags {
+		res[k] = byte(i)
+	}
+	return res
+}()
@@ -0,0 +1,680 @@
+// Package msgpack encodes and decodes *tahwil.Value trees using
+// MessagePack (https://msgpack.org).
+//
+// Every Value is stored as an array [kind, value] or, when it has a
+// non-zero refid, [kind, value, refid]. Kinds are stored as strings, so
+// the exact Go kind of every scalar survives the round trip. Integers
+// use the native MessagePack integer encodings, and slices or arrays of
+// uint8 values without refids (such as []byte) are stored as binary.
+// Func and stub nodes store their name as a string, and chan nodes nil.
+//
+// Decoding produces the same payload types as tahwil.ToValue:
+// map[string]*tahwil.Value for structs and maps, []*tahwil.Value for
+// slices and arrays, and the exact Go scalar type for every scalar kind.
+package msgpack
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/go-extras/tahwil"
+	"github.com/go-extras/tahwil/internal/bytesval"
+	"github.com/go-extras/tahwil/internal/nesting"
+)
+
+// A SyntaxError describes malformed MessagePack input.
+type SyntaxError struct {
+	Offset int
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return "msgpack: " + e.msg + " at offset " + strconv.Itoa(e.Offset)
+}
+
+// Marshal returns the MessagePack encoding of v. A *tahwil.Value is
+// encoded as the tree it holds, like MarshalValue does.
+func Marshal(v any) ([]byte, error) {
+	if val, ok := v.(*tahwil.Value); ok {
+		return MarshalValue(val)
+	}
+	val, err := tahwil.ToValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return MarshalValue(val)
+}
+
+// MarshalValue returns the MessagePack encoding of a *tahwil.Value tree,
+// such as one produced by tahwil.ToValue or decoded from tahwil JSON.
+func MarshalValue(v *tahwil.Value) ([]byte, error) {
+	e := &encoder{}
+	if err := e.encodeValue(v); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+// Unmarshal parses MessagePack data produced by Marshal and stores the
+// result in the value pointed to by v. If v is a *tahwil.Value, the
+// tree itself is stored in it. A nil input leaves v unchanged.
+func Unmarshal(data []byte, v any) error {
+	val, err := UnmarshalValue(data, nil)
+	if err != nil || val == nil {
+		return err
+	}
+	if tv, ok := v.(*tahwil.Value); ok && tv != nil {
+		*tv = *val
+		return nil
+	}
+	return tahwil.FromValue(val, v)
+}
+
+// UnmarshalValue parses MessagePack data produced by MarshalValue into a
+// *tahwil.Value tree; a nil input gives a nil tree. The kind of every
+// node is part of the encoding, so t, the destination type taken by
+// UnmarshalValue in every format package, is not needed and may be nil.
+func UnmarshalValue(data []byte, t reflect.Type) (*tahwil.Value, error) {
+	d := &decoder{data: data}
+	if d.peekNil() {
+		return nil, nil
+	}
+	v := &tahwil.Value{}
+	if err := d.decodeValue(v); err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, d.errorf("unexpected trailing data")
+	}
+	return v, nil
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) writeNil() {
+	e.buf = append(e.buf, 0xc0)
+}
+
+func (e *encoder) writeBool(b bool) {
+	if b {
+		e.buf = append(e.buf, 0xc3)
+	} else {
+		e.buf = append(e.buf, 0xc2)
+	}
+}
+
+func (e *encoder) writeUint(u uint64) {
+	switch {
+	case u <= 0x7f:
+		e.buf = append(e.buf, byte(u))
+	case u <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xce), uint32(u))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xcf), u)
+	}
+}
+
+func (e *encoder) writeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.writeUint(uint64(i))
+	case i >= -32:
+		e.buf = append(e.buf, byte(i))
+	case i >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xd2), uint32(i))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xd3), uint64(i))
+	}
+}
+
+// writeHeader writes a length header using the fix, 8 (if code8 != 0),
+// 16 and 32 bit variants of a type.
+func (e *encoder) writeHeader(n int, fix byte, fixMax int, code8, code16, code32 byte) {
+	switch {
+	case n <= fixMax:
+		e.buf = append(e.buf, fix|byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		e.buf = append(e.buf, code8, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, code16), uint16(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, code32), uint32(n)) //nolint:gosec // limited by memory
+	}
+}
+
+func (e *encoder) writeString(s string) {
+	e.writeHeader(len(s), 0xa0, 31, 0xd9, 0xda, 0xdb)
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) writeBinary(b []byte) {
+	switch {
+	case len(b) <= math.MaxUint8:
+		e.buf = append(e.buf, 0xc4, byte(len(b)))
+	case len(b) <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xc5), uint16(len(b)))
+	default:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xc6), uint32(len(b))) //nolint:gosec // limited by memory
+	}
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) writeArrayHeader(n int) {
+	e.writeHeader(n, 0x90, 15, 0, 0xdc, 0xdd)
+}
+
+func (e *encoder) writeMapHeader(n int) {
+	e.writeHeader(n, 0x80, 15, 0, 0xde, 0xdf)
+}
+
+func (e *encoder) encodeValue(v *tahwil.Value) error {
+	if v == nil {
+		e.writeNil()
+		return nil
+	}
+	if v.Refid != 0 {
+		e.writeArrayHeader(3)
+	} else {
+		e.writeArrayHeader(2)
+	}
+	e.writeString(string(v.Kind))
+	if err := e.encodePayload(v); err != nil {
+		return err
+	}
+	if v.Refid != 0 {
+		e.writeUint(v.Refid)
+	}
+	return nil
+}
+
+func (e *encoder) encodePayload(v *tahwil.Value) error {
+	if v.Value == nil {
+		e.writeNil()
+		return nil
+	}
+	switch v.Kind {
+	case tahwil.Ptr:
+		inner, ok := v.AsPtr()
+		if !ok {
+			return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		return e.encodeValue(inner)
+	case tahwil.Struct, tahwil.Map:
+		return e.encodeFields(v)
+	case tahwil.Slice, tahwil.Array:
+		return e.encodeElems(v)
+	case tahwil.String, tahwil.Func, tahwil.Stub:
+		s, ok := v.Value.(string)
+		if !ok {
+			return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		e.writeString(s)
+		return nil
+	case tahwil.Chan:
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	case tahwil.Bool:
+		b, ok := v.Value.(bool)
+		if !ok {
+			return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		e.writeBool(b)
+		return nil
+	case tahwil.Int, tahwil.Int8, tahwil.Int16, tahwil.Int32, tahwil.Int64,
+		tahwil.Uint, tahwil.Uint8, tahwil.Uint16, tahwil.Uint32, tahwil.Uint64,
+		tahwil.Float32, tahwil.Float64, tahwil.Ref:
+		return e.encodeNumber(v)
+	}
+	return &tahwil.InvalidValueKindError{Kind: v.Kind}
+}
+
+func (e *encoder) encodeNumber(v *tahwil.Value) error {
+	rv := reflect.ValueOf(v.Value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		e.writeUint(rv.Uint())
+	case reflect.Float32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xca), math.Float32bits(float32(rv.Float())))
+	case reflect.Float64:
+		if v.Kind == tahwil.Float32 {
+			e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xca), math.Float32bits(float32(rv.Float())))
+		} else {
+			e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xcb), math.Float64bits(rv.Float()))
+		}
+	default:
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	return nil
+}
+
+func (e *encoder) encodeFields(v *tahwil.Value) error {
+	fields, ok := v.AsFields()
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	e.writeMapHeader(len(keys))
+	for _, k := range keys {
+		e.writeString(k)
+		if err := e.encodeValue(fields[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) encodeElems(v *tahwil.Value) error {
+	elems, ok := v.AsSlice()
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	if b, ok := bytesval.Of(elems); ok {
+		e.writeBinary(b)
+		return nil
+	}
+	e.writeArrayHeader(len(elems))
+	for _, el := range elems {
+		if err := e.encodeValue(el); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type decoder struct {
+	data  []byte
+	pos   int
+	depth nesting.Depth
+}
+
+func (d *decoder) errorf(msg string) error {
+	return &SyntaxError{Offset: d.pos, msg: msg}
+}
+
+func (d *decoder) peekNil() bool {
+	return d.pos < len(d.data) && d.data[d.pos] == 0xc0
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, d.errorf("unexpected end of input")
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) readByte() (byte, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readLength reads a big-endian length of size bytes.
+func (d *decoder) readLength(size int) (int, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	if n > uint64(len(d.data)) {
+		// every element takes at least one byte
+		return 0, d.errorf("length out of range")
+	}
+	return int(n), nil
+}
+
+func (d *decoder) readArrayHeader() (int, error) {
+	c, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case c&0xf0 == 0x90:
+		return int(c & 0x0f), nil
+	case c == 0xdc:
+		return d.readLength(2)
+	case c == 0xdd:
+		return d.readLength(4)
+	}
+	d.pos--
+	return 0, d.errorf("expected array")
+}
+
+func (d *decoder) readMapHeader() (int, error) {
+	c, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case c&0xf0 == 0x80:
+		return int(c & 0x0f), nil
+	case c == 0xde:
+		return d.readLength(2)
+	case c == 0xdf:
+		return d.readLength(4)
+	}
+	d.pos--
+	return 0, d.errorf("expected map")
+}
+
+func (d *decoder) readString() (string, error) {
+	c, err := d.readByte()
+	if err != nil {
+		return "", err
+	}
+	var n int
+	switch {
+	case c&0xe0 == 0xa0:
+		n = int(c & 0x1f)
+	case c == 0xd9:
+		n, err = d.readLength(1)
+	case c == 0xda:
+		n, err = d.readLength(2)
+	case c == 0xdb:
+		n, err = d.readLength(4)
+	default:
+		d.pos--
+		return "", d.errorf("expected string")
+	}
+	if err != nil {
+		return "", err
+	}
+	b, err := d.next(n)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readNumber reads any MessagePack integer or float. Exactly one of the
+// results is meaningful, as indicated by kind.
+func (d *decoder) readNumber() (i int64, u uint64, f float64, kind reflect.Kind, err error) {
+	c, err := d.readByte()
+	if err != nil {
+		return 0, 0, 0, reflect.Invalid, err
+	}
+	switch {
+	case c <= 0x7f:
+		return 0, uint64(c), 0, reflect.Uint64, nil
+	case c >= 0xe0:
+		return int64(int8(c)), 0, 0, reflect.Int64, nil
+	}
+	var size int
+	switch c {
+	case 0xcc, 0xd0:
+		size = 1
+	case 0xcd, 0xd1:
+		size = 2
+	case 0xce, 0xd2, 0xca:
+		size = 4
+	case 0xcf, 0xd3, 0xcb:
+		size = 8
+	default:
+		d.pos--
+		return 0, 0, 0, reflect.Invalid, d.errorf("expected number")
+	}
+	b, err := d.next(size)
+	if err != nil {
+		return 0, 0, 0, reflect.Invalid, err
+	}
+	var raw uint64
+	for _, x := range b {
+		raw = raw<<8 | uint64(x)
+	}
+	switch c {
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return 0, raw, 0, reflect.Uint64, nil
+	case 0xd0:
+		return int64(int8(raw)), 0, 0, reflect.Int64, nil //nolint:gosec // sign extension
+	case 0xd1:
+		return int64(int16(raw)), 0, 0, reflect.Int64, nil //nolint:gosec // sign extension
+	case 0xd2:
+		return int64(int32(raw)), 0, 0, reflect.Int64, nil //nolint:gosec // sign extension
+	case 0xd3:
+		return int64(raw), 0, 0, reflect.Int64, nil //nolint:gosec // sign extension
+	case 0xca:
+		return 0, 0, float64(math.Float32frombits(uint32(raw))), reflect.Float64, nil
+	default:
+		return 0, 0, math.Float64frombits(raw), reflect.Float64, nil
+	}
+}
+
+func (d *decoder) decodeValue(v *tahwil.Value) error {
+	defer d.depth.Leave()
+	if !d.depth.Enter() {
+		return d.errorf("exceeded max depth")
+	}
+	n, err := d.readArrayHeader()
+	if err != nil {
+		return err
+	}
+	if n != 2 && n != 3 {
+		return d.errorf("expected value array of 2 or 3 elements")
+	}
+	kind, err := d.readString()
+	if err != nil {
+		return err
+	}
+	v.Kind = tahwil.Kind(kind)
+	if d.peekNil() {
+		d.pos++
+		v.Value = nil
+	} else if v.Value, err = d.decodePayload(v.Kind); err != nil {
+		return err
+	}
+	if n == 3 {
+		_, u, _, k, err := d.readNumber()
+		if err != nil {
+			return err
+		}
+		if k != reflect.Uint64 {
+			return d.errorf("expected refid")
+		}
+		v.Refid = u
+	}
+	return nil
+}
+
+func (d *decoder) decodePayload(kind tahwil.Kind) (any, error) {
+	switch kind {
+	case tahwil.Ptr:
+		inner := &tahwil.Value{}
+		if err := d.decodeValue(inner); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	case tahwil.Struct, tahwil.Map:
+		return d.decodeFields()
+	case tahwil.Slice, tahwil.Array:
+		return d.decodeElems()
+	case tahwil.String, tahwil.Func, tahwil.Stub:
+		return d.readString()
+	case tahwil.Chan:
+		return nil, d.errorf("unexpected chan value")
+	case tahwil.Bool:
+		c, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if c != 0xc2 && c != 0xc3 {
+			d.pos--
+			return nil, d.errorf("expected bool")
+		}
+		return c == 0xc3, nil
+	case tahwil.Int, tahwil.Int8, tahwil.Int16, tahwil.Int32, tahwil.Int64,
+		tahwil.Uint, tahwil.Uint8, tahwil.Uint16, tahwil.Uint32, tahwil.Uint64,
+		tahwil.Float32, tahwil.Float64, tahwil.Ref:
+		return d.decodeNumber(kind)
+	}
+	return nil, &tahwil.InvalidValueKindError{Kind: kind}
+}
+
+func (d *decoder) decodeFields() (map[string]*tahwil.Value, error) {
+	n, err := d.readMapHeader()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]*tahwil.Value, n)
+	for i := 0; i < n; i++ {
+		k, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if d.peekNil() {
+			d.pos++
+			res[k] = nil
+			continue
+		}
+		x := &tahwil.Value{}
+		if err = d.decodeValue(x); err != nil {
+			return nil, err
+		}
+		res[k] = x
+	}
+	return res, nil
+}
+
+func (d *decoder) decodeElems() ([]*tahwil.Value, error) {
+	c, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	d.pos--
+	if c == 0xc4 || c == 0xc5 || c == 0xc6 {
+		return d.decodeBinary()
+	}
+
+	n, err := d.readArrayHeader()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*tahwil.Value, n)
+	for i := range res {
+		if d.peekNil() {
+			d.pos++
+			continue
+		}
+		res[i] = &tahwil.Value{}
+		if err = d.decodeValue(res[i]); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (d *decoder) decodeBinary() ([]*tahwil.Value, error) {
+	c, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	// bin8, bin16 and bin32 have 1, 2 and 4 byte lengths
+	n, err := d.readLength(1 << (c - 0xc4))
+	if err != nil {
+		return nil, err
+	}
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*tahwil.Value, n)
+	values := make([]tahwil.Value, n)
+	for i, x := range b {
+		values[i] = tahwil.Value{Kind: tahwil.Uint8, Value: x}
+		res[i] = &values[i]
+	}
+	return res, nil
+}
+
+// decodeNumber reads a number and converts it to the exact Go type of kind.
+//
+//nolint:gocyclo // one case per kind
+func (d *decoder) decodeNumber(kind tahwil.Kind) (any, error) {
+	start := d.pos
+	i, u, f, k, err := d.readNumber()
+	if err != nil {
+		return nil, err
+	}
+	if k == reflect.Float64 && kind != tahwil.Float32 && kind != tahwil.Float64 {
+		d.pos = start
+		return nil, d.errorf("expected integer")
+	}
+	if k == reflect.Uint64 {
+		if u > math.MaxInt64 {
+			i = -1 // doesn't fit any signed kind
+		} else {
+			i = int64(u)
+		}
+	} else if k == reflect.Int64 && i >= 0 {
+		u = uint64(i)
+	}
+	signed := k == reflect.Int64 || (k == reflect.Uint64 && i >= 0)
+	unsigned := k == reflect.Uint64 || (k == reflect.Int64 && i >= 0)
+
+	var res any
+	ok := true
+	switch kind {
+	case tahwil.Int:
+		res, ok = int(i), signed && int64(int(i)) == i
+	case tahwil.Int8:
+		res, ok = int8(i), signed && int64(int8(i)) == i
+	case tahwil.Int16:
+		res, ok = int16(i), signed && int64(int16(i)) == i
+	case tahwil.Int32:
+		res, ok = int32(i), signed && int64(int32(i)) == i
+	case tahwil.Int64:
+		res, ok = i, signed
+	case tahwil.Uint:
+		res, ok = uint(u), unsigned && uint64(uint(u)) == u
+	case tahwil.Uint8:
+		res, ok = uint8(u), unsigned && uint64(uint8(u)) == u
+	case tahwil.Uint16:
+		res, ok = uint16(u), unsigned && uint64(uint16(u)) == u
+	case tahwil.Uint32:
+		res, ok = uint32(u), unsigned && uint64(uint32(u)) == u
+	case tahwil.Uint64, tahwil.Ref:
+		res, ok = u, unsigned
+	case tahwil.Float32:
+		res = float32(numberAsFloat(i, u, f, k))
+	case tahwil.Float64:
+		res = numberAsFloat(i, u, f, k)
+	}
+	if !ok {
+		d.pos = start
+		return nil, d.errorf("number out of range for " + string(kind))
+	}
+	return res, nil
+}
+
+func numberAsFloat(i int64, u uint64, f float64, k reflect.Kind) float64 {
+	switch k {
+	case reflect.Int64:
+		return float64(i)
+	case reflect.Uint64:
+		return float64(u)
+	}
+	return f
+}
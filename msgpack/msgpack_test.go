@@ -0,0 +1,351 @@
+package msgpack_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+	"github.com/go-extras/tahwil/internal/nesting"
+	"github.com/go-extras/tahwil/msgpack"
+)
+
+type personT struct {
+	Name     string
+	Parent   *personT
+	Children []*personT
+}
+
+type hooksT struct {
+	Name string
+	Fn   func(string) string
+	Nil  func(string) string
+	Done chan struct{}
+	Next *hooksT
+}
+
+type allKindsT struct {
+	Bool    bool
+	Int     int
+	Int8    int8
+	Int16   int16
+	Int32   int32
+	Int64   int64
+	Uint    uint
+	Uint8   uint8
+	Uint16  uint16
+	Uint32  uint32
+	Uint64  uint64
+	Float32 float32
+	Float64 float64
+	String  string
+	Bytes   []byte
+	Array   [2]int16
+	Map     map[string]int
+	Pointer *string
+}
+
+func TestMarshal(t *testing.T) {
+	v := &tahwil.Value{
+		Refid: 1,
+		Kind:  tahwil.Ptr,
+		Value: &tahwil.Value{Kind: tahwil.Int8, Value: int8(-1)},
+	}
+	res, err := msgpack.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// [ "ptr", [ "int8", -1 ], 1 ]
+	want := []byte{0x93, 0xa3, 'p', 't', 'r', 0x92, 0xa4, 'i', 'n', 't', '8', 0xff, 0x01}
+	if !bytes.Equal(res, want) {
+		t.Errorf("have % x\nwant % x", res, want)
+	}
+}
+
+func TestMarshal_Binary(t *testing.T) {
+	v, err := tahwil.ToValue([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := msgpack.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(res, []byte{0xc4, 0x03, 'a', 'b', 'c'}) {
+		t.Errorf("expected []byte to be stored as bin8, got % x", res)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	s := "pointer"
+	in := &allKindsT{
+		Bool: true, Int: -1 << 40, Int8: -100, Int16: -30000, Int32: -1 << 30, Int64: -1 << 62,
+		Uint: 1 << 40, Uint8: 200, Uint16: 60000, Uint32: 1 << 31, Uint64: 1<<64 - 1,
+		Float32: 1.5, Float64: -2.25, String: "string", Bytes: []byte{0, 1, 255},
+		Array: [2]int16{-1, 1}, Map: map[string]int{"a": 1}, Pointer: &s,
+	}
+	v, err := tahwil.ToValue(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := msgpack.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := msgpack.UnmarshalValue(b, reflect.TypeOf(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, v) {
+		x, _ := json.Marshal(decoded)
+		y, _ := json.Marshal(v)
+		t.Errorf("mismatch\nhave: %s\nwant: %s", x, y)
+	}
+
+	out := &allKindsT{}
+	if err = tahwil.FromValue(decoded, out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("mismatch\nhave: %+v\nwant: %+v", out, in)
+	}
+}
+
+func TestRoundTrip_Struct(t *testing.T) {
+	parent := &personT{Name: "Arthur"}
+	parent.Children = []*personT{{Name: "Ford", Parent: parent}}
+	b, err := msgpack.Marshal(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &personT{}
+	if err = msgpack.Unmarshal(b, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "Arthur" || len(out.Children) != 1 || out.Children[0].Name != "Ford" || out.Children[0].Parent != out {
+		t.Errorf("unexpected result: %+v", out)
+	}
+}
+
+func TestRoundTrip_ValueTree(t *testing.T) {
+	// a *tahwil.Value passed to Marshal and Unmarshal is the tree itself,
+	// not a Go struct to encode
+	v, err := tahwil.ToValue(&personT{Name: "Arthur"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := msgpack.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := msgpack.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("have %x, want %x", b, want)
+	}
+	decoded := &tahwil.Value{}
+	if err = msgpack.Unmarshal(b, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, v) {
+		t.Errorf("mismatch\nhave: %+v\nwant: %+v", decoded, v)
+	}
+}
+
+func TestRoundTrip_Cycle(t *testing.T) {
+	parent := &personT{Name: "Arthur"}
+	parent.Children = []*personT{{Name: "Ford", Parent: parent}}
+	v, err := tahwil.ToValueCompat(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := msgpack.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := msgpack.UnmarshalValue(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, v) {
+		x, _ := json.Marshal(decoded)
+		y, _ := json.Marshal(v)
+		t.Errorf("mismatch\nhave: %s\nwant: %s", x, y)
+	}
+
+	out := &personT{}
+	if err = tahwil.FromValue(decoded, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Children[0].Parent != out {
+		t.Error("expected the cycle to be preserved")
+	}
+}
+
+func TestRoundTrip_FuncsAndStubs(t *testing.T) {
+	funcs := tahwil.NewFuncRegistry()
+	if err := funcs.Register("upper", strings.ToUpper); err != nil {
+		t.Fatal(err)
+	}
+	fetched := &hooksT{Name: "fetched"}
+	opts := &tahwil.Options{
+		Funcs:         funcs,
+		FuncsAndChans: tahwil.FuncChanNull,
+		MaxDepth:      2,
+		FetchStub: func(refid uint64, typeName string) (any, error) {
+			return fetched, nil
+		},
+	}
+	in := &hooksT{Name: "a", Fn: strings.ToUpper, Done: make(chan struct{}), Next: &hooksT{Name: "b", Next: &hooksT{Name: "c"}}}
+	v, err := tahwil.ToValueWithOptions(in, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := msgpack.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := msgpack.UnmarshalValue(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, v) {
+		x, _ := json.Marshal(decoded)
+		y, _ := json.Marshal(v)
+		t.Errorf("mismatch\nhave: %s\nwant: %s", x, y)
+	}
+
+	out := &hooksT{}
+	if err = tahwil.FromValueWithOptions(decoded, out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if out.Fn == nil || out.Fn("x") != "X" || out.Nil != nil || out.Done != nil || out.Next.Next != fetched {
+		t.Errorf("unexpected result: %+v", out)
+	}
+}
+
+func TestMarshal_FromJSON(t *testing.T) {
+	parent := &personT{Name: "Arthur"}
+	parent.Children = []*personT{{Name: "Ford", Parent: parent}}
+	v, err := tahwil.ToValue(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON := &tahwil.Value{}
+	if err = json.Unmarshal(j, fromJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := msgpack.MarshalValue(fromJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := msgpack.UnmarshalValue(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &personT{}
+	if err = tahwil.FromValue(decoded, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "Arthur" || out.Children[0].Name != "Ford" || out.Children[0].Parent != out {
+		t.Errorf("unexpected result: %+v", out)
+	}
+}
+
+func TestUnmarshal_Null(t *testing.T) {
+	v, err := msgpack.UnmarshalValue([]byte{0xc0}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != nil {
+		t.Errorf("expected a nil tree, got %+v", v)
+	}
+
+	out := &personT{Name: "kept"}
+	if err = msgpack.Unmarshal([]byte{0xc0}, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "kept" {
+		t.Errorf("expected nil input to be ignored, got %+v", out)
+	}
+}
+
+func TestUnmarshal_Errors(t *testing.T) {
+	tests := [][]byte{
+		{},
+		{0x92, 0xa4, 'i', 'n', 't', '8'}, // truncated
+		{0x92, 0xa4, 'i', 'n', 't', '8', 0xcc, 0xff},              // out of range
+		{0x92, 0xa4, 'i', 'n', 't', '8', 0x01, 0x00},              // trailing data
+		{0x92, 0xa4, 'b', 'o', 'o', 'l', 0x01},                    // not a bool
+		{0x94, 0xa3, 'i', 'n', 't', 0x01, 0x01, 0x01},             // wrong arity
+		{0x92, 0xa3, 'i', 'n', 't', 0xcb, 0, 0, 0, 0, 0, 0, 0, 0}, // float for int
+		{0x92, 0xa4, 'c', 'h', 'a', 'n', 0xa1, 'x'},               // non-nil chan
+	}
+	for i, data := range tests {
+		var syntaxErr *msgpack.SyntaxError
+		_, err := msgpack.UnmarshalValue(data, nil)
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("#%d: expected *SyntaxError, got %T: %v", i, err, err)
+		}
+	}
+
+	var kindErr *tahwil.InvalidValueKindError
+	_, err := msgpack.UnmarshalValue([]byte{0x92, 0xa3, 'f', 'o', 'o', 0x01}, nil)
+	if !errors.As(err, &kindErr) {
+		t.Errorf("expected *InvalidValueKindError, got %T: %v", err, err)
+	}
+}
+
+func TestMarshal_Errors(t *testing.T) {
+	tests := []*tahwil.Value{
+		{Kind: "foo", Value: 1},
+		{Kind: tahwil.String, Value: 1},
+		{Kind: tahwil.Int, Value: "1"},
+		{Kind: tahwil.Ptr, Value: "x"},
+		{Kind: tahwil.Struct, Value: []int{}},
+		{Kind: tahwil.Func, Value: 1},
+		{Kind: tahwil.Chan, Value: "x"},
+	}
+	for i, v := range tests {
+		if _, err := msgpack.MarshalValue(v); err == nil {
+			t.Errorf("#%d: expected error, got nil", i)
+		}
+	}
+}
+
+// nested returns depth slices nested in each other.
+func nested(depth int) *tahwil.Value {
+	v := &tahwil.Value{Kind: tahwil.Slice, Value: []*tahwil.Value{}}
+	for i := 1; i < depth; i++ {
+		v = &tahwil.Value{Kind: tahwil.Slice, Value: []*tahwil.Value{v}}
+	}
+	return v
+}
+
+func TestUnmarshal_MaxDepth(t *testing.T) {
+	b, err := msgpack.MarshalValue(nested(nesting.MaxDepth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = msgpack.UnmarshalValue(b, nil); err != nil {
+		t.Errorf("UnmarshalValue() at max depth = %v", err)
+	}
+
+	if b, err = msgpack.MarshalValue(nested(nesting.MaxDepth + 1)); err != nil {
+		t.Fatal(err)
+	}
+	var syntaxErr *msgpack.SyntaxError
+	if _, err = msgpack.UnmarshalValue(b, nil); !errors.As(err, &syntaxErr) {
+		t.Errorf("expected *SyntaxError, got %T: %v", err, err)
+	}
+}
@@ -0,0 +1,118 @@
+package tahwil
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// Options configures ToValueWithOptions and FromValueWithOptions. A nil
+// *Options uses the defaults, which are the behavior of ToValue and
+// FromValue.
+type Options struct {
+	// Unexported includes the unexported struct fields, which are read
+	// and written through unsafe-backed reflection. Single fields can be
+	// included without it by tagging them `tahwil:"include"`. Fields
+	// that can't be meaningfully copied are left out either way: chans,
+	// funcs, unsafe pointers and the types of package sync (Mutex,
+	// RWMutex, WaitGroup, ...) or pointers to them; the unexported state
+	// of the sync types is never included, so e.g. an exported Mutex is
+	// always decoded unlocked.
+	Unexported bool
+	// Funcs encodes the funcs registered in it by their names, and
+	// decodes the names back to the funcs.
+	Funcs *FuncRegistry
+	// FuncsAndChans selects how the other funcs and the chans are
+	// encoded; by default they are an error.
+	FuncsAndChans FuncChanMode
+	// Progress, if set, is called with the number of nodes processed so
+	// far every 1024 nodes, and with the total once done.
+	Progress func(Progress)
+	// Exclude leaves out the struct fields and map entries matching any
+	// of the patterns, e.g. "User.PasswordHash". A pattern matches
+	//   - a field of a named struct type, wherever the struct is, written
+	//     as Type.Field, where Field is the Go name or the key of the
+	//     field;
+	//   - or a field or entry by its path from the root, written like
+	//     Path.String, e.g. Orders[0].Customer or Meta["api key"]. A path
+	//     of two keys is written with a leading dot, as in .Meta.source,
+	//     so that it is not taken for a Type.Field pattern.
+	// Keys may contain the wildcards * and ?, and indices may be *, as in
+	// Orders[*].Total or "Order.*".
+	Exclude []string
+	// Only restricts the fields and entries to the ones matching any of
+	// the patterns, written like in Exclude. A Type.Field pattern only
+	// restricts the structs of the types it names; a path pattern
+	// restricts the structs and maps on its path, keeping the fields
+	// leading to the ones matched. The others, like the root of another
+	// type or the structs below the fields matched, are left whole. E.g.
+	// "Order.*", "Customer.Name" keep all the fields of every Order but
+	// only the Name of their Customer.
+	//
+	// The filters only apply when encoding. A pointer target is encoded
+	// once, at its first occurrence not left out, where path patterns are
+	// matched; the other occurrences refer to it.
+	Only []string
+	// MaxDepth, if positive, limits the number of pointers followed from
+	// the root, the root included: the pointers below the limit are
+	// encoded as stubs, unless their target has already been encoded, in
+	// which case they are refs as usual. A stub stands for its pointer:
+	// the other occurrences of the pointer, even within the limit, are
+	// refs to the stub, so sharing and cycles are kept. E.g. 1 encodes
+	// the root value and stubs the pointers it holds.
+	MaxDepth int
+	// FetchStub, if set, is called to decode the stubs, with the refid
+	// and the type name they hold; the value it returns, which must be
+	// assignable to the target, is stored in place of the stub and of the
+	// refs to it. Without it, or if it returns nil, stubs are decoded as
+	// nil pointers.
+	FetchStub func(refid uint64, typeName string) (any, error)
+}
+
+// ToValueWithOptions works like ToValue, configured by opts.
+func ToValueWithOptions(i any, opts *Options) (*Value, error) {
+	v := reflect.ValueOf(i)
+	if v.Kind() != reflect.Ptr {
+		v = reflect.ValueOf(&i)
+	}
+	vm := newValueMapper()
+	if opts != nil {
+		vm.opts = *opts
+	}
+	return vm.toValue(v)
+}
+
+// FromValueWithOptions works like FromValue, configured by opts. The
+// options should match the ones data was encoded with.
+func FromValueWithOptions(data *Value, v any, opts *Options) error {
+	vu := newValueUnmapper()
+	if opts != nil {
+		vu.opts = *opts
+	}
+	return vu.fromValueRoot(data, v)
+}
+
+// includeUnexported reports whether the unexported field ft of a struct
+// of type t is transformed.
+func (o *Options) includeUnexported(t reflect.Type, ft reflect.StructField) bool {
+	if !o.Unexported && ft.Tag.Get("tahwil") != "include" {
+		return false
+	}
+	if t.PkgPath() == "sync" {
+		return false
+	}
+	ftyp := ft.Type
+	for ftyp.Kind() == reflect.Ptr {
+		ftyp = ftyp.Elem()
+	}
+	switch ftyp.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return false
+	}
+	return ftyp.PkgPath() != "sync"
+}
+
+// exposeField returns a settable view of the field f of an addressable
+// struct, which is needed to read or write unexported fields.
+func exposeField(f reflect.Value) reflect.Value {
+	return reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem()
+}
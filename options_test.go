@@ -0,0 +1,118 @@
+package tahwil_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+type stateT struct {
+	Name  string
+	count int
+	cache map[string]point
+	next  *stateT
+	mu    sync.Mutex
+	rw    *sync.RWMutex
+	ch    chan int
+	fn    func()
+	// tagged fields are included without Options.Unexported
+	version int `tahwil:"include"`
+}
+
+type point struct {
+	x, y int
+}
+
+func TestToValueWithOptions_Unexported(t *testing.T) {
+	in := &stateT{
+		Name:    "a",
+		count:   3,
+		cache:   map[string]point{"p": {x: 1, y: 2}},
+		rw:      &sync.RWMutex{},
+		ch:      make(chan int),
+		fn:      func() {},
+		version: 7,
+	}
+	in.next = in
+	in.mu.Lock()
+
+	v, err := tahwil.ToValueWithOptions(in, &tahwil.Options{Unexported: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, _ := v.Value.(*tahwil.Value).AsStruct()
+	for _, k := range []string{"mu", "rw", "ch", "fn"} {
+		if _, ok := fields[k]; ok {
+			t.Errorf("field %s was transformed", k)
+		}
+	}
+
+	var out stateT
+	if err = tahwil.FromValueWithOptions(v, &out, &tahwil.Options{Unexported: true}); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "a" || out.count != 3 || out.version != 7 {
+		t.Errorf("FromValueWithOptions() = %q, %d, %d", out.Name, out.count, out.version)
+	}
+	if out.cache["p"] != (point{x: 1, y: 2}) {
+		t.Errorf("cache = %v", out.cache)
+	}
+	if out.next != &out {
+		t.Errorf("next does not point back to the struct")
+	}
+	if !out.mu.TryLock() {
+		t.Errorf("decoded mutex is locked")
+	}
+	if out.rw != nil || out.ch != nil {
+		t.Errorf("excluded fields were decoded")
+	}
+}
+
+func TestToValue_IncludeTag(t *testing.T) {
+	in := &stateT{Name: "a", count: 3, version: 7}
+	v, err := tahwil.ToValue(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, _ := v.Value.(*tahwil.Value).AsStruct()
+	if _, ok := fields["count"]; ok {
+		t.Errorf("unexported field was transformed without the option")
+	}
+	if _, ok := fields["version"]; !ok {
+		t.Errorf("tagged field was not transformed")
+	}
+
+	var out stateT
+	if err = tahwil.FromValue(v, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.count != 0 || out.version != 7 {
+		t.Errorf("FromValue() count = %d, version = %d", out.count, out.version)
+	}
+
+	// unexported fields in the input are ignored unless enabled
+	if err = tahwil.FromValue(&tahwil.Value{Refid: 1, Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Struct, Value: map[string]*tahwil.Value{
+		"count": {Kind: tahwil.Int, Value: 5},
+	}}}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.count != 0 {
+		t.Errorf("unexported field decoded without the option")
+	}
+}
+
+func TestToValueWithOptions_Nil(t *testing.T) {
+	in := &stateT{Name: "a", count: 3}
+	v, err := tahwil.ToValueWithOptions(in, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := tahwil.ToValue(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tahwil.Equal(v, want) {
+		t.Errorf("ToValueWithOptions(nil) differs from ToValue()")
+	}
+}
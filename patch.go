@@ -0,0 +1,387 @@
+package tahwil
+
+import (
+	"sort"
+	"strconv"
+)
+
+// PatchOpType is the type of a patch operation.
+type PatchOpType string
+
+const (
+	// PatchSet sets the value at the path of a node, or the whole node,
+	// created if needed, if the path is empty.
+	PatchSet PatchOpType = "set"
+	// PatchAdd inserts a slice element at the index the path ends with.
+	PatchAdd PatchOpType = "add"
+	// PatchRemove removes the slice element, map entry or struct field the
+	// path ends with.
+	PatchRemove PatchOpType = "remove"
+	// PatchLink points the pointer at the path of a node to the node Target.
+	PatchLink PatchOpType = "link"
+)
+
+// PatchOp is a single operation of a Patch. It is addressed by the refid
+// of a node, i.e. of a pointer target as stored in a Table, and the path
+// of field keys (struct fields, map keys and decimal slice indices) inside
+// the node. Values are in Table form: the pointers they hold are Refs to
+// other nodes.
+type PatchOp struct {
+	Op     PatchOpType `json:"op"`
+	Refid  uint64      `json:"refid"`
+	Path   []string    `json:"path,omitempty"`
+	Value  *Value      `json:"value,omitempty"`
+	Target uint64      `json:"target,omitempty"`
+}
+
+// Patch is the delta between two *Value trees computed by ComputePatch.
+// Root is the refid of the root pointer of the new tree.
+type Patch struct {
+	Root uint64    `json:"root"`
+	Ops  []PatchOp `json:"ops"`
+}
+
+// An InvalidPatchError describes a patch operation that can't be applied.
+type InvalidPatchError struct {
+	// Op is the index of the operation in Patch.Ops
+	Op     int
+	Reason string
+}
+
+func (e *InvalidPatchError) Error() string {
+	return "tahwil.ApplyPatch: op " + strconv.Itoa(e.Op) + ": " + e.Reason
+}
+
+// ComputePatch returns the operations that turn old into new. Both trees
+// must be pointers as produced by ToValue; pointers with the same refid
+// are taken to be the same object, so the trees should come from the
+// same graph, e.g. before and after a change. Nodes only present in new
+// are set as a whole, nodes only present in old are left out of the
+// patch as they are no longer reachable. Slice elements are compared by
+// index: a longer slice gets PatchAdd operations at its end, a shorter
+// one PatchRemove operations.
+//
+// The refids assigned by ToValue are positional: pointers are numbered
+// in the order they are met, so inserting an object before others, e.g.
+// at the start of a slice, renumbers all the pointers met after it. The
+// patch is still correct, the renumbered nodes being patched into each
+// other, but it is not minimal.
+func ComputePatch(old, new *Value) (*Patch, error) {
+	ot, err := Flatten(old)
+	if err != nil {
+		return nil, err
+	}
+	nt, err := Flatten(new)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Patch{Root: nt.Root, Ops: []PatchOp{}}
+	refids := make([]uint64, 0, len(nt.Nodes))
+	for refid := range nt.Nodes {
+		refids = append(refids, refid)
+	}
+	sort.Slice(refids, func(i, j int) bool { return refids[i] < refids[j] })
+	for _, refid := range refids {
+		on, ok := ot.Nodes[refid]
+		if !ok {
+			p.Ops = append(p.Ops, PatchOp{Op: PatchSet, Refid: refid, Value: nt.Nodes[refid]})
+			continue
+		}
+		if err = p.diff(refid, nil, on, nt.Nodes[refid]); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// diff adds the operations turning the old value at path of the node
+// refid into the new one. Values with different refids are set as a
+// whole: the refids of nil pointers and refs left in a node may be used
+// by other nodes in the new tree.
+func (p *Patch) diff(refid uint64, path []string, o, n *Value) error {
+	set := func() {
+		p.Ops = append(p.Ops, PatchOp{Op: PatchSet, Refid: refid, Path: path, Value: n})
+	}
+	if o == nil || n == nil || o.Kind != n.Kind {
+		if o != n {
+			set()
+		}
+		return nil
+	}
+	if o.Refid != n.Refid || (o.Value == nil) != (n.Value == nil) {
+		set()
+		return nil
+	}
+
+	switch n.Kind {
+	case Ref:
+		ot, err := refFromValue(o)
+		if err != nil {
+			return err
+		}
+		nt, err := refFromValue(n)
+		if err != nil {
+			return err
+		}
+		if ot != nt {
+			p.Ops = append(p.Ops, PatchOp{Op: PatchLink, Refid: refid, Path: path, Target: nt})
+		}
+	case Ptr:
+		// non-nil pointers have been replaced by refs by Flatten
+	case Struct, Map:
+		ofields, ok := o.AsFields()
+		if !ok {
+			return &InvalidValueError{Value: o.Value, Kind: o.Kind}
+		}
+		okeys := sortedKeys(ofields)
+		nfields, ok := n.AsFields()
+		if !ok {
+			return &InvalidValueError{Value: n.Value, Kind: n.Kind}
+		}
+		nkeys := sortedKeys(nfields)
+		for _, k := range okeys {
+			if _, ok := nfields[k]; !ok {
+				p.Ops = append(p.Ops, PatchOp{Op: PatchRemove, Refid: refid, Path: appendPath(path, k)})
+			}
+		}
+		for _, k := range nkeys {
+			if err := p.diff(refid, appendPath(path, k), ofields[k], nfields[k]); err != nil {
+				return err
+			}
+		}
+	case Slice, Array:
+		oelems, ok := o.AsSlice()
+		if !ok {
+			return &InvalidValueError{Value: o.Value, Kind: o.Kind}
+		}
+		nelems, ok := n.AsSlice()
+		if !ok {
+			return &InvalidValueError{Value: n.Value, Kind: n.Kind}
+		}
+		if n.Kind == Array && len(oelems) != len(nelems) {
+			set()
+			return nil
+		}
+		common := min(len(oelems), len(nelems))
+		for i := 0; i < common; i++ {
+			if err := p.diff(refid, appendPath(path, strconv.Itoa(i)), oelems[i], nelems[i]); err != nil {
+				return err
+			}
+		}
+		// remove from the end, so that the indices stay valid
+		for i := len(oelems) - 1; i >= common; i-- {
+			p.Ops = append(p.Ops, PatchOp{Op: PatchRemove, Refid: refid, Path: appendPath(path, strconv.Itoa(i))})
+		}
+		for i := common; i < len(nelems); i++ {
+			p.Ops = append(p.Ops, PatchOp{Op: PatchAdd, Refid: refid, Path: appendPath(path, strconv.Itoa(i)), Value: nelems[i]})
+		}
+	default:
+		if o.Value != n.Value {
+			set()
+		}
+	}
+	return nil
+}
+
+// appendPath returns a new path, so that the paths of different
+// operations never share their backing array.
+func appendPath(path []string, key string) []string {
+	res := make([]string, len(path), len(path)+1)
+	copy(res, path)
+	return append(res, key)
+}
+
+// ApplyPatch applies p to v, which must be a pointer as produced by
+// ToValue, and returns the patched tree; v itself is not modified. The
+// operations are applied in order to the Table of v, which is then
+// converted back to a tree starting from p.Root.
+func ApplyPatch(v *Value, p *Patch) (*Value, error) {
+	t, err := Flatten(v)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range p.Ops {
+		if err = t.apply(op); err != nil {
+			return nil, &InvalidPatchError{Op: i, Reason: err.Error()}
+		}
+	}
+	t.Root = p.Root
+	return Unflatten(t)
+}
+
+// patchError is the reason of an InvalidPatchError
+type patchError string
+
+func (e patchError) Error() string {
+	return string(e)
+}
+
+func (t *Table) apply(op PatchOp) error {
+	value := op.Value
+	switch op.Op {
+	case PatchLink:
+		value = &Value{Kind: Ref, Value: op.Target}
+	case PatchSet, PatchAdd:
+		if value == nil {
+			return patchError("missing value")
+		}
+	case PatchRemove:
+	default:
+		return patchError("unknown op " + strconv.Quote(string(op.Op)))
+	}
+
+	if len(op.Path) == 0 {
+		if op.Op != PatchSet && op.Op != PatchLink {
+			return patchError("empty path")
+		}
+		t.Nodes[op.Refid] = value
+		return nil
+	}
+	node, ok := t.Nodes[op.Refid]
+	if !ok {
+		return patchError("unknown node " + strconv.FormatUint(op.Refid, 10))
+	}
+
+	// containers are copied on the way down, so that the values shared
+	// with v or with the patch are never modified
+	node, err := editableCopy(node)
+	if err != nil {
+		return err
+	}
+	t.Nodes[op.Refid] = node
+	parent := node
+	for _, key := range op.Path[:len(op.Path)-1] {
+		child, err := childOf(parent, key)
+		if err != nil {
+			return err
+		}
+		if child, err = editableCopy(child); err != nil {
+			return err
+		}
+		if err = setChild(parent, key, child); err != nil {
+			return err
+		}
+		parent = child
+	}
+
+	key := op.Path[len(op.Path)-1]
+	switch op.Op {
+	case PatchAdd:
+		return insertElem(parent, key, value)
+	case PatchRemove:
+		return removeChild(parent, key)
+	}
+	return setChild(parent, key, value)
+}
+
+// editableCopy copies a container node into the shapes produced by
+// ToValue, so that its children can be replaced.
+func editableCopy(v *Value) (*Value, error) {
+	if v == nil {
+		return nil, patchError("nil container")
+	}
+	res := &Value{Refid: v.Refid, Kind: v.Kind}
+	switch v.Kind {
+	case Struct, Map:
+		fields, ok := v.AsFields()
+		if !ok {
+			return nil, &InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		m := make(map[string]*Value, len(fields))
+		for k, x := range fields {
+			m[k] = x
+		}
+		res.Value = m
+	case Slice, Array:
+		elems, ok := v.AsSlice()
+		if !ok {
+			return nil, &InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		res.Value = append(make([]*Value, 0, len(elems)), elems...)
+	default:
+		return nil, patchError("not a container: " + string(v.Kind))
+	}
+	return res, nil
+}
+
+func elemIndex(v *Value, key string, n int) (int, error) {
+	i, err := strconv.Atoi(key)
+	if err != nil || i < 0 || i >= n {
+		return 0, patchError("invalid index " + strconv.Quote(key) + " of a " + string(v.Kind) + " of length " + strconv.Itoa(n))
+	}
+	return i, nil
+}
+
+// childOf returns the child of an editable container.
+func childOf(v *Value, key string) (*Value, error) {
+	switch x := v.Value.(type) {
+	case map[string]*Value:
+		child, ok := x[key]
+		if !ok {
+			return nil, patchError("unknown key " + strconv.Quote(key))
+		}
+		return child, nil
+	case []*Value:
+		i, err := elemIndex(v, key, len(x))
+		if err != nil {
+			return nil, err
+		}
+		return x[i], nil
+	}
+	return nil, patchError("nil " + string(v.Kind))
+}
+
+func setChild(v *Value, key string, child *Value) error {
+	switch x := v.Value.(type) {
+	case map[string]*Value:
+		x[key] = child
+		return nil
+	case []*Value:
+		i, err := elemIndex(v, key, len(x))
+		if err != nil {
+			return err
+		}
+		x[i] = child
+		return nil
+	}
+	return patchError("nil " + string(v.Kind))
+}
+
+func insertElem(v *Value, key string, elem *Value) error {
+	x, ok := v.Value.([]*Value)
+	if !ok || v.Kind != Slice {
+		return patchError("can't add an element to a " + string(v.Kind))
+	}
+	i, err := elemIndex(v, key, len(x)+1)
+	if err != nil {
+		return err
+	}
+	x = append(x, nil)
+	copy(x[i+1:], x[i:])
+	x[i] = elem
+	v.Value = x
+	return nil
+}
+
+func removeChild(v *Value, key string) error {
+	switch x := v.Value.(type) {
+	case map[string]*Value:
+		if _, ok := x[key]; !ok {
+			return patchError("unknown key " + strconv.Quote(key))
+		}
+		delete(x, key)
+		return nil
+	case []*Value:
+		if v.Kind != Slice {
+			return patchError("can't remove an element from a " + string(v.Kind))
+		}
+		i, err := elemIndex(v, key, len(x))
+		if err != nil {
+			return err
+		}
+		v.Value = append(x[:i], x[i+1:]...)
+		return nil
+	}
+	return patchError("nil " + string(v.Kind))
+}
@@ -0,0 +1,311 @@
+package tahwil_test
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+type patchNodeT struct {
+	Name     string
+	Tags     []string
+	Meta     map[string]int
+	Parent   *patchNodeT
+	Children []*patchNodeT
+}
+
+func TestComputePatch(t *testing.T) {
+	root := &patchNodeT{Name: "root", Tags: []string{"a"}}
+	child := &patchNodeT{Name: "child", Parent: root}
+	root.Children = []*patchNodeT{child}
+	old, err := tahwil.ToValue(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root.Name = "renamed"
+	root.Tags = nil
+	child.Parent = nil
+	root.Meta = map[string]int{"x": 1}
+	newV, err := tahwil.ToValue(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := tahwil.ComputePatch(old, newV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// node 1 is root, node 3 is child; nil maps and slices are encoded
+	// as empty ones, so they are patched entry by entry
+	want := `{"root":1,"ops":[` +
+		`{"op":"set","refid":1,"path":["Meta","x"],"value":{"refid":0,"kind":"int","value":1}},` +
+		`{"op":"set","refid":1,"path":["Name"],"value":{"refid":0,"kind":"string","value":"renamed"}},` +
+		`{"op":"remove","refid":1,"path":["Tags","0"]},` +
+		`{"op":"set","refid":3,"path":["Parent"],"value":{"refid":4,"kind":"ptr","value":null}}]}`
+	if string(res) != want {
+		t.Errorf("have:\n%s\nwant:\n%s", res, want)
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	root := &patchNodeT{Name: "root", Tags: []string{"a", "b", "c"}, Meta: map[string]int{"x": 1, "y": 2}}
+	root.Children = []*patchNodeT{
+		{Name: "child 1", Parent: root},
+		{Name: "child 2", Parent: root},
+	}
+	old, err := tahwil.ToValue(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// relink, grow and shrink slices, add and remove map entries
+	root.Children[0].Parent = root.Children[1]
+	root.Children = append(root.Children, &patchNodeT{Name: "child 3", Parent: root, Tags: []string{"new"}})
+	root.Tags = root.Tags[:1]
+	delete(root.Meta, "x")
+	root.Meta["z"] = 3
+	newV, err := tahwil.ToValue(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := tahwil.ComputePatch(old, newV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// send the patch through JSON, as between two services
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &tahwil.Patch{}
+	if err = json.Unmarshal(b, decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	patched, err := tahwil.ApplyPatch(old, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &patchNodeT{}
+	if err = tahwil.FromValue(patched, out); err != nil {
+		t.Fatal(err)
+	}
+	if diffs := tahwil.Diff(out, root); len(diffs) != 0 {
+		t.Errorf("unexpected differences: %v\npatch: %s", diffs, b)
+	}
+
+	// old is left untouched
+	orig := &patchNodeT{}
+	if err = tahwil.FromValue(old, orig); err != nil {
+		t.Fatal(err)
+	}
+	if len(orig.Children) != 2 || len(orig.Tags) != 3 || orig.Children[0].Parent != orig {
+		t.Errorf("expected the old tree to be unchanged, got %+v", orig)
+	}
+}
+
+func TestApplyPatch_NilPointers(t *testing.T) {
+	// the nil Parent pointers of both children must stay distinct nodes:
+	// if they were taken to be the same pointer, setting one of them
+	// would relink the other one as well
+	root := &patchNodeT{Name: "root"}
+	root.Children = []*patchNodeT{{Name: "child 1"}, {Name: "child 2"}}
+	old, err := tahwil.ToValue(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root.Children[1].Parent = root
+	newV, err := tahwil.ToValue(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := tahwil.ComputePatch(old, newV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := tahwil.ApplyPatch(old, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &patchNodeT{}
+	if err = tahwil.FromValue(patched, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Children[0].Parent != nil || out.Children[1].Parent != out {
+		t.Errorf("unexpected parents: %+v, %+v", out.Children[0].Parent, out.Children[1].Parent)
+	}
+}
+
+func TestApplyPatch_Renumbered(t *testing.T) {
+	// refids are positional: inserting a child first renumbers the nodes
+	// of the other children, the patch is larger but still correct
+	root := &patchNodeT{Name: "root"}
+	root.Children = []*patchNodeT{{Name: "child 1", Parent: root}, {Name: "child 2", Parent: root}}
+	old, err := tahwil.ToValue(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root.Children = append([]*patchNodeT{{Name: "child 0", Tags: []string{"new"}}}, root.Children...)
+	newV, err := tahwil.ToValue(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := tahwil.ComputePatch(old, newV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := tahwil.ApplyPatch(old, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &patchNodeT{}
+	if err = tahwil.FromValue(patched, out); err != nil {
+		t.Fatal(err)
+	}
+	if diffs := tahwil.Diff(out, root); len(diffs) != 0 {
+		t.Errorf("unexpected differences: %v", diffs)
+	}
+}
+
+func TestApplyPatch_EmptyPatch(t *testing.T) {
+	root := &patchNodeT{Name: "root"}
+	v, err := tahwil.ToValue(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := tahwil.ComputePatch(v, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Ops) != 0 {
+		t.Errorf("expected no operations, got %+v", p.Ops)
+	}
+	res, err := tahwil.ApplyPatch(v, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, v) {
+		t.Errorf("mismatch\nhave: %+v\nwant: %+v", res, v)
+	}
+}
+
+func TestApplyPatch_Errors(t *testing.T) {
+	root := &patchNodeT{Name: "root", Tags: []string{"a"}}
+	v, err := tahwil.ToValue(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	str := &tahwil.Value{Kind: tahwil.String, Value: "x"}
+	tests := []tahwil.PatchOp{
+		{Op: "move", Refid: 1, Path: []string{"Name"}},
+		{Op: tahwil.PatchSet, Refid: 1, Path: []string{"Name"}},
+		{Op: tahwil.PatchSet, Refid: 9, Path: []string{"Name"}, Value: str},
+		{Op: tahwil.PatchSet, Refid: 1, Path: []string{"Tags", "1"}, Value: str},
+		{Op: tahwil.PatchSet, Refid: 1, Path: []string{"Name", "x"}, Value: str},
+		{Op: tahwil.PatchSet, Refid: 1, Path: []string{"Missing", "x"}, Value: str},
+		{Op: tahwil.PatchAdd, Refid: 1, Path: []string{"Tags", "2"}, Value: str},
+		{Op: tahwil.PatchAdd, Refid: 1, Path: []string{"Name"}, Value: str},
+		{Op: tahwil.PatchRemove, Refid: 1, Path: []string{"Missing"}},
+		{Op: tahwil.PatchRemove, Refid: 1},
+	}
+	for i, op := range tests {
+		var patchErr *tahwil.InvalidPatchError
+		_, err := tahwil.ApplyPatch(v, &tahwil.Patch{Root: 1, Ops: []tahwil.PatchOp{op}})
+		if !errors.As(err, &patchErr) {
+			t.Errorf("#%d: expected *InvalidPatchError, got %T: %v", i, err, err)
+		}
+	}
+
+	// links to unknown nodes are detected when the tree is rebuilt
+	p := &tahwil.Patch{Root: 1, Ops: []tahwil.PatchOp{{Op: tahwil.PatchLink, Refid: 1, Path: []string{"Parent"}, Target: 9}}}
+	if _, err := tahwil.ApplyPatch(v, p); err == nil {
+		t.Error("expected error for a link to an unknown node, got nil")
+	}
+}
+
+type patchGraphT struct {
+	Name string
+	Up   *patchGraphT
+	Kids []*patchGraphT
+	Tags map[string]*patchGraphT
+}
+
+// randomPatchGraph links the nodes of pool at random and returns the root
+func randomPatchGraph(rnd *rand.Rand, pool []*patchGraphT) *patchGraphT {
+	pick := func() *patchGraphT {
+		if rnd.Intn(3) == 0 {
+			return nil
+		}
+		return pool[rnd.Intn(len(pool))]
+	}
+	for _, n := range pool {
+		n.Name = strconv.Itoa(rnd.Intn(3))
+		n.Up = pick()
+		n.Kids = nil
+		for i := rnd.Intn(4); i > 0; i-- {
+			n.Kids = append(n.Kids, pick())
+		}
+		n.Tags = nil
+		if rnd.Intn(2) == 0 {
+			n.Tags = map[string]*patchGraphT{}
+			for i := rnd.Intn(3); i > 0; i-- {
+				n.Tags[strconv.Itoa(rnd.Intn(3))] = pick()
+			}
+		}
+	}
+	return pool[0]
+}
+
+func TestApplyPatch_Random(t *testing.T) {
+	for seed := int64(0); seed < 500; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+		pool := make([]*patchGraphT, 1+rnd.Intn(6))
+		for i := range pool {
+			pool[i] = &patchGraphT{}
+		}
+		old, err := tahwil.ToValue(randomPatchGraph(rnd, pool))
+		if err != nil {
+			t.Fatal(err)
+		}
+		root := randomPatchGraph(rnd, pool)
+		newV, err := tahwil.ToValue(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := tahwil.ComputePatch(old, newV)
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		patched, err := tahwil.ApplyPatch(old, p)
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		if err = patched.Validate(); err != nil {
+			t.Errorf("seed %d: %v", seed, err)
+			continue
+		}
+		out := &patchGraphT{}
+		if err = tahwil.FromValue(patched, out); err != nil {
+			t.Errorf("seed %d: %v", seed, err)
+			continue
+		}
+		if !tahwil.Equal(out, root) {
+			t.Errorf("seed %d: unexpected differences: %v", seed, tahwil.Diff(out, root))
+		}
+	}
+}
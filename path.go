@@ -0,0 +1,136 @@
+package tahwil
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A PathSyntaxError describes a path string that can't be parsed.
+type PathSyntaxError struct {
+	Path   string
+	Offset int
+	Reason string
+}
+
+func (e *PathSyntaxError) Error() string {
+	return "tahwil: invalid path " + strconv.Quote(e.Path) + " at offset " + strconv.Itoa(e.Offset) + ": " + e.Reason
+}
+
+// ParsePath parses a path in the notation of Path.String, e.g.
+// Children[2].Parent or Meta["first name"]. The empty string is the
+// empty path.
+func ParsePath(s string) (Path, error) {
+	return parsePath(s, false)
+}
+
+// parsePath parses a path, or a field pattern if glob is set: keys may
+// then contain the wildcards * and ?, and indices may be *.
+func parsePath(s string, glob bool) (Path, error) {
+	p := Path{}
+	fail := func(i int, reason string) error {
+		return &PathSyntaxError{Path: s, Offset: i, Reason: reason}
+	}
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == '[':
+			i++
+			if i < len(s) && s[i] == '"' {
+				q, err := strconv.QuotedPrefix(s[i:])
+				if err != nil {
+					return nil, fail(i, "invalid quoted key")
+				}
+				k, _ := strconv.Unquote(q)
+				p = append(p, k)
+				i += len(q)
+			} else if glob && i < len(s) && s[i] == '*' {
+				p = append(p, anyIndex{})
+				i++
+			} else {
+				j := i
+				for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+					j++
+				}
+				idx, err := strconv.Atoi(s[i:j])
+				if err != nil {
+					return nil, fail(i, "invalid index")
+				}
+				p = append(p, idx)
+				i = j
+			}
+			if i >= len(s) || s[i] != ']' {
+				return nil, fail(i, "missing ]")
+			}
+			i++
+		case len(p) > 0 && s[i] != '.':
+			return nil, fail(i, "expected . or [")
+		default:
+			if len(p) > 0 {
+				i++
+			}
+			j := i
+			for j < len(s) && s[j] != '.' && s[j] != '[' {
+				j++
+			}
+			key := s[i:j]
+			if glob {
+				key = strings.NewReplacer("*", "_", "?", "_").Replace(key)
+			}
+			if !isIdent(key) {
+				return nil, fail(i, "invalid key "+strconv.Quote(s[i:j]))
+			}
+			p = append(p, s[i:j])
+			i = j
+		}
+	}
+	return p, nil
+}
+
+// FromValuePath decodes the node at path below data into v, which must
+// be a non-nil pointer, e.g. FromValuePath(data, "Children[2].Parent",
+// &parent). The path is followed like Graph.Get does, on data itself:
+// the pointers of the tree are only indexed as far as needed to resolve
+// the refs met. Only the subtree at path is decoded, together with the
+// pointer targets outside of it that its refs refer to, which are
+// decoded on demand, like FromTable does. If the node is a pointer, v
+// receives its target; a nil pointer, like a stub, leaves v unchanged.
+func FromValuePath(data *Value, path string, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &UnmapperError{text: "value must be non-nil Pointer"}
+	}
+	p, err := ParsePath(path)
+	if err != nil {
+		return err
+	}
+	g := newLazyGraph(data)
+	n, err := g.Get(p...)
+	if err != nil {
+		return err
+	}
+	if n, err = g.Resolve(n); err != nil {
+		return &UnmapperError{cause: err}
+	}
+
+	vu := newValueUnmapper()
+	vu.node = g.Node
+	switch {
+	case n == nil, n.Kind == Stub:
+		return nil
+	case n.Kind == Ptr:
+		inner, ok := n.AsPtr()
+		if !ok {
+			return &InvalidValueError{Value: n.Value, Kind: n.Kind}
+		}
+		if inner == nil {
+			return nil
+		}
+		if n.Refid != 0 {
+			vu.refs[n.Refid] = rv
+		}
+		vu.pending = append(vu.pending, pendingNode{data: inner, target: rv.Elem()})
+	default:
+		vu.pending = append(vu.pending, pendingNode{data: n, target: rv.Elem()})
+	}
+	return vu.fromPending()
+}
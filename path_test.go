@@ -0,0 +1,155 @@
+package tahwil_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		s    string
+		want tahwil.Path
+	}{
+		{"", tahwil.Path{}},
+		{"Children[2].Parent", tahwil.Path{"Children", 2, "Parent"}},
+		{`Meta["first name"]`, tahwil.Path{"Meta", "first name"}},
+		{`[1].x["2"][3]`, tahwil.Path{1, "x", "2", 3}},
+	}
+	for _, tt := range tests {
+		got, err := tahwil.ParsePath(tt.s)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParsePath(%q) = %#v, %v, want %#v", tt.s, got, err, tt.want)
+			continue
+		}
+		if got.String() != tt.s {
+			t.Errorf("ParsePath(%q).String() = %q", tt.s, got.String())
+		}
+	}
+}
+
+func TestParsePath_Errors(t *testing.T) {
+	tests := []struct {
+		s    string
+		want *tahwil.PathSyntaxError
+	}{
+		{".a", &tahwil.PathSyntaxError{Path: ".a", Offset: 0, Reason: `invalid key ""`}},
+		{"a..b", &tahwil.PathSyntaxError{Path: "a..b", Offset: 2, Reason: `invalid key ""`}},
+		{"a.", &tahwil.PathSyntaxError{Path: "a.", Offset: 2, Reason: `invalid key ""`}},
+		{"a b", &tahwil.PathSyntaxError{Path: "a b", Offset: 0, Reason: `invalid key "a b"`}},
+		{"a[x]", &tahwil.PathSyntaxError{Path: "a[x]", Offset: 2, Reason: "invalid index"}},
+		{"a[1", &tahwil.PathSyntaxError{Path: "a[1", Offset: 3, Reason: "missing ]"}},
+		{`a["x]`, &tahwil.PathSyntaxError{Path: `a["x]`, Offset: 2, Reason: "invalid quoted key"}},
+		{"a[1]b", &tahwil.PathSyntaxError{Path: "a[1]b", Offset: 4, Reason: "expected . or ["}},
+	}
+	for _, tt := range tests {
+		_, err := tahwil.ParsePath(tt.s)
+		if !reflect.DeepEqual(err, tt.want) {
+			t.Errorf("ParsePath(%q) error = %v, want %v", tt.s, err, tt.want)
+		}
+	}
+}
+
+func TestFromValuePath(t *testing.T) {
+	v := walkTree(t)
+
+	var parent walkNodeT
+	if err := tahwil.FromValuePath(v, "Children[1].Parent", &parent); err != nil {
+		t.Fatal(err)
+	}
+	// the ref to the root is decoded on demand, with its own cycles
+	if parent.Name != "root" || len(parent.Children) != 2 || parent.Children[0].Parent != &parent {
+		t.Errorf("FromValuePath() = %+v", parent)
+	}
+
+	var child walkNodeT
+	if err := tahwil.FromValuePath(v, "Children[0]", &child); err != nil {
+		t.Fatal(err)
+	}
+	if child.Name != "a" || child.Parent == nil || child.Parent.Children[0] != &child {
+		t.Errorf("FromValuePath() = %+v", child)
+	}
+
+	var children []*walkNodeT
+	if err := tahwil.FromValuePath(v, "Children", &children); err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 2 || children[1].Name != "b" || children[0].Parent != children[1].Parent {
+		t.Errorf("FromValuePath() = %v", children)
+	}
+
+	var name string
+	if err := tahwil.FromValuePath(v, `Meta["first name"]`, &name); err != nil || name != "x" {
+		t.Errorf("FromValuePath() = %q, %v", name, err)
+	}
+
+	var root walkNodeT
+	if err := tahwil.FromValuePath(v, "", &root); err != nil || root.Name != "root" {
+		t.Errorf("FromValuePath() = %+v, %v", root, err)
+	}
+}
+
+func TestFromValuePath_Lazy(t *testing.T) {
+	// the tree is not flattened: the malformed Meta of the root, which
+	// the selected subtree doesn't reach, is never looked at
+	str := func(s string) *tahwil.Value { return &tahwil.Value{Kind: tahwil.String, Value: s} }
+	v := &tahwil.Value{Kind: tahwil.Ptr, Refid: 1, Value: &tahwil.Value{Kind: tahwil.Struct, Value: map[string]*tahwil.Value{
+		"Name": str("root"),
+		"Meta": {Kind: tahwil.Map, Value: 5},
+		"Children": {Kind: tahwil.Slice, Value: []*tahwil.Value{
+			// a ref to a pointer met later, outside of the subtree
+			{Kind: tahwil.Ptr, Refid: 2, Value: &tahwil.Value{Kind: tahwil.Struct, Value: map[string]*tahwil.Value{
+				"Name":   str("a"),
+				"Parent": {Kind: tahwil.Ref, Value: uint64(3)},
+			}}},
+			// a ref to a pointer met later, inside of the subtree
+			{Kind: tahwil.Ptr, Refid: 3, Value: &tahwil.Value{Kind: tahwil.Struct, Value: map[string]*tahwil.Value{
+				"Name": str("b"),
+				"Children": {Kind: tahwil.Slice, Value: []*tahwil.Value{
+					{Kind: tahwil.Ref, Value: uint64(4)},
+					{Kind: tahwil.Ptr, Refid: 4, Value: &tahwil.Value{Kind: tahwil.Struct, Value: map[string]*tahwil.Value{
+						"Name": str("c"),
+					}}},
+				}},
+			}}},
+		}},
+	}}}
+
+	var a walkNodeT
+	if err := tahwil.FromValuePath(v, "Children[0]", &a); err != nil {
+		t.Fatal(err)
+	}
+	b := a.Parent
+	if a.Name != "a" || b == nil || b.Name != "b" || len(b.Children) != 2 {
+		t.Fatalf("FromValuePath() = %+v, parent %+v", a, b)
+	}
+	if b.Children[0] != b.Children[1] || b.Children[1].Name != "c" {
+		t.Errorf("expected the ref and the pointer to share their target, got %+v, %+v", b.Children[0], b.Children[1])
+	}
+
+	if err := tahwil.FromValue(v, &walkNodeT{}); err == nil {
+		t.Error("expected the malformed Meta to fail the whole tree")
+	}
+}
+
+func TestFromValuePath_Errors(t *testing.T) {
+	v := walkTree(t)
+	var n walkNodeT
+	var pe *tahwil.PathError
+	if err := tahwil.FromValuePath(v, "Children[5]", &n); !errors.As(err, &pe) {
+		t.Errorf("FromValuePath() error = %v, want a *PathError", err)
+	}
+	var se *tahwil.PathSyntaxError
+	if err := tahwil.FromValuePath(v, "Children[", &n); !errors.As(err, &se) {
+		t.Errorf("FromValuePath() error = %v, want a *PathSyntaxError", err)
+	}
+	var ke *tahwil.InvalidUnmapperKindError
+	if err := tahwil.FromValuePath(v, "Name", &n); !errors.As(err, &ke) {
+		t.Errorf("FromValuePath() error = %v, want an *InvalidUnmapperKindError", err)
+	}
+	if err := tahwil.FromValuePath(v, "", nil); err == nil {
+		t.Errorf("FromValuePath() accepted a nil target")
+	}
+}
@@ -1,9 +1,13 @@
 package tahwil
 
 import (
+	"encoding"
 	"fmt"
 	"reflect"
-	"strings"
+	"sort"
+	"strconv"
+
+	"github.com/go-extras/tahwil/internal/fieldtag"
 )
 
 // An InvalidMapperKindError describes an invalid argument passed to ToValue.
@@ -20,7 +24,20 @@ func (e *InvalidMapperKindError) Error() string {
 
 type structFieldInfo struct {
 	index []int
+	name  string
 	key   string
+	// unexported fields are accessed through exposeField
+	unexported bool
+}
+
+// mapTask is a value waiting to be transformed into result
+type mapTask struct {
+	v      reflect.Value
+	result *Value
+	// path is only tracked when fields are filtered
+	path Path
+	// depth is the number of pointers above the value
+	depth int
 }
 
 type valueMapper struct {
@@ -32,6 +49,16 @@ type valueMapper struct {
 	structFieldCache map[reflect.Type][]structFieldInfo
 	// allRefids assigns a refid to every value (compat mode)
 	allRefids bool
+	opts      Options
+	tracker   tracker
+	// filter is nil unless Options.Exclude or Options.Only are set
+	filter *fieldFilter
+	// path is the path of the value being transformed, if tracked
+	path Path
+	// depth is the number of pointers above the value being transformed
+	depth int
+	// stack holds the values that still need to be transformed
+	stack []mapTask
 }
 
 func newValueMapper() *valueMapper {
@@ -50,20 +77,11 @@ func (vm *valueMapper) cachedStructFields(t reflect.Type) []structFieldInfo {
 	visible := reflect.VisibleFields(t)
 	fields := make([]structFieldInfo, 0, len(visible))
 	for _, ft := range visible {
-		if !ft.IsExported() || ft.Anonymous {
+		k, ok := fieldtag.Key(ft)
+		if !ok || (!ft.IsExported() && !vm.opts.includeUnexported(t, ft)) {
 			continue
 		}
-		k := ft.Tag.Get("json")
-		if k != "" {
-			k, _, _ = strings.Cut(k, ",")
-		}
-		if k == "" {
-			k = ft.Name
-		}
-		if k == "-" || k == "_" {
-			continue
-		}
-		fields = append(fields, structFieldInfo{index: ft.Index, key: k})
+		fields = append(fields, structFieldInfo{index: ft.Index, name: ft.Name, key: k, unexported: !ft.IsExported()})
 	}
 	vm.structFieldCache[t] = fields
 	return fields
@@ -80,19 +98,37 @@ func (vm *valueMapper) nextRefid() uint64 {
 	return vm.lastRefid
 }
 
-func (vm *valueMapper) toValueSlice(v reflect.Value) (result []*Value, err error) {
-	result = make([]*Value, v.Len())
-	for i := 0; i < v.Len(); i++ {
-		result[i], err = vm.toValue(v.Index(i))
-		if err != nil {
-			return nil, err
-		}
+// push schedules v to be transformed into result
+func (vm *valueMapper) push(v reflect.Value, result *Value) {
+	vm.stack = append(vm.stack, mapTask{v: v, result: result, path: vm.path, depth: vm.depth})
+}
+
+// pushElem schedules the element e of the value being transformed
+func (vm *valueMapper) pushElem(e any, v reflect.Value, result *Value) {
+	t := mapTask{v: v, result: result, depth: vm.depth}
+	if vm.filter != nil {
+		t.path = vm.path.appendElem(e)
 	}
-	return
+	vm.stack = append(vm.stack, t)
 }
 
-func (vm *valueMapper) toValueMap(v reflect.Value) (result map[string]*Value, err error) {
-	result = make(map[string]*Value)
+func (vm *valueMapper) toValueSlice(v reflect.Value) []*Value {
+	n := v.Len()
+	result := make([]*Value, n)
+	values := make([]Value, n)
+	for i := range result {
+		result[i] = &values[i]
+	}
+	// children are pushed in reverse order, so that they are processed
+	// (and receive their refids) in their natural order
+	for i := n - 1; i >= 0; i-- {
+		vm.pushElem(i, v.Index(i), result[i])
+	}
+	return result
+}
+
+func (vm *valueMapper) toValueMap(v reflect.Value) (map[string]*Value, error) {
+	result := make(map[string]*Value)
 	kind := v.Kind()
 	if kind == reflect.Map {
 		keys := v.MapKeys()
@@ -100,30 +136,48 @@ func (vm *valueMapper) toValueMap(v reflect.Value) (result map[string]*Value, er
 			return result, nil
 		}
 
-		for _, idx := range keys {
-			i := idx.Interface()
-			val := v.MapIndex(idx)
-			var resIdx string
-			if s, ok := i.(string); ok {
-				resIdx = s
-			} else {
-				resIdx = fmt.Sprintf("%v", i)
-			}
-			result[resIdx], err = vm.toValue(val)
-			if err != nil {
+		// keys are sorted, so that refids are assigned in a stable order
+		names := make([]string, len(keys))
+		for n, key := range keys {
+			var err error
+			if names[n], err = mapKeyName(key); err != nil {
 				return nil, err
 			}
 		}
+		sort.Sort(mapKeys{names: names, keys: keys})
+
+		values := make([]Value, len(keys))
+		for n := len(keys) - 1; n >= 0; n-- {
+			mv := v.MapIndex(keys[n])
+			if vm.omitted(mv) || vm.filtered(v.Type(), names[n], names[n]) {
+				continue
+			}
+			result[names[n]] = &values[n]
+			vm.pushElem(names[n], mv, &values[n])
+		}
 		return result, nil
 	}
 
 	if kind == reflect.Struct {
-		for _, fi := range vm.cachedStructFields(v.Type()) {
+		fields := vm.cachedStructFields(v.Type())
+		if !v.CanAddr() && hasUnexported(fields) {
+			// unexported fields are read through their address
+			c := reflect.New(v.Type()).Elem()
+			c.Set(v)
+			v = c
+		}
+		values := make([]Value, len(fields))
+		for n := len(fields) - 1; n >= 0; n-- {
+			fi := fields[n]
 			f := v.FieldByIndex(fi.index)
-			result[fi.key], err = vm.toValue(f)
-			if err != nil {
-				return nil, err
+			if fi.unexported {
+				f = exposeField(f)
+			}
+			if vm.omitted(f) || vm.filtered(v.Type(), fi.name, fi.key) {
+				continue
 			}
+			result[fi.key] = &values[n]
+			vm.pushElem(fi.key, f, &values[n])
 		}
 		return result, nil
 	}
@@ -131,53 +185,110 @@ func (vm *valueMapper) toValueMap(v reflect.Value) (result map[string]*Value, er
 	return nil, &InvalidMapperKindError{Kind: kind.String()}
 }
 
-func (vm *valueMapper) ptrToValue(v reflect.Value) (result *Value, err error) {
-	result = &Value{}
+// filtered reports whether the field or entry with the given name and
+// key of the struct or map of type t being transformed is left out.
+func (vm *valueMapper) filtered(t reflect.Type, name, key string) bool {
+	if vm.filter == nil {
+		return false
+	}
+	return vm.filter.skip(t, vm.path.appendElem(key), name, key)
+}
+
+func hasUnexported(fields []structFieldInfo) bool {
+	for _, fi := range fields {
+		if fi.unexported {
+			return true
+		}
+	}
+	return false
+}
+
+// mapKeys sorts map keys by their names
+type mapKeys struct {
+	names []string
+	keys  []reflect.Value
+}
+
+func (mk mapKeys) Len() int           { return len(mk.names) }
+func (mk mapKeys) Less(i, j int) bool { return mk.names[i] < mk.names[j] }
+func (mk mapKeys) Swap(i, j int) {
+	mk.names[i], mk.names[j] = mk.names[j], mk.names[i]
+	mk.keys[i], mk.keys[j] = mk.keys[j], mk.keys[i]
+}
+
+// mapKeyName returns the key of a map entry in the *Value tree, following
+// the rules of encoding/json: strings are used as is, encoding.TextMarshaler
+// keys are marshaled and integers are formatted in decimal. Other keys are
+// formatted with fmt.
+func mapKeyName(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		b, err := tm.MarshalText()
+		return string(b), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return fmt.Sprintf("%v", k.Interface()), nil
+}
 
+func (vm *valueMapper) ptrToValue(v reflect.Value, result *Value) {
+	if v.IsNil() {
+		// nil pointers all share the address 0, so they are not tracked:
+		// each one is a distinct node, never a ref to another nil pointer
+		// that Flatten and ComputePatch could not resolve
+		result.Refid = vm.nextRefid()
+		result.Kind = Ptr
+		return
+	}
 	if refid, ok := vm.refs[v.Pointer()]; ok {
 		result.Refid = vm.nextRefid()
 		result.Kind = Ref
 		result.Value = refid
-		return result, nil
+		return
+	}
+	if vm.opts.MaxDepth > 0 && vm.depth >= vm.opts.MaxDepth {
+		// registered like a pointer: the stub stands for it, the other
+		// occurrences are refs to the stub
+		result.Refid = vm.saveRef(v)
+		result.Kind = Stub
+		result.Value = v.Type().Elem().String()
+		return
 	}
 
 	result.Refid = vm.saveRef(v)
 	result.Kind = Ptr
 
-	if v.IsNil() || v.Elem().Interface() == nil {
+	if v.Elem().Interface() == nil {
 		// nil values a final, no further elements
 		result.Value = nil
-		return result, nil
+		return
 	}
 
-	// recursively proceed to the pointer value
-	var val *Value
-	val, err = vm.toValue(v.Elem())
-	if err != nil {
-		return nil, err
-	}
+	// proceed to the pointer value
+	val := &Value{}
 	result.Value = val
-	return result, err
+	vm.push(v.Elem(), val)
+	vm.stack[len(vm.stack)-1].depth++
 }
 
-func (vm *valueMapper) sliceToValue(v reflect.Value, kind reflect.Kind) (result *Value, err error) {
-	result = &Value{}
-
+func (vm *valueMapper) sliceToValue(v reflect.Value, kind reflect.Kind, result *Value) {
 	if vm.allRefids {
 		result.Refid = vm.nextRefid()
 	}
 	result.Kind = Kind(kind.String())
-	result.Value, err = vm.toValueSlice(v)
-	if err != nil {
-		return nil, err
-	}
-
-	return result, nil
+	result.Value = vm.toValueSlice(v)
 }
 
-func (vm *valueMapper) mapOrStructToValue(v reflect.Value, kind reflect.Kind) (result *Value, err error) {
-	result = &Value{}
-
+func (vm *valueMapper) mapOrStructToValue(v reflect.Value, kind reflect.Kind, result *Value) (err error) {
 	if vm.allRefids {
 		result.Refid = vm.nextRefid()
 	}
@@ -185,30 +296,26 @@ func (vm *valueMapper) mapOrStructToValue(v reflect.Value, kind reflect.Kind) (r
 	// not only maps can be set here, but also slices as they
 	// can be represented as a map[fieldName]value
 	result.Value, err = vm.toValueMap(v)
-	if err != nil {
-		return nil, err
-	}
-
-	return result, nil
+	return err
 }
 
-func (vm *valueMapper) scalarToValue(v reflect.Value) (result *Value, err error) {
-	result = &Value{}
-
+func (vm *valueMapper) scalarToValue(v reflect.Value, result *Value) error {
 	// here we process the remaining kinds ("simple" ones)
 	if vm.allRefids {
 		result.Refid = vm.nextRefid()
 	}
 	result.Kind = Kind(v.Type().Name())
 	if result.Kind == "" {
-		return nil, &InvalidMapperKindError{Kind: ""}
+		return &InvalidMapperKindError{Kind: ""}
 	}
 	result.Value = v.Interface()
 
-	return result, nil
+	return nil
 }
 
-func (vm *valueMapper) toValue(v reflect.Value) (result *Value, err error) {
+// fillValue transforms a single value into result. Nested values are
+// not processed here, they are pushed to the work stack instead.
+func (vm *valueMapper) fillValue(v reflect.Value, result *Value) error {
 	kind := v.Kind()
 
 	// special case for interface (internally interfaces act similarly to pointers,
@@ -219,17 +326,51 @@ func (vm *valueMapper) toValue(v reflect.Value) (result *Value, err error) {
 	}
 
 	switch kind {
-	case reflect.Chan, reflect.Func, reflect.Uintptr, reflect.UnsafePointer:
-		return nil, &InvalidMapperKindError{Kind: kind.String()}
+	case reflect.Chan, reflect.Func:
+		return vm.funcOrChanToValue(v, kind, result)
+	case reflect.Uintptr, reflect.UnsafePointer:
+		return &InvalidMapperKindError{Kind: kind.String()}
 	case reflect.Ptr:
-		return vm.ptrToValue(v)
+		vm.ptrToValue(v, result)
+		return nil
 	case reflect.Array, reflect.Slice:
-		return vm.sliceToValue(v, kind)
+		vm.sliceToValue(v, kind, result)
+		return nil
 	case reflect.Struct, reflect.Map:
-		return vm.mapOrStructToValue(v, kind)
+		return vm.mapOrStructToValue(v, kind, result)
 	default:
-		return vm.scalarToValue(v)
+		return vm.scalarToValue(v, result)
+	}
+}
+
+// toValue transforms v to *Value. The graph is traversed depth-first
+// using an explicit work stack rather than recursion, so arbitrarily
+// deep graphs (e.g. long linked lists) are processed in bounded
+// goroutine stack space.
+func (vm *valueMapper) toValue(v reflect.Value) (*Value, error) {
+	filter, err := newFieldFilter(&vm.opts)
+	if err != nil {
+		return nil, err
 	}
+	vm.filter = filter
+	result := &Value{}
+	vm.tracker.progress = vm.opts.Progress
+	vm.push(v, result)
+	for len(vm.stack) > 0 {
+		t := vm.stack[len(vm.stack)-1]
+		vm.stack = vm.stack[:len(vm.stack)-1]
+		vm.path, vm.depth = t.path, t.depth
+		err := vm.fillValue(t.v, t.result)
+		if err == nil {
+			err = vm.tracker.visit()
+		}
+		if err != nil {
+			vm.stack = vm.stack[:0]
+			return nil, err
+		}
+	}
+	vm.tracker.done()
+	return result, nil
 }
 
 // ToValue transforms i to *Value.
@@ -245,7 +386,8 @@ func (vm *valueMapper) toValue(v reflect.Value) (result *Value, err error) {
 //   - non-serializable types (func, chan) will lead to a mapping error.
 //   - there are unsupported serializable types: complex[64,128], unsafe pointer.
 //   - ptr type will produce *Value with an underlying value.
-//   - nil ptr will result in (*Value).Value set to nil.
+//   - nil ptr will result in (*Value).Value set to nil. Every nil ptr gets its own
+//     Refid and is never referenced, as nil pointers don't share a target.
 //   - each non-nil pointer Refid is stored in a Refid map. This map is used
 //     to break circular references (when transforming a pointer the Refid map is being checked,
 //     and if the pointer is already on the list, (*Value).Kind is set to a special "ref" type
@@ -256,6 +398,9 @@ func (vm *valueMapper) toValue(v reflect.Value) (result *Value, err error) {
 //     exported but its json tag value is set to "_" or "-", it will be ignored.
 //   - map will produce a map of *Value with the key names that correspond to the original
 //     map keys, and the values will be *Value, with corresponding map values transformed.
+//     Keys are converted to strings like encoding/json does (see mapKeyName) and the
+//     entries are transformed in the order of the sorted keys, so the refids, and thus
+//     the output, are the same on every run.
 //   - slice will produce a slice of *Value in the same order like the original slice has
 //   - i is expected to be a pointer, but if it's not, a pointer from it will be created,
 //     it means that even for "simple" types the resulting (*Value).Value will hold *Value
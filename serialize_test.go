@@ -3,6 +3,8 @@ package tahwil_test
 import (
 	"encoding/json"
 	"reflect"
+	"runtime/debug"
+	"strconv"
 	"testing"
 	"unsafe"
 
@@ -555,3 +557,154 @@ func TestToValueCompat(t *testing.T) {
 		t.Errorf("expected Children refid 4, got %d", fields["Children"].Refid)
 	}
 }
+
+// TestToValue_LongChain verifies that a very long linked list is
+// transformed and restored without deep recursion.
+func TestToValue_LongChain(t *testing.T) {
+	n := 1000000
+	if testing.Short() {
+		n = 100000
+	}
+	head := &listNodeT{Value: 1}
+	p := head
+	for i := 2; i <= n; i++ {
+		p.Next = &listNodeT{Value: i}
+		p = p.Next
+	}
+
+	// a recursive traversal needs far more than 1MB of stack for this chain
+	defer debug.SetMaxStack(debug.SetMaxStack(1 << 20))
+
+	v, err := tahwil.ToValue(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result listNodeT
+	if err = tahwil.FromValue(v, &result); err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	for p := &result; p != nil; p = p.Next {
+		count++
+		if p.Value != count {
+			t.Fatalf("node %d has value %d", count, p.Value)
+		}
+	}
+	if count != n {
+		t.Errorf("chain length = %d, want %d", count, n)
+	}
+}
+
+func TestToValue_NilPointers(t *testing.T) {
+	// nil pointers share the address 0 but must not become refs to each other
+	type pairT struct {
+		A *int
+		B *int
+	}
+	v, err := tahwil.ToValue(&pairT{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := v.Value.(*tahwil.Value).Value.(map[string]*tahwil.Value)
+	want := map[string]*tahwil.Value{
+		"A": {Refid: 2, Kind: tahwil.Ptr},
+		"B": {Refid: 3, Kind: tahwil.Ptr},
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("mismatch\nhave: %+v, %+v\nwant: %+v, %+v", fields["A"], fields["B"], want["A"], want["B"])
+	}
+}
+
+type textKeyT struct {
+	A, B int
+}
+
+func (k textKeyT) MarshalText() ([]byte, error) {
+	return []byte(strconv.Itoa(k.A) + "-" + strconv.Itoa(k.B)), nil
+}
+
+func TestToValue_DeterministicRefids(t *testing.T) {
+	// the map entries hold pointers, so their refids depend on the order
+	// the entries are visited in
+	m := make(map[string]*childSerT)
+	for i := 0; i < 50; i++ {
+		m["child "+strconv.Itoa(i)] = &childSerT{Name: strconv.Itoa(i)}
+	}
+	first, err := tahwil.ToValue(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := json.Marshal(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		v, err := tahwil.ToValue(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(have) != string(want) {
+			t.Fatalf("run %d: output differs\nhave: %s\nwant: %s", i, have, want)
+		}
+	}
+
+	// "child 0" < "child 1" < "child 10" < ...: refids follow the sorted keys
+	entries := first.Value.(*tahwil.Value).Value.(map[string]*tahwil.Value)
+	if entries["child 0"].Refid != 2 || entries["child 1"].Refid != 4 || entries["child 10"].Refid != 6 {
+		t.Errorf("unexpected refids: %d, %d, %d", entries["child 0"].Refid, entries["child 1"].Refid, entries["child 10"].Refid)
+	}
+}
+
+func TestToValue_MapKeys(t *testing.T) {
+	v, err := tahwil.ToValue(map[textKeyT]int{{1, 2}: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := v.Value.(*tahwil.Value).Value.(map[string]*tahwil.Value)
+	if _, ok := entries["1-2"]; !ok {
+		t.Errorf("expected the key to be marshaled as text, got %v", entries)
+	}
+
+	v, err = tahwil.ToValue(map[int8]bool{-3: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries = v.Value.(*tahwil.Value).Value.(map[string]*tahwil.Value)
+	if _, ok := entries["-3"]; !ok {
+		t.Errorf("expected a decimal key, got %v", entries)
+	}
+}
+
+func TestToValue_NilPointersTable(t *testing.T) {
+	// the second nil pointer used to be a ref to the first one, which
+	// has no node in a Table
+	type pairT struct {
+		A *int
+		B *int
+		C *int
+	}
+	c := 1
+	tbl, err := tahwil.ToTable(&pairT{C: &c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := tahwil.Unflatten(tbl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = v.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	res := &pairT{}
+	if err = tahwil.FromTable(tbl, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.A != nil || res.B != nil || res.C == nil || *res.C != 1 {
+		t.Errorf("unexpected result %+v", res)
+	}
+}
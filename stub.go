@@ -0,0 +1,33 @@
+package tahwil
+
+import (
+	"reflect"
+	"strconv"
+)
+
+func (vu *valueUnmapper) fromStubValue(data *Value, v reflect.Value) error {
+	if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface {
+		return &InvalidUnmapperKindError{Expected: string(Ptr), Kind: v.Kind().String()}
+	}
+	typeName, ok := data.Value.(string)
+	if !ok {
+		return &InvalidValueError{Value: data.Value, Kind: data.Kind}
+	}
+	v.Set(reflect.Zero(v.Type()))
+	if vu.opts.FetchStub == nil {
+		return nil
+	}
+	x, err := vu.opts.FetchStub(data.Refid, typeName)
+	if err != nil {
+		return &UnmapperError{cause: err}
+	}
+	if x == nil {
+		return nil
+	}
+	rx := reflect.ValueOf(x)
+	if !rx.Type().AssignableTo(v.Type()) {
+		return &UnmapperError{text: "stub " + strconv.FormatUint(data.Refid, 10) + " fetched as " + rx.Type().String() + ", can't be assigned to " + v.Type().String()}
+	}
+	v.Set(rx)
+	return nil
+}
@@ -0,0 +1,182 @@
+package tahwil_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+func TestToValueWithOptions_MaxDepth(t *testing.T) {
+	v, err := tahwil.ToValueWithOptions(newList(5), &tahwil.Options{MaxDepth: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub, err := v.Get("Next", "Next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stub.Kind != tahwil.Stub || stub.Value != "tahwil_test.listNodeT" || stub.Refid == 0 {
+		t.Fatalf("stub = %+v", stub)
+	}
+	if err = v.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+
+	// stubs survive the JSON and binary round trips
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON tahwil.Value
+	if err = json.Unmarshal(data, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	bin, err := fromJSON.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromBinary tahwil.Value
+	if err = fromBinary.UnmarshalBinary(bin); err != nil {
+		t.Fatal(err)
+	}
+	if !tahwil.Equal(v, &fromBinary) {
+		t.Errorf("round trip changed the value")
+	}
+	if c := tahwil.Canonicalize(v); !tahwil.Equal(c, v) {
+		t.Errorf("Canonicalize() changed the value")
+	}
+
+	var out listNodeT
+	if err = tahwil.FromValue(v, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Value != 1 || out.Next.Value != 2 || out.Next.Next != nil {
+		t.Errorf("FromValue() = %+v", out)
+	}
+
+	res, err := tahwil.ToInterface(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := (*res.(*any)).(map[string]any)["Next"].(*any)
+	if p := (*next).(map[string]any)["Next"].(*any); p != nil {
+		t.Errorf("ToInterface() stub = %v, want a nil *any", p)
+	}
+}
+
+func TestToValueWithOptions_MaxDepthRefs(t *testing.T) {
+	// targets already encoded are referred to, not stubbed
+	u := &userT{Name: "u"}
+	u.Friend = u
+	v, err := tahwil.ToValueWithOptions(u, &tahwil.Options{MaxDepth: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := v.Get("Friend"); f.Kind != tahwil.Ref {
+		t.Errorf("Friend is a %s, want a ref", f.Kind)
+	}
+
+	// a target stubbed first is referred to by its other occurrences,
+	// even within the limit
+	w := &userT{Name: "w"}
+	type sharedT struct {
+		A *customerT
+		B *userT
+	}
+	if v, err = tahwil.ToValueWithOptions(&sharedT{&customerT{User: w}, w}, &tahwil.Options{MaxDepth: 2}); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := v.Get("A", "User")
+	b, _ := v.Get("B")
+	if a.Kind != tahwil.Stub || b.Kind != tahwil.Ref || b.Value != a.Refid {
+		t.Fatalf("A.User = %+v, B = %+v, want B to be a ref to the stub", a, b)
+	}
+	if err = v.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+	if c := tahwil.Canonicalize(v); !tahwil.Equal(c, v) {
+		t.Errorf("Canonicalize() changed the value")
+	}
+	table, err := tahwil.Flatten(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := tahwil.Unflatten(table); err != nil || !tahwil.Equal(u, v) {
+		t.Errorf("Unflatten(Flatten()) = %v, want the value back", err)
+	}
+	g, err := tahwil.NewGraph(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := g.Resolve(b); n != a {
+		t.Errorf("Resolve(B) = %+v, want the stub", n)
+	}
+
+	// the stub and the ref are decoded to the same value
+	fetched := &userT{Name: "fetched"}
+	opts := &tahwil.Options{FetchStub: func(uint64, string) (any, error) { return fetched, nil }}
+	var out sharedT
+	if err = tahwil.FromValueWithOptions(v, &out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if out.A.User != fetched || out.B != fetched {
+		t.Errorf("FromValueWithOptions() = %+v, want A.User and B fetched", out)
+	}
+	var fromTable sharedT
+	if err = tahwil.FromTable(table, &fromTable); err != nil {
+		t.Fatal(err)
+	}
+	if fromTable.A.User != nil || fromTable.B != nil {
+		t.Errorf("FromTable() = %+v, want nil stubs", fromTable)
+	}
+	kept := userT{Name: "kept"}
+	if err = tahwil.FromValuePath(v, "B", &kept); err != nil || kept.Name != "kept" {
+		t.Errorf("FromValuePath() = %v, %+v, want the value unchanged", err, kept)
+	}
+	res, err := tahwil.ToInterface(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := (*res.(*any)).(map[string]any)["B"].(*any); p != nil {
+		t.Errorf("ToInterface() ref to a stub = %v, want a nil *any", p)
+	}
+}
+
+func TestFromValueWithOptions_FetchStub(t *testing.T) {
+	v, err := tahwil.ToValueWithOptions(newList(5), &tahwil.Options{MaxDepth: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub, _ := v.Get("Next", "Next")
+
+	var gotRefid uint64
+	var gotType string
+	opts := &tahwil.Options{FetchStub: func(refid uint64, typeName string) (any, error) {
+		gotRefid, gotType = refid, typeName
+		return &listNodeT{Value: 3}, nil
+	}}
+	var out listNodeT
+	if err = tahwil.FromValueWithOptions(v, &out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if out.Next.Next == nil || out.Next.Next.Value != 3 {
+		t.Errorf("stub was not fetched")
+	}
+	if gotRefid != stub.Refid || gotType != "tahwil_test.listNodeT" {
+		t.Errorf("FetchStub() called with %d, %q", gotRefid, gotType)
+	}
+
+	errFetch := errors.New("fetch failed")
+	opts.FetchStub = func(uint64, string) (any, error) { return nil, errFetch }
+	if err = tahwil.FromValueWithOptions(v, &listNodeT{}, opts); !errors.Is(err, errFetch) {
+		t.Errorf("FromValueWithOptions() error = %v, want %v", err, errFetch)
+	}
+
+	opts.FetchStub = func(uint64, string) (any, error) { return &userT{}, nil }
+	var ue *tahwil.UnmapperError
+	if err = tahwil.FromValueWithOptions(v, &listNodeT{}, opts); !errors.As(err, &ue) {
+		t.Errorf("FromValueWithOptions() error = %v, want an *UnmapperError", err)
+	}
+}
@@ -0,0 +1,306 @@
+package tahwil
+
+import (
+	"reflect"
+)
+
+// Table is a normalized (flat) layout of a *Value tree. Every pointer
+// target is stored once in Nodes, keyed by the refid of its pointer, and
+// every non-nil pointer inside a node is replaced by a Ref to that refid.
+// Refs to nil pointers, which older versions of ToValue produced, are
+// replaced by nil pointers. Stubs stay in the nodes they are met in, and
+// so do the refs to them. Root holds the refid of the root pointer, or 0 if the root is nil.
+//
+// Unlike the nested tree, the nesting depth of a Table does not grow with
+// the length of pointer chains, so long linked lists and deep trees
+// produce shallow JSON.
+type Table struct {
+	Root  uint64            `json:"root"`
+	Nodes map[uint64]*Value `json:"nodes"`
+}
+
+// ToTable transforms i to *Table. It is equivalent to calling ToValue
+// followed by Flatten.
+func ToTable(i any) (*Table, error) {
+	v, err := ToValue(i)
+	if err != nil {
+		return nil, err
+	}
+	return Flatten(v)
+}
+
+// Flatten converts a *Value tree, as produced by ToValue, into a *Table.
+// The root must be a pointer (or a nil *Value). The input tree is not
+// modified; scalar nodes may be shared between the input and the result.
+func Flatten(v *Value) (*Table, error) {
+	t := &Table{Nodes: make(map[uint64]*Value)}
+	if v == nil {
+		return t, nil
+	}
+	if v.Kind != Ptr {
+		return nil, &InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	if v.Value == nil {
+		return t, nil
+	}
+
+	t.Root = v.Refid
+	st := &flattenState{nils: make(map[uint64]bool)}
+	if _, err := t.addNode(v, st); err != nil {
+		return nil, err
+	}
+
+	for len(st.stack) > 0 {
+		n := st.stack[len(st.stack)-1]
+		st.stack = st.stack[:len(st.stack)-1]
+		err := forEachChild(n, func(child *Value) (*Value, error) {
+			return t.flattenChild(child, st)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range st.refs {
+		if refid, err := refFromValue(r); err == nil && st.nils[refid] {
+			*r = Value{Refid: r.Refid, Kind: Ptr}
+		}
+	}
+	return t, nil
+}
+
+// flattenState holds the work left to Flatten
+type flattenState struct {
+	// stack holds the copied containers whose children still need to be flattened
+	stack []*Value
+	// nils holds the refids of the nil pointers met
+	nils map[uint64]bool
+	// refs holds copies of the refs met, which are replaced by nil
+	// pointers once all the nil pointers are known
+	refs []*Value
+}
+
+// addNode stores the target of the pointer p as a node and returns
+// the Ref that replaces p.
+func (t *Table) addNode(p *Value, st *flattenState) (*Value, error) {
+	inner, ok := p.AsPtr()
+	if !ok {
+		return nil, &InvalidValueError{Value: p.Value, Kind: p.Kind}
+	}
+	if _, ok := t.Nodes[p.Refid]; ok {
+		return nil, &InvalidValueError{Value: p.Refid, Kind: p.Kind}
+	}
+	node, err := t.flattenChild(inner, st)
+	if err != nil {
+		return nil, err
+	}
+	t.Nodes[p.Refid] = node
+	return &Value{Kind: Ref, Value: p.Refid}, nil
+}
+
+func (t *Table) flattenChild(child *Value, st *flattenState) (*Value, error) {
+	if child == nil {
+		return nil, nil
+	}
+	switch child.Kind {
+	case Ptr:
+		if child.Value == nil {
+			if child.Refid != 0 {
+				st.nils[child.Refid] = true
+			}
+			return child, nil
+		}
+		return t.addNode(child, st)
+	case Ref:
+		c := *child
+		st.refs = append(st.refs, &c)
+		return &c, nil
+	case Struct, Map, Slice, Array:
+		c, err := shallowCopy(child)
+		if err != nil {
+			return nil, err
+		}
+		st.stack = append(st.stack, c)
+		return c, nil
+	}
+	return child, nil
+}
+
+// shallowCopy copies a container node together with its payload, so that
+// the children of the copy can be replaced without touching the original.
+// The copy has the payload types of ToValue, and empty payloads are
+// copied as empty, not nil, containers.
+func shallowCopy(v *Value) (*Value, error) {
+	res := &Value{Refid: v.Refid, Kind: v.Kind}
+	if v.Value == nil {
+		return res, nil
+	}
+	if fields, ok := v.AsFields(); ok {
+		m := make(map[string]*Value, len(fields))
+		for k, x := range fields {
+			m[k] = x
+		}
+		res.Value = m
+		return res, nil
+	}
+	if elems, ok := v.AsSlice(); ok {
+		res.Value = append(make([]*Value, 0, len(elems)), elems...)
+		return res, nil
+	}
+	return nil, &InvalidValueError{Value: v.Value, Kind: v.Kind}
+}
+
+// forEachChild calls fn for every child of a container node copied by
+// shallowCopy and replaces the child with the result.
+func forEachChild(v *Value, fn func(*Value) (*Value, error)) error {
+	var err error
+	if fields, ok := v.AsFields(); ok {
+		for k, x := range fields {
+			if fields[k], err = fn(x); err != nil {
+				return err
+			}
+		}
+	}
+	if elems, ok := v.AsSlice(); ok {
+		for i, x := range elems {
+			if elems[i], err = fn(x); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// FromTable fills v, which must be a non-nil pointer, from a *Table.
+// Nodes are decoded one at a time: a Ref to a node allocates the target
+// and queues the node for decoding instead of descending into it, so the
+// decoding depth does not depend on the length of pointer chains.
+func FromTable(t *Table, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &UnmapperError{text: "value must be non-nil Pointer"}
+	}
+	if t == nil || t.Root == 0 {
+		return nil
+	}
+	root, ok := t.Nodes[t.Root]
+	if !ok {
+		return &UnmapperError{text: "root node not found"}
+	}
+
+	vu := newValueUnmapper()
+	vu.nodes = t.Nodes
+	vu.refs[t.Root] = rv
+	vu.pending = append(vu.pending, pendingNode{data: root, target: rv.Elem()})
+	return vu.fromPending()
+}
+
+// fromPending decodes the queued table nodes, including the ones queued
+// while decoding, and resolves the refs.
+func (vu *valueUnmapper) fromPending() error {
+	for len(vu.pending) > 0 {
+		n := vu.pending[len(vu.pending)-1]
+		vu.pending = vu.pending[:len(vu.pending)-1]
+		if err := vu.fromValue(n.data, n.target); err != nil {
+			return err
+		}
+	}
+
+	return vu.resolveDeferred()
+}
+
+// Unflatten converts a *Table back into a *Value tree. The first Ref to
+// every node met while walking the tree from the root is replaced by a
+// pointer to a copy of the node, the other Refs are kept. The result is
+// accepted by FromValue; a Table with no root gives a nil pointer. A Ref
+// to a nil pointer, which older versions of ToValue produced, becomes a
+// nil pointer; a ref to a stub is kept.
+func Unflatten(t *Table) (*Value, error) {
+	if t == nil || t.Root == 0 {
+		return &Value{Kind: Ptr}, nil
+	}
+
+	expanded := make(map[uint64]bool)
+	// nils holds the refids of the nil pointers met
+	nils := make(map[uint64]bool)
+	// stubs holds the refids of the stubs met
+	stubs := make(map[uint64]bool)
+	// dangling holds the refs to refids without a node, which are only
+	// valid if they point to one of the nil pointers or stubs
+	var dangling []danglingRef
+	// stack holds the copied containers whose children still need to be expanded
+	var stack []*Value
+	var expand func(child *Value) (*Value, error)
+	expand = func(child *Value) (*Value, error) {
+		if child == nil {
+			return nil, nil
+		}
+		switch child.Kind {
+		case Ref:
+			refid, err := refFromValue(child)
+			if err != nil {
+				return nil, err
+			}
+			node, ok := t.Nodes[refid]
+			if !ok {
+				c := &Value{Refid: child.Refid, Kind: Ptr}
+				dangling = append(dangling, danglingRef{refid: refid, ref: child, ptr: c})
+				return c, nil
+			}
+			if expanded[refid] {
+				return child, nil
+			}
+			expanded[refid] = true
+			inner, err := expand(node)
+			if err != nil {
+				return nil, err
+			}
+			return &Value{Refid: refid, Kind: Ptr, Value: inner}, nil
+		case Ptr:
+			if child.Value == nil && child.Refid != 0 {
+				nils[child.Refid] = true
+			}
+		case Stub:
+			if child.Refid != 0 {
+				stubs[child.Refid] = true
+			}
+		case Struct, Map, Slice, Array:
+			c, err := shallowCopy(child)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, c)
+			return c, nil
+		}
+		return child, nil
+	}
+
+	root, err := expand(&Value{Kind: Ref, Value: t.Root})
+	if err != nil {
+		return nil, err
+	}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if err = forEachChild(n, expand); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range dangling {
+		switch {
+		case stubs[d.refid]:
+			*d.ptr = *d.ref
+		case !nils[d.refid]:
+			return nil, &InvalidValueError{Value: d.refid, Kind: Ref}
+		}
+	}
+	return root, nil
+}
+
+// danglingRef is a ref to a refid without a node, replaced by the nil
+// pointer ptr, which becomes a copy of the ref again if it points to a
+// stub
+type danglingRef struct {
+	refid uint64
+	ref   *Value
+	ptr   *Value
+}
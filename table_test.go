@@ -0,0 +1,252 @@
+package tahwil_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+type listNodeT struct {
+	Value int
+	Next  *listNodeT
+}
+
+func TestToTable(t *testing.T) {
+	parent := &parentSerT{Name: "parent"}
+	parent.Children = []*childSerT{{Name: "child", Parent: parent}}
+
+	table, err := tahwil.ToTable(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &tahwil.Table{
+		Root: 1,
+		Nodes: map[uint64]*tahwil.Value{
+			1: {
+				Kind: tahwil.Struct,
+				Value: map[string]*tahwil.Value{
+					"Name": {Kind: tahwil.String, Value: "parent"},
+					"Children": {
+						Kind:  tahwil.Slice,
+						Value: []*tahwil.Value{{Kind: tahwil.Ref, Value: uint64(2)}},
+					},
+				},
+			},
+			2: {
+				Kind: tahwil.Struct,
+				Value: map[string]*tahwil.Value{
+					"Name":   {Kind: tahwil.String, Value: "child"},
+					"Parent": {Refid: 3, Kind: tahwil.Ref, Value: uint64(1)},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(table, want) {
+		x, _ := json.Marshal(table)
+		y, _ := json.Marshal(want)
+		t.Errorf("mismatch\nhave: %s\nwant: %s", x, y)
+	}
+}
+
+func TestFlatten_DoesNotModifyInput(t *testing.T) {
+	parent := &parentSerT{Name: "parent"}
+	parent.Children = []*childSerT{{Name: "child", Parent: parent}}
+	v, err := tahwil.ToValue(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tahwil.Flatten(v); err != nil {
+		t.Fatal(err)
+	}
+	after, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Errorf("input modified\nbefore: %s\nafter:  %s", before, after)
+	}
+}
+
+func TestFlatten_EmptySlice(t *testing.T) {
+	// an empty slice must not turn into a nil one
+	table, err := tahwil.ToTable(&parentSerT{Name: "parent", Children: []*childSerT{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, err := table.Nodes[table.Root].Get("Children")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elems, ok := children.AsSlice(); !ok || elems == nil {
+		t.Errorf("Children payload = %#v, want an empty slice", children.Value)
+	}
+
+	var out parentSerT
+	if err = tahwil.FromTable(table, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Children == nil || len(out.Children) != 0 {
+		t.Errorf("Children = %#v, want an empty slice", out.Children)
+	}
+
+	v, err := tahwil.Unflatten(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if children, err = v.Get("Children"); err != nil || children.Value == nil {
+		t.Errorf("Unflatten() Children = %v, %v", children, err)
+	}
+}
+
+func TestFlatten_Errors(t *testing.T) {
+	if _, err := tahwil.Flatten(&tahwil.Value{Kind: tahwil.String, Value: "x"}); err == nil {
+		t.Error("expected error for non-pointer root")
+	}
+	table, err := tahwil.Flatten(&tahwil.Value{Refid: 1, Kind: tahwil.Ptr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Root != 0 || len(table.Nodes) != 0 {
+		t.Errorf("expected empty table for nil root, got %+v", table)
+	}
+}
+
+func TestFromTable_JSONRoundTrip(t *testing.T) {
+	parent := &personT{Name: "Arthur"}
+	parent.Children = []*personT{{Name: "Ford", Parent: parent}, {Name: "Trillian", Parent: parent}}
+
+	table, err := tahwil.ToTable(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &tahwil.Table{}
+	if err = json.Unmarshal(b, decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	var result personT
+	if err = tahwil.FromTable(decoded, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Name != "Arthur" || len(result.Children) != 2 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	for i, c := range result.Children {
+		if c.Parent != &result {
+			t.Errorf("Children[%d].Parent does not point to the root", i)
+		}
+	}
+	if result.Children[0].Name != "Ford" || result.Children[1].Name != "Trillian" {
+		t.Errorf("unexpected children: %+v, %+v", result.Children[0], result.Children[1])
+	}
+}
+
+func TestFromTable_LongChain(t *testing.T) {
+	const n = 100000
+	table := &tahwil.Table{Root: 1, Nodes: make(map[uint64]*tahwil.Value, n)}
+	for i := 1; i <= n; i++ {
+		next := &tahwil.Value{Kind: tahwil.Ptr}
+		if i < n {
+			next = &tahwil.Value{Kind: tahwil.Ref, Value: uint64(i + 1)}
+		}
+		table.Nodes[uint64(i)] = &tahwil.Value{
+			Kind: tahwil.Struct,
+			Value: map[string]*tahwil.Value{
+				"Value": {Kind: tahwil.Int, Value: i},
+				"Next":  next,
+			},
+		}
+	}
+
+	var head listNodeT
+	if err := tahwil.FromTable(table, &head); err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for p := &head; p != nil; p = p.Next {
+		count++
+		if p.Value != count {
+			t.Fatalf("node %d has value %d", count, p.Value)
+		}
+	}
+	if count != n {
+		t.Errorf("chain length = %d, want %d", count, n)
+	}
+}
+
+func TestFromTable_Errors(t *testing.T) {
+	var result personT
+	if err := tahwil.FromTable(&tahwil.Table{Root: 1}, result); err == nil {
+		t.Error("expected error for non-pointer destination")
+	}
+	if err := tahwil.FromTable(&tahwil.Table{Root: 1}, &result); err == nil {
+		t.Error("expected error for missing root node")
+	}
+	table := &tahwil.Table{
+		Root: 1,
+		Nodes: map[uint64]*tahwil.Value{
+			1: {Kind: tahwil.Struct, Value: map[string]*tahwil.Value{"name": {Kind: tahwil.Ref, Value: uint64(2)}}},
+			2: {Kind: tahwil.String, Value: "x"},
+		},
+	}
+	if err := tahwil.FromTable(table, &result); err == nil {
+		t.Error("expected error for ref into a non-pointer field")
+	}
+}
+
+func TestUnflatten(t *testing.T) {
+	parent := &parentSerT{Name: "parent"}
+	parent.Children = []*childSerT{{Name: "child", Parent: parent}}
+
+	v, err := tahwil.ToValue(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := tahwil.Flatten(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tahwil.Unflatten(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, v) {
+		x, _ := json.Marshal(res)
+		y, _ := json.Marshal(v)
+		t.Errorf("mismatch\nhave: %s\nwant: %s", x, y)
+	}
+
+	out := &parentSerT{}
+	if err = tahwil.FromValue(res, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "parent" || len(out.Children) != 1 || out.Children[0].Parent != out {
+		t.Errorf("unexpected result: %+v", out)
+	}
+}
+
+func TestUnflatten_Errors(t *testing.T) {
+	if _, err := tahwil.Unflatten(&tahwil.Table{Root: 1}); err == nil {
+		t.Error("expected error for missing root node")
+	}
+	table := &tahwil.Table{
+		Root: 1,
+		Nodes: map[uint64]*tahwil.Value{
+			1: {Kind: tahwil.Slice, Value: []*tahwil.Value{{Kind: tahwil.Ref, Value: uint64(2)}}},
+		},
+	}
+	if _, err := tahwil.Unflatten(table); err == nil {
+		t.Error("expected error for ref to a missing node")
+	}
+}
@@ -0,0 +1,222 @@
+package tahwil
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// A ValidationError describes the first structural problem found by
+// Value.Validate.
+type ValidationError struct {
+	// Path locates the invalid node, see Walk
+	Path   Path
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Path) == 0 {
+		return "tahwil.Value.Validate: root: " + e.Reason
+	}
+	return "tahwil.Value.Validate: " + e.Path.String() + ": " + e.Reason
+}
+
+// pathLink is the last element of the path of a node, linked to the path
+// of its parent, so that the path of every node doesn't have to be
+// copied; a nil *pathLink is the empty path.
+type pathLink struct {
+	parent *pathLink
+	elem   any
+}
+
+func (l *pathLink) child(e any) *pathLink {
+	return &pathLink{parent: l, elem: e}
+}
+
+// path returns the path the link ends.
+func (l *pathLink) path() Path {
+	n := 0
+	for x := l; x != nil; x = x.parent {
+		n++
+	}
+	p := make(Path, n)
+	for x := l; x != nil; x = x.parent {
+		n--
+		p[n] = x.elem
+	}
+	return p
+}
+
+// validateTask checks n, or removes it from the current path if exit is set
+type validateTask struct {
+	path *pathLink
+	n    *Value
+	exit bool
+}
+
+type refNode struct {
+	path  *pathLink
+	refid uint64
+}
+
+type validator struct {
+	// nodes holds the nodes with a refid
+	nodes map[uint64]*Value
+	// paths holds the paths of the nodes with a refid
+	paths map[uint64]*pathLink
+	// onPath holds the nodes between the root and the current node
+	onPath map[*Value]bool
+	refs   []refNode
+	stack  []validateTask
+}
+
+func (vl *validator) push(path *pathLink, n *Value) {
+	vl.stack = append(vl.stack, validateTask{path: path, n: n})
+}
+
+// payloadValid reports whether the payload of a scalar node or a ref
+// matches its kind.
+func payloadValid(n *Value) bool {
+	var ok bool
+	switch n.Kind {
+	case Bool:
+		_, ok = n.AsBool()
+	case String, Stub:
+		_, ok = n.Value.(string)
+	case Func:
+		_, ok = n.Value.(string)
+		ok = ok || n.Value == nil
+	case Chan:
+		ok = n.Value == nil
+	case Int, Int8, Int16, Int32, Int64:
+		_, ok = n.AsInt64()
+	case Uint, Uint8, Uint16, Uint32, Uint64:
+		_, ok = n.AsUint64()
+	case Float32, Float64:
+		_, ok = n.AsFloat64()
+	case Ref:
+		_, ok = n.AsRef()
+	}
+	return ok
+}
+
+// check validates a single node. Children are not checked here, they
+// are pushed to the work stack instead.
+func (vl *validator) check(path *pathLink, n *Value) error {
+	fail := func(reason string) error {
+		return &ValidationError{Path: path.path(), Reason: reason}
+	}
+	if n == nil {
+		return fail("nil node")
+	}
+	if vl.onPath[n] {
+		return fail("node contains itself")
+	}
+	if _, ok := tagOfKind[n.Kind]; !ok {
+		return fail("unknown kind " + strconv.Quote(string(n.Kind)))
+	}
+	if n.Refid != 0 {
+		if _, ok := vl.nodes[n.Refid]; ok {
+			return fail("duplicate refid " + strconv.FormatUint(n.Refid, 10) + ", also used at " + pathOrRoot(vl.paths[n.Refid].path().String()))
+		}
+		vl.nodes[n.Refid] = n
+		vl.paths[n.Refid] = path
+	}
+	invalid := func() error {
+		return fail(fmt.Sprintf("invalid payload %T for kind %s", n.Value, n.Kind))
+	}
+
+	vl.onPath[n] = true
+	vl.stack = append(vl.stack, validateTask{n: n, exit: true})
+	switch n.Kind {
+	case Ptr:
+		inner, ok := n.AsPtr()
+		if !ok {
+			return invalid()
+		}
+		if n.Value != nil {
+			vl.push(path, inner)
+		}
+	case Struct, Map:
+		if n.Kind == Struct && n.Value == nil {
+			return invalid()
+		}
+		fields, ok := n.AsFields()
+		if !ok {
+			return invalid()
+		}
+		keys := sortedKeys(fields)
+		for i := len(keys) - 1; i >= 0; i-- {
+			vl.push(path.child(keys[i]), fields[keys[i]])
+		}
+	case Slice, Array:
+		elems, ok := n.AsSlice()
+		if !ok {
+			return invalid()
+		}
+		for i := len(elems) - 1; i >= 0; i-- {
+			vl.push(path.child(i), elems[i])
+		}
+	default:
+		if !payloadValid(n) {
+			return invalid()
+		}
+		if n.Kind == Ref {
+			refid, _ := n.AsRef()
+			vl.refs = append(vl.refs, refNode{path: path, refid: refid})
+		}
+	}
+	return nil
+}
+
+// checkRefs checks that every ref points to a pointer, or to the stub
+// standing for it.
+func (vl *validator) checkRefs() error {
+	for _, r := range vl.refs {
+		target, ok := vl.nodes[r.refid]
+		switch {
+		case !ok:
+			return &ValidationError{Path: r.path.path(), Reason: "ref to unknown refid " + strconv.FormatUint(r.refid, 10)}
+		case target.Kind == Ref:
+			return &ValidationError{Path: r.path.path(), Reason: "ref to ref " + strconv.FormatUint(r.refid, 10) + " at " + pathOrRoot(vl.paths[r.refid].path().String())}
+		case target.Kind != Ptr && target.Kind != Stub:
+			return &ValidationError{Path: r.path.path(), Reason: "ref to " + string(target.Kind) + " " + strconv.FormatUint(r.refid, 10) + " at " + pathOrRoot(vl.paths[r.refid].path().String())}
+		}
+	}
+	return nil
+}
+
+// Validate checks the structural integrity of the tree rooted at v, so
+// that malformed input, e.g. from another service, is reported before
+// FromValue runs. It reports the first of these problems it finds as a
+// *ValidationError:
+//   - nil nodes and unknown kinds;
+//   - payloads that don't match their kind, e.g. a string payload of an
+//     int node, or a struct node with no fields map;
+//   - refids used by more than one node;
+//   - refs to refids no node has, or whose node is neither a pointer
+//     nor a stub, including refs to refs;
+//   - nodes that contain themselves, i.e. cycles of *Value nodes that
+//     don't go through a ptr and a ref.
+//
+// Payloads may have the types produced by ToValue as well as the looser
+// map[string]any and []any shapes accepted by FromValue.
+func (v *Value) Validate() error {
+	vl := &validator{
+		nodes:  make(map[uint64]*Value),
+		paths:  make(map[uint64]*pathLink),
+		onPath: make(map[*Value]bool),
+	}
+	vl.push(nil, v)
+	for len(vl.stack) > 0 {
+		t := vl.stack[len(vl.stack)-1]
+		vl.stack = vl.stack[:len(vl.stack)-1]
+		if t.exit {
+			delete(vl.onPath, t.n)
+			continue
+		}
+		if err := vl.check(t.path, t.n); err != nil {
+			return err
+		}
+	}
+	return vl.checkRefs()
+}
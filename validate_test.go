@@ -0,0 +1,140 @@
+package tahwil_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+type validateT struct {
+	Name     string
+	Parent   *validateT
+	Children []*validateT
+	Meta     map[string]float64
+	Pair     [2]uint8
+}
+
+func TestValue_Validate(t *testing.T) {
+	root := &validateT{Name: "root", Meta: map[string]float64{"x": 1}}
+	root.Children = []*validateT{{Name: "a", Parent: root}}
+
+	v, err := tahwil.ToValue(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compat, err := tahwil.ToValueCompat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded tahwil.Value
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	table, err := tahwil.Flatten(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unflattened, err := tahwil.Unflatten(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tree := range map[string]*tahwil.Value{
+		"ToValue":       v,
+		"ToValueCompat": compat,
+		"UnmarshalJSON": &decoded,
+		"Unflatten":     unflattened,
+		"Canonicalize":  tahwil.Canonicalize(v),
+	} {
+		if err := tree.Validate(); err != nil {
+			t.Errorf("%s: Validate() = %v", name, err)
+		}
+	}
+}
+
+func TestValue_Validate_Errors(t *testing.T) {
+	ptr := func(refid uint64, inner *tahwil.Value) *tahwil.Value {
+		return &tahwil.Value{Refid: refid, Kind: tahwil.Ptr, Value: inner}
+	}
+	fields := func(m map[string]*tahwil.Value) *tahwil.Value {
+		return &tahwil.Value{Kind: tahwil.Struct, Value: m}
+	}
+	str := &tahwil.Value{Kind: tahwil.String, Value: "x"}
+	loop := &tahwil.Value{Kind: tahwil.Slice}
+	loop.Value = []*tahwil.Value{loop}
+
+	tests := []struct {
+		name string
+		v    *tahwil.Value
+		want string
+	}{
+		{"nil root", nil, "tahwil.Value.Validate: root: nil node"},
+		{"unknown kind", &tahwil.Value{Kind: "complex64"}, `tahwil.Value.Validate: root: unknown kind "complex64"`},
+		{"scalar payload", ptr(1, fields(map[string]*tahwil.Value{
+			"A": {Kind: tahwil.Int, Value: "1"},
+		})), "tahwil.Value.Validate: A: invalid payload string for kind int"},
+		{"nil pointer", &tahwil.Value{Refid: 1, Kind: tahwil.Ptr}, ""},
+		{"nil target", ptr(1, nil), "tahwil.Value.Validate: root: nil node"},
+		{"ptr to non-value", &tahwil.Value{Kind: tahwil.Ptr, Value: 1}, "tahwil.Value.Validate: root: invalid payload int for kind ptr"},
+		{"nil struct", ptr(1, &tahwil.Value{Kind: tahwil.Struct}), "tahwil.Value.Validate: root: invalid payload <nil> for kind struct"},
+		{"slice payload", ptr(1, &tahwil.Value{Kind: tahwil.Slice, Value: []any{1}}), "tahwil.Value.Validate: root: invalid payload []interface {} for kind slice"},
+		{"nil child", ptr(1, fields(map[string]*tahwil.Value{"A": nil})), "tahwil.Value.Validate: A: nil node"},
+		{"duplicate refid", ptr(1, fields(map[string]*tahwil.Value{
+			"A": ptr(2, str),
+			"B": ptr(2, str),
+		})), "tahwil.Value.Validate: B: duplicate refid 2, also used at A"},
+		{"unknown ref", ptr(1, fields(map[string]*tahwil.Value{
+			"A": {Kind: tahwil.Ref, Value: uint64(5)},
+		})), "tahwil.Value.Validate: A: ref to unknown refid 5"},
+		{"ref to ref", ptr(1, fields(map[string]*tahwil.Value{
+			"A": {Refid: 2, Kind: tahwil.Ref, Value: uint64(1)},
+			"B": {Kind: tahwil.Ref, Value: uint64(2)},
+		})), "tahwil.Value.Validate: B: ref to ref 2 at A"},
+		{"ref to struct", ptr(1, &tahwil.Value{Refid: 2, Kind: tahwil.Struct, Value: map[string]*tahwil.Value{
+			"A": {Kind: tahwil.Ref, Value: uint64(2)},
+		}}), "tahwil.Value.Validate: A: ref to struct 2 at root"},
+		{"negative ref", &tahwil.Value{Kind: tahwil.Ref, Value: -1}, "tahwil.Value.Validate: root: invalid payload int for kind ref"},
+		{"node cycle", ptr(1, loop), "tahwil.Value.Validate: [0]: node contains itself"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.v.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			var ve *tahwil.ValidationError
+			if !errors.As(err, &ve) {
+				t.Fatalf("Validate() = %v, want a *ValidationError", err)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("Validate() = %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValue_Validate_Deep(t *testing.T) {
+	// the paths are only built for the error, a deep tree doesn't copy
+	// them at every level
+	const depth = 100000
+	v := &tahwil.Value{Kind: tahwil.Int, Value: "x"}
+	for i := 0; i < depth; i++ {
+		v = &tahwil.Value{Kind: tahwil.Slice, Value: []*tahwil.Value{v}}
+	}
+	var ve *tahwil.ValidationError
+	if err := v.Validate(); !errors.As(err, &ve) {
+		t.Fatalf("Validate() = %v, want a *ValidationError", err)
+	}
+	if len(ve.Path) != depth || ve.Path[depth-1] != 0 {
+		t.Errorf("Validate() failed at a path of length %d, want %d", len(ve.Path), depth)
+	}
+}
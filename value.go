@@ -3,6 +3,7 @@ package tahwil
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 )
 
 type Value struct {
@@ -54,14 +55,15 @@ func fixStructOrMap(kind Kind, v any) (any, error) {
 	if !ok {
 		return nil, &InvalidValueError{Kind: kind, Value: v}
 	}
-	var err error
+	res := make(map[string]*Value, len(m))
 	for k, mv := range m {
-		m[k], err = fixTypes(Ptr, mv)
+		x, err := fixPtr(Ptr, mv)
 		if err != nil {
 			return nil, err
 		}
+		res[k] = x.(*Value)
 	}
-	return m, nil
+	return res, nil
 }
 
 func fixSlice(kind Kind, v any) (any, error) {
@@ -69,24 +71,33 @@ func fixSlice(kind Kind, v any) (any, error) {
 	if !ok {
 		return nil, &InvalidValueError{Kind: kind, Value: v}
 	}
-	var err error
-	for k, mv := range m {
-		m[k], err = fixTypes(Ptr, mv)
+	res := make([]*Value, len(m))
+	for i, mv := range m {
+		x, err := fixPtr(Ptr, mv)
 		if err != nil {
 			return nil, err
 		}
+		res[i] = x.(*Value)
 	}
-	return m, nil
+	return res, nil
 }
 
-// fixTypes recursively fixes field types after json.Unmarshal
+// fixTypes recursively fixes field types after json.Unmarshal, so that
+// payloads have the same types as the ones produced by ToValue.
 //
 //nolint:gocyclo // go lacks generics and as such there is no further way to optimize it
 func fixTypes(kind Kind, v any) (res any, err error) {
 	switch kind {
-	case String, Bool:
+	case String, Bool, Func, Stub:
 		return v, nil
-	case Ref, Int:
+	case Chan:
+		if v != nil {
+			return nil, &InvalidValueError{Kind: kind, Value: v}
+		}
+		return nil, nil
+	case Ref:
+		return uint64(v.(float64)), nil
+	case Int:
 		return int(v.(float64)), nil
 	case Int8:
 		return int8(v.(float64)), nil
@@ -152,3 +163,14 @@ func (v *Value) UnmarshalJSON(b []byte) error {
 
 	return nil
 }
+
+// sortedKeys returns the keys of the fields of a struct or map payload
+// in sorted order.
+func sortedKeys(fields map[string]*Value) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -187,7 +187,7 @@ func unmarshalJSONTests() []unmarshalJSONTest {
 		Value: &tahwil.Value{
 			Refid: 2,
 			Kind:  tahwil.Struct,
-			Value: map[string]any{
+			Value: map[string]*tahwil.Value{
 				"name": &tahwil.Value{
 					Refid: 3,
 					Kind:  tahwil.String,
@@ -196,7 +196,7 @@ func unmarshalJSONTests() []unmarshalJSONTest {
 				"children": &tahwil.Value{
 					Refid: 4,
 					Kind:  tahwil.Slice,
-					Value: []any{},
+					Value: []*tahwil.Value{},
 				},
 			},
 		},
@@ -257,7 +257,7 @@ func unmarshalJSONTests() []unmarshalJSONTest {
 		Value: &tahwil.Value{
 			Refid: 2,
 			Kind:  tahwil.Struct,
-			Value: map[string]any{
+			Value: map[string]*tahwil.Value{
 				"name": &tahwil.Value{
 					Refid: 3,
 					Kind:  tahwil.String,
@@ -271,14 +271,14 @@ func unmarshalJSONTests() []unmarshalJSONTest {
 				"children": &tahwil.Value{
 					Refid: 5,
 					Kind:  tahwil.Slice,
-					Value: []any{
+					Value: []*tahwil.Value{
 						&tahwil.Value{
 							Refid: 6,
 							Kind:  tahwil.Ptr,
 							Value: &tahwil.Value{
 								Refid: 7,
 								Kind:  tahwil.Struct,
-								Value: map[string]any{
+								Value: map[string]*tahwil.Value{
 									"name": &tahwil.Value{
 										Refid: 8,
 										Kind:  tahwil.String,
@@ -287,12 +287,12 @@ func unmarshalJSONTests() []unmarshalJSONTest {
 									"parent": &tahwil.Value{
 										Refid: 9,
 										Kind:  tahwil.Ref,
-										Value: 1,
+										Value: uint64(1),
 									},
 									"children": &tahwil.Value{
 										Refid: 10,
 										Kind:  tahwil.Slice,
-										Value: []any{},
+										Value: []*tahwil.Value{},
 									},
 								},
 							},
@@ -313,7 +313,7 @@ func unmarshalJSONTests() []unmarshalJSONTest {
 			Kind:  "chan",
 			Value: "aaa",
 		},
-		err: &tahwil.InvalidValueKindError{Kind: "chan"},
+		err: &tahwil.InvalidValueError{Kind: tahwil.Chan, Value: "aaa"},
 	})
 	res = append(res, unmarshalJSONTest{
 		in: `{
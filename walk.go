@@ -0,0 +1,379 @@
+package tahwil
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"unicode"
+)
+
+// Path locates a node in a *Value tree. Its elements are strings, the
+// keys of struct fields and map entries, and ints, the indices of slice
+// and array elements. Pointers add no element: a pointer and its target
+// have the same path.
+type Path []any
+
+// String returns the path in Go-like notation, e.g.
+// Children[0].Name or Meta["first name"]. Keys which are not identifiers
+// are quoted.
+func (p Path) String() string {
+	var b []byte
+	for _, e := range p {
+		switch x := e.(type) {
+		case int:
+			b = append(b, '[')
+			b = strconv.AppendInt(b, int64(x), 10)
+			b = append(b, ']')
+		case string:
+			if !isIdent(x) {
+				b = append(b, '[')
+				b = strconv.AppendQuote(b, x)
+				b = append(b, ']')
+				continue
+			}
+			if len(b) > 0 {
+				b = append(b, '.')
+			}
+			b = append(b, x...)
+		default:
+			b = append(b, fmt.Sprintf("[%v]", x)...)
+		}
+	}
+	return string(b)
+}
+
+func isIdent(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// appendElem returns a new path, which doesn't share its backing array
+// with p.
+func (p Path) appendElem(e any) Path {
+	res := make(Path, len(p), len(p)+1)
+	copy(res, p)
+	return append(res, e)
+}
+
+// A PathError describes a path that can't be followed.
+type PathError struct {
+	// Path is the path up to, and including, the element that failed
+	Path   Path
+	Reason string
+}
+
+func (e *PathError) Error() string {
+	return "tahwil: path " + strconv.Quote(e.Path.String()) + ": " + e.Reason
+}
+
+// SkipChildren is used as a return value from the callbacks of Walk to
+// indicate that the children of the node are to be skipped. It is not
+// returned as an error by Walk. Like filepath.SkipDir, which it mirrors,
+// it is a sentinel rather than a failure, hence the name without the Err
+// prefix.
+var SkipChildren = errors.New("skip children")
+
+// walkTask is a node waiting to be visited. Its path is the first depth
+// elements of the path of the node visited last, followed by elem if
+// hasElem is set.
+type walkTask struct {
+	depth   int
+	elem    any
+	hasElem bool
+	n       *Value
+}
+
+// Walk calls fn for every node of the tree rooted at v, v included, in
+// preorder: struct fields and map entries in the order of their sorted
+// keys, slice and array elements by index. Nil children are skipped and
+// refs are not followed. If fn returns SkipChildren the children of the
+// node are skipped; any other error stops the walk and is returned.
+//
+// The path passed to fn is only valid until fn returns: Walk reuses its
+// backing array for the next nodes, so fn must copy it to keep it.
+func (v *Value) Walk(fn func(path Path, n *Value) error) error {
+	if v == nil {
+		return nil
+	}
+	path := Path{}
+	stack := []walkTask{{n: v}}
+	for len(stack) > 0 {
+		t := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		path = path[:t.depth]
+		if t.hasElem {
+			path = append(path, t.elem)
+		}
+		if err := fn(path, t.n); err != nil {
+			if errors.Is(err, SkipChildren) {
+				continue
+			}
+			return err
+		}
+		switch t.n.Kind {
+		case Ptr:
+			inner, ok := t.n.AsPtr()
+			if !ok {
+				return &InvalidValueError{Value: t.n.Value, Kind: t.n.Kind}
+			}
+			if inner != nil {
+				stack = append(stack, walkTask{depth: len(path), n: inner})
+			}
+		case Struct, Map:
+			fields, ok := t.n.AsFields()
+			if !ok {
+				return &InvalidValueError{Value: t.n.Value, Kind: t.n.Kind}
+			}
+			keys := sortedKeys(fields)
+			for i := len(keys) - 1; i >= 0; i-- {
+				if x := fields[keys[i]]; x != nil {
+					stack = append(stack, walkTask{depth: len(path), elem: keys[i], hasElem: true, n: x})
+				}
+			}
+		case Slice, Array:
+			elems, ok := t.n.AsSlice()
+			if !ok {
+				return &InvalidValueError{Value: t.n.Value, Kind: t.n.Kind}
+			}
+			for i := len(elems) - 1; i >= 0; i-- {
+				if elems[i] != nil {
+					stack = append(stack, walkTask{depth: len(path), elem: i, hasElem: true, n: elems[i]})
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Children returns the direct children of v: the target of a pointer,
+// the fields or entries of a struct or map in the order of their sorted
+// keys, or the elements of a slice or array. Nil children are skipped.
+// Scalars, refs and malformed payloads have no children.
+func (v *Value) Children() []*Value {
+	if v == nil {
+		return nil
+	}
+	var res []*Value
+	switch v.Kind {
+	case Ptr:
+		if inner, _ := v.AsPtr(); inner != nil {
+			res = append(res, inner)
+		}
+	case Struct, Map:
+		fields, ok := v.AsFields()
+		if !ok {
+			return nil
+		}
+		keys := sortedKeys(fields)
+		for _, k := range keys {
+			if fields[k] != nil {
+				res = append(res, fields[k])
+			}
+		}
+	case Slice, Array:
+		elems, ok := v.AsSlice()
+		if !ok {
+			return nil
+		}
+		for _, x := range elems {
+			if x != nil {
+				res = append(res, x)
+			}
+		}
+	}
+	return res
+}
+
+// Get returns the node at path below v, e.g. v.Get("Children", 0,
+// "Name"). Pointers met on the way, v included, are dereferenced; the
+// node returned is the one stored at the end of the path, which may be a
+// pointer itself. Refs can't be followed without an index of the tree:
+// use Graph.Get for paths going through refs.
+func (v *Value) Get(path ...any) (*Value, error) {
+	return get(nil, v, path)
+}
+
+// get follows path from n, resolving refs through g if it's not nil.
+func get(g *Graph, n *Value, path []any) (*Value, error) {
+	for i, key := range path {
+		fail := func(reason string) error {
+			return &PathError{Path: append(Path{}, path[:i+1]...), Reason: reason}
+		}
+		for refs := 0; n != nil && (n.Kind == Ptr || n.Kind == Ref); {
+			if n.Kind == Ref {
+				if g == nil {
+					return nil, fail("unresolved ref")
+				}
+				// a pointer holding a ref to itself would loop forever
+				if refs++; refs > len(g.ptrs) {
+					return nil, fail("ref cycle")
+				}
+				p, err := g.Resolve(n)
+				if err != nil {
+					return nil, fail(err.Error())
+				}
+				if n = p; n.Kind == Stub {
+					break
+				}
+			}
+			inner, ok := n.AsPtr()
+			if !ok {
+				return nil, &InvalidValueError{Value: n.Value, Kind: n.Kind}
+			}
+			if inner == nil {
+				return nil, fail("nil pointer")
+			}
+			n = inner
+		}
+		if n == nil {
+			return nil, fail("nil value")
+		}
+
+		switch n.Kind {
+		case Struct, Map:
+			k, ok := key.(string)
+			if !ok {
+				return nil, fail(fmt.Sprintf("invalid key %v for a %s", key, n.Kind))
+			}
+			fields, ok := n.AsFields()
+			if !ok {
+				return nil, &InvalidValueError{Value: n.Value, Kind: n.Kind}
+			}
+			child, ok := fields[k]
+			if !ok {
+				return nil, fail("unknown key " + strconv.Quote(k))
+			}
+			n = child
+		case Slice, Array:
+			idx, ok := key.(int)
+			if !ok {
+				return nil, fail(fmt.Sprintf("invalid index %v for a %s", key, n.Kind))
+			}
+			elems, ok := n.AsSlice()
+			if !ok {
+				return nil, &InvalidValueError{Value: n.Value, Kind: n.Kind}
+			}
+			if idx < 0 || idx >= len(elems) {
+				return nil, fail("index out of range [" + strconv.Itoa(idx) + "] with length " + strconv.Itoa(len(elems)))
+			}
+			n = elems[idx]
+		default:
+			return nil, fail("not a container: " + string(n.Kind))
+		}
+	}
+	return n, nil
+}
+
+// Graph is an index of the pointers of a *Value tree by refid, which
+// resolves refs to the pointers they refer to. The stubs left by
+// Options.MaxDepth stand for their pointers and are indexed with them.
+type Graph struct {
+	// Root is the indexed tree
+	Root *Value
+	ptrs map[uint64]*Value
+	// unindexed holds the nodes whose subtrees a lazy graph has not
+	// indexed yet
+	unindexed []*Value
+}
+
+// NewGraph indexes the pointers of the tree rooted at v. Nil pointers
+// are indexed too, as older versions of ToValue encoded every nil pointer
+// of a graph but the first as a ref to the first one. Two pointers with
+// the same refid make the tree invalid.
+func NewGraph(v *Value) (*Graph, error) {
+	g := &Graph{Root: v, ptrs: make(map[uint64]*Value)}
+	err := v.Walk(func(_ Path, n *Value) error {
+		if !indexed(n) {
+			return nil
+		}
+		if _, ok := g.ptrs[n.Refid]; ok {
+			return &InvalidValueError{Value: n.Refid, Kind: n.Kind}
+		}
+		g.ptrs[n.Refid] = n
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// indexed reports whether a graph indexes n: pointers and stubs with a
+// refid are.
+func indexed(n *Value) bool {
+	return (n.Kind == Ptr || n.Kind == Stub) && n.Refid != 0
+}
+
+// newLazyGraph returns a graph of the tree rooted at v which indexes its
+// pointers on demand: the tree is only walked as far as needed to find
+// the refids looked up.
+func newLazyGraph(v *Value) *Graph {
+	g := &Graph{Root: v, ptrs: make(map[uint64]*Value)}
+	if v != nil {
+		g.unindexed = []*Value{v}
+	}
+	return g
+}
+
+// indexUntil indexes the unindexed nodes of a lazy graph until the
+// pointer with the given refid is found.
+func (g *Graph) indexUntil(refid uint64) error {
+	for len(g.unindexed) > 0 {
+		if _, ok := g.ptrs[refid]; ok {
+			return nil
+		}
+		n := g.unindexed[len(g.unindexed)-1]
+		g.unindexed = g.unindexed[:len(g.unindexed)-1]
+		if indexed(n) {
+			if _, ok := g.ptrs[n.Refid]; ok {
+				return &InvalidValueError{Value: n.Refid, Kind: n.Kind}
+			}
+			g.ptrs[n.Refid] = n
+		}
+		g.unindexed = append(g.unindexed, n.Children()...)
+	}
+	return nil
+}
+
+// Node returns the pointer with the given refid, nil pointers included,
+// or the stub standing for it.
+func (g *Graph) Node(refid uint64) (*Value, bool) {
+	if _, ok := g.ptrs[refid]; !ok && g.indexUntil(refid) != nil {
+		return nil, false
+	}
+	p, ok := g.ptrs[refid]
+	return p, ok
+}
+
+// Resolve returns the pointer, or the stub, a ref refers to. Other nodes
+// are returned as is.
+func (g *Graph) Resolve(n *Value) (*Value, error) {
+	if n == nil || n.Kind != Ref {
+		return n, nil
+	}
+	refid, err := refFromValue(n)
+	if err != nil {
+		return nil, err
+	}
+	if err = g.indexUntil(refid); err != nil {
+		return nil, err
+	}
+	p, ok := g.ptrs[refid]
+	if !ok {
+		return nil, &InvalidValueError{Value: refid, Kind: Ref}
+	}
+	return p, nil
+}
+
+// Get works like Value.Get on the root of g, following refs as well as
+// pointers.
+func (g *Graph) Get(path ...any) (*Value, error) {
+	return get(g, g.Root, path)
+}
@@ -0,0 +1,230 @@
+package tahwil_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+)
+
+type walkNodeT struct {
+	Name     string
+	Meta     map[string]string
+	Parent   *walkNodeT
+	Children []*walkNodeT
+}
+
+func walkTree(t *testing.T) *tahwil.Value {
+	t.Helper()
+	root := &walkNodeT{Name: "root", Meta: map[string]string{"first name": "x"}}
+	root.Children = []*walkNodeT{{Name: "a", Parent: root}, {Name: "b", Parent: root}}
+	v, err := tahwil.ToValue(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// navigate the JSON-decoded shapes
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded tahwil.Value
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	return &decoded
+}
+
+func TestPath_String(t *testing.T) {
+	tests := []struct {
+		path tahwil.Path
+		want string
+	}{
+		{tahwil.Path{}, ""},
+		{tahwil.Path{"Children", 0, "Name"}, "Children[0].Name"},
+		{tahwil.Path{"Meta", "first name"}, `Meta["first name"]`},
+		{tahwil.Path{1, "x"}, "[1].x"},
+	}
+	for _, tt := range tests {
+		if got := tt.path.String(); got != tt.want {
+			t.Errorf("%#v.String() = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestValue_Walk(t *testing.T) {
+	v := walkTree(t)
+	var got []string
+	err := v.Walk(func(path tahwil.Path, n *tahwil.Value) error {
+		got = append(got, path.String()+":"+string(n.Kind))
+		if n.Kind == tahwil.Map {
+			return tahwil.SkipChildren
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		":ptr", ":struct",
+		"Children:slice",
+		"Children[0]:ptr", "Children[0]:struct",
+		"Children[0].Children:slice", "Children[0].Meta:map", "Children[0].Name:string", "Children[0].Parent:ref",
+		"Children[1]:ptr", "Children[1]:struct",
+		"Children[1].Children:slice", "Children[1].Meta:map", "Children[1].Name:string", "Children[1].Parent:ref",
+		"Meta:map", "Name:string", "Parent:ptr",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk() visited\n%v\nwant\n%v", got, want)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = v.Walk(func(tahwil.Path, *tahwil.Value) error {
+		n++
+		return stop
+	})
+	if !errors.Is(err, stop) || n != 1 {
+		t.Errorf("Walk() = %v after %d calls, want stop after 1", err, n)
+	}
+}
+
+func TestValue_Walk_Deep(t *testing.T) {
+	// the path is shared between the nodes, a deep tree doesn't copy it
+	// at every level
+	const depth = 100000
+	v := &tahwil.Value{Kind: tahwil.String, Value: "end"}
+	for i := 0; i < depth; i++ {
+		v = &tahwil.Value{Kind: tahwil.Struct, Value: map[string]*tahwil.Value{"Next": v}}
+	}
+	var last tahwil.Path
+	err := v.Walk(func(path tahwil.Path, n *tahwil.Value) error {
+		if n.Kind == tahwil.String {
+			last = append(tahwil.Path(nil), path...)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(last) != depth || last[depth-1] != "Next" {
+		t.Errorf("Walk() reached the leaf at a path of length %d, want %d", len(last), depth)
+	}
+}
+
+func TestValue_Children(t *testing.T) {
+	v := walkTree(t)
+	root := v.Children()
+	if len(root) != 1 || root[0].Kind != tahwil.Struct {
+		t.Fatalf("Children() of the root pointer = %v", root)
+	}
+	var kinds []tahwil.Kind
+	for _, c := range root[0].Children() {
+		kinds = append(kinds, c.Kind)
+	}
+	want := []tahwil.Kind{tahwil.Slice, tahwil.Map, tahwil.String, tahwil.Ptr}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("Children() kinds = %v, want %v", kinds, want)
+	}
+	if c := (&tahwil.Value{Kind: tahwil.String, Value: "x"}).Children(); c != nil {
+		t.Errorf("Children() of a scalar = %v, want nil", c)
+	}
+}
+
+func TestValue_Get(t *testing.T) {
+	v := walkTree(t)
+	n, err := v.Get("Children", 1, "Name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Value != "b" {
+		t.Errorf(`Get("Children", 1, "Name") = %v, want "b"`, n.Value)
+	}
+	n, err = v.Get("Meta", "first name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Value != "x" {
+		t.Errorf(`Get("Meta", "first name") = %v, want "x"`, n.Value)
+	}
+	if n, err = v.Get(); err != nil || n != v {
+		t.Errorf("Get() = %v, %v, want the root", n, err)
+	}
+
+	tests := []struct {
+		name string
+		path []any
+		want string
+	}{
+		{"ref", []any{"Children", 0, "Parent", "Name"}, `tahwil: path "Children[0].Parent.Name": unresolved ref`},
+		{"unknown key", []any{"Nope"}, `tahwil: path "Nope": unknown key "Nope"`},
+		{"out of range", []any{"Children", 2}, `tahwil: path "Children[2]": index out of range [2] with length 2`},
+		{"invalid index", []any{"Children", "0"}, `tahwil: path "Children[\"0\"]": invalid index 0 for a slice`},
+		{"invalid key", []any{0}, `tahwil: path "[0]": invalid key 0 for a struct`},
+		{"scalar", []any{"Name", "x"}, `tahwil: path "Name.x": not a container: string`},
+		{"nil pointer", []any{"Parent", "Name"}, `tahwil: path "Parent.Name": nil pointer`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := v.Get(tt.path...)
+			var pe *tahwil.PathError
+			if !errors.As(err, &pe) {
+				t.Fatalf("Get() error = %v, want a *PathError", err)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("Get() error = %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestGraph(t *testing.T) {
+	v := walkTree(t)
+	g, err := tahwil.NewGraph(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := g.Get("Children", 0, "Parent", "Children", 1, "Name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Value != "b" {
+		t.Errorf("Get() through refs = %v, want \"b\"", n.Value)
+	}
+
+	ref, err := v.Get("Children", 0, "Parent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := g.Resolve(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != v {
+		t.Errorf("Resolve() = %v, want the root pointer", p)
+	}
+	if node, ok := g.Node(v.Refid); !ok || node != v {
+		t.Errorf("Node(%d) = %v, %v, want the root pointer", v.Refid, node, ok)
+	}
+	if _, ok := g.Node(100); ok {
+		t.Errorf("Node(100) found a node")
+	}
+	if _, err = g.Resolve(&tahwil.Value{Kind: tahwil.Ref, Value: uint64(100)}); err == nil {
+		t.Errorf("Resolve() of an unknown ref returned no error")
+	}
+}
+
+func TestNewGraph_Errors(t *testing.T) {
+	dup := &tahwil.Value{Refid: 1, Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Slice, Value: []*tahwil.Value{
+		{Refid: 2, Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Int, Value: 1}},
+		{Refid: 2, Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Int, Value: 2}},
+	}}}
+	if _, err := tahwil.NewGraph(dup); err == nil {
+		t.Errorf("NewGraph() with duplicate refids returned no error")
+	}
+	bad := &tahwil.Value{Kind: tahwil.Struct, Value: 1}
+	if _, err := tahwil.NewGraph(bad); err == nil {
+		t.Errorf("NewGraph() with a malformed payload returned no error")
+	}
+}
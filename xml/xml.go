@@ -0,0 +1,779 @@
+// Package xml encodes and decodes *tahwil.Value trees as XML, using
+// id and idref attributes for shared and cyclic pointers.
+//
+// Every Value becomes an element with a kind attribute holding its
+// tahwil kind. The root element is named value, struct fields become
+// elements named after the field, map entries become entry elements
+// with a key attribute and slice or array items become item elements.
+// Struct fields whose name is not a valid XML name are written as field
+// elements with a name attribute. Scalars are stored as character data.
+//
+// A non-nil pointer is written as its target element with an id
+// attribute holding the pointer refid, and a ref node as an element of
+// kind ref with an idref attribute:
+//
+//	<value kind="struct" id="1">
+//	  <Children kind="slice">
+//	    <item kind="struct" id="3">
+//	      <Children kind="slice"></Children>
+//	      <Name kind="string">Ford</Name>
+//	      <Parent kind="ref" idref="1"></Parent>
+//	    </item>
+//	  </Children>
+//	  <Name kind="string">Arthur</Name>
+//	  <Parent kind="ptr" id="2"></Parent>
+//	</value>
+//
+// Nil pointers are empty elements of kind ptr. Pointers without a refid
+// and pointers to pointers are written as elements of kind ptr holding
+// their target in a single elem element. Struct, map, slice and array
+// values with a nil payload carry a nil="true" attribute.
+//
+// Func nodes hold the name of their func as character data, or carry a
+// nil="true" attribute, and chan nodes are empty elements. Stub nodes
+// hold the name of their type, and the refid of the pointer they stand
+// for in an id attribute:
+//
+//	<Next kind="stub" id="3">main.Node</Next>
+//
+// Only the refids of pointers and stubs are kept.
+//
+// Strings, keys and names holding characters XML documents can't
+// contain, such as most control characters or invalid UTF-8, can't be
+// encoded: Marshal returns an *UnsupportedValueError rather than
+// replacing them.
+package xml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-extras/tahwil"
+	"github.com/go-extras/tahwil/internal/nesting"
+)
+
+// A SyntaxError describes XML input that is well-formed but does not
+// describe a Value tree. Malformed XML is reported with the errors of
+// encoding/xml.
+type SyntaxError struct {
+	Line   int
+	Column int
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return "xml: line " + strconv.Itoa(e.Line) + ", column " + strconv.Itoa(e.Column) + ": " + e.msg
+}
+
+// An UnsupportedValueError is returned by Marshal for a Value that has
+// no XML representation, such as a string holding a NUL character.
+type UnsupportedValueError struct {
+	Value  *tahwil.Value
+	Reason string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "xml: unsupported value: " + e.Reason
+}
+
+const (
+	attrKind  = "kind"
+	attrID    = "id"
+	attrIDRef = "idref"
+	attrNil   = "nil"
+	attrName  = "name"
+	attrKey   = "key"
+)
+
+// Marshal returns the XML encoding of v. A *tahwil.Value is encoded as
+// the tree it holds, like MarshalValue does.
+func Marshal(v any) ([]byte, error) {
+	if val, ok := v.(*tahwil.Value); ok {
+		return MarshalValue(val)
+	}
+	val, err := tahwil.ToValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return MarshalValue(val)
+}
+
+// MarshalValue returns the XML encoding of a *tahwil.Value tree, such as
+// one produced by tahwil.ToValue or decoded from tahwil JSON.
+func MarshalValue(v *tahwil.Value) ([]byte, error) {
+	var buf bytes.Buffer
+	g, err := tahwil.NewGraph(v)
+	if err != nil {
+		return nil, err
+	}
+	e := &encoder{
+		enc:     xml.NewEncoder(&buf),
+		written: make(map[uint64]bool),
+		graph:   g,
+	}
+	e.enc.Indent("", "  ")
+	if err := e.encode(v, xml.StartElement{Name: xml.Name{Local: "value"}}); err != nil {
+		return nil, err
+	}
+	if err := e.enc.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal parses an XML document produced by Marshal and stores the
+// result in the value pointed to by v. If v is a *tahwil.Value, the
+// tree itself is stored in it.
+func Unmarshal(data []byte, v any) error {
+	val, err := UnmarshalValue(data, nil)
+	if err != nil {
+		return err
+	}
+	if tv, ok := v.(*tahwil.Value); ok && tv != nil {
+		*tv = *val
+		return nil
+	}
+	return tahwil.FromValue(val, v)
+}
+
+// UnmarshalValue parses an XML document produced by MarshalValue into a
+// *tahwil.Value tree. Payloads have the same types as the ones produced
+// by tahwil.ToValue. The kind of every element is part of the encoding,
+// so t, the destination type taken by UnmarshalValue in every format
+// package, is not needed and may be nil.
+func UnmarshalValue(data []byte, t reflect.Type) (*tahwil.Value, error) {
+	d := &decoder{dec: xml.NewDecoder(bytes.NewReader(data))}
+	for {
+		tok, err := d.dec.Token()
+		if err == io.EOF {
+			return nil, d.errorf("missing root element")
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			res, err := d.decode(t)
+			if err != nil {
+				return nil, err
+			}
+			if err = d.expectEnd(); err != nil {
+				return nil, err
+			}
+			return res, nil
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) != 0 {
+				return nil, d.errorf("unexpected character data")
+			}
+		}
+	}
+}
+
+type encoder struct {
+	enc *xml.Encoder
+	// written holds the refids of the pointers whose target has been
+	// written, and of the stubs written
+	written map[uint64]bool
+	// graph indexes the pointers by refid, so that a ref can be encoded
+	// before the pointer it refers to has been reached
+	graph *tahwil.Graph
+}
+
+func attr(name, value string) xml.Attr {
+	return xml.Attr{Name: xml.Name{Local: name}, Value: value}
+}
+
+// writeEmpty writes an element without content.
+func (e *encoder) writeEmpty(start xml.StartElement) error {
+	if err := e.enc.EncodeToken(start); err != nil {
+		return err
+	}
+	return e.enc.EncodeToken(start.End())
+}
+
+// encode writes v as the element start; the attributes of start are
+// kept in front of the ones describing v.
+func (e *encoder) encode(v *tahwil.Value, start xml.StartElement) error {
+	if v == nil {
+		start.Attr = append(start.Attr, attr(attrKind, string(tahwil.Ptr)))
+		return e.writeEmpty(start)
+	}
+	switch v.Kind {
+	case tahwil.Ptr:
+		return e.encodePtr(v, start)
+	case tahwil.Ref:
+		return e.encodeRef(v, start)
+	case tahwil.Stub:
+		return e.encodeStub(v, start)
+	}
+	return e.encodeNode(v, 0, start)
+}
+
+// encodeStub writes a stub with the refid of the pointer it stands for,
+// which the refs to the stub refer to.
+func (e *encoder) encodeStub(v *tahwil.Value, start xml.StartElement) error {
+	if v.Refid != 0 {
+		if e.written[v.Refid] {
+			// already written through a forward ref
+			return e.writeRef(v.Refid, start)
+		}
+		e.written[v.Refid] = true
+	}
+	return e.encodeNode(v, v.Refid, start)
+}
+
+func (e *encoder) writeRef(refid uint64, start xml.StartElement) error {
+	start.Attr = append(start.Attr,
+		attr(attrKind, string(tahwil.Ref)),
+		attr(attrIDRef, strconv.FormatUint(refid, 10)))
+	return e.writeEmpty(start)
+}
+
+func (e *encoder) encodePtr(v *tahwil.Value, start xml.StartElement) error {
+	if v.Refid != 0 && e.written[v.Refid] {
+		// already written through a forward ref
+		return e.writeRef(v.Refid, start)
+	}
+	inner, ok := v.AsPtr()
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	if v.Refid != 0 {
+		e.written[v.Refid] = true
+	}
+	if inner != nil && v.Refid != 0 && inner.Kind != tahwil.Ptr && inner.Kind != tahwil.Ref {
+		return e.encodeNode(inner, v.Refid, start)
+	}
+
+	start.Attr = append(start.Attr, attr(attrKind, string(tahwil.Ptr)))
+	if v.Refid != 0 {
+		start.Attr = append(start.Attr, attr(attrID, strconv.FormatUint(v.Refid, 10)))
+	}
+	if inner == nil {
+		return e.writeEmpty(start)
+	}
+	if err := e.enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if err := e.encode(inner, xml.StartElement{Name: xml.Name{Local: "elem"}}); err != nil {
+		return err
+	}
+	return e.enc.EncodeToken(start.End())
+}
+
+func (e *encoder) encodeRef(v *tahwil.Value, start xml.StartElement) error {
+	refid, ok := v.AsRef()
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	if e.written[refid] {
+		return e.writeRef(refid, start)
+	}
+	// forward ref: write the target pointer, or its stub, here
+	p, ok := e.graph.Node(refid)
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	return e.encode(p, start)
+}
+
+// encodeNode writes a value that is neither a pointer nor a ref; id is
+// the refid of the pointer the value is the target of.
+func (e *encoder) encodeNode(v *tahwil.Value, id uint64, start xml.StartElement) error {
+	start.Attr = append(start.Attr, attr(attrKind, string(v.Kind)))
+	if id != 0 {
+		start.Attr = append(start.Attr, attr(attrID, strconv.FormatUint(id, 10)))
+	}
+	if v.Value == nil {
+		switch v.Kind {
+		case tahwil.Struct, tahwil.Map, tahwil.Slice, tahwil.Array, tahwil.Func:
+			start.Attr = append(start.Attr, attr(attrNil, "true"))
+			return e.writeEmpty(start)
+		case tahwil.Chan:
+			return e.writeEmpty(start)
+		}
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+
+	switch v.Kind {
+	case tahwil.Struct, tahwil.Map:
+		return e.encodeFields(v, start)
+	case tahwil.Slice, tahwil.Array:
+		return e.encodeElems(v, start)
+	case tahwil.Chan:
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	case tahwil.Bool, tahwil.String, tahwil.Func, tahwil.Stub,
+		tahwil.Int, tahwil.Int8, tahwil.Int16, tahwil.Int32, tahwil.Int64,
+		tahwil.Uint, tahwil.Uint8, tahwil.Uint16, tahwil.Uint32, tahwil.Uint64,
+		tahwil.Float32, tahwil.Float64:
+		text, err := scalarText(v)
+		if err != nil {
+			return err
+		}
+		if !isText(text) {
+			return &UnsupportedValueError{Value: v, Reason: "invalid XML character in " + strconv.Quote(text)}
+		}
+		if err = e.enc.EncodeToken(start); err != nil {
+			return err
+		}
+		if err = e.enc.EncodeToken(xml.CharData(text)); err != nil {
+			return err
+		}
+		return e.enc.EncodeToken(start.End())
+	}
+	return &tahwil.InvalidValueKindError{Kind: v.Kind}
+}
+
+func (e *encoder) encodeFields(v *tahwil.Value, start xml.StartElement) error {
+	fields, ok := v.AsFields()
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if err := e.enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if !isText(k) {
+			return &UnsupportedValueError{Value: v, Reason: "invalid XML character in key " + strconv.Quote(k)}
+		}
+		var child xml.StartElement
+		switch {
+		case v.Kind == tahwil.Map:
+			child.Name.Local = "entry"
+			child.Attr = []xml.Attr{attr(attrKey, k)}
+		case isName(k):
+			child.Name.Local = k
+		default:
+			child.Name.Local = "field"
+			child.Attr = []xml.Attr{attr(attrName, k)}
+		}
+		if err := e.encode(fields[k], child); err != nil {
+			return err
+		}
+	}
+	return e.enc.EncodeToken(start.End())
+}
+
+func (e *encoder) encodeElems(v *tahwil.Value, start xml.StartElement) error {
+	elems, ok := v.AsSlice()
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	if err := e.enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, el := range elems {
+		if err := e.encode(el, xml.StartElement{Name: xml.Name{Local: "item"}}); err != nil {
+			return err
+		}
+	}
+	return e.enc.EncodeToken(start.End())
+}
+
+func scalarText(v *tahwil.Value) (string, error) {
+	switch v.Kind {
+	case tahwil.Bool:
+		b, ok := v.Value.(bool)
+		if !ok {
+			return "", &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		return strconv.FormatBool(b), nil
+	case tahwil.String, tahwil.Func, tahwil.Stub:
+		s, ok := v.Value.(string)
+		if !ok {
+			return "", &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		return s, nil
+	}
+
+	rv := reflect.ValueOf(v.Value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Kind == tahwil.Float32 || v.Kind == tahwil.Float64 {
+			return "", &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		return strconv.FormatInt(rv.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Kind == tahwil.Float32 || v.Kind == tahwil.Float64 {
+			return "", &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		return strconv.FormatUint(rv.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		switch v.Kind {
+		case tahwil.Float32:
+			return strconv.FormatFloat(rv.Float(), 'g', -1, 32), nil
+		case tahwil.Float64:
+			return strconv.FormatFloat(rv.Float(), 'g', -1, 64), nil
+		}
+	}
+	return "", &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+}
+
+// isText reports whether s is valid UTF-8 made of characters allowed in
+// XML documents; encoding/xml would replace the others with U+FFFD.
+func isText(s string) bool {
+	for i, r := range s {
+		switch {
+		case r == utf8.RuneError:
+			if _, size := utf8.DecodeRuneInString(s[i:]); size == 1 {
+				return false
+			}
+		case r == '\t' || r == '\n' || r == '\r':
+		case r < 0x20, r == 0xfffe, r == 0xffff:
+			return false
+		}
+	}
+	return true
+}
+
+// isName reports whether s can be used as an element name. Names
+// starting with "xml" are reserved and the names used for items and
+// entries are avoided, so that they can't be mistaken for fields.
+func isName(s string) bool {
+	if s == "" || strings.HasPrefix(strings.ToLower(s), "xml") {
+		return false
+	}
+	switch s {
+	case "field", "item", "entry", "elem", "value":
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_' || unicode.IsLetter(r):
+		case i > 0 && (r == '-' || r == '.' || unicode.IsDigit(r)):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type decoder struct {
+	dec   *xml.Decoder
+	depth nesting.Depth
+}
+
+func (d *decoder) errorf(msg string) error {
+	line, col := d.dec.InputPos()
+	return &SyntaxError{Line: line, Column: col, msg: msg}
+}
+
+// expectEnd checks that only whitespace, comments and processing
+// instructions follow the root element.
+func (d *decoder) expectEnd() error {
+	for {
+		tok, err := d.dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			return d.errorf("unexpected element <" + t.Name.Local + "> after the root element")
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) != 0 {
+				return d.errorf("unexpected character data")
+			}
+		}
+	}
+}
+
+func attrOf(start xml.StartElement, name string) (string, bool) {
+	for _, a := range start.Attr {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+func (d *decoder) refidAttr(start xml.StartElement, name string) (uint64, error) {
+	s, _ := attrOf(start, name)
+	refid, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || refid == 0 {
+		return 0, d.errorf("invalid " + name + " attribute " + strconv.Quote(s))
+	}
+	return refid, nil
+}
+
+// decode reads the content of the element start up to its end.
+func (d *decoder) decode(start xml.StartElement) (*tahwil.Value, error) {
+	defer d.depth.Leave()
+	if !d.depth.Enter() {
+		return nil, d.errorf("exceeded max depth")
+	}
+	kindAttr, ok := attrOf(start, attrKind)
+	if !ok {
+		return nil, d.errorf("missing kind attribute in <" + start.Name.Local + ">")
+	}
+	kind := tahwil.Kind(kindAttr)
+
+	switch kind {
+	case tahwil.Ref:
+		refid, err := d.refidAttr(start, attrIDRef)
+		if err != nil {
+			return nil, err
+		}
+		if err = d.skipEmpty(start); err != nil {
+			return nil, err
+		}
+		return &tahwil.Value{Kind: tahwil.Ref, Value: refid}, nil
+	case tahwil.Ptr:
+		return d.decodePtr(start)
+	}
+
+	v, err := d.decodeNode(kind, start)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := attrOf(start, attrID); !ok {
+		return v, nil
+	}
+	if kind == tahwil.Stub {
+		// the refid of the pointer the stub stands for
+		v.Refid, err = d.refidAttr(start, attrID)
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	// the element is the target of a pointer
+	refid, err := d.refidAttr(start, attrID)
+	if err != nil {
+		return nil, err
+	}
+	return &tahwil.Value{Kind: tahwil.Ptr, Refid: refid, Value: v}, nil
+}
+
+func (d *decoder) decodePtr(start xml.StartElement) (*tahwil.Value, error) {
+	v := &tahwil.Value{Kind: tahwil.Ptr}
+	if _, ok := attrOf(start, attrID); ok {
+		var err error
+		if v.Refid, err = d.refidAttr(start, attrID); err != nil {
+			return nil, err
+		}
+	}
+	children, err := d.children(start)
+	if err != nil {
+		return nil, err
+	}
+	switch len(children) {
+	case 0:
+		return v, nil
+	case 1:
+		if children[0].name.Local == "elem" {
+			v.Value = children[0].value
+			return v, nil
+		}
+	}
+	return nil, d.errorf("expected a single <elem> in <" + start.Name.Local + ">")
+}
+
+type child struct {
+	name  xml.Name
+	start xml.StartElement
+	value *tahwil.Value
+}
+
+// children decodes the child elements of start up to its end; character
+// data other than whitespace is not allowed.
+func (d *decoder) children(start xml.StartElement) ([]child, error) {
+	var res []child
+	for {
+		tok, err := d.dec.Token()
+		if err != nil {
+			return nil, d.unexpectedEOF(err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			t = t.Copy()
+			v, err := d.decode(t)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, child{name: t.Name, start: t, value: v})
+		case xml.EndElement:
+			return res, nil
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) != 0 {
+				return nil, d.errorf("unexpected character data in <" + start.Name.Local + ">")
+			}
+		}
+	}
+}
+
+func (d *decoder) unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return d.errorf("unexpected end of input")
+	}
+	return err
+}
+
+// skipEmpty checks that the element start has no content.
+func (d *decoder) skipEmpty(start xml.StartElement) error {
+	children, err := d.children(start)
+	if err != nil {
+		return err
+	}
+	if len(children) != 0 {
+		return d.errorf("unexpected content in <" + start.Name.Local + ">")
+	}
+	return nil
+}
+
+// text reads the character data of a scalar element.
+func (d *decoder) text(start xml.StartElement) (string, error) {
+	var sb strings.Builder
+	for {
+		tok, err := d.dec.Token()
+		if err != nil {
+			return "", d.unexpectedEOF(err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			return "", d.errorf("unexpected element <" + t.Name.Local + "> in <" + start.Name.Local + ">")
+		case xml.EndElement:
+			return sb.String(), nil
+		case xml.CharData:
+			sb.Write(t)
+		}
+	}
+}
+
+func (d *decoder) decodeNode(kind tahwil.Kind, start xml.StartElement) (*tahwil.Value, error) {
+	switch kind {
+	case tahwil.Struct, tahwil.Map, tahwil.Slice, tahwil.Array, tahwil.Func:
+		if isNil, _ := attrOf(start, attrNil); isNil == "true" {
+			if err := d.skipEmpty(start); err != nil {
+				return nil, err
+			}
+			return &tahwil.Value{Kind: kind}, nil
+		}
+	}
+
+	switch kind {
+	case tahwil.Struct, tahwil.Map:
+		return d.decodeFields(kind, start)
+	case tahwil.Slice, tahwil.Array:
+		return d.decodeElems(kind, start)
+	case tahwil.Chan:
+		if err := d.skipEmpty(start); err != nil {
+			return nil, err
+		}
+		return &tahwil.Value{Kind: kind}, nil
+	case tahwil.Bool, tahwil.String, tahwil.Func, tahwil.Stub,
+		tahwil.Int, tahwil.Int8, tahwil.Int16, tahwil.Int32, tahwil.Int64,
+		tahwil.Uint, tahwil.Uint8, tahwil.Uint16, tahwil.Uint32, tahwil.Uint64,
+		tahwil.Float32, tahwil.Float64:
+		s, err := d.text(start)
+		if err != nil {
+			return nil, err
+		}
+		v, err := scalarValue(kind, s)
+		if err != nil {
+			return nil, d.errorf("invalid " + string(kind) + " value " + strconv.Quote(s))
+		}
+		return &tahwil.Value{Kind: kind, Value: v}, nil
+	}
+	return nil, d.errorf("unknown kind " + strconv.Quote(string(kind)))
+}
+
+func (d *decoder) decodeFields(kind tahwil.Kind, start xml.StartElement) (*tahwil.Value, error) {
+	children, err := d.children(start)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]*tahwil.Value, len(children))
+	for _, c := range children {
+		key := c.name.Local
+		if kind == tahwil.Map {
+			var ok bool
+			if key, ok = attrOf(c.start, attrKey); !ok || c.name.Local != "entry" {
+				return nil, d.errorf("expected <entry> with a key attribute in <" + start.Name.Local + ">")
+			}
+		} else if name, ok := attrOf(c.start, attrName); ok && key == "field" {
+			key = name
+		}
+		if _, ok := fields[key]; ok {
+			return nil, d.errorf("duplicate key " + strconv.Quote(key) + " in <" + start.Name.Local + ">")
+		}
+		fields[key] = c.value
+	}
+	return &tahwil.Value{Kind: kind, Value: fields}, nil
+}
+
+func (d *decoder) decodeElems(kind tahwil.Kind, start xml.StartElement) (*tahwil.Value, error) {
+	children, err := d.children(start)
+	if err != nil {
+		return nil, err
+	}
+	elems := make([]*tahwil.Value, len(children))
+	for i, c := range children {
+		if c.name.Local != "item" {
+			return nil, d.errorf("expected <item> in <" + start.Name.Local + ">")
+		}
+		elems[i] = c.value
+	}
+	return &tahwil.Value{Kind: kind, Value: elems}, nil
+}
+
+// scalarValue parses the text of a scalar of the given kind.
+//
+//nolint:gocyclo // one case per kind
+func scalarValue(kind tahwil.Kind, s string) (any, error) {
+	switch kind {
+	case tahwil.String, tahwil.Func, tahwil.Stub:
+		return s, nil
+	case tahwil.Bool:
+		return strconv.ParseBool(s)
+	case tahwil.Int:
+		i, err := strconv.ParseInt(s, 10, strconv.IntSize)
+		return int(i), err
+	case tahwil.Int8:
+		i, err := strconv.ParseInt(s, 10, 8)
+		return int8(i), err
+	case tahwil.Int16:
+		i, err := strconv.ParseInt(s, 10, 16)
+		return int16(i), err
+	case tahwil.Int32:
+		i, err := strconv.ParseInt(s, 10, 32)
+		return int32(i), err
+	case tahwil.Int64:
+		return strconv.ParseInt(s, 10, 64)
+	case tahwil.Uint:
+		u, err := strconv.ParseUint(s, 10, strconv.IntSize)
+		return uint(u), err
+	case tahwil.Uint8:
+		u, err := strconv.ParseUint(s, 10, 8)
+		return uint8(u), err
+	case tahwil.Uint16:
+		u, err := strconv.ParseUint(s, 10, 16)
+		return uint16(u), err
+	case tahwil.Uint32:
+		u, err := strconv.ParseUint(s, 10, 32)
+		return uint32(u), err
+	case tahwil.Uint64:
+		return strconv.ParseUint(s, 10, 64)
+	case tahwil.Float32:
+		f, err := strconv.ParseFloat(s, 32)
+		return float32(f), err
+	case tahwil.Float64:
+		return strconv.ParseFloat(s, 64)
+	}
+	return nil, strconv.ErrSyntax
+}
@@ -0,0 +1,401 @@
+package xml_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+	"github.com/go-extras/tahwil/internal/nesting"
+	"github.com/go-extras/tahwil/xml"
+)
+
+type personT struct {
+	Name     string
+	Parent   *personT
+	Children []*personT
+}
+
+type hooksT struct {
+	Name string
+	Fn   func(string) string
+	Nil  func(string) string
+	Done chan struct{}
+	Next *hooksT
+}
+
+type allKindsT struct {
+	Bool    bool
+	Int     int
+	Int8    int8
+	Int16   int16
+	Int32   int32
+	Int64   int64
+	Uint    uint
+	Uint8   uint8
+	Uint16  uint16
+	Uint32  uint32
+	Uint64  uint64
+	Float32 float32
+	Float64 float64
+	String  string `json:"string value"`
+	Array   [2]int16
+	Map     map[string]int
+	Pointer *string
+	PtrPtr  **int
+}
+
+func TestMarshal(t *testing.T) {
+	parent := &personT{Name: "Arthur"}
+	parent.Children = []*personT{{Name: "Ford", Parent: parent}}
+	v, err := tahwil.ToValue(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := xml.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<value kind="struct" id="1">
+  <Children kind="slice">
+    <item kind="struct" id="3">
+      <Children kind="slice"></Children>
+      <Name kind="string">Ford</Name>
+      <Parent kind="ref" idref="1"></Parent>
+    </item>
+  </Children>
+  <Name kind="string">Arthur</Name>
+  <Parent kind="ptr" id="2"></Parent>
+</value>`
+	if string(res) != want {
+		t.Errorf("have:\n%s\nwant:\n%s", res, want)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	s := "pointer <&>\n"
+	i := 7
+	pi := &i
+	in := &allKindsT{
+		Bool: true, Int: -1 << 40, Int8: -100, Int16: -30000, Int32: -1 << 30, Int64: -1 << 62,
+		Uint: 1 << 40, Uint8: 200, Uint16: 60000, Uint32: 1 << 31, Uint64: 1<<64 - 1,
+		Float32: 1.5, Float64: -2.25, String: "  spaced  ",
+		Array: [2]int16{-1, 1}, Map: map[string]int{"a b": 1, "": 2}, Pointer: &s, PtrPtr: &pi,
+	}
+	v, err := tahwil.ToValue(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := xml.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := xml.UnmarshalValue(b, reflect.TypeOf(in))
+	if err != nil {
+		t.Fatalf("%v\n%s", err, b)
+	}
+	if !reflect.DeepEqual(decoded, v) {
+		x, _ := json.Marshal(decoded)
+		y, _ := json.Marshal(v)
+		t.Errorf("mismatch\nhave: %s\nwant: %s", x, y)
+	}
+
+	out := &allKindsT{}
+	if err = tahwil.FromValue(decoded, out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("mismatch\nhave: %+v\nwant: %+v", out, in)
+	}
+}
+
+func TestRoundTrip_Struct(t *testing.T) {
+	parent := &personT{Name: "Arthur"}
+	parent.Children = []*personT{{Name: "Ford", Parent: parent}}
+	b, err := xml.Marshal(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &personT{}
+	if err = xml.Unmarshal(b, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "Arthur" || len(out.Children) != 1 || out.Children[0].Name != "Ford" || out.Children[0].Parent != out {
+		t.Errorf("unexpected result: %+v", out)
+	}
+}
+
+func TestRoundTrip_ValueTree(t *testing.T) {
+	// a *tahwil.Value passed to Marshal and Unmarshal is the tree itself,
+	// not a Go struct to encode
+	v, err := tahwil.ToValue(&personT{Name: "Arthur"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := xml.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := xml.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(want) {
+		t.Errorf("have:\n%s\nwant:\n%s", b, want)
+	}
+	decoded := &tahwil.Value{}
+	if err = xml.Unmarshal(b, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, v) {
+		t.Errorf("mismatch\nhave: %+v\nwant: %+v", decoded, v)
+	}
+}
+
+func TestRoundTrip_Cycle(t *testing.T) {
+	parent := &personT{Name: "Arthur"}
+	parent.Children = []*personT{
+		{Name: "Ford", Parent: parent},
+		{Name: "Trillian", Parent: parent},
+	}
+	v, err := tahwil.ToValue(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// decode through JSON first to make sure both payload shapes are accepted
+	j, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON := &tahwil.Value{}
+	if err = json.Unmarshal(j, fromJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := xml.MarshalValue(fromJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := xml.UnmarshalValue(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &personT{}
+	if err = tahwil.FromValue(decoded, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Children[0].Parent != out || out.Children[1].Parent != out {
+		t.Error("expected the cycle to be preserved")
+	}
+}
+
+func TestRoundTrip_FuncsAndStubs(t *testing.T) {
+	funcs := tahwil.NewFuncRegistry()
+	if err := funcs.Register("upper", strings.ToUpper); err != nil {
+		t.Fatal(err)
+	}
+	fetched := &hooksT{Name: "fetched"}
+	opts := &tahwil.Options{
+		Funcs:         funcs,
+		FuncsAndChans: tahwil.FuncChanNull,
+		MaxDepth:      1,
+		FetchStub: func(refid uint64, typeName string) (any, error) {
+			return fetched, nil
+		},
+	}
+	in := &hooksT{Name: "a", Fn: strings.ToUpper, Done: make(chan struct{}), Next: &hooksT{Name: "b"}}
+	v, err := tahwil.ToValueWithOptions(in, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := xml.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<value kind="struct" id="1">
+  <Done kind="chan"></Done>
+  <Fn kind="func">upper</Fn>
+  <Name kind="string">a</Name>
+  <Next kind="stub" id="2">xml_test.hooksT</Next>
+  <Nil kind="func" nil="true"></Nil>
+</value>`
+	if string(b) != want {
+		t.Errorf("have:\n%s\nwant:\n%s", b, want)
+	}
+
+	decoded, err := xml.UnmarshalValue(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, v) {
+		x, _ := json.Marshal(decoded)
+		y, _ := json.Marshal(v)
+		t.Errorf("mismatch\nhave: %s\nwant: %s", x, y)
+	}
+	out := &hooksT{}
+	if err = tahwil.FromValueWithOptions(decoded, out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if out.Fn == nil || out.Fn("x") != "X" || out.Nil != nil || out.Done != nil || out.Next != fetched {
+		t.Errorf("unexpected result: %+v", out)
+	}
+}
+
+func TestRoundTrip_SharedStub(t *testing.T) {
+	c := &personT{Name: "c"}
+	in := &personT{Name: "a", Parent: c, Children: []*personT{c}}
+	v, err := tahwil.ToValueWithOptions(in, &tahwil.Options{MaxDepth: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := xml.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fields are sorted: the stub is written at the first of them
+	want := `<value kind="struct" id="1">
+  <Children kind="slice">
+    <item kind="stub" id="2">xml_test.personT</item>
+  </Children>
+  <Name kind="string">a</Name>
+  <Parent kind="ref" idref="2"></Parent>
+</value>`
+	if string(b) != want {
+		t.Errorf("have:\n%s\nwant:\n%s", b, want)
+	}
+	decoded, err := xml.UnmarshalValue(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tahwil.Canonicalize(decoded), tahwil.Canonicalize(v)) {
+		x, _ := json.Marshal(decoded)
+		y, _ := json.Marshal(v)
+		t.Errorf("mismatch\nhave: %s\nwant: %s", x, y)
+	}
+
+	fetched := &personT{Name: "fetched"}
+	opts := &tahwil.Options{FetchStub: func(uint64, string) (any, error) { return fetched, nil }}
+	out := &personT{}
+	if err = tahwil.FromValueWithOptions(decoded, out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if out.Parent != fetched || out.Children[0] != fetched {
+		t.Errorf("unexpected result: %+v", out)
+	}
+}
+
+func TestMarshal_ForwardRef(t *testing.T) {
+	// the ref is reached before the pointer it refers to
+	v := &tahwil.Value{Kind: tahwil.Struct, Value: map[string]*tahwil.Value{
+		"A": {Kind: tahwil.Ref, Value: uint64(2)},
+		"B": {Kind: tahwil.Ptr, Refid: 2, Value: &tahwil.Value{Kind: tahwil.String, Value: "b"}},
+	}}
+	res, err := xml.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<value kind="struct">
+  <A kind="string" id="2">b</A>
+  <B kind="ref" idref="2"></B>
+</value>`
+	if string(res) != want {
+		t.Errorf("have:\n%s\nwant:\n%s", res, want)
+	}
+}
+
+func TestUnmarshal_Errors(t *testing.T) {
+	tests := []string{
+		``,
+		`<value/>`,
+		`<value kind="foo"/>`,
+		`<value kind="int8">300</value>`,
+		`<value kind="ref" idref="x"/>`,
+		`<value kind="ref" idref="1">content</value>`,
+		`<value kind="slice"><x kind="int">1</x></value>`,
+		`<value kind="map"><entry kind="int">1</entry></value>`,
+		`<value kind="struct"><a kind="int">1</a><a kind="int">2</a></value>`,
+		`<value kind="struct">text</value>`,
+		`<value kind="int"><a kind="int">1</a></value>`,
+		`<value kind="ptr"><x kind="int">1</x></value>`,
+		`<value kind="int">1</value><value kind="int">1</value>`,
+		`<value kind="chan">x</value>`,
+		`<value kind="stub" id="x">T</value>`,
+	}
+	for i, data := range tests {
+		var syntaxErr *xml.SyntaxError
+		_, err := xml.UnmarshalValue([]byte(data), nil)
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("#%d: expected *SyntaxError, got %T: %v", i, err, err)
+		}
+	}
+
+	if _, err := xml.UnmarshalValue([]byte(`<value kind="int">1`), nil); err == nil {
+		t.Error("expected error for malformed XML, got nil")
+	}
+}
+
+func TestUnmarshal_MaxDepth(t *testing.T) {
+	// depth slices nested in each other
+	nested := func(depth int) []byte {
+		return []byte(`<value kind="slice">` + strings.Repeat(`<item kind="slice">`, depth-1) + strings.Repeat(`</item>`, depth-1) + `</value>`)
+	}
+	if _, err := xml.UnmarshalValue(nested(nesting.MaxDepth), nil); err != nil {
+		t.Errorf("UnmarshalValue() at max depth = %v", err)
+	}
+	var syntaxErr *xml.SyntaxError
+	if _, err := xml.UnmarshalValue(nested(nesting.MaxDepth+1), nil); !errors.As(err, &syntaxErr) {
+		t.Errorf("expected *SyntaxError, got %T: %v", err, err)
+	}
+}
+
+func TestMarshal_Errors(t *testing.T) {
+	tests := []*tahwil.Value{
+		{Kind: "foo", Value: 1},
+		{Kind: tahwil.String, Value: 1},
+		{Kind: tahwil.Int, Value: "1"},
+		{Kind: tahwil.Ptr, Value: "x"},
+		{Kind: tahwil.Struct, Value: []int{}},
+		{Kind: tahwil.Ref, Value: uint64(3)},
+		{Kind: tahwil.Func, Value: 1},
+		{Kind: tahwil.Chan, Value: "x"},
+		{Kind: tahwil.Stub},
+	}
+	for i, v := range tests {
+		if _, err := xml.MarshalValue(v); err == nil {
+			t.Errorf("#%d: expected error, got nil", i)
+		}
+	}
+}
+
+func TestMarshal_InvalidCharacters(t *testing.T) {
+	// whitespace control characters are kept
+	in := map[string]string{"a\tb\r\nc": "d\te\r\nf"}
+	b, err := xml.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]string
+	if err = xml.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("round trip = %q, want %q", out, in)
+	}
+
+	tests := []any{
+		"a\x00b",
+		"\xff",
+		"\ufffe",
+		map[string]int{"\x01": 1},
+		&struct{ A string }{"\x1b[0m"},
+	}
+	for i, v := range tests {
+		var unsupported *xml.UnsupportedValueError
+		if _, err := xml.Marshal(v); !errors.As(err, &unsupported) {
+			t.Errorf("#%d: expected *UnsupportedValueError, got %T: %v", i, err, err)
+		}
+	}
+}
@@ -0,0 +1,1053 @@
+package yaml
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-extras/tahwil"
+	"github.com/go-extras/tahwil/internal/fieldtag"
+	"github.com/go-extras/tahwil/internal/nesting"
+)
+
+type nodeKind int
+
+const (
+	scalarNode nodeKind = iota
+	mappingNode
+	sequenceNode
+	aliasNode
+)
+
+// node is a parsed YAML node.
+type node struct {
+	kind   nodeKind
+	tag    string
+	anchor string
+	// value holds the text of a scalar or the anchor name of an alias
+	value  string
+	quoted bool
+	// children holds the items of a sequence, or the keys and values
+	// of a mapping in turn
+	children []*node
+	line     int
+	column   int
+}
+
+// parser is a recursive descent parser for the block and flow styles of
+// a single YAML document.
+type parser struct {
+	data      []byte
+	pos       int
+	line      int
+	lineStart int
+	depth     nesting.Depth
+}
+
+func (p *parser) errorf(msg string) error {
+	return &SyntaxError{Line: p.line, Column: p.pos - p.lineStart + 1, msg: msg}
+}
+
+func (p *parser) peek(i int) byte {
+	if p.pos+i < len(p.data) {
+		return p.data[p.pos+i]
+	}
+	return 0
+}
+
+func (p *parser) column() int {
+	return p.pos - p.lineStart
+}
+
+func (p *parser) newNode() *node {
+	return &node{line: p.line, column: p.column() + 1}
+}
+
+// newline consumes a line break.
+func (p *parser) newline() {
+	p.pos++
+	p.line++
+	p.lineStart = p.pos
+}
+
+// isBlank reports whether c ends a token.
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == 0
+}
+
+func (p *parser) skipInline() {
+	for p.peek(0) == ' ' || p.peek(0) == '\t' {
+		p.pos++
+	}
+}
+
+// atLineEnd skips spaces and reports whether only a comment or a line
+// break follows.
+func (p *parser) atLineEnd() bool {
+	p.skipInline()
+	switch p.peek(0) {
+	case 0, '\n', '#':
+		return true
+	case '\r':
+		return p.peek(1) == '\n' || p.peek(1) == 0
+	}
+	return false
+}
+
+// atDocumentMarker reports whether a "---" or "..." marker starts at pos.
+func (p *parser) atDocumentMarker() bool {
+	if p.column() != 0 || p.pos+3 > len(p.data) {
+		return false
+	}
+	m := string(p.data[p.pos : p.pos+3])
+	return (m == "---" || m == "...") && isBlank(p.peek(3))
+}
+
+// skipToContent skips comments, blank lines and indentation and returns
+// the column of the next content, or -1 at the end of the document.
+func (p *parser) skipToContent() (int, error) {
+	for {
+		p.skipInline()
+		switch p.peek(0) {
+		case 0:
+			return -1, nil
+		case '\n':
+			p.newline()
+			continue
+		case '\r':
+			p.pos++
+			continue
+		case '#':
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		}
+		if p.atDocumentMarker() {
+			return -1, nil
+		}
+		for i := p.lineStart; i < p.pos; i++ {
+			if p.data[i] == '\t' {
+				return 0, p.errorf("tabs are not allowed in indentation")
+			}
+		}
+		return p.column(), nil
+	}
+}
+
+func (p *parser) parseDocument() (*node, error) {
+	// a byte order mark may start the stream
+	if bytes.HasPrefix(p.data, []byte("\ufeff")) {
+		p.pos = len("\ufeff")
+		p.lineStart = p.pos
+	}
+	// skip directives
+	for {
+		if _, err := p.skipToContent(); err != nil {
+			return nil, err
+		}
+		if p.column() != 0 || p.peek(0) != '%' {
+			break
+		}
+		for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+			p.pos++
+		}
+	}
+	if p.atDocumentMarker() && p.peek(0) == '-' {
+		p.pos += 3
+	}
+	root, err := p.parseBlock(-1, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = p.skipToContent(); err != nil {
+		return nil, err
+	}
+	if p.atDocumentMarker() && p.peek(0) == '.' {
+		p.pos += 3
+		if !p.atLineEnd() {
+			return nil, p.errorf("unexpected content after document end")
+		}
+		if _, err = p.skipToContent(); err != nil {
+			return nil, err
+		}
+	}
+	if p.pos < len(p.data) {
+		if p.atDocumentMarker() {
+			return nil, p.errorf("multiple documents are not supported")
+		}
+		return nil, p.errorf("unexpected content")
+	}
+	return root, nil
+}
+
+// readToken reads an anchor, alias or tag name.
+func (p *parser) readToken() string {
+	start := p.pos
+	for !isBlank(p.peek(0)) && !strings.ContainsRune(",[]{}", rune(p.peek(0))) {
+		p.pos++
+	}
+	return string(p.data[start:p.pos])
+}
+
+// parseProperties reads the anchor and tag of a node.
+func (p *parser) parseProperties(n *node) error {
+	for {
+		switch p.peek(0) {
+		case '&':
+			if n.anchor != "" {
+				return p.errorf("node has more than one anchor")
+			}
+			p.pos++
+			if n.anchor = p.readToken(); n.anchor == "" {
+				return p.errorf("empty anchor name")
+			}
+		case '!':
+			if n.tag != "" {
+				return p.errorf("node has more than one tag")
+			}
+			n.tag = p.readToken()
+		default:
+			return nil
+		}
+		p.skipInline()
+	}
+}
+
+// parseBlock parses a node in block context; parent is the indentation
+// of the enclosing collection. In a mapping value (mapValue), a block
+// sequence may have the same indentation as the mapping.
+func (p *parser) parseBlock(parent int, mapValue bool) (*node, error) {
+	defer p.depth.Leave()
+	if !p.depth.Enter() {
+		return nil, p.errorf("exceeded max depth")
+	}
+	p.skipInline()
+	n := p.newNode()
+	if err := p.parseProperties(n); err != nil {
+		return nil, err
+	}
+	if !p.atLineEnd() {
+		return n, p.parseContent(n, parent, mapValue)
+	}
+
+	indent, err := p.skipToContent()
+	if err != nil {
+		return nil, err
+	}
+	if indent > parent || (mapValue && indent == parent && p.atSequenceEntry()) {
+		return n, p.parseContent(n, parent, false)
+	}
+	// empty node
+	n.kind = scalarNode
+	return n, nil
+}
+
+func (p *parser) atSequenceEntry() bool {
+	return p.peek(0) == '-' && isBlank(p.peek(1))
+}
+
+// parseContent parses the content of n starting at pos. inlineValue
+// tells whether the content follows a mapping key on the same line,
+// where no block collection can start.
+func (p *parser) parseContent(n *node, parent int, inlineValue bool) error {
+	col := p.column()
+	sameLine := p.line == n.line
+	switch c := p.peek(0); {
+	case c == '*':
+		if err := p.parseAlias(n); err != nil {
+			return err
+		}
+		if !p.atLineEnd() {
+			return p.errorf("unexpected content after alias")
+		}
+		return nil
+	case c == '[' || c == '{':
+		if err := p.parseFlowCollection(n); err != nil {
+			return err
+		}
+		if !p.atLineEnd() {
+			return p.errorf("unexpected content after flow collection")
+		}
+		return nil
+	case c == '|' || c == '>':
+		return p.parseBlockScalar(n, parent)
+	case p.atSequenceEntry():
+		if inlineValue {
+			return p.errorf("block sequence cannot start after a mapping key")
+		}
+		return p.parseBlockSequence(n, col)
+	}
+
+	key := p.newNode()
+	if err := p.parseScalar(key, false); err != nil {
+		return err
+	}
+	p.skipInline()
+	if p.peek(0) == ':' && isBlank(p.peek(1)) {
+		if inlineValue {
+			return p.errorf("mapping values are not allowed here")
+		}
+		if sameLine && (n.anchor != "" || n.tag != "") {
+			return p.errorf("properties of mapping keys are not supported")
+		}
+		return p.parseBlockMapping(n, key, col)
+	}
+	if !p.atLineEnd() {
+		return p.errorf("unexpected content after scalar")
+	}
+	n.kind, n.value, n.quoted = scalarNode, key.value, key.quoted
+	return nil
+}
+
+func (p *parser) parseAlias(n *node) error {
+	if n.anchor != "" || n.tag != "" {
+		return p.errorf("alias cannot have properties")
+	}
+	p.pos++
+	n.kind = aliasNode
+	if n.value = p.readToken(); n.value == "" {
+		return p.errorf("empty alias name")
+	}
+	return nil
+}
+
+func (p *parser) parseBlockMapping(n, key *node, indent int) error {
+	n.kind = mappingNode
+	for {
+		// pos is at the ':' following the key
+		p.pos++
+		value, err := p.parseBlock(indent, true)
+		if err != nil {
+			return err
+		}
+		n.children = append(n.children, key, value)
+
+		next, err := p.skipToContent()
+		if err != nil {
+			return err
+		}
+		if next < indent {
+			return nil
+		}
+		if next > indent {
+			return p.errorf("unexpected indentation")
+		}
+		if p.atSequenceEntry() {
+			return p.errorf("unexpected sequence entry in mapping")
+		}
+		key = p.newNode()
+		if err = p.parseScalar(key, false); err != nil {
+			return err
+		}
+		p.skipInline()
+		if p.peek(0) != ':' || !isBlank(p.peek(1)) {
+			return p.errorf("expected ':' after mapping key")
+		}
+	}
+}
+
+func (p *parser) parseBlockSequence(n *node, indent int) error {
+	n.kind = sequenceNode
+	for {
+		// pos is at the '-' indicator
+		p.pos++
+		item, err := p.parseBlock(indent, false)
+		if err != nil {
+			return err
+		}
+		n.children = append(n.children, item)
+
+		next, err := p.skipToContent()
+		if err != nil {
+			return err
+		}
+		if next < indent || (next == indent && !p.atSequenceEntry()) {
+			// the enclosing mapping continues
+			return nil
+		}
+		if next > indent {
+			return p.errorf("unexpected indentation")
+		}
+	}
+}
+
+// parseScalar parses a plain or quoted scalar. Plain scalars end at the
+// end of the line, at a comment or at ": "; in flow context they also
+// end at flow indicators.
+func (p *parser) parseScalar(n *node, flow bool) error {
+	n.kind = scalarNode
+	switch c := p.peek(0); c {
+	case '"':
+		return p.parseDoubleQuoted(n)
+	case '\'':
+		return p.parseSingleQuoted(n)
+	case '&', '!', '*', '|', '>', '%', '@', '`', '[', ']', '{', '}', ',', '#':
+		return p.errorf("unexpected character " + strconv.QuoteRune(rune(c)))
+	case '?', ':', '-':
+		if isBlank(p.peek(1)) {
+			return p.errorf("unexpected character " + strconv.QuoteRune(rune(c)))
+		}
+	}
+
+	start, end := p.pos, p.pos
+	for {
+		c := p.peek(0)
+		if c == 0 || c == '\n' || (c == '#' && p.pos > start && isBlank(p.data[p.pos-1])) {
+			break
+		}
+		if c == ':' && (isBlank(p.peek(1)) || (flow && strings.ContainsRune(",[]{}", rune(p.peek(1))))) {
+			break
+		}
+		if flow && strings.ContainsRune(",[]{}", rune(c)) {
+			break
+		}
+		p.pos++
+		if !isBlank(c) {
+			end = p.pos
+		}
+	}
+	n.value = string(p.data[start:end])
+	return nil
+}
+
+func (p *parser) parseSingleQuoted(n *node) error {
+	var sb strings.Builder
+	p.pos++
+	for {
+		switch c := p.peek(0); c {
+		case 0, '\n':
+			return p.errorf("unterminated single-quoted scalar")
+		case '\'':
+			if p.peek(1) != '\'' {
+				p.pos++
+				n.value, n.quoted = sb.String(), true
+				return nil
+			}
+			sb.WriteByte('\'')
+			p.pos += 2
+		default:
+			sb.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+var escapes = map[byte]string{
+	'0': "\x00", 'a': "\a", 'b': "\b", 't': "\t", '\t': "\t", 'n': "\n",
+	'v': "\v", 'f': "\f", 'r': "\r", 'e': "\x1b", ' ': " ", '"': "\"",
+	'/': "/", '\\': "\\", 'N': "\u0085", '_': "\u00a0", 'L': "\u2028", 'P': "\u2029",
+}
+
+func (p *parser) parseDoubleQuoted(n *node) error {
+	var sb strings.Builder
+	p.pos++
+	for {
+		c := p.peek(0)
+		switch c {
+		case 0, '\n':
+			return p.errorf("unterminated double-quoted scalar")
+		case '"':
+			p.pos++
+			n.value, n.quoted = sb.String(), true
+			return nil
+		case '\\':
+		default:
+			sb.WriteByte(c)
+			p.pos++
+			continue
+		}
+
+		esc := p.peek(1)
+		if s, ok := escapes[esc]; ok {
+			sb.WriteString(s)
+			p.pos += 2
+			continue
+		}
+		size := map[byte]int{'x': 2, 'u': 4, 'U': 8}[esc]
+		if size == 0 || p.pos+2+size > len(p.data) {
+			return p.errorf("invalid escape sequence")
+		}
+		r, err := strconv.ParseUint(string(p.data[p.pos+2:p.pos+2+size]), 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return p.errorf("invalid escape sequence")
+		}
+		sb.WriteRune(rune(r))
+		p.pos += 2 + size
+	}
+}
+
+// parseBlockScalar parses a literal (|) or folded (>) scalar.
+func (p *parser) parseBlockScalar(n *node, parent int) error {
+	folded := p.peek(0) == '>'
+	p.pos++
+	chomp := byte(0)
+	indent := -1
+	for i := 0; i < 2; i++ {
+		switch c := p.peek(0); {
+		case (c == '-' || c == '+') && chomp == 0:
+			chomp = c
+			p.pos++
+		case c >= '1' && c <= '9' && indent < 0:
+			indent = max(parent, 0) + int(c-'0')
+			p.pos++
+		}
+	}
+	if !p.atLineEnd() {
+		return p.errorf("unexpected content after block scalar indicator")
+	}
+	for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+		p.pos++
+	}
+
+	var lines []string
+	for p.pos < len(p.data) {
+		// pos is at the line break preceding the line
+		start := p.pos + 1
+		end := start
+		for end < len(p.data) && p.data[end] != '\n' {
+			end++
+		}
+		line := strings.TrimSuffix(string(p.data[start:end]), "\r")
+		spaces := len(line) - len(strings.TrimLeft(line, " "))
+		if spaces < len(line) {
+			if indent < 0 {
+				indent = spaces
+			}
+			if spaces < indent || indent <= parent {
+				break
+			}
+		}
+		if indent >= 0 && len(line) > indent {
+			line = line[indent:]
+		} else {
+			line = ""
+		}
+		lines = append(lines, line)
+		p.newline()
+		p.pos = end
+	}
+
+	trailing := 0
+	for trailing < len(lines) && lines[len(lines)-1-trailing] == "" {
+		trailing++
+	}
+	body := lines[:len(lines)-trailing]
+
+	var sb strings.Builder
+	for i, l := range body {
+		if i > 0 {
+			prev := body[i-1]
+			switch {
+			case folded && prev != "" && l != "" && prev[0] != ' ' && l[0] != ' ':
+				sb.WriteByte(' ')
+			case folded && prev != "" && prev[0] != ' ' && l == "":
+			default:
+				sb.WriteByte('\n')
+			}
+		}
+		sb.WriteString(l)
+	}
+	if len(body) > 0 && chomp != '-' {
+		sb.WriteByte('\n')
+	}
+	if chomp == '+' {
+		sb.WriteString(strings.Repeat("\n", trailing))
+	}
+	n.kind, n.value, n.quoted = scalarNode, sb.String(), true
+	return nil
+}
+
+// skipFlowSpace skips whitespace, line breaks and comments inside a flow
+// collection.
+func (p *parser) skipFlowSpace() {
+	for {
+		switch c := p.peek(0); {
+		case c == '\n':
+			p.newline()
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '#' && (p.pos == 0 || isBlank(p.data[p.pos-1])):
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) parseFlowNode() (*node, error) {
+	defer p.depth.Leave()
+	if !p.depth.Enter() {
+		return nil, p.errorf("exceeded max depth")
+	}
+	n := p.newNode()
+	if err := p.parseProperties(n); err != nil {
+		return nil, err
+	}
+	p.skipFlowSpace()
+	switch p.peek(0) {
+	case '*':
+		return n, p.parseAlias(n)
+	case '[', '{':
+		return n, p.parseFlowCollection(n)
+	case ',', ']', '}':
+		// empty node
+		n.kind = scalarNode
+		return n, nil
+	}
+	return n, p.parseScalar(n, true)
+}
+
+// parseFlowCollection parses a flow sequence ([a, b]) or mapping ({a: b}).
+func (p *parser) parseFlowCollection(n *node) error {
+	closing := byte(']')
+	n.kind = sequenceNode
+	if p.peek(0) == '{' {
+		closing = '}'
+		n.kind = mappingNode
+	}
+	p.pos++
+	for {
+		p.skipFlowSpace()
+		if p.peek(0) == closing {
+			p.pos++
+			return nil
+		}
+		item, err := p.parseFlowNode()
+		if err != nil {
+			return err
+		}
+		p.skipFlowSpace()
+		if n.kind == mappingNode {
+			if p.peek(0) != ':' {
+				return p.errorf("expected ':' after mapping key")
+			}
+			p.pos++
+			p.skipFlowSpace()
+			value, err := p.parseFlowNode()
+			if err != nil {
+				return err
+			}
+			n.children = append(n.children, item, value)
+			p.skipFlowSpace()
+		} else {
+			if p.peek(0) == ':' {
+				return p.errorf("mappings in flow sequences are not supported")
+			}
+			n.children = append(n.children, item)
+		}
+		switch p.peek(0) {
+		case ',':
+			p.pos++
+		case closing:
+		case 0:
+			return p.errorf("unterminated flow collection")
+		default:
+			return p.errorf("expected ',' or " + strconv.QuoteRune(rune(closing)))
+		}
+	}
+}
+
+// knownKinds holds the kinds that can be used as local tags.
+var knownKinds = map[tahwil.Kind]bool{
+	tahwil.Bool: true, tahwil.String: true,
+	tahwil.Int: true, tahwil.Int8: true, tahwil.Int16: true, tahwil.Int32: true, tahwil.Int64: true,
+	tahwil.Uint: true, tahwil.Uint8: true, tahwil.Uint16: true, tahwil.Uint32: true, tahwil.Uint64: true,
+	tahwil.Float32: true, tahwil.Float64: true,
+	tahwil.Struct: true, tahwil.Slice: true, tahwil.Array: true, tahwil.Map: true, tahwil.Ptr: true,
+	tahwil.Func: true, tahwil.Chan: true, tahwil.Stub: true,
+}
+
+// indirectTag marks a pointer to a pointer: a sequence holding the inner
+// pointer as its only element.
+const indirectTag = "!indirect"
+
+// standardTags maps the tags of the YAML core schema to kinds.
+var standardTags = map[string]tahwil.Kind{
+	"!!str": tahwil.String, "!!int": tahwil.Int, "!!float": tahwil.Float64, "!!bool": tahwil.Bool,
+	"!!null": tahwil.Ptr, "!!map": tahwil.Struct, "!!seq": tahwil.Slice,
+}
+
+type converter struct {
+	// refids maps anchor names to pointer refids
+	refids map[string]uint64
+	// lastRefid is the last refid given to an anchor or a pointer
+	lastRefid uint64
+}
+
+func (c *converter) nextRefid() uint64 {
+	c.lastRefid++
+	return c.lastRefid
+}
+
+func nodeError(n *node, msg string) error {
+	return &SyntaxError{Line: n.line, Column: n.column, msg: msg}
+}
+
+// collectAnchors assigns refids to anchors: anchors named after a
+// positive number keep it, the others get fresh refids in document order.
+func (c *converter) collectAnchors(root *node) error {
+	var named []string
+	var maxRefid uint64
+	stack := []*node{root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for i := len(n.children) - 1; i >= 0; i-- {
+			stack = append(stack, n.children[i])
+		}
+		if n.anchor == "" {
+			continue
+		}
+		if _, ok := c.refids[n.anchor]; ok {
+			return nodeError(n, "duplicate anchor &"+n.anchor)
+		}
+		refid, err := strconv.ParseUint(n.anchor, 10, 64)
+		if err != nil || refid == 0 || n.anchor[0] == '0' || n.anchor[0] == '+' {
+			named = append(named, n.anchor)
+			c.refids[n.anchor] = 0
+			continue
+		}
+		c.refids[n.anchor] = refid
+		maxRefid = max(maxRefid, refid)
+	}
+	c.lastRefid = maxRefid
+	for _, name := range named {
+		c.refids[name] = c.nextRefid()
+	}
+	return nil
+}
+
+// kindOf returns the kind the tag of n stands for, or "" for untagged nodes.
+func kindOf(n *node) (tahwil.Kind, error) {
+	switch {
+	case n.tag == "":
+		return "", nil
+	case strings.HasPrefix(n.tag, "!!"):
+		if k, ok := standardTags[n.tag]; ok {
+			return k, nil
+		}
+	case strings.HasPrefix(n.tag, "!"):
+		if k := tahwil.Kind(n.tag[1:]); knownKinds[k] {
+			return k, nil
+		}
+	}
+	return "", nodeError(n, "unknown tag "+n.tag)
+}
+
+func isNull(n *node) bool {
+	return n.kind == scalarNode && !n.quoted && plainKind(n.value) == tahwil.Ptr
+}
+
+// typeKind returns the kind of the values of type t, or "" if t doesn't
+// tell, i.e. if it is nil or an interface.
+func typeKind(t reflect.Type) tahwil.Kind {
+	if t == nil || t.Kind() == reflect.Interface {
+		return ""
+	}
+	return tahwil.Kind(t.Kind().String())
+}
+
+// elemType returns the element type of t, or nil if t has none.
+func elemType(t reflect.Type) reflect.Type {
+	switch typeKind(t) {
+	case tahwil.Ptr, tahwil.Map, tahwil.Slice, tahwil.Array:
+		return t.Elem()
+	}
+	return nil
+}
+
+// convert converts n into a Value. Untagged nodes take the kind of t, the
+// Go type they are decoded into, if it is known: mappings become maps,
+// scalars are parsed as numbers of the right size, or kept as strings,
+// and nodes decoded into pointers become pointers without needing an
+// anchor or the !ptr tag.
+func (c *converter) convert(n *node, t reflect.Type) (*tahwil.Value, error) {
+	if n.kind == aliasNode {
+		refid, ok := c.refids[n.value]
+		if !ok {
+			return nil, nodeError(n, "unknown anchor *"+n.value)
+		}
+		return &tahwil.Value{Kind: tahwil.Ref, Value: refid}, nil
+	}
+	if n.tag == indirectTag {
+		return c.convertIndirect(n, t)
+	}
+
+	kind, err := kindOf(n)
+	if err != nil {
+		return nil, err
+	}
+	if kind == tahwil.Stub {
+		return c.convertStub(n)
+	}
+	if n.anchor != "" || (kind == tahwil.Ptr && n.tag == "!ptr") || typeKind(t) == tahwil.Ptr {
+		// pointer to the node
+		res := &tahwil.Value{Kind: tahwil.Ptr, Refid: c.refids[n.anchor]}
+		if n.anchor == "" {
+			res.Refid = c.nextRefid()
+		}
+		target := *n
+		target.anchor = ""
+		if n.tag == "!ptr" {
+			target.tag = ""
+		}
+		if isNull(&target) && (target.tag == "" || kind == tahwil.Ptr) {
+			return res, nil
+		}
+		if res.Value, err = c.convert(&target, elemType(t)); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+
+	if kind == "" {
+		kind = typeKind(t)
+	}
+	switch n.kind {
+	case mappingNode:
+		return c.convertMapping(n, kind, t)
+	case sequenceNode:
+		return c.convertSequence(n, kind, t)
+	}
+	if isNull(n) {
+		switch kind {
+		case "", tahwil.Ptr:
+			kind = tahwil.Ptr
+		case tahwil.Map, tahwil.Slice, tahwil.Func, tahwil.Chan:
+		default:
+			return nil, nodeError(n, "null cannot be a "+string(kind))
+		}
+		return &tahwil.Value{Kind: kind}, nil
+	}
+	switch {
+	case kind == "":
+		kind = tahwil.String
+		if !n.quoted {
+			kind = plainKind(n.value)
+		}
+	case n.tag == "" && n.quoted && kind != tahwil.String:
+		// quoted scalars are strings, whatever the Go type
+		kind = tahwil.String
+	}
+	v, err := scalarValue(kind, n.value)
+	if err != nil {
+		return nil, nodeError(n, err.Error())
+	}
+	return &tahwil.Value{Kind: kind, Value: v}, nil
+}
+
+// convertIndirect converts an !indirect node into a pointer to the
+// pointer it holds.
+func (c *converter) convertIndirect(n *node, t reflect.Type) (*tahwil.Value, error) {
+	if n.kind != sequenceNode || len(n.children) != 1 {
+		return nil, nodeError(n, indirectTag+" must be a sequence of one pointer")
+	}
+	res := &tahwil.Value{Kind: tahwil.Ptr, Refid: c.refids[n.anchor]}
+	if n.anchor == "" {
+		res.Refid = c.nextRefid()
+	}
+	inner, err := c.convert(n.children[0], elemType(t))
+	if err != nil {
+		return nil, err
+	}
+	if inner.Kind != tahwil.Ptr && inner.Kind != tahwil.Ref {
+		return nil, nodeError(n.children[0], indirectTag+" must hold a pointer, not a "+string(inner.Kind))
+	}
+	res.Value = inner
+	return res, nil
+}
+
+// convertStub converts a !stub node. Its anchor is the refid of the
+// pointer the stub stands for, not a pointer to the node.
+func (c *converter) convertStub(n *node) (*tahwil.Value, error) {
+	if n.kind != scalarNode || isNull(n) {
+		return nil, nodeError(n, "stub must be a type name")
+	}
+	return &tahwil.Value{Kind: tahwil.Stub, Refid: c.refids[n.anchor], Value: n.value}, nil
+}
+
+// fieldTypes returns the types of the fields of the struct type t by key,
+// or nil if t is not a struct type.
+func fieldTypes(t reflect.Type) map[string]reflect.Type {
+	if typeKind(t) != tahwil.Struct {
+		return nil
+	}
+	res := make(map[string]reflect.Type)
+	for _, ft := range reflect.VisibleFields(t) {
+		k, ok := fieldtag.Key(ft)
+		if !ok || !ft.IsExported() {
+			continue
+		}
+		res[k] = ft.Type
+	}
+	return res
+}
+
+func (c *converter) convertMapping(n *node, kind tahwil.Kind, t reflect.Type) (*tahwil.Value, error) {
+	if kind == "" {
+		kind = tahwil.Struct
+	}
+	if kind != tahwil.Struct && kind != tahwil.Map {
+		return nil, nodeError(n, "mapping cannot be a "+string(kind))
+	}
+	ftypes := fieldTypes(t)
+	fields := make(map[string]*tahwil.Value, len(n.children)/2)
+	for i := 0; i < len(n.children); i += 2 {
+		key := n.children[i]
+		if key.kind != scalarNode || key.anchor != "" || key.tag != "" {
+			return nil, nodeError(key, "mapping keys must be scalars without properties")
+		}
+		if _, ok := fields[key.value]; ok {
+			return nil, nodeError(key, "duplicate mapping key "+strconv.Quote(key.value))
+		}
+		ft := elemType(t)
+		if ftypes != nil {
+			ft = ftypes[key.value]
+		}
+		v, err := c.convert(n.children[i+1], ft)
+		if err != nil {
+			return nil, err
+		}
+		fields[key.value] = v
+	}
+	return &tahwil.Value{Kind: kind, Value: fields}, nil
+}
+
+func (c *converter) convertSequence(n *node, kind tahwil.Kind, t reflect.Type) (*tahwil.Value, error) {
+	if kind == "" {
+		kind = tahwil.Slice
+	}
+	if kind != tahwil.Slice && kind != tahwil.Array {
+		return nil, nodeError(n, "sequence cannot be a "+string(kind))
+	}
+	elems := make([]*tahwil.Value, len(n.children))
+	for i, child := range n.children {
+		v, err := c.convert(child, elemType(t))
+		if err != nil {
+			return nil, err
+		}
+		elems[i] = v
+	}
+	return &tahwil.Value{Kind: kind, Value: elems}, nil
+}
+
+// scalarValue parses the text of a scalar of the given kind.
+//
+//nolint:gocyclo // one case per kind
+func scalarValue(kind tahwil.Kind, s string) (any, error) {
+	switch kind {
+	case tahwil.String, tahwil.Func:
+		return s, nil
+	case tahwil.Bool:
+		switch s {
+		case "true", "True", "TRUE":
+			return true, nil
+		case "false", "False", "FALSE":
+			return false, nil
+		}
+		return nil, invalidScalar(kind, s)
+	case tahwil.Int:
+		i, err := parseInt(s, strconv.IntSize)
+		return int(i), scalarError(err, kind, s)
+	case tahwil.Int8:
+		i, err := parseInt(s, 8)
+		return int8(i), scalarError(err, kind, s)
+	case tahwil.Int16:
+		i, err := parseInt(s, 16)
+		return int16(i), scalarError(err, kind, s)
+	case tahwil.Int32:
+		i, err := parseInt(s, 32)
+		return int32(i), scalarError(err, kind, s)
+	case tahwil.Int64:
+		i, err := parseInt(s, 64)
+		return i, scalarError(err, kind, s)
+	case tahwil.Uint:
+		u, err := parseUint(s, strconv.IntSize)
+		return uint(u), scalarError(err, kind, s)
+	case tahwil.Uint8:
+		u, err := parseUint(s, 8)
+		return uint8(u), scalarError(err, kind, s)
+	case tahwil.Uint16:
+		u, err := parseUint(s, 16)
+		return uint16(u), scalarError(err, kind, s)
+	case tahwil.Uint32:
+		u, err := parseUint(s, 32)
+		return uint32(u), scalarError(err, kind, s)
+	case tahwil.Uint64:
+		u, err := parseUint(s, 64)
+		return u, scalarError(err, kind, s)
+	case tahwil.Float32:
+		f, err := parseFloat(s, 32)
+		return float32(f), scalarError(err, kind, s)
+	case tahwil.Float64:
+		f, err := parseFloat(s, 64)
+		return f, scalarError(err, kind, s)
+	}
+	return nil, invalidScalar(kind, s)
+}
+
+func invalidScalar(kind tahwil.Kind, s string) error {
+	return &scalarErr{kind: kind, s: s}
+}
+
+func scalarError(err error, kind tahwil.Kind, s string) error {
+	if err != nil {
+		return invalidScalar(kind, s)
+	}
+	return nil
+}
+
+type scalarErr struct {
+	kind tahwil.Kind
+	s    string
+}
+
+func (e *scalarErr) Error() string {
+	return "invalid " + string(e.kind) + " value " + strconv.Quote(e.s)
+}
+
+func parseInt(s string, bitSize int) (int64, error) {
+	switch {
+	case strings.HasPrefix(s, "0o"):
+		return strconv.ParseInt(s[2:], 8, bitSize)
+	case strings.HasPrefix(s, "0x"):
+		return strconv.ParseInt(s[2:], 16, bitSize)
+	}
+	return strconv.ParseInt(s, 10, bitSize)
+}
+
+func parseUint(s string, bitSize int) (uint64, error) {
+	switch {
+	case strings.HasPrefix(s, "0o"):
+		return strconv.ParseUint(s[2:], 8, bitSize)
+	case strings.HasPrefix(s, "0x"):
+		return strconv.ParseUint(s[2:], 16, bitSize)
+	}
+	return strconv.ParseUint(strings.TrimPrefix(s, "+"), 10, bitSize)
+}
+
+func parseFloat(s string, bitSize int) (float64, error) {
+	switch strings.TrimLeft(s, "+-") {
+	case ".inf", ".Inf", ".INF":
+		if s[0] == '-' {
+			return math.Inf(-1), nil
+		}
+		return math.Inf(1), nil
+	case ".nan", ".NaN", ".NAN":
+		return math.NaN(), nil
+	}
+	if !floatRe.MatchString(s) && !intRe.MatchString(s) {
+		return 0, strconv.ErrSyntax
+	}
+	if strings.HasPrefix(s, "0o") || strings.HasPrefix(s, "0x") {
+		i, err := parseInt(s, 64)
+		return float64(i), err
+	}
+	return strconv.ParseFloat(s, bitSize)
+}
@@ -0,0 +1,502 @@
+// Package yaml encodes and decodes *tahwil.Value trees as YAML, using
+// anchors and aliases for shared and cyclic pointers.
+//
+// Every non-nil pointer becomes its target node with an anchor named
+// after the pointer refid (&1), and every ref node becomes an alias of
+// that anchor (*1). Structs and maps become block mappings, slices and
+// arrays block sequences, nil pointers null, and scalars plain or
+// double-quoted scalars. When the kind of a node differs from the one
+// YAML resolves for it by default (struct for mappings, slice for
+// sequences, int, float64, bool and string for scalars), the kind is
+// written as a local tag, e.g. !int8 5 or !map {}:
+//
+//	--- &1
+//	Children:
+//	  - &3
+//	    Children: []
+//	    Name: Ford
+//	    Parent: *1
+//	Name: Arthur
+//	Parent: null
+//
+// Funcs are written as the name they are registered under (!func upper),
+// skipped chans as !chan null, and stubs as their type name, anchored
+// after the refid of the pointer they stand for (&2 !stub pkg.T).
+//
+// A pointer to a pointer is written as a sequence tagged !indirect that
+// holds the inner pointer:
+//
+//	PtrPtr: &1 !indirect
+//	  - &2 7
+//
+// Only the refids of pointers and stubs are kept. Unmarshal accepts hand-written
+// documents as well: untagged nodes are decoded after the Go type of the
+// destination, so that "port: 80" fills a uint16 and "name: 123" a
+// string, and mappings and pointers need neither tags nor anchors.
+// Anchors that are not positive numbers (&arthur) get fresh refids, and
+// flow collections, comments, quoted scalars, block scalars (| and >)
+// and the standard !!str, !!int, !!float, !!bool, !!null, !!map and
+// !!seq tags are understood. Multi-line plain and quoted scalars,
+// complex keys and multiple documents are not supported.
+package yaml
+
+import (
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-extras/tahwil"
+)
+
+// A SyntaxError describes malformed YAML input.
+type SyntaxError struct {
+	Line   int
+	Column int
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return "yaml: line " + strconv.Itoa(e.Line) + ", column " + strconv.Itoa(e.Column) + ": " + e.msg
+}
+
+// An UnsupportedValueError is returned by Marshal for a Value that has
+// no YAML representation, such as a pointer without refid to a value
+// that needs a tag.
+type UnsupportedValueError struct {
+	Value  *tahwil.Value
+	Reason string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "yaml: unsupported value: " + e.Reason
+}
+
+// Marshal returns the YAML encoding of v. A *tahwil.Value is encoded as
+// the tree it holds, like MarshalValue does.
+func Marshal(v any) ([]byte, error) {
+	if val, ok := v.(*tahwil.Value); ok {
+		return MarshalValue(val)
+	}
+	val, err := tahwil.ToValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return MarshalValue(val)
+}
+
+// MarshalValue returns the YAML encoding of a *tahwil.Value tree, such as
+// one produced by tahwil.ToValue or decoded from tahwil JSON.
+func MarshalValue(v *tahwil.Value) ([]byte, error) {
+	g, err := tahwil.NewGraph(v)
+	if err != nil {
+		return nil, err
+	}
+	e := &encoder{
+		written: make(map[uint64]bool),
+		graph:   g,
+	}
+	e.buf = append(e.buf, "---"...)
+	if err := e.encode(v, 0, false); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+// Unmarshal parses a YAML document and stores the result in the value
+// pointed to by v. If v is a *tahwil.Value, the tree itself is stored
+// in it, shaped after the tags of the document only.
+func Unmarshal(data []byte, v any) error {
+	if tv, ok := v.(*tahwil.Value); ok && tv != nil {
+		val, err := UnmarshalValue(data, nil)
+		if err != nil {
+			return err
+		}
+		*tv = *val
+		return nil
+	}
+	val, err := UnmarshalValue(data, reflect.TypeOf(v))
+	if err != nil {
+		return err
+	}
+	return tahwil.FromValue(val, v)
+}
+
+// UnmarshalValue parses a YAML document into a *tahwil.Value tree.
+// Payloads have the same types as the ones produced by tahwil.ToValue.
+// If t is not nil, the tree is shaped after t, the type of the value it
+// is meant to be decoded into: untagged nodes take the kinds of the
+// matching Go types, so that hand-written documents need neither tags
+// nor anchors. Tags and aliases take precedence over t.
+func UnmarshalValue(data []byte, t reflect.Type) (*tahwil.Value, error) {
+	p := &parser{data: data, line: 1}
+	root, err := p.parseDocument()
+	if err != nil {
+		return nil, err
+	}
+	c := &converter{refids: make(map[string]uint64)}
+	if err = c.collectAnchors(root); err != nil {
+		return nil, err
+	}
+	return c.convert(root, t)
+}
+
+type encoder struct {
+	buf []byte
+	// written holds the refids of the pointers and stubs whose anchor has
+	// been written
+	written map[uint64]bool
+	// graph indexes the pointers by refid, so that a ref can be encoded
+	// before the pointer it refers to has been reached
+	graph *tahwil.Graph
+}
+
+func (e *encoder) indent(n int) {
+	for i := 0; i < n; i++ {
+		e.buf = append(e.buf, ' ')
+	}
+}
+
+// writeScalar writes an inline node with its properties and ends the line.
+func (e *encoder) writeScalar(props, text string) {
+	e.buf = append(e.buf, ' ')
+	if props != "" {
+		e.buf = append(e.buf, props...)
+		e.buf = append(e.buf, ' ')
+	}
+	e.buf = append(e.buf, text...)
+	e.buf = append(e.buf, '\n')
+}
+
+// encode writes v right after a "---", "key:" or "-" indicator. Nested
+// block collections are indented by indent; inline allows the first
+// entry of a block collection without properties to follow on the
+// same line (as in "- key: value").
+func (e *encoder) encode(v *tahwil.Value, indent int, inline bool) error {
+	if v == nil {
+		e.writeScalar("", "null")
+		return nil
+	}
+	switch v.Kind {
+	case tahwil.Ptr:
+		return e.encodePtr(v, indent, inline)
+	case tahwil.Ref:
+		return e.encodeRef(v, indent, inline)
+	case tahwil.Stub:
+		return e.encodeStub(v, indent, inline)
+	}
+	return e.encodeNode(v, "", indent, inline)
+}
+
+func (e *encoder) encodePtr(v *tahwil.Value, indent int, inline bool) error {
+	if v.Refid != 0 && e.written[v.Refid] {
+		// already written through a forward ref
+		e.writeScalar("", "*"+strconv.FormatUint(v.Refid, 10))
+		return nil
+	}
+	if v.Value == nil {
+		e.writeScalar("", "null")
+		return nil
+	}
+	inner, ok := v.AsPtr()
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	if inner == nil {
+		e.writeScalar("", "null")
+		return nil
+	}
+	if inner.Kind == tahwil.Ptr || inner.Kind == tahwil.Ref {
+		return e.encodeIndirect(v, inner, indent, inline)
+	}
+	if v.Refid == 0 {
+		return e.encodeNode(inner, "!ptr", indent, inline)
+	}
+	e.written[v.Refid] = true
+	return e.encodeNode(inner, "&"+strconv.FormatUint(v.Refid, 10), indent, inline)
+}
+
+// encodeIndirect writes a pointer to a pointer as an !indirect sequence
+// holding the inner pointer, since a node can't carry two anchors.
+func (e *encoder) encodeIndirect(v, inner *tahwil.Value, indent int, inline bool) error {
+	props := indirectTag
+	if v.Refid != 0 {
+		e.written[v.Refid] = true
+		props = "&" + strconv.FormatUint(v.Refid, 10) + " " + props
+	}
+	e.startBlock(props, inline)
+	e.indent(indent)
+	e.buf = append(e.buf, '-')
+	return e.encode(inner, indent+2, true)
+}
+
+func (e *encoder) encodeRef(v *tahwil.Value, indent int, inline bool) error {
+	refid, ok := v.AsRef()
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	if e.written[refid] {
+		e.writeScalar("", "*"+strconv.FormatUint(refid, 10))
+		return nil
+	}
+	// forward ref: write the target pointer, or its stub, here
+	p, ok := e.graph.Node(refid)
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	return e.encode(p, indent, inline)
+}
+
+// encodeStub writes a stub as its type name, anchored after the refid of
+// the pointer it stands for, so that the refs to it are aliases.
+func (e *encoder) encodeStub(v *tahwil.Value, indent int, inline bool) error {
+	if _, ok := v.Value.(string); !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	if v.Refid == 0 {
+		return e.encodeNode(v, "", indent, inline)
+	}
+	if e.written[v.Refid] {
+		// already written through a forward ref
+		e.writeScalar("", "*"+strconv.FormatUint(v.Refid, 10))
+		return nil
+	}
+	e.written[v.Refid] = true
+	return e.encodeNode(v, "&"+strconv.FormatUint(v.Refid, 10), indent, inline)
+}
+
+// encodeNode writes a non-pointer node. prop is the anchor of the
+// pointer the node is the target of, or the !ptr tag for pointers
+// without a refid.
+func (e *encoder) encodeNode(v *tahwil.Value, prop string, indent int, inline bool) error {
+	if !knownKinds[v.Kind] {
+		return &tahwil.InvalidValueKindError{Kind: v.Kind}
+	}
+	tag := ""
+	if !isDefaultKind(v.Kind) || v.Value == nil {
+		tag = "!" + string(v.Kind)
+	}
+	props := prop
+	if tag != "" {
+		if strings.HasPrefix(prop, "!") {
+			return &UnsupportedValueError{Value: v, Reason: "pointer without refid to a " + string(v.Kind)}
+		}
+		if props != "" {
+			props += " "
+		}
+		props += tag
+	}
+	if v.Value == nil {
+		e.writeScalar(props, "null")
+		return nil
+	}
+
+	switch v.Kind {
+	case tahwil.Struct, tahwil.Map:
+		return e.encodeFields(v, props, indent, inline)
+	case tahwil.Slice, tahwil.Array:
+		return e.encodeElems(v, props, indent, inline)
+	case tahwil.Bool, tahwil.String,
+		tahwil.Int, tahwil.Int8, tahwil.Int16, tahwil.Int32, tahwil.Int64,
+		tahwil.Uint, tahwil.Uint8, tahwil.Uint16, tahwil.Uint32, tahwil.Uint64,
+		tahwil.Float32, tahwil.Float64, tahwil.Func, tahwil.Chan, tahwil.Stub:
+		text, err := scalarText(v)
+		if err != nil {
+			return err
+		}
+		e.writeScalar(props, text)
+		return nil
+	}
+	return &tahwil.InvalidValueKindError{Kind: v.Kind}
+}
+
+// startBlock starts a block collection after its indicator and returns
+// whether its first entry continues the current line.
+func (e *encoder) startBlock(props string, inline bool) bool {
+	if props != "" {
+		e.buf = append(e.buf, ' ')
+		e.buf = append(e.buf, props...)
+	} else if inline {
+		e.buf = append(e.buf, ' ')
+		return true
+	}
+	e.buf = append(e.buf, '\n')
+	return false
+}
+
+func (e *encoder) encodeFields(v *tahwil.Value, props string, indent int, inline bool) error {
+	fields, ok := v.AsFields()
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	if len(fields) == 0 {
+		e.writeScalar(props, "{}")
+		return nil
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	sameLine := e.startBlock(props, inline)
+	for i, k := range keys {
+		if i > 0 || !sameLine {
+			e.indent(indent)
+		}
+		e.buf = append(e.buf, stringText(k)...)
+		e.buf = append(e.buf, ':')
+		if err := e.encode(fields[k], indent+2, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) encodeElems(v *tahwil.Value, props string, indent int, inline bool) error {
+	elems, ok := v.AsSlice()
+	if !ok {
+		return &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+	if len(elems) == 0 {
+		e.writeScalar(props, "[]")
+		return nil
+	}
+
+	sameLine := e.startBlock(props, inline)
+	for i, el := range elems {
+		if i > 0 || !sameLine {
+			e.indent(indent)
+		}
+		e.buf = append(e.buf, '-')
+		if err := e.encode(el, indent+2, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scalarText(v *tahwil.Value) (string, error) {
+	switch v.Kind {
+	case tahwil.Bool:
+		b, ok := v.Value.(bool)
+		if !ok {
+			return "", &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		return strconv.FormatBool(b), nil
+	case tahwil.String, tahwil.Func, tahwil.Stub:
+		s, ok := v.Value.(string)
+		if !ok {
+			return "", &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		return stringText(s), nil
+	case tahwil.Chan:
+		// only nil chans are written, as !chan null
+		return "", &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+	}
+
+	rv := reflect.ValueOf(v.Value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Kind == tahwil.Float32 || v.Kind == tahwil.Float64 {
+			return "", &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		return strconv.FormatInt(rv.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Kind == tahwil.Float32 || v.Kind == tahwil.Float64 {
+			return "", &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+		}
+		return strconv.FormatUint(rv.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		switch v.Kind {
+		case tahwil.Float32:
+			return floatText(rv.Float(), 32), nil
+		case tahwil.Float64:
+			return floatText(rv.Float(), 64), nil
+		}
+	}
+	return "", &tahwil.InvalidValueError{Value: v.Value, Kind: v.Kind}
+}
+
+// floatText formats f so that it is resolved as a float, not an int.
+func floatText(f float64, bitSize int) string {
+	switch {
+	case math.IsInf(f, 1):
+		return ".inf"
+	case math.IsInf(f, -1):
+		return "-.inf"
+	case math.IsNaN(f):
+		return ".nan"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, bitSize)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+// stringText returns s as a plain scalar when it is read back as the
+// same string, and as a double-quoted scalar otherwise.
+func stringText(s string) string {
+	if isPlainSafe(s) {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+func isPlainSafe(s string) bool {
+	if s == "" || s[0] == ' ' || s[len(s)-1] == ' ' || s[len(s)-1] == ':' {
+		return false
+	}
+	if strings.ContainsRune("-?:,[]{}#&*!|>'\"%@`", rune(s[0])) || strings.HasPrefix(s, "...") {
+		return false
+	}
+	// the merge key of YAML 1.1
+	if s == "<<" {
+		return false
+	}
+	if strings.Contains(s, ": ") || strings.Contains(s, " #") {
+		return false
+	}
+	for _, r := range s {
+		if r < ' ' || r == 0x7f || r == 0x85 || r == 0x2028 || r == 0x2029 || r == 0xfeff {
+			return false
+		}
+	}
+	return plainKind(s) == tahwil.String
+}
+
+// isDefaultKind reports whether YAML resolves the node a value of kind k
+// is written as to k by default, so that it doesn't need a tag.
+func isDefaultKind(k tahwil.Kind) bool {
+	switch k {
+	case tahwil.Struct, tahwil.Slice, tahwil.Bool, tahwil.String, tahwil.Int, tahwil.Float64:
+		return true
+	}
+	return false
+}
+
+var (
+	intRe   = regexp.MustCompile(`^([-+]?[0-9]+|0o[0-7]+|0x[0-9a-fA-F]+)$`)
+	floatRe = regexp.MustCompile(`^([-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?|[-+]?\.(inf|Inf|INF)|\.(nan|NaN|NAN))$`)
+)
+
+// plainKind resolves an untagged plain scalar following the YAML 1.2
+// core schema: Ptr stands for null.
+func plainKind(s string) tahwil.Kind {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return tahwil.Ptr
+	case "true", "True", "TRUE", "false", "False", "FALSE":
+		return tahwil.Bool
+	}
+	if intRe.MatchString(s) {
+		return tahwil.Int
+	}
+	if floatRe.MatchString(s) {
+		return tahwil.Float64
+	}
+	return tahwil.String
+}
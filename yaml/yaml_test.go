@@ -0,0 +1,598 @@
+package yaml_test
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-extras/tahwil"
+	"github.com/go-extras/tahwil/internal/nesting"
+	"github.com/go-extras/tahwil/yaml"
+)
+
+type personT struct {
+	Name     string
+	Parent   *personT
+	Children []*personT
+}
+
+type hooksT struct {
+	Name string
+	Fn   func(string) string
+	Nil  func(string) string
+	Done chan struct{}
+	Next *hooksT
+}
+
+type allKindsT struct {
+	Bool    bool
+	Int     int
+	Int8    int8
+	Int16   int16
+	Int32   int32
+	Int64   int64
+	Uint    uint
+	Uint8   uint8
+	Uint16  uint16
+	Uint32  uint32
+	Uint64  uint64
+	Float32 float32
+	Float64 float64
+	String  string
+	Strings []string
+	Array   [2]int16
+	Map     map[string]int
+	Empty   map[string]int
+	Pointer *string
+	PtrPtr  **int
+}
+
+type ptrPtrT struct {
+	A **int
+	B *int
+	C **int
+}
+
+func TestMarshal(t *testing.T) {
+	parent := &personT{Name: "Arthur"}
+	parent.Children = []*personT{{Name: "Ford", Parent: parent}}
+	v, err := tahwil.ToValue(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := yaml.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `--- &1
+Children:
+  - &3
+    Children: []
+    Name: Ford
+    Parent: *1
+Name: Arthur
+Parent: null
+`
+	if string(res) != want {
+		t.Errorf("have:\n%s\nwant:\n%s", res, want)
+	}
+}
+
+func TestMarshal_Scalars(t *testing.T) {
+	tests := []struct {
+		v    *tahwil.Value
+		want string
+	}{
+		{&tahwil.Value{Kind: tahwil.String, Value: "plain text"}, "--- plain text\n"},
+		{&tahwil.Value{Kind: tahwil.String, Value: "true"}, "--- \"true\"\n"},
+		{&tahwil.Value{Kind: tahwil.String, Value: "12"}, "--- \"12\"\n"},
+		{&tahwil.Value{Kind: tahwil.String, Value: "a: b"}, "--- \"a: b\"\n"},
+		{&tahwil.Value{Kind: tahwil.String, Value: "two\nlines"}, "--- \"two\\nlines\"\n"},
+		{&tahwil.Value{Kind: tahwil.String, Value: ""}, "--- \"\"\n"},
+		{&tahwil.Value{Kind: tahwil.String, Value: "<<"}, "--- \"<<\"\n"},
+		{&tahwil.Value{Kind: tahwil.Map, Value: map[string]*tahwil.Value{"<<": {Kind: tahwil.String, Value: "x"}}}, "--- !map\n\"<<\": x\n"},
+		{&tahwil.Value{Kind: tahwil.Int, Value: -3}, "--- -3\n"},
+		{&tahwil.Value{Kind: tahwil.Int8, Value: int8(5)}, "--- !int8 5\n"},
+		{&tahwil.Value{Kind: tahwil.Float64, Value: 2.0}, "--- 2.0\n"},
+		{&tahwil.Value{Kind: tahwil.Float64, Value: math.Inf(-1)}, "--- -.inf\n"},
+		{&tahwil.Value{Kind: tahwil.Float32, Value: float32(0.5)}, "--- !float32 0.5\n"},
+		{&tahwil.Value{Kind: tahwil.Slice}, "--- !slice null\n"},
+		{&tahwil.Value{Kind: tahwil.Map, Value: map[string]*tahwil.Value{}}, "--- !map {}\n"},
+		{&tahwil.Value{Kind: tahwil.Ptr, Refid: 2, Value: &tahwil.Value{Kind: tahwil.Uint, Value: uint(1)}}, "--- &2 !uint 1\n"},
+	}
+	for i, test := range tests {
+		res, err := yaml.MarshalValue(test.v)
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if string(res) != test.want {
+			t.Errorf("#%d: have %q, want %q", i, res, test.want)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	s := "pointer"
+	i := 7
+	pi := &i
+	in := &allKindsT{
+		Bool: true, Int: -1 << 40, Int8: -100, Int16: -30000, Int32: -1 << 30, Int64: -1 << 62,
+		Uint: 1 << 40, Uint8: 200, Uint16: 60000, Uint32: 1 << 31, Uint64: 1<<64 - 1,
+		Float32: 1.5, Float64: -2.25, String: "- not a list #1", Strings: []string{"", "null", "x"},
+		Array: [2]int16{-1, 1}, Map: map[string]int{"a b": 1, "": 2}, Empty: map[string]int{}, Pointer: &s,
+		PtrPtr: &pi,
+	}
+	v, err := tahwil.ToValue(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := yaml.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := yaml.UnmarshalValue(b, nil)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, b)
+	}
+
+	out := &allKindsT{}
+	if err = tahwil.FromValue(decoded, out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("mismatch\nhave: %+v\nwant: %+v", out, in)
+	}
+
+	// encoding the decoded tree again gives the same document
+	again, err := yaml.MarshalValue(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(b) {
+		t.Errorf("have:\n%s\nwant:\n%s", again, b)
+	}
+}
+
+func TestRoundTrip_Struct(t *testing.T) {
+	parent := &personT{Name: "Arthur"}
+	parent.Children = []*personT{{Name: "Ford", Parent: parent}}
+	b, err := yaml.Marshal(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &personT{}
+	if err = yaml.Unmarshal(b, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "Arthur" || len(out.Children) != 1 || out.Children[0].Name != "Ford" || out.Children[0].Parent != out {
+		t.Errorf("unexpected result: %+v", out)
+	}
+}
+
+func TestRoundTrip_ValueTree(t *testing.T) {
+	// a *tahwil.Value passed to Marshal and Unmarshal is the tree itself,
+	// not a Go struct to encode
+	v, err := tahwil.ToValue(&personT{Name: "Arthur"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := yaml.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(want) {
+		t.Errorf("have:\n%s\nwant:\n%s", b, want)
+	}
+	decoded := &tahwil.Value{}
+	if err = yaml.Unmarshal(b, decoded); err != nil {
+		t.Fatal(err)
+	}
+	// only the refids of pointers are kept, so compare the documents
+	again, err := yaml.MarshalValue(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(b) {
+		t.Errorf("have:\n%s\nwant:\n%s", again, b)
+	}
+}
+
+func TestRoundTrip_Cycle(t *testing.T) {
+	parent := &personT{Name: "Arthur"}
+	parent.Children = []*personT{
+		{Name: "Ford", Parent: parent},
+		{Name: "Trillian", Parent: parent},
+	}
+	v, err := tahwil.ToValue(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// decode through JSON first to make sure both payload shapes are accepted
+	j, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON := &tahwil.Value{}
+	if err = json.Unmarshal(j, fromJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := yaml.MarshalValue(fromJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := yaml.UnmarshalValue(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &personT{}
+	if err = tahwil.FromValue(decoded, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Children[0].Parent != out || out.Children[1].Parent != out {
+		t.Error("expected the cycle to be preserved")
+	}
+}
+
+func TestRoundTrip_FuncsAndStubs(t *testing.T) {
+	funcs := tahwil.NewFuncRegistry()
+	if err := funcs.Register("upper", strings.ToUpper); err != nil {
+		t.Fatal(err)
+	}
+	fetched := &hooksT{Name: "fetched"}
+	opts := &tahwil.Options{
+		Funcs:         funcs,
+		FuncsAndChans: tahwil.FuncChanNull,
+		MaxDepth:      1,
+		FetchStub: func(refid uint64, typeName string) (any, error) {
+			return fetched, nil
+		},
+	}
+	in := &hooksT{Name: "a", Fn: strings.ToUpper, Done: make(chan struct{}), Next: &hooksT{Name: "b"}}
+	v, err := tahwil.ToValueWithOptions(in, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := yaml.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "--- &1\nDone: !chan null\nFn: !func upper\nName: a\nNext: &2 !stub yaml_test.hooksT\nNil: !func null\n"
+	if string(b) != want {
+		t.Errorf("have %q, want %q", b, want)
+	}
+
+	for _, typ := range []reflect.Type{nil, reflect.TypeOf(&hooksT{})} {
+		decoded, err := yaml.UnmarshalValue(b, typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, v) {
+			x, _ := json.Marshal(decoded)
+			y, _ := json.Marshal(v)
+			t.Errorf("mismatch\nhave: %s\nwant: %s", x, y)
+		}
+	}
+	out := &hooksT{}
+	decoded, err := yaml.UnmarshalValue(b, reflect.TypeOf(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tahwil.FromValueWithOptions(decoded, out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if out.Fn == nil || out.Fn("x") != "X" || out.Nil != nil || out.Done != nil || out.Next != fetched {
+		t.Errorf("unexpected result: %+v", out)
+	}
+}
+
+func TestRoundTrip_SharedStub(t *testing.T) {
+	c := &personT{Name: "c"}
+	in := &personT{Name: "a", Parent: c, Children: []*personT{c}}
+	v, err := tahwil.ToValueWithOptions(in, &tahwil.Options{MaxDepth: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := yaml.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the keys are sorted: the stub is written at the first of them
+	want := "--- &1\nChildren:\n  - &2 !stub yaml_test.personT\nName: a\nParent: *2\n"
+	if string(b) != want {
+		t.Errorf("have %q, want %q", b, want)
+	}
+	decoded, err := yaml.UnmarshalValue(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tahwil.Canonicalize(decoded), tahwil.Canonicalize(v)) {
+		x, _ := json.Marshal(decoded)
+		y, _ := json.Marshal(v)
+		t.Errorf("mismatch\nhave: %s\nwant: %s", x, y)
+	}
+
+	fetched := &personT{Name: "fetched"}
+	opts := &tahwil.Options{FetchStub: func(uint64, string) (any, error) { return fetched, nil }}
+	out := &personT{}
+	if err = tahwil.FromValueWithOptions(decoded, out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if out.Parent != fetched || out.Children[0] != fetched {
+		t.Errorf("unexpected result: %+v", out)
+	}
+}
+
+func TestRoundTrip_PtrPtr(t *testing.T) {
+	i := 7
+	in := &ptrPtrT{B: &i, C: new(*int)}
+	in.A = &in.B
+	v, err := tahwil.ToValue(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := yaml.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "--- &1\nA: &2 !indirect\n  - &3 7\nB: *3\nC: &5 !indirect\n  - null\n"
+	if string(b) != want {
+		t.Errorf("have %q, want %q", b, want)
+	}
+
+	for _, typ := range []reflect.Type{nil, reflect.TypeOf(in)} {
+		decoded, err := yaml.UnmarshalValue(b, typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &ptrPtrT{}
+		if err = tahwil.FromValue(decoded, out); err != nil {
+			t.Fatal(err)
+		}
+		if out.A == nil || *out.A != out.B || *out.B != 7 || out.C == nil || *out.C != nil {
+			t.Errorf("unexpected result: %+v", out)
+		}
+	}
+}
+
+func TestMarshal_ForwardRef(t *testing.T) {
+	// the ref is reached before the pointer it refers to
+	v := &tahwil.Value{Kind: tahwil.Struct, Value: map[string]*tahwil.Value{
+		"A": {Kind: tahwil.Ref, Value: uint64(2)},
+		"B": {Kind: tahwil.Ptr, Refid: 2, Value: &tahwil.Value{Kind: tahwil.String, Value: "b"}},
+	}}
+	res, err := yaml.MarshalValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "---\nA: &2 b\nB: *2\n"
+	if string(res) != want {
+		t.Errorf("have %q, want %q", res, want)
+	}
+}
+
+func TestUnmarshal_HandWritten(t *testing.T) {
+	data := `
+# the crew
+%YAML 1.2
+--- &crew
+name: Arthur
+parent: ~
+children:
+- &ford
+  name: 'Ford Prefect'
+  parent: &arthur !ptr
+    name: "Arthur"
+  children: []
+- !ptr {name: Zaphod, parent: *arthur, children: [*ford]}
+...
+`
+	type crewT struct {
+		Name     string   `json:"name"`
+		Parent   *crewT   `json:"parent"`
+		Children []*crewT `json:"children"`
+	}
+	v, err := yaml.UnmarshalValue([]byte(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &crewT{}
+	if err := tahwil.FromValue(v, out); err != nil {
+		t.Fatal(err)
+	}
+	typed := &crewT{}
+	if err := yaml.Unmarshal([]byte(data), typed); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(typed, out) {
+		t.Error("expected the same result when decoding after the Go type")
+	}
+	ford, zaphod := out.Children[0], out.Children[1]
+	if out.Name != "Arthur" || out.Parent != nil || ford.Name != "Ford Prefect" || zaphod.Name != "Zaphod" {
+		t.Errorf("unexpected result: %+v", out)
+	}
+	if ford.Parent == nil || ford.Parent != zaphod.Parent || ford.Parent.Name != "Arthur" {
+		t.Error("expected the parents of Ford and Zaphod to be shared")
+	}
+	if zaphod.Children[0] != ford {
+		t.Error("expected Zaphod's child to be Ford")
+	}
+}
+
+func TestUnmarshal_Typed(t *testing.T) {
+	// no tags and no anchors: the kinds come from the Go types
+	data := `
+name: 123
+port: 80
+ratio: 1
+quoted: "80"
+labels:
+  env: prod
+  tier: "2"
+limits: {cpu: 2, mem: 512}
+owner:
+  Name: Arthur
+backup: null
+replicas:
+- name: a
+  port: 81
+- name: b
+`
+	type serverT struct {
+		Name     string             `json:"name"`
+		Port     uint16             `json:"port"`
+		Ratio    float64            `json:"ratio"`
+		Quoted   string             `json:"quoted"`
+		Labels   map[string]string  `json:"labels"`
+		Limits   map[string]int16   `json:"limits"`
+		Owner    *personT           `json:"owner"`
+		Backup   *serverT           `json:"backup"`
+		Replicas []*serverT         `json:"replicas"`
+		Extra    map[string]float32 `json:"extra"`
+	}
+	out := &serverT{}
+	if err := yaml.Unmarshal([]byte(data), out); err != nil {
+		t.Fatal(err)
+	}
+	want := &serverT{
+		Name:   "123",
+		Port:   80,
+		Ratio:  1,
+		Quoted: "80",
+		Labels: map[string]string{"env": "prod", "tier": "2"},
+		Limits: map[string]int16{"cpu": 2, "mem": 512},
+		Owner:  &personT{Name: "Arthur"},
+		Replicas: []*serverT{
+			{Name: "a", Port: 81},
+			{Name: "b"},
+		},
+	}
+	if !reflect.DeepEqual(out, want) {
+		x, _ := json.Marshal(out)
+		y, _ := json.Marshal(want)
+		t.Errorf("mismatch\nhave: %s\nwant: %s", x, y)
+	}
+
+	var syntaxErr *yaml.SyntaxError
+	err := yaml.Unmarshal([]byte("port: 70000\n"), &serverT{})
+	if !errors.As(err, &syntaxErr) {
+		t.Errorf("expected *SyntaxError for an out of range port, got %T: %v", err, err)
+	}
+}
+
+func TestUnmarshal_Scalars(t *testing.T) {
+	tests := []struct {
+		in   string
+		want *tahwil.Value
+	}{
+		{"42", &tahwil.Value{Kind: tahwil.Int, Value: 42}},
+		{"0x1f", &tahwil.Value{Kind: tahwil.Int, Value: 31}},
+		{"!!str 42", &tahwil.Value{Kind: tahwil.String, Value: "42"}},
+		{"'42'", &tahwil.Value{Kind: tahwil.String, Value: "42"}},
+		{"!uint16 0o17", &tahwil.Value{Kind: tahwil.Uint16, Value: uint16(15)}},
+		{"1e3", &tahwil.Value{Kind: tahwil.Float64, Value: 1000.0}},
+		{"FALSE", &tahwil.Value{Kind: tahwil.Bool, Value: false}},
+		{"hello world # comment", &tahwil.Value{Kind: tahwil.String, Value: "hello world"}},
+		{`"tab\tand é"`, &tahwil.Value{Kind: tahwil.String, Value: "tab\tand é"}},
+		{"'it''s'", &tahwil.Value{Kind: tahwil.String, Value: "it's"}},
+		{"|\n  one\n  two\n\n", &tahwil.Value{Kind: tahwil.String, Value: "one\ntwo\n"}},
+		{">-\n  one\n  two\n\n  three\n", &tahwil.Value{Kind: tahwil.String, Value: "one two\nthree"}},
+		{"", &tahwil.Value{Kind: tahwil.Ptr}},
+		{"!map null", &tahwil.Value{Kind: tahwil.Map}},
+		{"\ufeffa: 1", &tahwil.Value{Kind: tahwil.Struct, Value: map[string]*tahwil.Value{"a": {Kind: tahwil.Int, Value: 1}}}},
+		{"&7 5", &tahwil.Value{Kind: tahwil.Ptr, Refid: 7, Value: &tahwil.Value{Kind: tahwil.Int, Value: 5}}},
+		{"!array [1, x]", &tahwil.Value{Kind: tahwil.Array, Value: []*tahwil.Value{
+			{Kind: tahwil.Int, Value: 1},
+			{Kind: tahwil.String, Value: "x"},
+		}}},
+	}
+	for i, test := range tests {
+		v, err := yaml.UnmarshalValue([]byte(test.in), nil)
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, test.want) {
+			t.Errorf("#%d: have %#v, want %#v", i, v, test.want)
+		}
+	}
+}
+
+func TestUnmarshal_Errors(t *testing.T) {
+	tests := []string{
+		"a: b: c",
+		"a: 1\n  b: 2",
+		"[1, 2",
+		"\"unterminated",
+		"a: *missing",
+		"- &x 1\n- &x 2",
+		"!int8 300",
+		"!foo 1",
+		"!int {a: 1}",
+		"a: 1\na: 2",
+		"---\na\n---\nb",
+		"&a *b",
+		"\ta: 1",
+		"!chan x",
+		"!stub null",
+		"&2 !stub [a]",
+		"!indirect 1",
+		"!indirect [&1 1, &2 2]",
+		"!indirect [1]",
+	}
+	for i, data := range tests {
+		var syntaxErr *yaml.SyntaxError
+		_, err := yaml.UnmarshalValue([]byte(data), nil)
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("#%d: expected *SyntaxError, got %T: %v", i, err, err)
+		}
+	}
+}
+
+func TestUnmarshal_MaxDepth(t *testing.T) {
+	// depth flow sequences nested in each other
+	flow := func(depth int) []byte {
+		return []byte(strings.Repeat("[", depth) + strings.Repeat("]", depth))
+	}
+	if _, err := yaml.UnmarshalValue(flow(nesting.MaxDepth), nil); err != nil {
+		t.Errorf("UnmarshalValue() at max depth = %v", err)
+	}
+	var syntaxErr *yaml.SyntaxError
+	if _, err := yaml.UnmarshalValue(flow(nesting.MaxDepth+1), nil); !errors.As(err, &syntaxErr) {
+		t.Errorf("expected *SyntaxError, got %T: %v", err, err)
+	}
+}
+
+func TestMarshal_Errors(t *testing.T) {
+	tests := []*tahwil.Value{
+		{Kind: "foo", Value: 1},
+		{Kind: tahwil.String, Value: 1},
+		{Kind: tahwil.Int, Value: "1"},
+		{Kind: tahwil.Ptr, Value: "x"},
+		{Kind: tahwil.Struct, Value: []int{}},
+		{Kind: tahwil.Ref, Value: uint64(3)},
+		{Kind: tahwil.Func, Value: 1},
+		{Kind: tahwil.Chan, Value: "x"},
+		{Kind: tahwil.Stub},
+	}
+	for i, v := range tests {
+		if _, err := yaml.MarshalValue(v); err == nil {
+			t.Errorf("#%d: expected error, got nil", i)
+		}
+	}
+
+	var unsupported *yaml.UnsupportedValueError
+	_, err := yaml.MarshalValue(&tahwil.Value{Kind: tahwil.Ptr, Value: &tahwil.Value{Kind: tahwil.Int8, Value: int8(1)}})
+	if !errors.As(err, &unsupported) {
+		t.Errorf("expected *UnsupportedValueError, got %T: %v", err, err)
+	}
+}